@@ -1,59 +1,244 @@
 package gorm
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net/url"
+	"strings"
+
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/spf13/viper"
 	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/plugin/dbresolver"
 )
 
+/*
+配置示例:
+database:
+  Driver: mysql                                # mysql、postgres 或 sqlite
+  Host: 127.0.0.1:3306
+  Replicas: [127.0.0.2:3306, 127.0.0.3:3306]  # 只读从库, 与主库使用相同的账号和库名, 可选
+  ...
+  orders:                                      # 具名数据库, 配置项与 database 相同
+    Driver: mysql
+    Host: 127.0.0.4:3306
+    ...
+  local:
+    Driver: sqlite                             # sqlite 只需要 Db, 为数据库文件路径
+    Db: /tmp/local.db
+  analytics:
+    Driver: postgres                           # postgres 不需要 Charset, SSLMode 默认为 disable
+    Host: 127.0.0.5:5432
+    ...
+
+FilterGroup 等按连接的方言构建 SQL, 见 repository.SQLDialect.
+配置了 Replicas 时按 gorm dbresolver 路由: 查询走从库(随机选择), 写入、事务及事务内的查询走主库,
+需要读到刚写入的数据时用 WithPrimary 标记 ctx, 并通过 WithContext 获取会话;
+gormrepo 需以 gormrepo.NewBaseRepositoryWithResolver(db, gorm.Resolver{}) 创建
+*/
+
 func NewDbProvider(config *viper.Viper) (*gorm.DB, error) {
-	driver := config.GetString("database.Driver")
+	return newDb(config, "database")
+}
+
+// NewNamedDbProvider 按 database.<name> 下的配置连接数据库, 如 NewNamedDbProvider(config, "orders")
+func NewNamedDbProvider(config *viper.Viper, name string) (*gorm.DB, error) {
+	return newDb(config, "database."+name)
+}
+
+// Databases 按名称管理多个数据库连接, 名称不区分大小写
+type Databases map[string]*gorm.DB
+
+func (d Databases) Get(name string) (*gorm.DB, error) {
+	db, ok := d[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("database %s is not configured", name)
+	}
+	return db, nil
+}
+
+// NewDatabasesProvider 连接 database 下的全部具名数据库(值为对象的配置项)
+func NewDatabasesProvider(config *viper.Viper) (Databases, error) {
+	databases := make(Databases)
+	for name, value := range config.GetStringMap("database") {
+		if _, ok := value.(map[string]interface{}); !ok {
+			continue
+		}
+		db, err := NewNamedDbProvider(config, name)
+		if err != nil {
+			return nil, err
+		}
+		databases[strings.ToLower(name)] = db
+	}
+	return databases, nil
+}
+
+func newDb(config *viper.Viper, prefix string) (*gorm.DB, error) {
+	driver := strings.ToLower(config.GetString(prefix + ".Driver"))
 	if len(driver) == 0 {
-		return nil, errors.New("driver is empty")
+		return nil, configError(prefix, "driver")
+	}
+
+	var dial func(host string) gorm.Dialector
+	var err error
+	switch driver {
+	case "mysql":
+		dial, err = mysqlDialector(config, prefix)
+	case "postgres", "postgresql":
+		dial, err = postgresDialector(config, prefix)
+	case "sqlite", "sqlite3":
+		dial, err = sqliteDialector(config, prefix)
+	default:
+		return nil, fmt.Errorf("%s: unsupported driver %s", prefix, driver)
 	}
+	if err != nil {
+		return nil, err
+	}
+
+	gormConf := &gorm.Config{}
+
+	ormDb, err := gorm.Open(dial(config.GetString(prefix+".Host")), gormConf)
+	if err != nil {
+		return nil, err
+	}
+
+	if replicas := config.GetStringSlice(prefix + ".Replicas"); len(replicas) > 0 {
+		var dialectors []gorm.Dialector
+		for _, replica := range replicas {
+			dialectors = append(dialectors, dial(replica))
+		}
+		err = ormDb.Use(dbresolver.Register(dbresolver.Config{Replicas: dialectors}))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ormDb, nil
+}
 
-	user := config.GetString("database.User")
+// mysqlDialector 校验 MySQL 配置, 返回按主机创建连接的函数
+func mysqlDialector(config *viper.Viper, prefix string) (func(host string) gorm.Dialector, error) {
+	user := config.GetString(prefix + ".User")
 	if len(user) == 0 {
-		return nil, errors.New("user is empty")
+		return nil, configError(prefix, "user")
 	}
 
-	password := config.GetString("database.Password")
+	password := config.GetString(prefix + ".Password")
 	if len(password) == 0 {
-		return nil, errors.New("password is empty")
+		return nil, configError(prefix, "password")
 	}
 
-	host := config.GetString("database.Host")
+	host := config.GetString(prefix + ".Host")
 	if len(host) == 0 {
-		return nil, errors.New("host is empty")
+		return nil, configError(prefix, "host")
 	}
 
-	db := config.GetString("database.Db")
+	db := config.GetString(prefix + ".Db")
 	if len(db) == 0 {
-		return nil, errors.New("db is empty")
+		return nil, configError(prefix, "db")
 	}
 
-	charset := config.GetString("database.Charset")
+	charset := config.GetString(prefix + ".Charset")
 	if len(charset) == 0 {
-		return nil, errors.New("charset is empty")
+		return nil, configError(prefix, "charset")
 	}
 
-	dial := "%s:%s@(%s)/%s?charset=%s&parseTime=True&loc=Local"
-	dial = fmt.Sprintf(dial,
-		user,
-		password,
-		host,
-		db,
-		charset)
+	return func(host string) gorm.Dialector {
+		return mysql.Open(fmt.Sprintf("%s:%s@(%s)/%s?charset=%s&parseTime=True&loc=Local",
+			user,
+			password,
+			host,
+			db,
+			charset))
+	}, nil
+}
 
-	gormConf := &gorm.Config{}
+// postgresDialector 校验 PostgreSQL 配置, SSLMode 默认为 disable
+func postgresDialector(config *viper.Viper, prefix string) (func(host string) gorm.Dialector, error) {
+	user := config.GetString(prefix + ".User")
+	if len(user) == 0 {
+		return nil, configError(prefix, "user")
+	}
 
-	ormDb, err := gorm.Open(mysql.Open(dial), gormConf)
-	if err != nil {
-		return nil, err
+	password := config.GetString(prefix + ".Password")
+	if len(password) == 0 {
+		return nil, configError(prefix, "password")
 	}
 
-	return ormDb, nil
+	host := config.GetString(prefix + ".Host")
+	if len(host) == 0 {
+		return nil, configError(prefix, "host")
+	}
+
+	db := config.GetString(prefix + ".Db")
+	if len(db) == 0 {
+		return nil, configError(prefix, "db")
+	}
+
+	sslMode := config.GetString(prefix + ".SSLMode")
+	if len(sslMode) == 0 {
+		sslMode = "disable"
+	}
+
+	return func(host string) gorm.Dialector {
+		dsn := url.URL{
+			Scheme:   "postgres",
+			User:     url.UserPassword(user, password),
+			Host:     host,
+			Path:     "/" + db,
+			RawQuery: url.Values{"sslmode": []string{sslMode}}.Encode(),
+		}
+		return postgres.Open(dsn.String())
+	}, nil
+}
+
+// sqliteDialector Db 为数据库文件路径, 也可以是 :memory:; 不需要账号与主机
+func sqliteDialector(config *viper.Viper, prefix string) (func(host string) gorm.Dialector, error) {
+	db := config.GetString(prefix + ".Db")
+	if len(db) == 0 {
+		return nil, configError(prefix, "db")
+	}
+	return func(string) gorm.Dialector {
+		return sqlite.Open(db)
+	}, nil
+}
+
+func configError(prefix string, key string) error {
+	if prefix == "database" {
+		return errors.New(key + " is empty")
+	}
+	return fmt.Errorf("%s: %s is empty", prefix, key)
+}
+
+type primaryKey struct{}
+
+// WithPrimary 标记 ctx 中的查询走主库, 用于写入后立即读取(read your writes)
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey{}, true)
+}
+
+// UsePrimary ctx 是否经 WithPrimary 标记
+func UsePrimary(ctx context.Context) bool {
+	primary, _ := ctx.Value(primaryKey{}).(bool)
+	return primary
+}
+
+// WithContext 返回绑定 ctx 的会话, ctx 经 WithPrimary 标记时查询也走主库; 未配置从库时与 db.WithContext 相同
+func WithContext(db *gorm.DB, ctx context.Context) *gorm.DB {
+	db = db.WithContext(ctx)
+	if UsePrimary(ctx) {
+		db = db.Clauses(dbresolver.Write)
+	}
+	return db
+}
+
+// Resolver 按 WithContext 获取会话, 实现 gormrepo.SessionResolver
+type Resolver struct{}
+
+func (Resolver) Session(ctx context.Context, db *gorm.DB) *gorm.DB {
+	return WithContext(db, ctx)
 }
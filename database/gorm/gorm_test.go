@@ -1 +1,37 @@
 package gorm_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spf13/viper"
+
+	"github.com/henrion-y/base.services/database/gorm"
+)
+
+func TestNewNamedDbProvider(t *testing.T) {
+	v := viper.New()
+	v.Set("database.Driver", "mysql")
+	v.Set("database.orders.Driver", "mysql")
+	v.Set("database.orders.User", "root")
+	v.Set("database.orders.Password", "123456")
+
+	_, err := gorm.NewNamedDbProvider(v, "orders")
+	if err == nil || err.Error() != "database.orders: host is empty" {
+		t.Fatalf("expect host is empty, got %v", err)
+	}
+	_, err = gorm.NewDatabasesProvider(v)
+	if err == nil || err.Error() != "database.orders: host is empty" {
+		t.Fatalf("expect host is empty, got %v", err)
+	}
+}
+
+func TestWithPrimary(t *testing.T) {
+	ctx := context.Background()
+	if gorm.UsePrimary(ctx) {
+		t.Fatal("expect replica by default")
+	}
+	if !gorm.UsePrimary(gorm.WithPrimary(ctx)) {
+		t.Fatal("expect primary after WithPrimary")
+	}
+}
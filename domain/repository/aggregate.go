@@ -0,0 +1,236 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+/********* 聚合 ***********/
+
+type AggregateFunc string
+
+const (
+	AggregateFunc_COUNT AggregateFunc = "COUNT" // 计数, Column 为空时统计行数, 否则统计非空值个数
+	AggregateFunc_SUM   AggregateFunc = "SUM"   // 求和
+	AggregateFunc_AVG   AggregateFunc = "AVG"   // 平均值
+	AggregateFunc_MIN   AggregateFunc = "MIN"   // 最小值
+	AggregateFunc_MAX   AggregateFunc = "MAX"   // 最大值
+)
+
+var (
+	ErrAggregateEmpty          = errors.New("aggregate spec has neither group by columns nor aggregations")
+	ErrAggregateCursorNotAllow = errors.New("aggregate does not support cursor pagination")
+)
+
+type Aggregation struct {
+	Func   AggregateFunc
+	Column string
+	Alias  string // 结果列名
+}
+
+// AggregateSpec 聚合查询, 结果每行包含 GroupBy 的列与各 Aggregation 的 Alias 列.
+// 匹配阶段复用 FilterGroup, Having 以分组列或别名作为列名对聚合结果过滤, 排序同样使用分组列或别名;
+// PostgreSQL 的 HAVING 不能引用 SELECT 中的别名, 构建 SQL 时 Having 中的别名替换为对应的聚合表达式
+type AggregateSpec struct {
+	GroupBy      []string
+	Aggregations []Aggregation
+	Having       *FilterGroup
+}
+
+// NewAggregateSpec 创建聚合查询, groupBy 为空时对全部匹配记录聚合为一行
+func NewAggregateSpec(groupBy ...string) *AggregateSpec {
+	return &AggregateSpec{GroupBy: groupBy}
+}
+
+// Count 统计行数
+func (s *AggregateSpec) Count(alias string) *AggregateSpec {
+	return s.AddAggregation(AggregateFunc_COUNT, "", alias)
+}
+
+// CountColumn 统计列的非空值个数
+func (s *AggregateSpec) CountColumn(column string, alias string) *AggregateSpec {
+	return s.AddAggregation(AggregateFunc_COUNT, column, alias)
+}
+
+func (s *AggregateSpec) Sum(column string, alias string) *AggregateSpec {
+	return s.AddAggregation(AggregateFunc_SUM, column, alias)
+}
+
+func (s *AggregateSpec) Avg(column string, alias string) *AggregateSpec {
+	return s.AddAggregation(AggregateFunc_AVG, column, alias)
+}
+
+func (s *AggregateSpec) Min(column string, alias string) *AggregateSpec {
+	return s.AddAggregation(AggregateFunc_MIN, column, alias)
+}
+
+func (s *AggregateSpec) Max(column string, alias string) *AggregateSpec {
+	return s.AddAggregation(AggregateFunc_MAX, column, alias)
+}
+
+// AddAggregation 添加聚合函数, alias 为空时使用 函数名_列名 的小写形式, 如 sum_amount
+func (s *AggregateSpec) AddAggregation(fn AggregateFunc, column string, alias string) *AggregateSpec {
+	if alias == "" {
+		alias = strings.ToLower(string(fn))
+		if column != "" {
+			alias += "_" + strings.ReplaceAll(column, ".", "_")
+		}
+	}
+	s.Aggregations = append(s.Aggregations, Aggregation{Func: fn, Column: column, Alias: alias})
+	return s
+}
+
+// SetHaving 设置聚合结果的过滤条件
+func (s *AggregateSpec) SetHaving(having *FilterGroup) *AggregateSpec {
+	s.Having = having
+	return s
+}
+
+// Validate 校验聚合配置
+func (s *AggregateSpec) Validate() error {
+	if len(s.GroupBy) == 0 && len(s.Aggregations) == 0 {
+		return ErrAggregateEmpty
+	}
+	for _, aggregation := range s.Aggregations {
+		switch aggregation.Func {
+		case AggregateFunc_COUNT:
+		case AggregateFunc_SUM, AggregateFunc_AVG, AggregateFunc_MIN, AggregateFunc_MAX:
+			if aggregation.Column == "" {
+				return fmt.Errorf("aggregate function %s requires a column", aggregation.Func)
+			}
+		default:
+			return fmt.Errorf("unsupported aggregate function %s", aggregation.Func)
+		}
+	}
+	return nil
+}
+
+// BuildToMysql 与 BuildToSQL 相同
+//
+// Deprecated: 使用 BuildToSQL
+func (s *AggregateSpec) BuildToMysql(db *gorm.DB) *gorm.DB {
+	return s.BuildToSQL(db)
+}
+
+func (s *AggregateSpec) BuildToSQL(db *gorm.DB) *gorm.DB {
+	// 列名与别名都作为 clause.Column 传入, 由方言加引号
+	var selects []string
+	var vars []interface{}
+	aliases := make(map[string]clause.Column, len(s.Aggregations))
+	groupBy := clause.GroupBy{}
+	for _, column := range s.GroupBy {
+		selects = append(selects, "?")
+		vars = append(vars, clause.Column{Name: column})
+		groupBy.Columns = append(groupBy.Columns, clause.Column{Name: column})
+	}
+	for _, aggregation := range s.Aggregations {
+		if aggregation.Column == "" {
+			selects = append(selects, fmt.Sprintf("%s(*) AS ?", aggregation.Func))
+			vars = append(vars, clause.Column{Name: aggregation.Alias})
+			aliases[aggregation.Alias] = clause.Column{Name: fmt.Sprintf("%s(*)", aggregation.Func), Raw: true}
+			continue
+		}
+		selects = append(selects, fmt.Sprintf("%s(?) AS ?", aggregation.Func))
+		vars = append(vars, clause.Column{Name: aggregation.Column}, clause.Column{Name: aggregation.Alias})
+		aliases[aggregation.Alias] = clause.Column{
+			Name: fmt.Sprintf("%s(%s)", aggregation.Func, db.Statement.Quote(clause.Column{Name: aggregation.Column})),
+			Raw:  true,
+		}
+	}
+	db = db.Select(strings.Join(selects, ", "), vars...)
+
+	if len(groupBy.Columns) > 0 {
+		db = db.Clauses(groupBy)
+	}
+	if s.Having != nil {
+		expression, err := s.Having.buildSQLExpression(DialectOf(db), aliases)
+		if err != nil {
+			_ = db.AddError(err)
+			return db
+		}
+		if expression != nil {
+			db = db.Having(expression)
+		}
+	}
+	return db
+}
+
+// BuildToMongo 构建聚合管道: $match -> $group -> $project(展开分组列) -> $match(having) -> $sort -> $skip -> $limit
+func (s *AggregateSpec) BuildToMongo(filterGroup *FilterGroup, sortSpecs *SortSpecs, limitSpec *LimitSpec) mongo.Pipeline {
+	pipeline := mongo.Pipeline{}
+	if filterGroup != nil {
+		if match := filterGroup.BuildToMongo(); len(match) > 0 {
+			pipeline = append(pipeline, bson.D{{Key: "$match", Value: match}})
+		}
+	}
+
+	// 分组 key 中不允许出现 ".", 嵌套列用 "_" 替换
+	var groupID interface{}
+	project := bson.D{{Key: "_id", Value: 0}}
+	if len(s.GroupBy) > 0 {
+		id := bson.D{}
+		for _, column := range s.GroupBy {
+			key := strings.ReplaceAll(column, ".", "_")
+			id = append(id, bson.E{Key: key, Value: "$" + column})
+			project = append(project, bson.E{Key: column, Value: "$_id." + key})
+		}
+		groupID = id
+	}
+
+	group := bson.D{{Key: "_id", Value: groupID}}
+	for _, aggregation := range s.Aggregations {
+		group = append(group, bson.E{Key: aggregation.Alias, Value: aggregation.buildToMongo()})
+		project = append(project, bson.E{Key: aggregation.Alias, Value: 1})
+	}
+	pipeline = append(pipeline,
+		bson.D{{Key: "$group", Value: group}},
+		bson.D{{Key: "$project", Value: project}},
+	)
+
+	if s.Having != nil {
+		if match := s.Having.BuildToMongo(); len(match) > 0 {
+			pipeline = append(pipeline, bson.D{{Key: "$match", Value: match}})
+		}
+	}
+	if sortSpecs != nil && len(*sortSpecs) > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$sort", Value: sortSpecs.BuildToMongo()}})
+	}
+	if limitSpec != nil {
+		limit, skip := limitSpec.BuildToMongo()
+		if skip != nil {
+			pipeline = append(pipeline, bson.D{{Key: "$skip", Value: *skip}})
+		}
+		if limit != nil {
+			pipeline = append(pipeline, bson.D{{Key: "$limit", Value: *limit}})
+		}
+	}
+	return pipeline
+}
+
+func (a Aggregation) buildToMongo() bson.D {
+	field := "$" + a.Column
+	switch a.Func {
+	case AggregateFunc_COUNT:
+		if a.Column == "" {
+			return bson.D{{Key: "$sum", Value: 1}}
+		}
+		// 与 SQL COUNT(column) 一致只统计非空值
+		return bson.D{{Key: "$sum", Value: bson.D{{Key: "$cond", Value: bson.A{
+			bson.D{{Key: "$gt", Value: bson.A{field, nil}}}, 1, 0,
+		}}}}}
+	case AggregateFunc_SUM:
+		return bson.D{{Key: "$sum", Value: field}}
+	case AggregateFunc_AVG:
+		return bson.D{{Key: "$avg", Value: field}}
+	case AggregateFunc_MIN:
+		return bson.D{{Key: "$min", Value: field}}
+	default:
+		return bson.D{{Key: "$max", Value: field}}
+	}
+}
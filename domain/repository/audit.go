@@ -0,0 +1,322 @@
+package repository
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/henrion-y/base.services/infra/zlog"
+)
+
+/********* 操作人与审计 ***********/
+
+// StampHook 在写入时按 ctx 中的操作人(见 WithOperator)填充创建人、更新人列, 模型没有对应列或 ctx 中没有操作人时不处理.
+// Create、CreateBatch、Upsert 填充模型字段(创建人为空时才填充), Update 在更新内容中追加更新人; 字段须为 string 类型
+type StampHook struct {
+	createdByColumn string
+	updatedByColumn string
+}
+
+// NewStampHook 创建填充钩子, 列名为空时跳过对应的列, 如 NewStampHook("created_by", "updated_by")
+func NewStampHook(createdByColumn string, updatedByColumn string) *StampHook {
+	return &StampHook{createdByColumn: createdByColumn, updatedByColumn: updatedByColumn}
+}
+
+func (h *StampHook) Before(ctx context.Context, call *HookCall) error {
+	operator := OperatorFromContext(ctx)
+	if operator == "" {
+		return nil
+	}
+
+	switch call.Operation {
+	case Operation_CREATE:
+		h.stamp(call.Model, operator)
+	case Operation_CREATE_BATCH:
+		batches, err := SplitBatches(call.Models, 0)
+		if err != nil {
+			return err
+		}
+		for _, batch := range batches {
+			for _, item := range batch.Items {
+				h.stamp(item, operator)
+			}
+		}
+	case Operation_UPSERT:
+		h.stamp(call.Model, operator)
+		// 指定了更新列时, 冲突更新也要写入更新人
+		if len(call.UpdateColumns) > 0 && h.hasColumn(call.Model, h.updatedByColumn) && !containsString(call.UpdateColumns, h.updatedByColumn) {
+			call.UpdateColumns = append(append([]string{}, call.UpdateColumns...), h.updatedByColumn)
+		}
+	case Operation_UPDATE:
+		if h.hasColumn(call.Model, h.updatedByColumn) {
+			call.Data = WithUpdateOperator(call.Data, UpdateOperator_SET, h.updatedByColumn, operator)
+		}
+	}
+	return nil
+}
+
+func (h *StampHook) After(ctx context.Context, call *HookCall) error {
+	return nil
+}
+
+func (h *StampHook) stamp(mod Model, operator string) {
+	setStringColumn(mod, h.createdByColumn, operator, false)
+	setStringColumn(mod, h.updatedByColumn, operator, true)
+}
+
+func (h *StampHook) hasColumn(mod Model, column string) bool {
+	if column == "" {
+		return false
+	}
+	_, ok := columnType(indirectType(reflect.TypeOf(mod)), column)
+	return ok
+}
+
+// setStringColumn 为模型的 string 字段赋值, overwrite 为 false 时只填充空字段
+func setStringColumn(mod Model, column string, value string, overwrite bool) {
+	if column == "" {
+		return
+	}
+	field, ok := FieldByColumn(reflect.ValueOf(mod), column)
+	if !ok || !field.CanSet() || field.Kind() != reflect.String {
+		return
+	}
+	if overwrite || field.String() == "" {
+		field.SetString(value)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+const DefaultAuditTable = "t_audit_log"
+
+// auditMaxRows Update、Delete、Restore 最多记录的变更记录数, 超出部分只体现在 RowsAffected 中
+const auditMaxRows = 100
+
+const auditRowsKey = "repository.audit.rows"
+
+// AuditLog 审计记录, 每次成功的写操作一条
+type AuditLog struct {
+	ID           int64     `json:"id" gorm:"primaryKey" bson:"id,omitempty"`
+	TargetTable  string    `json:"target_table" bson:"target_table"` // 被修改的表
+	Operation    string    `json:"operation" bson:"operation"`
+	Operator     string    `json:"operator" bson:"operator"`           // 操作人, 见 WithOperator
+	Filter       string    `json:"filter" bson:"filter"`               // 过滤条件 JSON
+	Changes      string    `json:"changes" bson:"changes"`             // 变更内容 JSON, 为 []AuditRecord
+	RowsAffected int64     `json:"rows_affected" bson:"rows_affected"` // 受影响行数, Delete 为变更前匹配的记录数
+	CreatedAt    time.Time `json:"created_at" bson:"created_at"`
+
+	table string
+}
+
+func (l *AuditLog) TableName() string {
+	if l.table == "" {
+		return DefaultAuditTable
+	}
+	return l.table
+}
+
+// AuditRecord 单条记录的变更
+type AuditRecord struct {
+	ID      interface{}            `json:"id,omitempty"` // 记录的 id, 按 id、_id 列取值
+	Changes map[string]AuditChange `json:"changes"`
+}
+
+// AuditChange 单列的变更, Create 时 Old 为空, Delete 时 New 为空
+type AuditChange struct {
+	Old interface{} `json:"old"`
+	New interface{} `json:"new"`
+}
+
+// AuditHook 将每次成功的写操作写入审计表:
+// Create、CreateBatch、Upsert 记录模型各列的值; Update 在执行前查出匹配的记录, 记录更新内容中值发生变化的列;
+// Delete 记录被删除记录各列的值; Restore 记录删除标记列的变化.
+// 审计记录写入失败时该 error 作为写操作的结果返回, 在事务中会导致回滚
+type AuditHook struct {
+	table string
+	store BaseRepository
+}
+
+// NewAuditHook 创建审计钩子, table 为空时使用 DefaultAuditTable;
+// store 为审计记录写入的仓储, 为 nil 时写入被修改的仓储, 在事务中与写操作处于同一事务
+func NewAuditHook(table string, store BaseRepository) *AuditHook {
+	if table == "" {
+		table = DefaultAuditTable
+	}
+	return &AuditHook{table: table, store: store}
+}
+
+func (h *AuditHook) Before(ctx context.Context, call *HookCall) error {
+	if h.skip(call) {
+		return nil
+	}
+
+	var (
+		rows []interface{}
+		err  error
+	)
+	switch call.Operation {
+	case Operation_UPDATE, Operation_DELETE:
+		rows, err = h.findRows(ctx, call.Repo.Find, call.Model, call.FilterGroup)
+	case Operation_RESTORE:
+		filterGroup, deletedErr := OnlyDeleted(call.Model, call.FilterGroup)
+		if deletedErr != nil {
+			// 由 Restore 自身返回 ErrSoftDeleteNotSupported
+			return nil
+		}
+		rows, err = h.findRows(ctx, call.Repo.FindWithDeleted, call.Model, filterGroup)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	call.Set(auditRowsKey, rows)
+	return nil
+}
+
+func (h *AuditHook) After(ctx context.Context, call *HookCall) error {
+	if call.Err != nil || !call.Operation.IsWrite() || h.skip(call) {
+		return nil
+	}
+
+	var records []AuditRecord
+	rowsAffected := call.RowsAffected
+	switch call.Operation {
+	case Operation_CREATE, Operation_UPSERT:
+		records = append(records, newAuditRecord(call.Model))
+		if call.Operation == Operation_CREATE {
+			rowsAffected = 1
+		}
+	case Operation_CREATE_BATCH:
+		batches, _ := SplitBatches(call.Models, 0)
+		for _, batch := range batches {
+			for _, item := range batch.Items {
+				records = append(records, newAuditRecord(item))
+			}
+		}
+	case Operation_UPDATE, Operation_DELETE, Operation_RESTORE:
+		value, _ := call.Get(auditRowsKey)
+		rows, _ := value.([]interface{})
+		data := call.Data
+		if call.Operation == Operation_RESTORE {
+			column, _ := SoftDeleteColumn(call.Model)
+			data = map[string]interface{}{column: nil}
+		}
+		for _, row := range rows {
+			if record := diffAuditRecord(row, data, call.Operation == Operation_DELETE); len(record.Changes) > 0 {
+				records = append(records, record)
+			}
+		}
+		if call.Operation == Operation_DELETE {
+			rowsAffected = int64(len(rows))
+		}
+	}
+
+	log := &AuditLog{
+		TargetTable:  auditTarget(call),
+		Operation:    string(call.Operation),
+		Operator:     OperatorFromContext(ctx),
+		Changes:      jsonString(records),
+		RowsAffected: rowsAffected,
+		CreatedAt:    time.Now(),
+		table:        h.table,
+	}
+	if call.FilterGroup != nil {
+		log.Filter = jsonString(call.FilterGroup)
+	}
+
+	store := h.store
+	if store == nil {
+		store = call.Repo
+	}
+	if err := store.Create(ctx, log); err != nil {
+		zlog.Error("AuditHook.After", zap.Any("log", log), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// skip 不审计对审计表自身的操作
+func (h *AuditHook) skip(call *HookCall) bool {
+	return auditTarget(call) == h.table
+}
+
+type findFunc func(ctx context.Context, mod Model, result interface{}, fields []string, filterGroup *FilterGroup, sortSpecs *SortSpecs, limitSpec *LimitSpec) error
+
+// findRows 查出将被修改的记录, 最多 auditMaxRows 条
+func (h *AuditHook) findRows(ctx context.Context, find findFunc, mod Model, filterGroup *FilterGroup) ([]interface{}, error) {
+	list := reflect.New(reflect.SliceOf(indirectType(reflect.TypeOf(mod))))
+	if err := find(ctx, mod, list.Interface(), nil, filterGroup, nil, NewLimitSpec(1, auditMaxRows)); err != nil {
+		return nil, err
+	}
+	rows := make([]interface{}, list.Elem().Len())
+	for i := range rows {
+		rows[i] = list.Elem().Index(i).Addr().Interface()
+	}
+	return rows, nil
+}
+
+func auditTarget(call *HookCall) string {
+	if call.Model != nil {
+		return call.Model.TableName()
+	}
+	if batches, err := SplitBatches(call.Models, 0); err == nil && len(batches) > 0 {
+		return batches[0].Items[0].TableName()
+	}
+	return ""
+}
+
+func newAuditRecord(mod Model) AuditRecord {
+	record := AuditRecord{ID: recordID(mod), Changes: make(map[string]AuditChange)}
+	for _, column := range StructColumns(reflect.TypeOf(mod)) {
+		value, _ := ColumnValue(mod, column)
+		record.Changes[column] = AuditChange{New: value}
+	}
+	return record
+}
+
+// diffAuditRecord 对比记录与更新内容, 只保留值发生变化的列; deleted 为 true 时记录全部列的旧值
+func diffAuditRecord(row interface{}, data map[string]interface{}, deleted bool) AuditRecord {
+	record := AuditRecord{ID: recordID(row), Changes: make(map[string]AuditChange)}
+	if deleted {
+		for _, column := range StructColumns(reflect.TypeOf(row)) {
+			value, _ := ColumnValue(row, column)
+			record.Changes[column] = AuditChange{Old: value}
+		}
+		return record
+	}
+	assignments, _ := ParseUpdateData(data)
+	for _, assignment := range assignments {
+		old, _ := ColumnValue(row, assignment.Column)
+		if assignment.Operator != UpdateOperator_SET {
+			// 操作符更新不查询更新后的值, 记录操作本身, 如 {"$inc": 1}
+			record.Changes[assignment.Column] = AuditChange{Old: old, New: map[string]interface{}{string(assignment.Operator): assignment.Value}}
+			continue
+		}
+		// 按 JSON 比较, 忽略 int 与 int64 等类型差异
+		if jsonString(old) != jsonString(assignment.Value) {
+			record.Changes[assignment.Column] = AuditChange{Old: old, New: assignment.Value}
+		}
+	}
+	return record
+}
+
+// recordID 返回记录的 id, 按 id、_id 列取值
+func recordID(row interface{}) interface{} {
+	for _, column := range []string{"id", "_id"} {
+		if value, ok := ColumnValue(row, column); ok {
+			return value
+		}
+	}
+	return nil
+}
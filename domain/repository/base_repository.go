@@ -2,11 +2,13 @@ package repository
 
 import (
 	"context"
-	"fmt"
+	"strings"
 
 	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/henrion-y/base.services/infra/geo"
 )
 
 /*
@@ -15,11 +17,39 @@ import (
 
 type BaseRepository interface {
 	Create(ctx context.Context, mod Model) error
+	// CreateBatch 批量插入, models 为模型切片(如 []*User), 每 batchSize 条一批写入, batchSize <= 0 时一次写入.
+	// 返回每批插入的行数, 出错时返回已成功批次的行数
+	CreateBatch(ctx context.Context, models interface{}, batchSize int) ([]int64, error)
+	// Upsert 按 conflictColumns 判断记录是否存在, 存在时更新 updateColumns(为空时更新全部列), 否则插入 mod.
+	// 返回受影响行数, 具体取值与驱动有关, 如 MySQL 插入为 1、更新为 2、未变化为 0
+	Upsert(ctx context.Context, mod Model, conflictColumns []string, updateColumns []string) (int64, error)
+	// Update data 为 列名: 值, 也可以使用 $inc 等操作符, 见 UpdateSpec
 	Update(ctx context.Context, mod Model, data map[string]interface{}, filterGroup *FilterGroup) (int64, error)
+	// Delete 删除记录, 模型实现 SoftDeleteModel 时只写入删除标记
 	Delete(ctx context.Context, mod Model, filterGroup *FilterGroup) error
+	// Restore 恢复软删除的记录, 返回恢复的行数; 模型未实现 SoftDeleteModel 时返回 ErrSoftDeleteNotSupported
+	Restore(ctx context.Context, mod Model, filterGroup *FilterGroup) (int64, error)
 	Find(ctx context.Context, mod Model, result interface{}, fields []string, filterGroup *FilterGroup, sortSpecs *SortSpecs, limitSpec *LimitSpec) error
+	// FindWithDeleted 与 Find 相同, 但结果包含软删除的记录
+	FindWithDeleted(ctx context.Context, mod Model, result interface{}, fields []string, filterGroup *FilterGroup, sortSpecs *SortSpecs, limitSpec *LimitSpec) error
+	// FindEach 分批遍历查询结果(不含软删除的记录), 每批写入 result 后调用 fn, batchSize <= 0 时使用 DefaultEachBatchSize.
+	// fn 返回 ErrStopIteration 时提前结束并返回 nil, 见 each.go
+	FindEach(ctx context.Context, mod Model, result interface{}, fields []string, filterGroup *FilterGroup, sortSpecs *SortSpecs, batchSize int, fn func() error) error
 	FindOne(ctx context.Context, mod Model, fields []string, filterGroup *FilterGroup, sortSpecs *SortSpecs) error
+	// FindByIDs 按主键(见 PrimaryKeyColumn)批量查询, 不存在的 id 被忽略, 结果顺序不保证与 ids 一致; 并发调用的合并见 Loader
+	FindByIDs(ctx context.Context, mod Model, result interface{}, ids interface{}) error
 	Count(ctx context.Context, mod Model, filterGroup *FilterGroup) (int64, error)
+	// Exists 是否存在满足条件的记录, 只查询一条
+	Exists(ctx context.Context, mod Model, filterGroup *FilterGroup) (bool, error)
+	// Distinct 查询满足条件的记录中 column 的不重复值, result 为切片指针, 如 *[]string, 结果顺序不保证
+	Distinct(ctx context.Context, mod Model, column string, result interface{}, filterGroup *FilterGroup) error
+	// FindPage 查询一页结果并统计满足条件的总数, result 为切片指针, 同时作为 Page.Items 返回, 见 page.go
+	FindPage(ctx context.Context, mod Model, result interface{}, fields []string, filterGroup *FilterGroup, sortSpecs *SortSpecs, limitSpec *LimitSpec) (*Page, error)
+	// Aggregate 分组聚合查询, result 为切片指针, 元素的字段(或 map 的 key)对应分组列与聚合别名
+	Aggregate(ctx context.Context, mod Model, result interface{}, filterGroup *FilterGroup, aggregateSpec *AggregateSpec, sortSpecs *SortSpecs, limitSpec *LimitSpec) error
+	// WithTransaction 在事务中执行 fn, fn 内须使用 txRepo 操作数据; fn 返回 error 时回滚, panic 时回滚后重新 panic, 否则提交.
+	// 在 txRepo 上再次调用 WithTransaction 不会开启新事务, 而是直接复用当前事务
+	WithTransaction(ctx context.Context, fn func(txRepo BaseRepository) error) error
 }
 
 type Model interface {
@@ -42,6 +72,16 @@ const (
 	FilterType_LIKE        FilterType = "LIKE"        //like
 	FilterType_IS_NULL     FilterType = "IS_NULL"     //为空
 	FilterType_IS_NOT_NULL FilterType = "IS_NOT_NULL" //非空
+
+	FilterType_BETWEEN            FilterType = "BETWEEN"            // 闭区间, Value 为两个元素的切片
+	FilterType_NOT_LIKE           FilterType = "NOT_LIKE"           // not like
+	FilterType_STARTS_WITH        FilterType = "STARTS_WITH"        // 前缀匹配, Value 按字面量处理
+	FilterType_ENDS_WITH          FilterType = "ENDS_WITH"          // 后缀匹配, Value 按字面量处理
+	FilterType_CONTAINS           FilterType = "CONTAINS"           // 包含子串, Value 按字面量处理
+	FilterType_REGEX              FilterType = "REGEX"              // 正则匹配, 语法与大小写规则取决于数据库
+	FilterType_ARRAY_CONTAINS     FilterType = "ARRAY_CONTAINS"     // 数组列包含 Value 中的全部元素
+	FilterType_ARRAY_CONTAINS_ANY FilterType = "ARRAY_CONTAINS_ANY" // 数组列包含 Value 中的任一元素
+	FilterType_EXISTS             FilterType = "EXISTS"             // Value 为 true(或 nil) 时要求字段存在且非空, false 时相反
 )
 
 type FilterLogic string
@@ -118,11 +158,56 @@ func (g *FilterGroup) IsNotNull(column string) *FilterGroup {
 	return g.AddFilter(column, FilterType_IS_NOT_NULL, nil)
 }
 
-// Like 添加一个LIKE的过滤条件
+// Like 添加一个LIKE的过滤条件, pattern 为 LIKE 模式(% _ 及 \ 转义), 各仓储均匹配整个值, 子串匹配使用 Contains
 func (g *FilterGroup) Like(column string, pattern string) *FilterGroup {
 	return g.AddFilter(column, FilterType_LIKE, pattern)
 }
 
+// NotLike 添加一个NOT LIKE的过滤条件
+func (g *FilterGroup) NotLike(column string, pattern string) *FilterGroup {
+	return g.AddFilter(column, FilterType_NOT_LIKE, pattern)
+}
+
+// Between 添加一个闭区间 [from, to] 的过滤条件
+func (g *FilterGroup) Between(column string, from interface{}, to interface{}) *FilterGroup {
+	return g.AddFilter(column, FilterType_BETWEEN, []interface{}{from, to})
+}
+
+// StartsWith 添加一个前缀匹配的过滤条件, prefix 中的 % _ 不作为通配符
+func (g *FilterGroup) StartsWith(column string, prefix string) *FilterGroup {
+	return g.AddFilter(column, FilterType_STARTS_WITH, prefix)
+}
+
+// EndsWith 添加一个后缀匹配的过滤条件
+func (g *FilterGroup) EndsWith(column string, suffix string) *FilterGroup {
+	return g.AddFilter(column, FilterType_ENDS_WITH, suffix)
+}
+
+// Contains 添加一个包含子串的过滤条件
+func (g *FilterGroup) Contains(column string, substr string) *FilterGroup {
+	return g.AddFilter(column, FilterType_CONTAINS, substr)
+}
+
+// Regex 添加一个正则匹配的过滤条件
+func (g *FilterGroup) Regex(column string, pattern string) *FilterGroup {
+	return g.AddFilter(column, FilterType_REGEX, pattern)
+}
+
+// ArrayContains 添加一个数组列包含全部 values 的过滤条件
+func (g *FilterGroup) ArrayContains(column string, values interface{}) *FilterGroup {
+	return g.AddFilter(column, FilterType_ARRAY_CONTAINS, values)
+}
+
+// ArrayContainsAny 添加一个数组列包含任一 values 的过滤条件
+func (g *FilterGroup) ArrayContainsAny(column string, values interface{}) *FilterGroup {
+	return g.AddFilter(column, FilterType_ARRAY_CONTAINS_ANY, values)
+}
+
+// Exists 添加一个字段是否存在(且非空)的过滤条件
+func (g *FilterGroup) Exists(column string, exists bool) *FilterGroup {
+	return g.AddFilter(column, FilterType_EXISTS, exists)
+}
+
 // AddFilter 是一个通用的方法，用于将过滤器添加到组中
 func (g *FilterGroup) AddFilter(column string, filterType FilterType, value interface{}) *FilterGroup {
 	g.Filters = append(g.Filters, FilterSpec{
@@ -167,46 +252,66 @@ func (g *FilterGroup) Or(filters ...*FilterGroup) *FilterGroup {
 	return g.AddGroup(newGroup)
 }
 
+// BuildToSQL 将过滤组构建为 where 条件, 组内的 Filters 与 Groups 按组的 Logic 连接, 子组整体加括号.
+// 按 db 的方言构建(见 SQLDialect), 列名会按方言加引号, 但仍需先用 ColumnSet 校验列名是否属于模型;
+// 方言不支持的条件通过 db.AddError 在执行时返回
+func (g *FilterGroup) BuildToSQL(db *gorm.DB) *gorm.DB {
+	expression, err := g.buildSQLExpression(DialectOf(db), nil)
+	if err != nil {
+		_ = db.AddError(err)
+		return db
+	}
+	if expression != nil {
+		db = db.Where(expression)
+	}
+	return db
+}
+
+// BuildToMysql 与 BuildToSQL 相同, 方言按 db 自动选择
+//
+// Deprecated: 使用 BuildToSQL
 func (g *FilterGroup) BuildToMysql(db *gorm.DB) *gorm.DB {
-	// 应用这一层的过滤条件
+	return g.BuildToSQL(db)
+}
+
+// buildSQLExpression columns 为列名到表达式的替换, 如 Having 中的聚合别名替换为聚合表达式, 不在其中的列按列名引用
+func (g *FilterGroup) buildSQLExpression(dialect SQLDialect, columns map[string]clause.Column) (clause.Expression, error) {
+	var expressions []clause.Expression
+
+	// 这一层的过滤条件
 	for _, filter := range g.Filters {
-		// 根据比较类型生成查询表达式
-		switch filter.FilterType {
-		case FilterType_IS_NULL:
-			expression := fmt.Sprintf("%s IS NULL", filter.Column)
-			db = db.Where(expression)
-		case FilterType_IS_NOT_NULL:
-			expression := fmt.Sprintf("%s IS NOT NULL", filter.Column)
-			db = db.Where(expression)
-		default:
-			expression := fmt.Sprintf("%s %s ?", filter.Column, toMySQLComparator(filter.FilterType))
-			db = db.Where(expression, filter.Value)
+		expression, err := filter.buildSQLExpression(dialect, columns)
+		if err != nil {
+			return nil, err
 		}
-
+		expressions = append(expressions, expression)
 	}
 
-	// 如果有嵌套的FilterGroup，根据当前组的Logic来递归构建查询条件
-	if len(g.Groups) > 0 {
-		subQuery := db
-		if g.Logic == FilterLogic_OR {
-			// 为嵌套 OR 查询创建一个新的子查询
-			subQuery = db.Session(&gorm.Session{NewDB: true})
+	// 递归构建嵌套的子组
+	for _, subGroup := range g.Groups {
+		if subGroup == nil {
+			continue
 		}
-
-		for _, subGroup := range g.Groups {
-			if g.Logic == FilterLogic_OR {
-				// 使用`Or`链接子组条件，需要先构建完整的嵌套条件
-				// 然后再将结果作为OR条件应用到原始查询
-				nested := subGroup.BuildToMysql(subQuery)
-				db = db.Or(nested)
-			} else {
-				// 默认按照AND链接子组条件使用现有的db实例
-				db = subGroup.BuildToMysql(db)
-			}
+		expression, err := subGroup.buildSQLExpression(dialect, columns)
+		if err != nil {
+			return nil, err
+		}
+		if expression != nil {
+			expressions = append(expressions, expression)
 		}
 	}
 
-	return db
+	switch {
+	case len(expressions) == 0:
+		return nil, nil
+	case len(expressions) == 1:
+		// 单个条件不能包成 OrConditions, 否则 gorm 会把它当作 OR 拼接到前一个条件上
+		return expressions[0], nil
+	case g.Logic == FilterLogic_OR:
+		return clause.Or(expressions...), nil
+	default:
+		return clause.And(expressions...), nil
+	}
 }
 
 func (g *FilterGroup) BuildToMongo() bson.D {
@@ -214,33 +319,14 @@ func (g *FilterGroup) BuildToMongo() bson.D {
 
 	// 处理 g.Filters 中的顶层过滤器
 	for _, filter := range g.Filters {
-		operator := "$eq" // 这是默认的比较操作符
-		// 此处省略了你之前的逻辑，根据具体的filter.Operator设置不同的MongoDB操作符
-		switch filter.FilterType {
-		case FilterType_NE, FilterType_IS_NOT_NULL:
-			operator = "$ne"
-		case FilterType_GT:
-			operator = "$gt"
-		case FilterType_GTE:
-			operator = "$gte"
-		case FilterType_LT:
-			operator = "$lt"
-		case FilterType_LTE:
-			operator = "$lte"
-		case FilterType_IN:
-			operator = "$in"
-		case FilterType_NOT_IN:
-			operator = "$nin"
-		case FilterType_LIKE:
-			// MongoDB使用正则表达式来实现LIKE功能
-			operator = "$regex"
-			filter.Value = primitive.Regex{Pattern: filter.Value.(string), Options: "i"} // 我们假设filter.Value是一个字符串
-		}
-		topLevelConditions = append(topLevelConditions, bson.D{{Key: filter.Column, Value: bson.D{{Key: operator, Value: filter.Value}}}})
+		topLevelConditions = append(topLevelConditions, bson.D{{Key: filter.Column, Value: filter.buildMongoCondition()}})
 	}
 
 	// 处理子过滤器组 g.Groups
 	for _, subgroup := range g.Groups {
+		if subgroup == nil {
+			continue
+		}
 		subFilterDoc := subgroup.BuildToMongo() // 递归构建子过滤器的查询条件
 		// 这里检查子过滤器是否为空，如果为空则跳过
 		if len(subFilterDoc) == 0 {
@@ -268,32 +354,6 @@ func (g *FilterGroup) BuildToMongo() bson.D {
 	return bson.D{{Key: logicOperator, Value: topLevelConditions}}
 }
 
-func toMySQLComparator(filterType FilterType) string {
-	switch filterType {
-	case FilterType_EQ:
-		return "="
-	case FilterType_NE:
-		return "<>"
-	case FilterType_GT:
-		return ">"
-	case FilterType_GTE:
-		return ">="
-	case FilterType_LT:
-		return "<"
-	case FilterType_LTE:
-		return "<="
-	case FilterType_LIKE:
-		return "LIKE"
-	// IN 和 NOT IN 需要特殊处理，因为它们涉及到切片作为参数
-	case FilterType_IN:
-		return "IN"
-	case FilterType_NOT_IN:
-		return "NOT IN"
-	default:
-		panic("unsupported filter type")
-	}
-}
-
 /********* 排序 ***********/
 
 type SortType string
@@ -304,14 +364,16 @@ const (
 )
 
 type SortSpec struct {
-	Property string   `json:"property"` // 属性名
-	Type     SortType `json:"type"`     // 排序类型
+	Property string          `json:"property"`       // 属性名
+	Type     SortType        `json:"type"`           // 排序类型
+	Near     *geo.Coordinate `json:"near,omitempty"` // 不为空时按 Property 位置列到该坐标的距离排序, 见 AddDistance
 }
 
+// SortSpecs 排序规则, 各实现均将 NULL(及 mongo、es 中缺失的字段)视为最小值: 升序排在最前, 降序排在最后
 type SortSpecs []SortSpec
 
 func NewSortSpecs(property string, sortType SortType) *SortSpecs {
-	return &SortSpecs{{property, sortType}}
+	return &SortSpecs{{Property: property, Type: sortType}}
 }
 
 func NewDefaultSortSpecs() *SortSpecs {
@@ -319,17 +381,17 @@ func NewDefaultSortSpecs() *SortSpecs {
 }
 
 func (s *SortSpecs) Add(property string, sortType SortType) *SortSpecs {
-	*s = append(*s, SortSpec{property, sortType})
+	*s = append(*s, SortSpec{Property: property, Type: sortType})
 	return s
 }
 
 func (s *SortSpecs) AddDesc(property string) *SortSpecs {
-	*s = append(*s, SortSpec{property, SortType_DESC})
+	*s = append(*s, SortSpec{Property: property, Type: SortType_DESC})
 	return s
 }
 
 func (s *SortSpecs) AddAsc(property string) *SortSpecs {
-	*s = append(*s, SortSpec{property, SortType_ASC})
+	*s = append(*s, SortSpec{Property: property, Type: SortType_ASC})
 	return s
 }
 
@@ -338,40 +400,107 @@ var mongoSortTypeSet = map[SortType]int{
 	SortType_DESC: -1,
 }
 
+// BuildToMongo 距离排序不能放在 sort 中, 会被跳过, 见 BuildMongoDistanceSort
 func (s *SortSpecs) BuildToMongo() bson.D {
 	sortSpecs := bson.D{}
 	for i := range *s {
+		if (*s)[i].Near != nil {
+			continue
+		}
 		sortSpecs = append(sortSpecs, bson.E{Key: (*s)[i].Property, Value: mongoSortTypeSet[(*s)[i].Type]})
 	}
 	return sortSpecs
 }
 
-var mysqlSortTypeSet = map[SortType]string{
-	SortType_ASC:  "ASC",
-	SortType_DESC: "DESC",
+// BuildToSQL 按 gormDb 的方言构建排序, 方言不支持距离排序时通过 gormDb.AddError 在执行时返回
+func (s *SortSpecs) BuildToSQL(gormDb *gorm.DB) {
+	dialect := DialectOf(gormDb)
+	nullsDialect, nullsOrdered := dialect.(NullsOrderDialect)
+	if s.HasDistance() || nullsOrdered {
+		// 距离排序需要带参数的表达式, 需要指定 NULL 顺序时同样, 整个 ORDER BY 作为一个表达式构建
+		var sql []string
+		var vars []interface{}
+		for _, spec := range *s {
+			item := "?"
+			column := clause.Column{Name: spec.Property}
+			if spec.Near != nil {
+				distance, err := dialect.Distance(column, *spec.Near)
+				if err != nil {
+					_ = gormDb.AddError(err)
+					return
+				}
+				item = distance.SQL
+				vars = append(vars, distance.Vars...)
+			} else {
+				vars = append(vars, column)
+			}
+			if spec.Type == SortType_DESC {
+				item += " DESC"
+			}
+			if nullsOrdered {
+				item += " " + nullsDialect.NullsOrder(spec.Type == SortType_DESC)
+			}
+			sql = append(sql, item)
+		}
+		gormDb.Statement.AddClause(clause.OrderBy{Expression: clause.Expr{SQL: strings.Join(sql, ","), Vars: vars}})
+		return
+	}
+	for i := range *s {
+		gormDb.Order(clause.OrderByColumn{
+			Column: clause.Column{Name: (*s)[i].Property},
+			Desc:   (*s)[i].Type == SortType_DESC,
+		})
+	}
 }
 
+// BuildToMysql 与 BuildToSQL 相同
+//
+// Deprecated: 使用 BuildToSQL
 func (s *SortSpecs) BuildToMysql(gormDb *gorm.DB) {
-	for i := range *s {
-		gormDb.Order(fmt.Sprintf("%s %s", (*s)[i].Property, mysqlSortTypeSet[(*s)[i].Type]))
-	}
+	s.BuildToSQL(gormDb)
 }
 
 /********* 翻页 ***********/
 
 type LimitSpec struct {
-	Page int
-	Size int
+	Page int `json:"page,omitempty"`
+	Size int `json:"size,omitempty"`
+
+	// 游标翻页, 见 NewCursorLimitSpec. 开启后忽略 Page, 按 SortSpecs 及末尾追加的主键做 keyset 分页(见 CursorSpecs)
+	UseCursor  bool   `json:"use_cursor,omitempty"`
+	Cursor     string `json:"cursor,omitempty"`      // 上一页返回的游标, 首页为空
+	NextCursor string `json:"next_cursor,omitempty"` // Find 执行后回填的下一页游标, 为空表示没有更多数据
 }
 
 func NewLimitSpec(page int, size int) *LimitSpec {
 	return &LimitSpec{
-		page,
-		size,
+		Page: page,
+		Size: size,
+	}
+}
+
+// NewCursorLimitSpec 创建游标翻页, cursor 为上一页 Find 后回填的 NextCursor, 首页传空字符串
+func NewCursorLimitSpec(cursor string, size int) *LimitSpec {
+	return &LimitSpec{
+		Size:      size,
+		UseCursor: true,
+		Cursor:    cursor,
 	}
 }
 
+// BuildToMysql 与 BuildToSQL 相同
+//
+// Deprecated: 使用 BuildToSQL
 func (s *LimitSpec) BuildToMysql(gormDb *gorm.DB) {
+	s.BuildToSQL(gormDb)
+}
+
+func (s *LimitSpec) BuildToSQL(gormDb *gorm.DB) {
+	if s.UseCursor {
+		// 多查一条用于判断是否还有下一页
+		gormDb.Limit(s.Size + 1)
+		return
+	}
 	if s.Size > 0 {
 		gormDb.Limit(s.Size)
 	}
@@ -381,6 +510,11 @@ func (s *LimitSpec) BuildToMysql(gormDb *gorm.DB) {
 }
 
 func (s *LimitSpec) BuildToMongo() (optLimit *int64, optSkip *int64) {
+	if s.UseCursor {
+		limit := int64(s.Size + 1)
+		optLimit = &limit
+		return
+	}
 	if s.Size > 0 {
 		limit := int64(s.Size)
 		optLimit = &limit
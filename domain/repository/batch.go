@@ -0,0 +1,52 @@
+package repository
+
+import (
+	"fmt"
+	"reflect"
+)
+
+/********* 批量写入 ***********/
+
+// Batch 批量写入时的一批数据
+type Batch struct {
+	Models interface{} // 原切片的子切片, 类型与传入的 models 相同
+	Items  []Model     // 子切片中的各个模型
+}
+
+// SplitBatches 将模型切片按 batchSize 切分, batchSize <= 0 时不切分; models 为空时返回 nil
+func SplitBatches(models interface{}, batchSize int) ([]Batch, error) {
+	v := reflect.ValueOf(models)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("models must be a slice, got %T", models)
+	}
+
+	length := v.Len()
+	if length == 0 {
+		return nil, nil
+	}
+	if batchSize <= 0 || batchSize > length {
+		batchSize = length
+	}
+
+	items := make([]Model, length)
+	for i := 0; i < length; i++ {
+		item, ok := v.Index(i).Interface().(Model)
+		if !ok {
+			return nil, fmt.Errorf("models element %T does not implement Model", v.Index(i).Interface())
+		}
+		items[i] = item
+	}
+
+	batches := make([]Batch, 0, (length+batchSize-1)/batchSize)
+	for start := 0; start < length; start += batchSize {
+		end := start + batchSize
+		if end > length {
+			end = length
+		}
+		batches = append(batches, Batch{Models: v.Slice(start, end).Interface(), Items: items[start:end]})
+	}
+	return batches, nil
+}
@@ -0,0 +1,328 @@
+package repository
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/henrion-y/base.services/infra/zlog"
+)
+
+/********* 查询缓存 ***********/
+
+/*
+NewCacheRepository 为 Find、FindOne、Count、Exists、Distinct 增加读穿透缓存, FindPage、FindByIDs 由缓存的 Find 与 Count 组成:
+1. 缓存 key 为 数据库名 + 表名 + 表的缓存版本 + 租户(见 WithTenant、WithoutTenant)、结果类型与查询参数(fields、FilterGroup、SortSpecs、LimitSpec)规范 JSON 的哈希(见 canonical.go),
+   条件顺序不同的相同查询共用缓存; 查询参数无法序列化(如 NaN)时不使用缓存. 多个具名数据库有同名表时用 NewNamedCacheRepository 区分
+2. 经该仓储执行的 Create、CreateBatch、Upsert、Update、Delete、Restore 会递增表的缓存版本, 旧版本的缓存不再命中, 等待过期;
+   绕过该仓储直接写数据库时缓存在 ttl 内可能读到旧数据
+3. 事务内的查询不使用缓存, 事务内的写操作在事务结束后再递增版本
+4. 结果经 JSON 序列化缓存, 模型与结果须能 JSON 往返; 缓存读写失败时记录日志并回退到数据库
+5. FindOne 未找到记录(模型未被赋值)时不缓存
+FindWithDeleted、FindEach、Aggregate 不缓存
+*/
+
+const (
+	DefaultCacheTTL = 5 * time.Minute
+	cacheKeyPrefix  = "repo:cache:"
+)
+
+// Cache 缓存存储, 如 redisapi.RepositoryCache
+type Cache interface {
+	// Get 读取 key, 不存在时第二个返回值为 false
+	Get(ctx context.Context, key string) (string, bool, error)
+	Set(ctx context.Context, key string, value string, expiration time.Duration) error
+	// Incr 将 key 加 1 并返回新值, 不存在时视为 0
+	Incr(ctx context.Context, key string) (int64, error)
+}
+
+type cacheRepository struct {
+	BaseRepository
+	cache    Cache
+	database string
+	ttl      time.Duration
+	tx       *cacheTx // 事务内的仓储不为空
+}
+
+// cacheTx 记录事务内写过的表, 事务结束后统一失效
+type cacheTx struct {
+	mu     sync.Mutex
+	tables map[string]bool
+}
+
+func (t *cacheTx) add(table string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tables[table] = true
+}
+
+// cachedFind Find 的缓存内容, 游标翻页时同时缓存下一页游标
+type cachedFind struct {
+	Result     interface{} `json:"result"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// NewCacheRepository 为 base 增加查询缓存, ttl <= 0 时使用 DefaultCacheTTL
+func NewCacheRepository(base BaseRepository, cache Cache, ttl time.Duration) BaseRepository {
+	return NewNamedCacheRepository(base, cache, "", ttl)
+}
+
+// NewNamedCacheRepository 同 NewCacheRepository, 缓存 key 以数据库名 database 区分, 用于具名数据库
+func NewNamedCacheRepository(base BaseRepository, cache Cache, database string, ttl time.Duration) BaseRepository {
+	if ttl <= 0 {
+		ttl = DefaultCacheTTL
+	}
+	return &cacheRepository{BaseRepository: base, cache: cache, database: database, ttl: ttl}
+}
+
+// tableKey 返回 key 中的表名部分, 具名数据库带上数据库名
+func (r *cacheRepository) tableKey(table string) string {
+	if r.database == "" {
+		return table
+	}
+	return r.database + ":" + table
+}
+
+func (r *cacheRepository) versionKey(table string) string {
+	return cacheKeyPrefix + r.tableKey(table) + ":version"
+}
+
+// cacheKey 返回查询的缓存 key, result 为结果, parts 为查询参数的哈希.
+// 事务内、查询参数无法序列化(哈希为空)或读取版本失败时第二个返回值为 false, 此时不使用缓存
+func (r *cacheRepository) cacheKey(ctx context.Context, table string, operation Operation, result interface{}, parts ...string) (string, bool) {
+	if r.tx != nil {
+		return "", false
+	}
+	for _, part := range parts {
+		if part == "" {
+			zlog.Warn("cacheRepository.cacheKey", zap.String("table", table), zap.String("operation", string(operation)),
+				zap.String("reason", "query is not serializable, bypass cache"))
+			return "", false
+		}
+	}
+	version, ok, err := r.cache.Get(ctx, r.versionKey(table))
+	if err != nil {
+		zlog.Error("cacheRepository.cacheKey", zap.String("table", table), zap.Error(err))
+		return "", false
+	}
+	if !ok {
+		version = "0"
+	}
+	// 租户条件由内层的租户钩子追加, 不在 parts 中, key 须按 ctx 的租户区分
+	sum := sha1.Sum([]byte(tenantScope(ctx) + "\n" + reflect.TypeOf(result).String() + "\n" + strings.Join(parts, "\n")))
+	return cacheKeyPrefix + r.tableKey(table) + ":" + version + ":" + string(operation) + ":" + hex.EncodeToString(sum[:]), true
+}
+
+// load 读取缓存并解码到 dst, 未命中或失败时返回 false
+func (r *cacheRepository) load(ctx context.Context, key string, dst interface{}) bool {
+	value, ok, err := r.cache.Get(ctx, key)
+	if err != nil {
+		zlog.Error("cacheRepository.load", zap.String("key", key), zap.Error(err))
+		return false
+	}
+	if !ok {
+		return false
+	}
+	if err = json.Unmarshal([]byte(value), dst); err != nil {
+		zlog.Error("cacheRepository.load", zap.String("key", key), zap.Error(err))
+		return false
+	}
+	return true
+}
+
+func (r *cacheRepository) store(ctx context.Context, key string, value interface{}) {
+	data, err := json.Marshal(value)
+	if err == nil {
+		err = r.cache.Set(ctx, key, string(data), r.ttl)
+	}
+	if err != nil {
+		zlog.Error("cacheRepository.store", zap.String("key", key), zap.Error(err))
+	}
+}
+
+// invalidate 递增表的缓存版本, 事务内延迟到事务结束
+func (r *cacheRepository) invalidate(ctx context.Context, table string) {
+	if r.tx != nil {
+		r.tx.add(table)
+		return
+	}
+	if _, err := r.cache.Incr(ctx, r.versionKey(table)); err != nil {
+		zlog.Error("cacheRepository.invalidate", zap.String("table", table), zap.Error(err))
+	}
+}
+
+// resetResult 解码缓存失败时清空 result, 避免残留部分数据
+func resetResult(result interface{}) {
+	value := reflect.ValueOf(result)
+	if value.Kind() == reflect.Ptr && !value.IsNil() && value.Elem().CanSet() {
+		value.Elem().Set(reflect.Zero(value.Elem().Type()))
+	}
+}
+
+// 写操作无论成功与否都使缓存失效, 避免部分成功时读到旧数据
+
+func (r *cacheRepository) Create(ctx context.Context, mod Model) error {
+	defer r.invalidate(ctx, mod.TableName())
+	return r.BaseRepository.Create(ctx, mod)
+}
+
+func (r *cacheRepository) CreateBatch(ctx context.Context, models interface{}, batchSize int) ([]int64, error) {
+	if batches, err := SplitBatches(models, 0); err == nil && len(batches) > 0 {
+		defer r.invalidate(ctx, batches[0].Items[0].TableName())
+	}
+	return r.BaseRepository.CreateBatch(ctx, models, batchSize)
+}
+
+func (r *cacheRepository) Upsert(ctx context.Context, mod Model, conflictColumns []string, updateColumns []string) (int64, error) {
+	defer r.invalidate(ctx, mod.TableName())
+	return r.BaseRepository.Upsert(ctx, mod, conflictColumns, updateColumns)
+}
+
+func (r *cacheRepository) Update(ctx context.Context, mod Model, data map[string]interface{}, filterGroup *FilterGroup) (int64, error) {
+	defer r.invalidate(ctx, mod.TableName())
+	return r.BaseRepository.Update(ctx, mod, data, filterGroup)
+}
+
+func (r *cacheRepository) Delete(ctx context.Context, mod Model, filterGroup *FilterGroup) error {
+	defer r.invalidate(ctx, mod.TableName())
+	return r.BaseRepository.Delete(ctx, mod, filterGroup)
+}
+
+func (r *cacheRepository) Restore(ctx context.Context, mod Model, filterGroup *FilterGroup) (int64, error) {
+	defer r.invalidate(ctx, mod.TableName())
+	return r.BaseRepository.Restore(ctx, mod, filterGroup)
+}
+
+func (r *cacheRepository) Find(ctx context.Context, mod Model, result interface{}, fields []string, filterGroup *FilterGroup, sortSpecs *SortSpecs, limitSpec *LimitSpec) error {
+	key, ok := r.cacheKey(ctx, mod.TableName(), Operation_FIND, result,
+		hashJSON(fields), filterGroup.Hash(), sortSpecs.Hash(), limitSpec.Hash())
+	if !ok {
+		return r.BaseRepository.Find(ctx, mod, result, fields, filterGroup, sortSpecs, limitSpec)
+	}
+
+	cached := &cachedFind{Result: result}
+	if r.load(ctx, key, cached) {
+		if limitSpec != nil {
+			limitSpec.NextCursor = cached.NextCursor
+		}
+		return nil
+	}
+	resetResult(result)
+
+	if err := r.BaseRepository.Find(ctx, mod, result, fields, filterGroup, sortSpecs, limitSpec); err != nil {
+		return err
+	}
+	if limitSpec != nil {
+		cached.NextCursor = limitSpec.NextCursor
+	}
+	r.store(ctx, key, cached)
+	return nil
+}
+
+func (r *cacheRepository) FindByIDs(ctx context.Context, mod Model, result interface{}, ids interface{}) error {
+	return r.Find(ctx, mod, result, nil, IDsFilter(mod, ids), nil, nil)
+}
+
+func (r *cacheRepository) Exists(ctx context.Context, mod Model, filterGroup *FilterGroup) (bool, error) {
+	key, ok := r.cacheKey(ctx, mod.TableName(), Operation_EXISTS, true, filterGroup.Hash())
+	if !ok {
+		return r.BaseRepository.Exists(ctx, mod, filterGroup)
+	}
+	var exists bool
+	if r.load(ctx, key, &exists) {
+		return exists, nil
+	}
+
+	exists, err := r.BaseRepository.Exists(ctx, mod, filterGroup)
+	if err != nil {
+		return false, err
+	}
+	r.store(ctx, key, exists)
+	return exists, nil
+}
+
+func (r *cacheRepository) Distinct(ctx context.Context, mod Model, column string, result interface{}, filterGroup *FilterGroup) error {
+	key, ok := r.cacheKey(ctx, mod.TableName(), Operation_DISTINCT, result, column, filterGroup.Hash())
+	if !ok {
+		return r.BaseRepository.Distinct(ctx, mod, column, result, filterGroup)
+	}
+	if r.load(ctx, key, result) {
+		return nil
+	}
+	resetResult(result)
+
+	if err := r.BaseRepository.Distinct(ctx, mod, column, result, filterGroup); err != nil {
+		return err
+	}
+	r.store(ctx, key, result)
+	return nil
+}
+
+// FindPage 经缓存的 Find 与 Count 构造
+func (r *cacheRepository) FindPage(ctx context.Context, mod Model, result interface{}, fields []string, filterGroup *FilterGroup, sortSpecs *SortSpecs, limitSpec *LimitSpec) (*Page, error) {
+	return LoadPage(ctx, r, mod, result, fields, filterGroup, sortSpecs, limitSpec)
+}
+
+func (r *cacheRepository) FindOne(ctx context.Context, mod Model, fields []string, filterGroup *FilterGroup, sortSpecs *SortSpecs) error {
+	key, ok := r.cacheKey(ctx, mod.TableName(), Operation_FIND_ONE, mod,
+		hashJSON(fields), filterGroup.Hash(), sortSpecs.Hash())
+	if !ok {
+		return r.BaseRepository.FindOne(ctx, mod, fields, filterGroup, sortSpecs)
+	}
+	if r.load(ctx, key, mod) {
+		return nil
+	}
+
+	before := reflect.Indirect(reflect.ValueOf(mod)).Interface()
+	if err := r.BaseRepository.FindOne(ctx, mod, fields, filterGroup, sortSpecs); err != nil {
+		return err
+	}
+	// 未找到记录时模型不变, 不缓存
+	if reflect.DeepEqual(before, reflect.Indirect(reflect.ValueOf(mod)).Interface()) {
+		return nil
+	}
+	r.store(ctx, key, mod)
+	return nil
+}
+
+func (r *cacheRepository) Count(ctx context.Context, mod Model, filterGroup *FilterGroup) (int64, error) {
+	key, ok := r.cacheKey(ctx, mod.TableName(), Operation_COUNT, int64(0), filterGroup.Hash())
+	if !ok {
+		return r.BaseRepository.Count(ctx, mod, filterGroup)
+	}
+	var count int64
+	if r.load(ctx, key, &count) {
+		return count, nil
+	}
+
+	count, err := r.BaseRepository.Count(ctx, mod, filterGroup)
+	if err != nil {
+		return 0, err
+	}
+	r.store(ctx, key, count)
+	return count, nil
+}
+
+// WithTransaction 事务内的仓储不读写缓存, 事务结束后使写过的表失效
+func (r *cacheRepository) WithTransaction(ctx context.Context, fn func(txRepo BaseRepository) error) error {
+	tx := r.tx
+	if tx == nil {
+		tx = &cacheTx{tables: make(map[string]bool)}
+	}
+	err := r.BaseRepository.WithTransaction(ctx, func(txRepo BaseRepository) error {
+		return fn(&cacheRepository{BaseRepository: txRepo, cache: r.cache, database: r.database, ttl: r.ttl, tx: tx})
+	})
+	if r.tx == nil {
+		for table := range tx.tables {
+			r.invalidate(ctx, table)
+		}
+	}
+	return err
+}
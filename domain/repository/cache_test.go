@@ -0,0 +1,181 @@
+package repository_test
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/henrion-y/base.services/domain/repository"
+	"github.com/henrion-y/base.services/domain/repository/memrepo"
+)
+
+type fakeCache struct {
+	values map[string]string
+}
+
+func (c *fakeCache) Get(ctx context.Context, key string) (string, bool, error) {
+	value, ok := c.values[key]
+	return value, ok, nil
+}
+
+func (c *fakeCache) Set(ctx context.Context, key string, value string, expiration time.Duration) error {
+	c.values[key] = value
+	return nil
+}
+
+func (c *fakeCache) Incr(ctx context.Context, key string) (int64, error) {
+	version, _ := strconv.ParseInt(c.values[key], 10, 64)
+	version++
+	c.values[key] = strconv.FormatInt(version, 10)
+	return version, nil
+}
+
+func TestCacheRepository(t *testing.T) {
+	ctx := context.Background()
+	base := newRepo(t)
+	repo := repository.NewCacheRepository(base, &fakeCache{values: make(map[string]string)}, time.Minute)
+	age21 := repository.NewFilterGroup().Equals("age", 21)
+	byID := repository.NewSortSpecs("id", repository.SortType_ASC)
+
+	assertNames(t, findNames(t, repo, age21, byID, nil), "关羽", "赵云")
+	// 绕过缓存仓储写入, 缓存未失效
+	if err := base.Create(ctx, &User{Name: "马超", Age: 21}); err != nil {
+		t.Fatal(err)
+	}
+	assertNames(t, findNames(t, repo, age21, byID, nil), "关羽", "赵云")
+	if count, err := repo.Count(ctx, &User{}, age21); err != nil || count != 3 {
+		t.Fatalf("expect count 3, got %d %v", count, err)
+	}
+
+	// 经缓存仓储写入后整表失效
+	if _, err := repo.Update(ctx, &User{}, map[string]interface{}{"age": 22}, repository.NewFilterGroup().Equals("name", "关羽")); err != nil {
+		t.Fatal(err)
+	}
+	assertNames(t, findNames(t, repo, age21, byID, nil), "赵云", "马超")
+	if count, err := repo.Count(ctx, &User{}, age21); err != nil || count != 2 {
+		t.Fatalf("expect count 2, got %d %v", count, err)
+	}
+
+	// 游标翻页的下一页游标随结果缓存
+	limitSpec := repository.NewCursorLimitSpec("", 1)
+	assertNames(t, findNames(t, repo, age21, byID, limitSpec), "赵云")
+	cursor := limitSpec.NextCursor
+	limitSpec = repository.NewCursorLimitSpec("", 1)
+	assertNames(t, findNames(t, repo, age21, byID, limitSpec), "赵云")
+	if cursor == "" || limitSpec.NextCursor != cursor {
+		t.Fatalf("expect cached next cursor %q, got %q", cursor, limitSpec.NextCursor)
+	}
+
+	// 事务提交后失效
+	err := repo.WithTransaction(ctx, func(txRepo repository.BaseRepository) error {
+		if err := txRepo.Delete(ctx, &User{}, repository.NewFilterGroup().Equals("name", "赵云")); err != nil {
+			return err
+		}
+		user := &User{}
+		if err := txRepo.FindOne(ctx, user, nil, repository.NewFilterGroup().Equals("name", "赵云"), nil); err != nil || user.ID != 0 {
+			t.Fatalf("expect deleted user not found in transaction, got %+v %v", user, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &User{}
+	if err = repo.FindOne(ctx, user, nil, age21, byID); err != nil || user.Name != "马超" {
+		t.Fatalf("expect 马超, got %+v %v", user, err)
+	}
+}
+
+func (c *fakeCache) queryKeys() int {
+	n := 0
+	for key := range c.values {
+		if !strings.HasSuffix(key, ":version") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestCacheRepository_Key(t *testing.T) {
+	ctx := context.Background()
+	cache := &fakeCache{values: make(map[string]string)}
+	base := newRepo(t)
+	repo := repository.NewCacheRepository(base, cache, time.Minute)
+
+	// 查询参数无法序列化时不使用缓存
+	if _, err := repo.Count(ctx, &User{}, repository.NewFilterGroup().Equals("age", math.NaN())); err != nil {
+		t.Fatal(err)
+	}
+	if n := cache.queryKeys(); n != 0 {
+		t.Fatalf("expect no cached query, got %d", n)
+	}
+
+	// 结果类型不同的相同查询不共用缓存
+	var users []User
+	var pointers []*User
+	if err := repo.Find(ctx, &User{}, &users, nil, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Find(ctx, &User{}, &pointers, nil, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := cache.queryKeys(); n != 2 {
+		t.Fatalf("expect 2 cached queries, got %d", n)
+	}
+
+	// 未找到的记录不缓存
+	byName := repository.NewFilterGroup().Equals("name", "马超")
+	user := &User{}
+	if err := repo.FindOne(ctx, user, nil, byName, nil); err != nil || user.ID != 0 {
+		t.Fatalf("expect not found, got %+v %v", user, err)
+	}
+	if err := base.Create(ctx, &User{Name: "马超", Age: 21}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.FindOne(ctx, user, nil, byName, nil); err != nil || user.Name != "马超" {
+		t.Fatalf("expect 马超, got %+v %v", user, err)
+	}
+
+	// 具名数据库的同名表不共用缓存
+	other := repository.NewNamedCacheRepository(memrepo.NewBaseRepository(), cache, "orders", time.Minute)
+	if count, err := other.Count(ctx, &User{}, nil); err != nil || count != 0 {
+		t.Fatalf("expect count 0 in named database, got %d %v", count, err)
+	}
+	if count, err := repo.Count(ctx, &User{}, nil); err != nil || count != 5 {
+		t.Fatalf("expect count 5, got %d %v", count, err)
+	}
+}
+
+func TestCacheRepository_Tenant(t *testing.T) {
+	base := memrepo.NewBaseRepository()
+	repo := repository.NewCacheRepository(repository.NewTenantRepository(base, ""), &fakeCache{values: make(map[string]string)}, time.Minute)
+	tenantA := repository.WithTenant(context.Background(), uint64(1))
+	tenantB := repository.WithTenant(context.Background(), uint64(2))
+	if err := repo.Create(tenantA, &Invoice{Title: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 租户由内层的租户钩子追加到条件中, 相同条件的查询按租户分别缓存
+	byTitle := repository.NewFilterGroup().Equals("title", "a")
+	for _, c := range []struct {
+		ctx  context.Context
+		want int64
+	}{
+		{tenantA, 1}, {tenantB, 0}, {repository.WithoutTenant(context.Background()), 1}, {tenantA, 1}, {tenantB, 0},
+	} {
+		if count, err := repo.Count(c.ctx, &Invoice{}, byTitle); err != nil || count != c.want {
+			t.Fatalf("expect count %d, got %d %v", c.want, count, err)
+		}
+	}
+	invoice := &Invoice{}
+	if err := repo.FindOne(tenantA, invoice, nil, byTitle, nil); err != nil || invoice.ID == 0 {
+		t.Fatalf("expect invoice of tenant 1, got %+v %v", invoice, err)
+	}
+	invoice = &Invoice{}
+	if err := repo.FindOne(tenantB, invoice, nil, byTitle, nil); err != nil || invoice.ID != 0 {
+		t.Fatalf("expect no invoice of tenant 2, got %+v %v", invoice, err)
+	}
+}
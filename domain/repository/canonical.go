@@ -0,0 +1,499 @@
+package repository
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/henrion-y/base.services/infra/geo"
+)
+
+/********* 序列化 ***********/
+
+/*
+FilterGroup、SortSpecs、LimitSpec 的 JSON 为规范形式, 可在服务间传递后还原, 也可用于缓存 key、日志与回放:
+1. FilterSpec 的值带上类型, 还原后整数为 int64、无符号整数为 uint64、浮点数为 float64, 切片为 []interface{},
+   time.Time、ObjectID 与地理位置值(GeoRadius、GeoBox、GeoPolygon)保持原类型, 其他类型(map、结构体等)按普通 JSON 还原
+2. FilterGroup 的条件与子组按规范 JSON 排序并去重, 丢弃空的子组, 与父组逻辑相同或只有一个条件的子组合并到父组,
+   只有一个条件时逻辑统一为 AND. 语义相同但构造顺序不同的 FilterGroup 得到相同的 JSON 与 Hash
+3. SortSpecs 的顺序有意义, 原样序列化; LimitSpec 的 Hash 不包含 Find 回填的 NextCursor
+String 返回类似 SQL 的可读文本, 仅用于日志, 不保证能被数据库执行
+*/
+
+type filterSpecJSON struct {
+	Column string       `json:"column"`
+	Type   FilterType   `json:"type"`
+	Value  *cursorValue `json:"value,omitempty"`
+}
+
+type filterGroupJSON struct {
+	Logic   FilterLogic    `json:"logic"`
+	Filters []FilterSpec   `json:"filters,omitempty"`
+	Groups  []*FilterGroup `json:"groups,omitempty"`
+}
+
+// geoValueJSON 地理位置值, 坐标为 [经度, 纬度]
+type geoValueJSON struct {
+	Center *[2]float64  `json:"center,omitempty"`
+	Radius float64      `json:"radius,omitempty"`
+	Min    *[2]float64  `json:"min,omitempty"`
+	Max    *[2]float64  `json:"max,omitempty"`
+	Points [][2]float64 `json:"points,omitempty"`
+}
+
+func (f FilterSpec) MarshalJSON() ([]byte, error) {
+	spec := filterSpecJSON{Column: f.Column, Type: f.FilterType}
+	if f.Value != nil {
+		value, err := encodeFilterValue(f.Value)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", f.Column, err)
+		}
+		spec.Value = &value
+	}
+	return json.Marshal(spec)
+}
+
+func (f *FilterSpec) UnmarshalJSON(data []byte) error {
+	spec := filterSpecJSON{}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return err
+	}
+	*f = FilterSpec{Column: spec.Column, FilterType: spec.Type}
+	if spec.Value != nil {
+		value, err := decodeFilterValue(*spec.Value)
+		if err != nil {
+			return fmt.Errorf("column %s: %w", spec.Column, err)
+		}
+		f.Value = value
+	}
+	return nil
+}
+
+func (g *FilterGroup) MarshalJSON() ([]byte, error) {
+	canonical, err := g.canonical()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(filterGroupJSON{Logic: canonical.Logic, Filters: canonical.Filters, Groups: canonical.Groups})
+}
+
+func (g *FilterGroup) UnmarshalJSON(data []byte) error {
+	group := filterGroupJSON{}
+	if err := json.Unmarshal(data, &group); err != nil {
+		return err
+	}
+	*g = FilterGroup{Filters: group.Filters, Logic: group.Logic, Groups: group.Groups}
+	return nil
+}
+
+// Hash 返回规范 JSON 的 SHA-1, nil 与空的 FilterGroup 相同; 值无法序列化时返回空字符串
+func (g *FilterGroup) Hash() string {
+	if g == nil {
+		g = NewFilterGroup()
+	}
+	return hashJSON(g)
+}
+
+// String 返回类似 SQL 的条件, 如 age > 20 AND (name LIKE '张%' OR id IN (1, 2)), 没有条件时为空字符串
+func (g *FilterGroup) String() string {
+	if g == nil {
+		return ""
+	}
+	canonical, err := g.canonical()
+	if err != nil {
+		return fmt.Sprintf("<invalid filter: %v>", err)
+	}
+	return canonical.string()
+}
+
+// canonical 返回规范形式的副本, 不修改 g
+func (g *FilterGroup) canonical() (*FilterGroup, error) {
+	logic := FilterLogic_AND
+	if g.Logic == FilterLogic_OR {
+		logic = FilterLogic_OR
+	}
+	result := &FilterGroup{Logic: logic}
+	filters := make(map[string]FilterSpec, len(g.Filters))
+	groups := make(map[string]*FilterGroup, len(g.Groups))
+	addFilter := func(filter FilterSpec) error {
+		data, err := json.Marshal(filter)
+		if err != nil {
+			return err
+		}
+		filters[string(data)] = filter
+		return nil
+	}
+
+	for _, filter := range g.Filters {
+		if err := addFilter(filter); err != nil {
+			return nil, err
+		}
+	}
+	for _, subGroup := range g.Groups {
+		if subGroup == nil {
+			continue
+		}
+		sub, err := subGroup.canonical()
+		if err != nil {
+			return nil, err
+		}
+		if len(sub.Filters)+len(sub.Groups) == 0 {
+			continue
+		}
+		if sub.Logic != logic && len(sub.Filters)+len(sub.Groups) > 1 {
+			data, err := json.Marshal(sub)
+			if err != nil {
+				return nil, err
+			}
+			groups[string(data)] = sub
+			continue
+		}
+		// 逻辑相同或只有一个条件的子组合并到父组
+		for _, filter := range sub.Filters {
+			if err = addFilter(filter); err != nil {
+				return nil, err
+			}
+		}
+		for _, item := range sub.Groups {
+			data, err := json.Marshal(item)
+			if err != nil {
+				return nil, err
+			}
+			groups[string(data)] = item
+		}
+	}
+
+	for _, key := range sortedKeys(filters) {
+		result.Filters = append(result.Filters, filters[key])
+	}
+	for _, key := range sortedKeys(groups) {
+		result.Groups = append(result.Groups, groups[key])
+	}
+	switch {
+	case len(result.Filters) == 0 && len(result.Groups) == 1:
+		return result.Groups[0], nil
+	case len(result.Filters)+len(result.Groups) <= 1:
+		result.Logic = FilterLogic_AND
+	}
+	return result, nil
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// string g 须为规范形式, 子组整体加括号
+func (g *FilterGroup) string() string {
+	items := make([]string, 0, len(g.Filters)+len(g.Groups))
+	for _, filter := range g.Filters {
+		items = append(items, filter.String())
+	}
+	for _, subGroup := range g.Groups {
+		items = append(items, "("+subGroup.string()+")")
+	}
+	return strings.Join(items, " "+string(g.Logic)+" ")
+}
+
+// String 返回类似 SQL 的单个条件, LIKE 系列统一显示为 LIKE 模式
+func (f FilterSpec) String() string {
+	column := f.Column
+	switch f.FilterType {
+	case FilterType_EQ, FilterType_NE, FilterType_GT, FilterType_GTE, FilterType_LT, FilterType_LTE:
+		comparator := map[FilterType]string{
+			FilterType_EQ: "=", FilterType_NE: "<>", FilterType_GT: ">", FilterType_GTE: ">=", FilterType_LT: "<", FilterType_LTE: "<=",
+		}[f.FilterType]
+		return column + " " + comparator + " " + literal(f.Value)
+	case FilterType_IN:
+		return column + " IN " + literalList(f.Values())
+	case FilterType_NOT_IN:
+		return column + " NOT IN " + literalList(f.Values())
+	case FilterType_IS_NULL:
+		return column + " IS NULL"
+	case FilterType_IS_NOT_NULL:
+		return column + " IS NOT NULL"
+	case FilterType_LIKE, FilterType_STARTS_WITH, FilterType_ENDS_WITH, FilterType_CONTAINS:
+		if pattern, ok := f.LikePattern(); ok {
+			return column + " LIKE " + literal(pattern)
+		}
+	case FilterType_NOT_LIKE:
+		if pattern, ok := f.LikePattern(); ok {
+			return column + " NOT LIKE " + literal(pattern)
+		}
+	case FilterType_REGEX:
+		return column + " REGEXP " + literal(f.Value)
+	case FilterType_BETWEEN:
+		if values := f.Values(); len(values) == 2 {
+			return column + " BETWEEN " + literal(values[0]) + " AND " + literal(values[1])
+		}
+	case FilterType_ARRAY_CONTAINS:
+		return column + " CONTAINS ALL " + literalList(f.Values())
+	case FilterType_ARRAY_CONTAINS_ANY:
+		return column + " CONTAINS ANY " + literalList(f.Values())
+	case FilterType_EXISTS:
+		if f.Value == false {
+			return "NOT EXISTS(" + column + ")"
+		}
+		return "EXISTS(" + column + ")"
+	case FilterType_NEAR, FilterType_WITHIN_RADIUS:
+		if radius, ok := f.Value.(GeoRadius); ok {
+			distance := "DISTANCE(" + column + ", " + pointString(radius.Center) + ")"
+			if radius.Radius <= 0 {
+				return distance + " IS NOT NULL"
+			}
+			return distance + " <= " + strconv.FormatFloat(radius.Radius, 'g', -1, 64)
+		}
+	case FilterType_WITHIN_BOX:
+		if box, ok := f.Value.(GeoBox); ok {
+			return column + " WITHIN BOX(" + pointString(box.Min) + ", " + pointString(box.Max) + ")"
+		}
+	case FilterType_WITHIN_POLYGON:
+		if polygon, ok := f.Value.(GeoPolygon); ok {
+			return column + " WITHIN " + polygon.wkt()
+		}
+	}
+	return column + " " + string(f.FilterType) + " " + literal(f.Value)
+}
+
+func pointString(coordinate geo.Coordinate) string {
+	return fmt.Sprintf("POINT(%g %g)", coordinate.Lon, coordinate.Lat)
+}
+
+// literal 返回值的 SQL 字面量形式, 字符串与时间加单引号
+func literal(value interface{}) string {
+	v := indirectValue(reflect.ValueOf(value))
+	if !v.IsValid() {
+		return "NULL"
+	}
+	switch val := v.Interface().(type) {
+	case time.Time:
+		return quote(val.Format(time.RFC3339Nano))
+	case primitive.DateTime:
+		return quote(val.Time().Format(time.RFC3339Nano))
+	case primitive.ObjectID:
+		return "ObjectId(" + quote(val.Hex()) + ")"
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'g', -1, 64)
+	case reflect.Bool:
+		if v.Bool() {
+			return "TRUE"
+		}
+		return "FALSE"
+	case reflect.String:
+		return quote(v.String())
+	case reflect.Slice, reflect.Array:
+		return literalList(toInterfaceSlice(v.Interface()))
+	}
+	return quote(jsonString(value))
+}
+
+func literalList(values []interface{}) string {
+	items := make([]string, len(values))
+	for i, value := range values {
+		items[i] = literal(value)
+	}
+	return "(" + strings.Join(items, ", ") + ")"
+}
+
+func quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// encodeFilterValue 在游标值的基础上增加切片、地理位置与普通 JSON 值
+func encodeFilterValue(value interface{}) (cursorValue, error) {
+	var geoValue *geoValueJSON
+	switch val := value.(type) {
+	case GeoRadius:
+		center := lonLatArray(val.Center)
+		geoValue = &geoValueJSON{Center: &center, Radius: val.Radius}
+	case GeoBox:
+		min, max := lonLatArray(val.Min), lonLatArray(val.Max)
+		geoValue = &geoValueJSON{Min: &min, Max: &max}
+	case GeoPolygon:
+		geoValue = &geoValueJSON{Points: make([][2]float64, len(val))}
+		for i, point := range val {
+			geoValue.Points[i] = lonLatArray(point)
+		}
+	}
+	if geoValue != nil {
+		return rawFilterValue(geoTypeName(value), geoValue)
+	}
+
+	v := indirectValue(reflect.ValueOf(value))
+	if v.IsValid() && (v.Kind() == reflect.Slice || v.Kind() == reflect.Array) {
+		values := toInterfaceSlice(v.Interface())
+		items := make([]cursorValue, len(values))
+		for i, item := range values {
+			var err error
+			if items[i], err = encodeFilterValue(item); err != nil {
+				return cursorValue{}, err
+			}
+		}
+		return rawFilterValue("list", items)
+	}
+	if encoded, err := encodeCursorValue(value); err == nil {
+		return encoded, nil
+	}
+	return rawFilterValue("json", value)
+}
+
+func rawFilterValue(typ string, raw interface{}) (cursorValue, error) {
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return cursorValue{}, fmt.Errorf("%w: %v", ErrInvalidFilterValue, err)
+	}
+	return cursorValue{Type: typ, Value: data}, nil
+}
+
+func geoTypeName(value interface{}) string {
+	switch value.(type) {
+	case GeoRadius:
+		return "radius"
+	case GeoBox:
+		return "box"
+	default:
+		return "polygon"
+	}
+}
+
+func lonLatArray(coordinate geo.Coordinate) [2]float64 {
+	return [2]float64{coordinate.Lon, coordinate.Lat}
+}
+
+func decodeFilterValue(value cursorValue) (interface{}, error) {
+	switch value.Type {
+	case "list":
+		var items []cursorValue
+		if err := json.Unmarshal(value.Value, &items); err != nil {
+			return nil, err
+		}
+		values := make([]interface{}, len(items))
+		for i, item := range items {
+			var err error
+			if values[i], err = decodeFilterValue(item); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	case "json":
+		var v interface{}
+		err := json.Unmarshal(value.Value, &v)
+		return v, err
+	case "radius", "box", "polygon":
+		geoValue := geoValueJSON{}
+		if err := json.Unmarshal(value.Value, &geoValue); err != nil {
+			return nil, err
+		}
+		return geoValue.decode(value.Type)
+	}
+	v, err := decodeCursorValue(value)
+	if err == ErrInvalidCursor {
+		return nil, fmt.Errorf("%w: unsupported value type %q", ErrInvalidFilterValue, value.Type)
+	}
+	return v, err
+}
+
+func (g geoValueJSON) decode(typ string) (interface{}, error) {
+	coordinate := func(point *[2]float64) geo.Coordinate {
+		if point == nil {
+			return geo.Coordinate{}
+		}
+		return geo.Coordinate{Lon: point[0], Lat: point[1]}
+	}
+	switch typ {
+	case "radius":
+		return GeoRadius{Center: coordinate(g.Center), Radius: g.Radius}, nil
+	case "box":
+		return GeoBox{Min: coordinate(g.Min), Max: coordinate(g.Max)}, nil
+	}
+	polygon := make(GeoPolygon, len(g.Points))
+	for i := range g.Points {
+		polygon[i] = coordinate(&g.Points[i])
+	}
+	return polygon, nil
+}
+
+// Hash 返回 JSON 的 SHA-1, nil 与空的 SortSpecs 相同
+func (s *SortSpecs) Hash() string {
+	if s == nil {
+		s = NewDefaultSortSpecs()
+	}
+	return hashJSON(s)
+}
+
+// String 返回类似 SQL 的排序, 如 age DESC, DISTANCE(location, POINT(116.4 39.9)) ASC
+func (s *SortSpecs) String() string {
+	if s == nil {
+		return ""
+	}
+	items := make([]string, 0, len(*s))
+	for _, spec := range *s {
+		property := spec.Property
+		if spec.Near != nil {
+			property = "DISTANCE(" + property + ", " + pointString(*spec.Near) + ")"
+		}
+		sortType := SortType_ASC
+		if spec.Type == SortType_DESC {
+			sortType = SortType_DESC
+		}
+		items = append(items, property+" "+string(sortType))
+	}
+	return strings.Join(items, ", ")
+}
+
+// Hash 返回 JSON 的 SHA-1, 不包含 NextCursor, nil 与不翻页的 LimitSpec 相同
+func (s *LimitSpec) Hash() string {
+	if s == nil {
+		s = &LimitSpec{}
+	}
+	limit := *s
+	limit.NextCursor = ""
+	return hashJSON(&limit)
+}
+
+// String 返回类似 SQL 的翻页, 如 LIMIT 10 OFFSET 20, 游标翻页为 LIMIT 10 CURSOR '...', 不限制时为空字符串
+func (s *LimitSpec) String() string {
+	if s == nil {
+		return ""
+	}
+	var items []string
+	if s.Size > 0 {
+		items = append(items, "LIMIT "+strconv.Itoa(s.Size))
+	}
+	switch {
+	case s.UseCursor:
+		if s.Cursor != "" {
+			items = append(items, "CURSOR "+quote(s.Cursor))
+		}
+	case s.Page > 1:
+		items = append(items, "OFFSET "+strconv.Itoa((s.Page-1)*s.Size))
+	}
+	return strings.Join(items, " ")
+}
+
+func hashJSON(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
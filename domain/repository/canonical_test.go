@@ -0,0 +1,77 @@
+package repository_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/henrion-y/base.services/domain/repository"
+	"github.com/henrion-y/base.services/infra/geo"
+)
+
+func TestFilterGroup_JSON(t *testing.T) {
+	repo := newRepo(t)
+	byID := repository.NewSortSpecs("id", repository.SortType_ASC)
+	since := time.Now().Add(-time.Hour)
+	filterGroup := repository.NewFilterGroup().GreaterThan("ctime", since).Or(
+		repository.NewFilterGroup().In("age", []int{21, 30}),
+		repository.NewFilterGroup().StartsWith("name", "张").IsNull("dtime"),
+	)
+
+	data, err := json.Marshal(filterGroup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &repository.FilterGroup{}
+	if err = json.Unmarshal(data, decoded); err != nil {
+		t.Fatal(err)
+	}
+	again, _ := json.Marshal(decoded)
+	if string(again) != string(data) || decoded.Hash() != filterGroup.Hash() {
+		t.Fatalf("expect round trip, got %s and %s", data, again)
+	}
+	assertNames(t, findNames(t, repo, decoded, byID, nil), findNames(t, repo, filterGroup, byID, nil)...)
+
+	// 条件顺序与嵌套方式不影响规范形式
+	reordered := repository.NewFilterGroup().Or(
+		repository.NewFilterGroup().IsNull("dtime").StartsWith("name", "张"),
+		repository.NewFilterGroup().In("age", []int64{21, 30}),
+	).And(repository.NewFilterGroup().GreaterThan("ctime", since))
+	if reordered.Hash() != filterGroup.Hash() {
+		t.Fatalf("expect same hash for reordered filter group")
+	}
+	if repository.NewFilterGroup().Equals("age", 21).Hash() == repository.NewFilterGroup().Equals("age", "21").Hash() {
+		t.Fatalf("expect different hash for different value types")
+	}
+
+	want := "ctime > '" + since.Format(time.RFC3339Nano) + "' AND (age IN (21, 30) OR (dtime IS NULL AND name LIKE '张%'))"
+	if got := filterGroup.String(); got != want {
+		t.Fatalf("expect %s, got %s", want, got)
+	}
+
+	geoGroup := repository.NewFilterGroup().WithinRadius("location", geo.Coordinate{Lat: 39.9, Lon: 116.4}, 1000).
+		WithinPolygon("location", geo.Coordinate{Lat: 1, Lon: 2}, geo.Coordinate{Lat: 3, Lon: 4}, geo.Coordinate{Lat: 5, Lon: 6})
+	data, _ = json.Marshal(geoGroup)
+	decoded = &repository.FilterGroup{}
+	if err = json.Unmarshal(data, decoded); err != nil || decoded.Hash() != geoGroup.Hash() {
+		t.Fatalf("expect geo round trip, got %s %v", data, err)
+	}
+	for _, filter := range decoded.Filters {
+		switch filter.Value.(type) {
+		case repository.GeoRadius, repository.GeoPolygon:
+		default:
+			t.Fatalf("expect geo value, got %T", filter.Value)
+		}
+	}
+
+	sortSpecs := repository.NewSortSpecs("age", repository.SortType_DESC).AddDistance("location", geo.Coordinate{Lat: 39.9, Lon: 116.4}, repository.SortType_ASC)
+	if got := sortSpecs.String(); got != "age DESC, DISTANCE(location, POINT(116.4 39.9)) ASC" {
+		t.Fatalf("unexpected sort specs %s", got)
+	}
+	limitSpec := repository.NewCursorLimitSpec("abc", 10)
+	hash := limitSpec.Hash()
+	limitSpec.NextCursor = "next"
+	if limitSpec.Hash() != hash || limitSpec.String() != "LIMIT 10 CURSOR 'abc'" || repository.NewLimitSpec(3, 10).String() != "LIMIT 10 OFFSET 20" {
+		t.Fatalf("unexpected limit spec %s", limitSpec)
+	}
+}
@@ -0,0 +1,257 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+/********* 列名校验 ***********/
+
+/*
+FilterSpec.Column、SortSpec.Property 等列名可能来自客户端参数, 各仓储实现在执行前用 ColumnSet 校验列名,
+只允许模型结构体中存在的列, 拼接 SQL 时再对列名加引号, 避免注入
+*/
+
+var ErrUnknownColumn = errors.New("unknown column")
+
+// ColumnError 列名不属于模型时返回, errors.Is(err, ErrUnknownColumn) 为 true
+type ColumnError struct {
+	Table  string
+	Column string
+}
+
+func (e *ColumnError) Error() string {
+	return fmt.Sprintf("unknown column %q in %s", e.Column, e.Table)
+}
+
+func (e *ColumnError) Unwrap() error {
+	return ErrUnknownColumn
+}
+
+// ColumnSet 模型允许使用的列名, 按 gorm column 标签、bson 标签、json 标签、蛇形字段名、小写字段名匹配, 与 ColumnValue 一致.
+// 支持 a.b 形式的嵌套路径, map 字段下的任意 key 均允许
+type ColumnSet struct {
+	table string
+	typ   reflect.Type    // 模型结构体类型, 为 nil 时不校验
+	extra map[string]bool // 额外允许的列, 如 mongo 的 _id、聚合别名
+}
+
+// columnCache 缓存 类型+列名 的校验结果
+var columnCache sync.Map
+
+type columnCacheKey struct {
+	typ    reflect.Type
+	column string
+}
+
+// ModelColumns 返回模型的列集合, 模型不是结构体时不做校验
+func ModelColumns(mod Model) *ColumnSet {
+	columns := &ColumnSet{table: mod.TableName()}
+	if typ := reflect.TypeOf(mod); typ != nil {
+		if typ = indirectType(typ); typ.Kind() == reflect.Struct {
+			columns.typ = typ
+		}
+	}
+	return columns
+}
+
+// With 返回额外允许 columns 的新集合
+func (c *ColumnSet) With(columns ...string) *ColumnSet {
+	extra := make(map[string]bool, len(c.extra)+len(columns))
+	for column := range c.extra {
+		extra[column] = true
+	}
+	for _, column := range columns {
+		extra[column] = true
+	}
+	return &ColumnSet{table: c.table, typ: c.typ, extra: extra}
+}
+
+// Has 判断列名是否允许使用
+func (c *ColumnSet) Has(column string) bool {
+	if c.typ == nil || c.extra[column] {
+		return true
+	}
+	key := columnCacheKey{typ: c.typ, column: column}
+	if ok, loaded := columnCache.Load(key); loaded {
+		return ok.(bool)
+	}
+	_, ok := columnType(c.typ, column)
+	columnCache.Store(key, ok)
+	return ok
+}
+
+// Type 返回列对应字段的类型, map 字段下的 key 返回 map 的元素类型; 额外允许的列或不做校验时第二个返回值为 false
+func (c *ColumnSet) Type(column string) (reflect.Type, bool) {
+	if c.typ == nil {
+		return nil, false
+	}
+	return columnType(c.typ, column)
+}
+
+// Check 校验列名, 第一个不允许的列返回 *ColumnError
+func (c *ColumnSet) Check(columns ...string) error {
+	for _, column := range columns {
+		if !c.Has(column) {
+			return &ColumnError{Table: c.table, Column: column}
+		}
+	}
+	return nil
+}
+
+// CheckFilter 校验过滤条件中的列名与过滤值, 包括全部子组
+func (c *ColumnSet) CheckFilter(filterGroup *FilterGroup) error {
+	if filterGroup == nil {
+		return nil
+	}
+	for _, filter := range filterGroup.Filters {
+		if err := c.Check(filter.Column); err != nil {
+			return err
+		}
+		if err := filter.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, subGroup := range filterGroup.Groups {
+		if err := c.CheckFilter(subGroup); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckSort 校验排序字段
+func (c *ColumnSet) CheckSort(sortSpecs *SortSpecs) error {
+	if sortSpecs == nil {
+		return nil
+	}
+	for _, spec := range *sortSpecs {
+		if err := c.Check(spec.Property); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckQuery 校验查询字段、过滤条件与排序字段
+func (c *ColumnSet) CheckQuery(fields []string, filterGroup *FilterGroup, sortSpecs *SortSpecs) error {
+	if err := c.Check(fields...); err != nil {
+		return err
+	}
+	if err := c.CheckFilter(filterGroup); err != nil {
+		return err
+	}
+	return c.CheckSort(sortSpecs)
+}
+
+// CheckData 校验更新数据中的操作符与列名, 见 UpdateSpec
+func (c *ColumnSet) CheckData(data map[string]interface{}) error {
+	assignments, err := ParseUpdateData(data)
+	if err != nil {
+		return err
+	}
+	for _, assignment := range assignments {
+		if err := c.Check(assignment.Column); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckAggregate 校验聚合查询, Having 与排序字段还允许使用聚合别名
+func (c *ColumnSet) CheckAggregate(filterGroup *FilterGroup, aggregateSpec *AggregateSpec, sortSpecs *SortSpecs) error {
+	if err := c.CheckFilter(filterGroup); err != nil {
+		return err
+	}
+	if err := c.Check(aggregateSpec.GroupBy...); err != nil {
+		return err
+	}
+
+	aliases := make([]string, 0, len(aggregateSpec.Aggregations))
+	for _, aggregation := range aggregateSpec.Aggregations {
+		if aggregation.Column != "" {
+			if err := c.Check(aggregation.Column); err != nil {
+				return err
+			}
+		}
+		if !isIdentifier(aggregation.Alias) {
+			return fmt.Errorf("invalid aggregate alias %q", aggregation.Alias)
+		}
+		aliases = append(aliases, aggregation.Alias)
+	}
+
+	resultColumns := c.With(aliases...)
+	if err := resultColumns.CheckFilter(aggregateSpec.Having); err != nil {
+		return err
+	}
+	return resultColumns.CheckSort(sortSpecs)
+}
+
+// columnType 在结构体类型上按列名查找字段类型, 规则与 columnField 相同
+func columnType(t reflect.Type, column string) (reflect.Type, bool) {
+	t = indirectType(t)
+	switch t.Kind() {
+	case reflect.Struct:
+		if typ, ok := structFieldType(t, column); ok {
+			return typ, true
+		}
+	case reflect.Map:
+		return t.Elem(), t.Key().Kind() == reflect.String && column != ""
+	case reflect.Interface:
+		// 动态类型, 只能在运行时确定
+		return t, column != ""
+	default:
+		return nil, false
+	}
+
+	// 嵌套路径
+	if idx := strings.Index(column, "."); idx > 0 {
+		if parent, ok := structFieldType(t, column[:idx]); ok {
+			return columnType(parent, column[idx+1:])
+		}
+	}
+	return nil, false
+}
+
+func structFieldType(t reflect.Type, column string) (reflect.Type, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		fieldType := t.Field(i)
+		if fieldType.PkgPath != "" && !fieldType.Anonymous {
+			continue
+		}
+
+		if fieldType.Anonymous || strings.Contains(fieldType.Tag.Get("bson"), "inline") {
+			if embedded := indirectType(fieldType.Type); embedded.Kind() == reflect.Struct {
+				if typ, ok := structFieldType(embedded, column); ok {
+					return typ, true
+				}
+			}
+			if fieldType.Anonymous {
+				continue
+			}
+		}
+
+		for _, name := range fieldColumnNames(fieldType) {
+			if name == column {
+				return fieldType.Type, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// isIdentifier 别名只允许字母、数字与下划线
+func isIdentifier(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,272 @@
+package repository
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/********* 游标翻页 ***********/
+
+var (
+	ErrInvalidCursor      = errors.New("invalid cursor")
+	ErrCursorSortRequired = errors.New("cursor pagination requires sort specs")
+	ErrCursorSizeRequired = errors.New("cursor pagination requires a positive size")
+	ErrCursorDistanceSort = errors.New("cursor pagination does not support distance sort")
+)
+
+// cursorToken 游标内容, 记录上一页最后一条记录的排序字段值, 值带上类型以便还原时间、ObjectID 等类型
+type cursorToken struct {
+	Properties []string      `json:"p"`
+	Values     []cursorValue `json:"v"`
+}
+
+type cursorValue struct {
+	Type  string          `json:"t"`
+	Value json.RawMessage `json:"v,omitempty"`
+}
+
+// CursorSpecs 游标翻页时在排序末尾追加主键升序(已包含主键时不追加), 使排序值相同的记录不会在翻页时被跳过,
+// 并将缺少的排序字段补充到 fields 中, 使游标取到真实的排序字段值. 非游标翻页时原样返回
+func (s *LimitSpec) CursorSpecs(mod Model, fields []string, sortSpecs *SortSpecs) ([]string, *SortSpecs) {
+	if !s.UseCursor || sortSpecs != nil && sortSpecs.HasDistance() {
+		return fields, sortSpecs
+	}
+	primaryKey := PrimaryKeyColumn(mod)
+	specs := SortSpecs{}
+	if sortSpecs != nil {
+		specs = append(specs, *sortSpecs...)
+	}
+	hasPrimaryKey := false
+	for _, spec := range specs {
+		hasPrimaryKey = hasPrimaryKey || spec.Property == primaryKey
+	}
+	if !hasPrimaryKey {
+		specs = append(specs, SortSpec{Property: primaryKey, Type: SortType_ASC})
+	}
+
+	if len(fields) > 0 {
+		fields = append([]string(nil), fields...)
+		for _, spec := range specs {
+			if !containsString(fields, spec.Property) {
+				fields = append(fields, spec.Property)
+			}
+		}
+	}
+	return fields, &specs
+}
+
+// BuildCursorFilter 将游标转换为 keyset 条件并与 filterGroup 以 AND 合并, 非游标翻页或首页时原样返回 filterGroup.
+// 对排序 (a ASC, b DESC) 与上一页末尾值 (va, vb) 生成: a > va OR (a = va AND (b < vb OR b IS NULL)).
+// NULL 视为最小值, 与各实现的排序一致(见 SortSpecs): 末尾值为 NULL 时升序取 IS NOT NULL, 降序没有更靠后的值, 相等取 IS NULL
+func (s *LimitSpec) BuildCursorFilter(filterGroup *FilterGroup, sortSpecs *SortSpecs) (*FilterGroup, error) {
+	if !s.UseCursor {
+		return filterGroup, nil
+	}
+	if s.Size <= 0 {
+		return nil, ErrCursorSizeRequired
+	}
+	if sortSpecs == nil || len(*sortSpecs) == 0 {
+		return nil, ErrCursorSortRequired
+	}
+	if sortSpecs.HasDistance() {
+		return nil, ErrCursorDistanceSort
+	}
+	if s.Cursor == "" {
+		return filterGroup, nil
+	}
+
+	values, err := decodeCursor(s.Cursor, sortSpecs)
+	if err != nil {
+		return nil, err
+	}
+
+	cursorGroup := NewFilterGroup().SetLogic(FilterLogic_OR)
+	for i, spec := range *sortSpecs {
+		branch := NewFilterGroup()
+		for j := 0; j < i; j++ {
+			if values[j] == nil {
+				branch.IsNull((*sortSpecs)[j].Property)
+			} else {
+				branch.Equals((*sortSpecs)[j].Property, values[j])
+			}
+		}
+		switch {
+		case spec.Type == SortType_DESC && values[i] == nil:
+			continue
+		case spec.Type == SortType_DESC:
+			branch.AddGroup(NewFilterGroup().SetLogic(FilterLogic_OR).LessThan(spec.Property, values[i]).IsNull(spec.Property))
+		case values[i] == nil:
+			branch.IsNotNull(spec.Property)
+		default:
+			branch.GreaterThan(spec.Property, values[i])
+		}
+		cursorGroup.AddGroup(branch)
+	}
+	return NewFilterGroup().And(filterGroup, cursorGroup), nil
+}
+
+// FillNextCursor 截掉多查的一条记录, 并用本页最后一条记录的排序字段值回填 NextCursor.
+// result 须为切片指针, 查询字段 fields 须包含全部排序字段
+func (s *LimitSpec) FillNextCursor(result interface{}, sortSpecs *SortSpecs) error {
+	s.NextCursor = ""
+	if !s.UseCursor {
+		return nil
+	}
+
+	resultValue := reflect.ValueOf(result)
+	if resultValue.Kind() != reflect.Ptr || resultValue.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("cursor pagination result must be a pointer to slice, got %T", result)
+	}
+	list := resultValue.Elem()
+	if list.Len() <= s.Size {
+		return nil
+	}
+	list.Set(list.Slice(0, s.Size))
+
+	last := list.Index(s.Size - 1)
+	values := make([]interface{}, len(*sortSpecs))
+	for i, spec := range *sortSpecs {
+		value, ok := columnField(last, spec.Property)
+		if !ok {
+			return fmt.Errorf("cursor pagination: sort property %s not found in result", spec.Property)
+		}
+		values[i] = value.Interface()
+	}
+
+	cursor, err := encodeCursor(sortSpecs, values)
+	if err != nil {
+		return err
+	}
+	s.NextCursor = cursor
+	return nil
+}
+
+func encodeCursor(sortSpecs *SortSpecs, values []interface{}) (string, error) {
+	token := cursorToken{}
+	for i, spec := range *sortSpecs {
+		value, err := encodeCursorValue(values[i])
+		if err != nil {
+			return "", err
+		}
+		token.Properties = append(token.Properties, spec.Property)
+		token.Values = append(token.Values, value)
+	}
+
+	data, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCursor(cursor string, sortSpecs *SortSpecs) ([]interface{}, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	token := cursorToken{}
+	if err = json.Unmarshal(data, &token); err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	// 游标须与当前排序一致
+	if len(token.Properties) != len(*sortSpecs) || len(token.Values) != len(*sortSpecs) {
+		return nil, ErrInvalidCursor
+	}
+	values := make([]interface{}, len(token.Values))
+	for i, spec := range *sortSpecs {
+		if token.Properties[i] != spec.Property {
+			return nil, ErrInvalidCursor
+		}
+		if values[i], err = decodeCursorValue(token.Values[i]); err != nil {
+			return nil, ErrInvalidCursor
+		}
+	}
+	return values, nil
+}
+
+func encodeCursorValue(value interface{}) (cursorValue, error) {
+	v := indirectValue(reflect.ValueOf(value))
+	if !v.IsValid() {
+		return cursorValue{Type: "nil"}, nil
+	}
+
+	var typ string
+	var raw interface{}
+	switch val := v.Interface().(type) {
+	case time.Time:
+		typ, raw = "time", val.Format(time.RFC3339Nano)
+	case primitive.DateTime:
+		typ, raw = "time", val.Time().Format(time.RFC3339Nano)
+	case primitive.ObjectID:
+		typ, raw = "oid", val.Hex()
+	default:
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			typ, raw = "int", v.Int()
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			typ, raw = "uint", v.Uint()
+		case reflect.Float32, reflect.Float64:
+			typ, raw = "float", v.Float()
+		case reflect.String:
+			typ, raw = "string", v.String()
+		case reflect.Bool:
+			typ, raw = "bool", v.Bool()
+		default:
+			return cursorValue{}, fmt.Errorf("cursor pagination: unsupported sort value type %T", value)
+		}
+	}
+
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return cursorValue{}, err
+	}
+	return cursorValue{Type: typ, Value: data}, nil
+}
+
+func decodeCursorValue(value cursorValue) (interface{}, error) {
+	switch value.Type {
+	case "nil":
+		return nil, nil
+	case "time":
+		var s string
+		if err := json.Unmarshal(value.Value, &s); err != nil {
+			return nil, err
+		}
+		return time.Parse(time.RFC3339Nano, s)
+	case "oid":
+		var s string
+		if err := json.Unmarshal(value.Value, &s); err != nil {
+			return nil, err
+		}
+		return primitive.ObjectIDFromHex(s)
+	case "int":
+		var i int64
+		err := json.Unmarshal(value.Value, &i)
+		return i, err
+	case "uint":
+		var u uint64
+		err := json.Unmarshal(value.Value, &u)
+		return u, err
+	case "float":
+		var f float64
+		err := json.Unmarshal(value.Value, &f)
+		return f, err
+	case "string":
+		var s string
+		err := json.Unmarshal(value.Value, &s)
+		return s, err
+	case "bool":
+		var b bool
+		err := json.Unmarshal(value.Value, &b)
+		return b, err
+	default:
+		return nil, ErrInvalidCursor
+	}
+}
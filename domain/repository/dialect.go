@@ -0,0 +1,358 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/henrion-y/base.services/infra/geo"
+)
+
+/********* SQL 方言 ***********/
+
+/*
+FilterGroup、SortSpecs、AggregateSpec 与更新操作符构建 SQL 时按 gorm 连接的方言(db.Dialector.Name())选择 SQLDialect,
+内置 mysql、postgres、sqlite, 未注册的方言按 mysql 处理, 可通过 RegisterSQLDialect 注册或替换. 列名由 gorm 方言加引号.
+各方言的差异:
+1. LIKE 系列不区分大小写: MySQL 依赖列的排序规则, PostgreSQL 使用 ILIKE, SQLite 的 LIKE 只对 ASCII 字符不区分大小写
+2. REGEX: MySQL REGEXP, PostgreSQL ~, SQLite 不支持
+3. IN、NOT_IN: PostgreSQL 使用 = ANY(ARRAY[...])、<> ALL(ARRAY[...]), 其他为 IN (...)
+4. ARRAY_CONTAINS 及 $push 等数组更新操作符: MySQL 列为 JSON, PostgreSQL 列为 jsonb, SQLite 列为 JSON 文本
+5. 地理位置: MySQL 见 geo.go; PostgreSQL 依赖 PostGIS, 列为 geometry(Point, 4326); SQLite 不支持
+6. 排序: PostgreSQL 默认将 NULL 视为最大值, 排序时附加 NULLS FIRST / NULLS LAST, 见 NullsOrderDialect
+方言不支持的条件在执行时返回 ErrDialectUnsupported
+*/
+
+var ErrDialectUnsupported = errors.New("unsupported by sql dialect")
+
+// SQLDialect 构建 SQL 时与数据库相关的部分
+type SQLDialect interface {
+	Name() string
+	// Like 不区分大小写的 LIKE, 模式中以 \ 转义
+	Like(column clause.Column, pattern string, not bool) clause.Expression
+	Regex(column clause.Column, pattern string) (clause.Expression, error)
+	In(column clause.Column, values []interface{}, not bool) clause.Expression
+	// ArrayContains 数组列包含 value, value 为切片时须包含全部元素
+	ArrayContains(column clause.Column, value interface{}) clause.Expression
+	// Geo 地理位置过滤, value 为 GeoRadius(半径大于 0)、GeoBox 或 GeoPolygon
+	Geo(column clause.Column, value interface{}) (clause.Expression, error)
+	// Distance 列到 point 的球面距离(米), 用于距离排序
+	Distance(column clause.Column, point geo.Coordinate) (clause.Expr, error)
+	// UpdateValue $min、$max、$currentDate 及数组更新操作符的赋值表达式, 语义见 UpdateSpec
+	UpdateValue(assignment UpdateAssignment) (interface{}, error)
+}
+
+// NullsOrderDialect 默认排序中 NULL 不是最小值的方言实现该接口, 返回附加在 ASC、DESC 之后的 NULL 顺序,
+// 使 NULL 升序在前、降序在后, 与 MySQL、SQLite 及其他仓储一致, 游标翻页依赖该顺序
+type NullsOrderDialect interface {
+	NullsOrder(desc bool) string
+}
+
+var (
+	sqlDialectsMu sync.RWMutex
+	sqlDialects   = map[string]SQLDialect{
+		"mysql":    MySQLDialect{},
+		"postgres": PostgresDialect{},
+		"sqlite":   SQLiteDialect{},
+	}
+)
+
+// RegisterSQLDialect 按 gorm 方言名注册 SQLDialect, 已存在时替换
+func RegisterSQLDialect(name string, dialect SQLDialect) {
+	sqlDialectsMu.Lock()
+	defer sqlDialectsMu.Unlock()
+	sqlDialects[name] = dialect
+}
+
+// DialectOf 返回 db 使用的 SQLDialect, 未注册的方言返回 MySQLDialect
+func DialectOf(db *gorm.DB) SQLDialect {
+	if db == nil || db.Dialector == nil {
+		return MySQLDialect{}
+	}
+	sqlDialectsMu.RLock()
+	defer sqlDialectsMu.RUnlock()
+	if dialect, ok := sqlDialects[db.Dialector.Name()]; ok {
+		return dialect
+	}
+	return MySQLDialect{}
+}
+
+func unsupported(dialect SQLDialect, feature string) error {
+	return fmt.Errorf("%w: %s does not support %s", ErrDialectUnsupported, dialect.Name(), feature)
+}
+
+// jsonArray 将单个值包装为 JSON 数组文本, 切片原样转换
+func jsonArray(value interface{}) string {
+	return jsonString(toInterfaceSlice(value))
+}
+
+// arrayPlaceholders 返回 n 个以逗号分隔的占位符
+func arrayPlaceholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+/********* MySQL ***********/
+
+type MySQLDialect struct{}
+
+func (MySQLDialect) Name() string {
+	return "mysql"
+}
+
+func (MySQLDialect) Like(column clause.Column, pattern string, not bool) clause.Expression {
+	if not {
+		return clause.Expr{SQL: "? NOT LIKE ?", Vars: []interface{}{column, pattern}}
+	}
+	return clause.Expr{SQL: "? LIKE ?", Vars: []interface{}{column, pattern}}
+}
+
+func (MySQLDialect) Regex(column clause.Column, pattern string) (clause.Expression, error) {
+	return clause.Expr{SQL: "? REGEXP ?", Vars: []interface{}{column, pattern}}, nil
+}
+
+func (MySQLDialect) In(column clause.Column, values []interface{}, not bool) clause.Expression {
+	if not {
+		return clause.Expr{SQL: "? NOT IN ?", Vars: []interface{}{column, values}}
+	}
+	return clause.Expr{SQL: "? IN ?", Vars: []interface{}{column, values}}
+}
+
+// ArrayContains JSON_CONTAINS 的候选值需为 JSON 文本
+func (MySQLDialect) ArrayContains(column clause.Column, value interface{}) clause.Expression {
+	return clause.Expr{SQL: "JSON_CONTAINS(?, ?)", Vars: []interface{}{column, jsonString(value)}}
+}
+
+func (d MySQLDialect) Geo(column clause.Column, value interface{}) (clause.Expression, error) {
+	switch value := value.(type) {
+	case GeoRadius:
+		return clause.Expr{
+			SQL:  "ST_Distance_Sphere(?, POINT(?, ?)) <= ?",
+			Vars: []interface{}{column, value.Center.Lon, value.Center.Lat, value.Radius},
+		}, nil
+	case GeoBox:
+		return clause.Expr{
+			SQL:  "MBRContains(ST_MakeEnvelope(POINT(?, ?), POINT(?, ?)), ?)",
+			Vars: []interface{}{value.Min.Lon, value.Min.Lat, value.Max.Lon, value.Max.Lat, column},
+		}, nil
+	case GeoPolygon:
+		return clause.Expr{SQL: "ST_Contains(ST_GeomFromText(?), ?)", Vars: []interface{}{value.wkt(), column}}, nil
+	}
+	return nil, unsupported(d, fmt.Sprintf("geo value %T", value))
+}
+
+func (MySQLDialect) Distance(column clause.Column, point geo.Coordinate) (clause.Expr, error) {
+	return clause.Expr{SQL: "ST_Distance_Sphere(?, POINT(?, ?))", Vars: []interface{}{column, point.Lon, point.Lat}}, nil
+}
+
+func (d MySQLDialect) UpdateValue(assignment UpdateAssignment) (interface{}, error) {
+	column := clause.Column{Name: assignment.Column}
+	switch assignment.Operator {
+	case UpdateOperator_MIN:
+		return clause.Expr{SQL: "LEAST(COALESCE(?, ?), ?)", Vars: []interface{}{column, assignment.Value, assignment.Value}}, nil
+	case UpdateOperator_MAX:
+		return clause.Expr{SQL: "GREATEST(COALESCE(?, ?), ?)", Vars: []interface{}{column, assignment.Value, assignment.Value}}, nil
+	case UpdateOperator_CURRENT_DATE:
+		return clause.Expr{SQL: "NOW()"}, nil
+	case UpdateOperator_PUSH:
+		return clause.Expr{
+			SQL:  "JSON_ARRAY_APPEND(COALESCE(?, JSON_ARRAY()), '$', CAST(? AS JSON))",
+			Vars: []interface{}{column, jsonString(assignment.Value)},
+		}, nil
+	case UpdateOperator_ADD_TO_SET:
+		value := jsonString(assignment.Value)
+		return clause.Expr{
+			SQL: "IF(JSON_CONTAINS(COALESCE(?, JSON_ARRAY()), CAST(? AS JSON)), ?, " +
+				"JSON_ARRAY_APPEND(COALESCE(?, JSON_ARRAY()), '$', CAST(? AS JSON)))",
+			Vars: []interface{}{column, value, column, column, value},
+		}, nil
+	case UpdateOperator_PULL:
+		// JSON_TABLE 需要 MySQL 8
+		return clause.Expr{
+			SQL: "(SELECT COALESCE(JSON_ARRAYAGG(t.v), JSON_ARRAY()) FROM JSON_TABLE(COALESCE(?, JSON_ARRAY()), '$[*]' " +
+				"COLUMNS (v JSON PATH '$')) AS t WHERE t.v <> CAST(? AS JSON))",
+			Vars: []interface{}{column, jsonString(assignment.Value)},
+		}, nil
+	}
+	return nil, unsupported(d, string(assignment.Operator))
+}
+
+/********* PostgreSQL ***********/
+
+// PostgresDialect 数组列为 jsonb, 地理位置依赖 PostGIS, 列为 geometry(Point, 4326)
+type PostgresDialect struct{}
+
+func (PostgresDialect) Name() string {
+	return "postgres"
+}
+
+func (PostgresDialect) NullsOrder(desc bool) string {
+	if desc {
+		return "NULLS LAST"
+	}
+	return "NULLS FIRST"
+}
+
+func (PostgresDialect) Like(column clause.Column, pattern string, not bool) clause.Expression {
+	if not {
+		return clause.Expr{SQL: "? NOT ILIKE ?", Vars: []interface{}{column, pattern}}
+	}
+	return clause.Expr{SQL: "? ILIKE ?", Vars: []interface{}{column, pattern}}
+}
+
+func (PostgresDialect) Regex(column clause.Column, pattern string) (clause.Expression, error) {
+	return clause.Expr{SQL: "? ~ ?", Vars: []interface{}{column, pattern}}, nil
+}
+
+func (PostgresDialect) In(column clause.Column, values []interface{}, not bool) clause.Expression {
+	if len(values) == 0 {
+		// 空数组的 ARRAY[] 无法推断类型
+		if not {
+			return clause.Expr{SQL: "TRUE"}
+		}
+		return clause.Expr{SQL: "FALSE"}
+	}
+	sql := "? = ANY(ARRAY[" + arrayPlaceholders(len(values)) + "])"
+	if not {
+		sql = "? <> ALL(ARRAY[" + arrayPlaceholders(len(values)) + "])"
+	}
+	return clause.Expr{SQL: sql, Vars: append([]interface{}{column}, values...)}
+}
+
+func (PostgresDialect) ArrayContains(column clause.Column, value interface{}) clause.Expression {
+	return clause.Expr{SQL: "CAST(? AS jsonb) @> CAST(? AS jsonb)", Vars: []interface{}{column, jsonArray(value)}}
+}
+
+func (d PostgresDialect) Geo(column clause.Column, value interface{}) (clause.Expression, error) {
+	switch value := value.(type) {
+	case GeoRadius:
+		return clause.Expr{
+			SQL:  "ST_DistanceSphere(?, ST_SetSRID(ST_MakePoint(?, ?), 4326)) <= ?",
+			Vars: []interface{}{column, value.Center.Lon, value.Center.Lat, value.Radius},
+		}, nil
+	case GeoBox:
+		return clause.Expr{
+			SQL:  "ST_Contains(ST_MakeEnvelope(?, ?, ?, ?, 4326), ?)",
+			Vars: []interface{}{value.Min.Lon, value.Min.Lat, value.Max.Lon, value.Max.Lat, column},
+		}, nil
+	case GeoPolygon:
+		return clause.Expr{SQL: "ST_Contains(ST_GeomFromText(?, 4326), ?)", Vars: []interface{}{value.wkt(), column}}, nil
+	}
+	return nil, unsupported(d, fmt.Sprintf("geo value %T", value))
+}
+
+func (PostgresDialect) Distance(column clause.Column, point geo.Coordinate) (clause.Expr, error) {
+	return clause.Expr{
+		SQL:  "ST_DistanceSphere(?, ST_SetSRID(ST_MakePoint(?, ?), 4326))",
+		Vars: []interface{}{column, point.Lon, point.Lat},
+	}, nil
+}
+
+func (d PostgresDialect) UpdateValue(assignment UpdateAssignment) (interface{}, error) {
+	column := clause.Column{Name: assignment.Column}
+	switch assignment.Operator {
+	case UpdateOperator_MIN:
+		return clause.Expr{SQL: "LEAST(COALESCE(?, ?), ?)", Vars: []interface{}{column, assignment.Value, assignment.Value}}, nil
+	case UpdateOperator_MAX:
+		return clause.Expr{SQL: "GREATEST(COALESCE(?, ?), ?)", Vars: []interface{}{column, assignment.Value, assignment.Value}}, nil
+	case UpdateOperator_CURRENT_DATE:
+		return clause.Expr{SQL: "NOW()"}, nil
+	case UpdateOperator_PUSH:
+		return clause.Expr{
+			SQL:  "COALESCE(?, '[]'::jsonb) || CAST(? AS jsonb)",
+			Vars: []interface{}{column, jsonArray([]interface{}{assignment.Value})},
+		}, nil
+	case UpdateOperator_ADD_TO_SET:
+		value := jsonArray([]interface{}{assignment.Value})
+		return clause.Expr{
+			SQL:  "CASE WHEN COALESCE(?, '[]'::jsonb) @> CAST(? AS jsonb) THEN ? ELSE COALESCE(?, '[]'::jsonb) || CAST(? AS jsonb) END",
+			Vars: []interface{}{column, value, column, column, value},
+		}, nil
+	case UpdateOperator_PULL:
+		return clause.Expr{
+			SQL: "(SELECT COALESCE(jsonb_agg(t.v), '[]'::jsonb) FROM jsonb_array_elements(COALESCE(?, '[]'::jsonb)) AS t(v) " +
+				"WHERE t.v <> CAST(? AS jsonb))",
+			Vars: []interface{}{column, jsonString(assignment.Value)},
+		}, nil
+	}
+	return nil, unsupported(d, string(assignment.Operator))
+}
+
+/********* SQLite ***********/
+
+// SQLiteDialect 数组列为 JSON 文本, 使用 json_each 展开; 不支持 REGEX 与地理位置
+type SQLiteDialect struct{}
+
+func (SQLiteDialect) Name() string {
+	return "sqlite"
+}
+
+// Like SQLite 的 LIKE 没有默认的转义字符, 需显式指定
+func (SQLiteDialect) Like(column clause.Column, pattern string, not bool) clause.Expression {
+	if not {
+		return clause.Expr{SQL: `? NOT LIKE ? ESCAPE '\'`, Vars: []interface{}{column, pattern}}
+	}
+	return clause.Expr{SQL: `? LIKE ? ESCAPE '\'`, Vars: []interface{}{column, pattern}}
+}
+
+func (d SQLiteDialect) Regex(column clause.Column, pattern string) (clause.Expression, error) {
+	return nil, unsupported(d, "REGEX")
+}
+
+func (SQLiteDialect) In(column clause.Column, values []interface{}, not bool) clause.Expression {
+	return MySQLDialect{}.In(column, values, not)
+}
+
+func (SQLiteDialect) ArrayContains(column clause.Column, value interface{}) clause.Expression {
+	var expressions []clause.Expression
+	for _, item := range toInterfaceSlice(value) {
+		expressions = append(expressions, clause.Expr{
+			SQL:  "EXISTS (SELECT 1 FROM json_each(?) AS j WHERE j.value = ?)",
+			Vars: []interface{}{column, item},
+		})
+	}
+	if len(expressions) == 1 {
+		return expressions[0]
+	}
+	return clause.And(expressions...)
+}
+
+func (d SQLiteDialect) Geo(column clause.Column, value interface{}) (clause.Expression, error) {
+	return nil, unsupported(d, "geo filters")
+}
+
+func (d SQLiteDialect) Distance(column clause.Column, point geo.Coordinate) (clause.Expr, error) {
+	return clause.Expr{}, unsupported(d, "distance sort")
+}
+
+func (d SQLiteDialect) UpdateValue(assignment UpdateAssignment) (interface{}, error) {
+	column := clause.Column{Name: assignment.Column}
+	switch assignment.Operator {
+	case UpdateOperator_MIN:
+		return clause.Expr{SQL: "MIN(COALESCE(?, ?), ?)", Vars: []interface{}{column, assignment.Value, assignment.Value}}, nil
+	case UpdateOperator_MAX:
+		return clause.Expr{SQL: "MAX(COALESCE(?, ?), ?)", Vars: []interface{}{column, assignment.Value, assignment.Value}}, nil
+	case UpdateOperator_CURRENT_DATE:
+		return clause.Expr{SQL: "CURRENT_TIMESTAMP"}, nil
+	case UpdateOperator_PUSH:
+		return clause.Expr{
+			SQL:  "json_insert(COALESCE(?, '[]'), '$[#]', json(?))",
+			Vars: []interface{}{column, jsonString(assignment.Value)},
+		}, nil
+	case UpdateOperator_ADD_TO_SET:
+		return clause.Expr{
+			SQL: "CASE WHEN EXISTS (SELECT 1 FROM json_each(?) AS j WHERE j.value = ?) THEN ? " +
+				"ELSE json_insert(COALESCE(?, '[]'), '$[#]', json(?)) END",
+			Vars: []interface{}{column, assignment.Value, column, column, jsonString(assignment.Value)},
+		}, nil
+	case UpdateOperator_PULL:
+		return clause.Expr{
+			SQL:  "(SELECT json_group_array(j.value) FROM json_each(COALESCE(?, '[]')) AS j WHERE j.value <> ?)",
+			Vars: []interface{}{column, assignment.Value},
+		}, nil
+	}
+	return nil, unsupported(d, string(assignment.Operator))
+}
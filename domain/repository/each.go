@@ -0,0 +1,112 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+/********* 分批遍历 ***********/
+
+/*
+FindEach 以流的方式遍历查询结果, 避免一次性载入内存:
+1. 每凑满 batchSize 条记录写入 result(切片指针, 与 Find 相同)后调用 fn, 每批使用新的切片, fn 可以保留上一批的数据
+2. fn 返回 ErrStopIteration 时提前结束, FindEach 返回 nil; 返回其他 error 时结束并返回该 error
+3. 每批开始前检查 ctx, ctx 取消时返回 ctx.Err()
+4. gormrepo 使用 Rows 逐行读取, 读取期间占用一个连接, 在事务内使用时 fn 中不能再使用该事务执行查询;
+   mongorepo 使用游标, esrepo 使用 scroll
+*/
+
+var ErrStopIteration = errors.New("stop iteration")
+
+// DefaultEachBatchSize batchSize <= 0 时使用的批大小
+const DefaultEachBatchSize = 100
+
+// EachBatch FindEach 的分批缓冲, 供各仓储实现使用
+type EachBatch struct {
+	ctx       context.Context
+	result    reflect.Value // result 指向的切片
+	itemType  reflect.Type  // 解码的目标类型, 切片元素为指针时为其指向的类型
+	ptrItem   bool
+	batchSize int
+	fn        func() error
+}
+
+// NewEachBatch 创建分批缓冲, result 须为切片指针
+func NewEachBatch(ctx context.Context, result interface{}, batchSize int, fn func() error) (*EachBatch, error) {
+	resultValue := reflect.ValueOf(result)
+	if resultValue.Kind() != reflect.Ptr || resultValue.Elem().Kind() != reflect.Slice {
+		return nil, fmt.Errorf("result must be a pointer to slice, got %T", result)
+	}
+	if batchSize <= 0 {
+		batchSize = DefaultEachBatchSize
+	}
+
+	batch := &EachBatch{
+		ctx:       ctx,
+		result:    resultValue.Elem(),
+		itemType:  resultValue.Elem().Type().Elem(),
+		batchSize: batchSize,
+		fn:        fn,
+	}
+	if batch.itemType.Kind() == reflect.Ptr {
+		batch.itemType = batch.itemType.Elem()
+		batch.ptrItem = true
+	}
+	batch.reset()
+	return batch, nil
+}
+
+// BatchSize 实际使用的批大小
+func (b *EachBatch) BatchSize() int {
+	return b.batchSize
+}
+
+// Add 用 decode 解码一条记录并加入当前批, dest 为新元素的指针; 凑满一批时调用 fn
+func (b *EachBatch) Add(decode func(dest interface{}) error) error {
+	if b.result.Len() == 0 {
+		if err := b.ctx.Err(); err != nil {
+			return err
+		}
+	}
+
+	item := reflect.New(b.itemType)
+	if err := decode(item.Interface()); err != nil {
+		return err
+	}
+	if !b.ptrItem {
+		item = item.Elem()
+	}
+	b.result.Set(reflect.Append(b.result, item))
+
+	if b.result.Len() >= b.batchSize {
+		return b.Flush()
+	}
+	return nil
+}
+
+// Flush 将当前批交给 fn 处理, 批为空时不调用 fn; 遍历结束后须调用一次以处理最后不满一批的数据
+func (b *EachBatch) Flush() error {
+	if b.result.Len() == 0 {
+		return nil
+	}
+	if err := b.ctx.Err(); err != nil {
+		return err
+	}
+	err := b.fn()
+	b.reset()
+	return err
+}
+
+func (b *EachBatch) reset() {
+	b.result.Set(reflect.MakeSlice(b.result.Type(), 0, b.batchSize))
+}
+
+// EachResult 将 ErrStopIteration 视为正常结束, 各实现在 FindEach 返回前调用
+func EachResult(err error) error {
+	if errors.Is(err, ErrStopIteration) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,190 @@
+package repository
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/olivere/elastic"
+)
+
+/********* Elasticsearch ***********/
+
+// BuildToElastic 将过滤组构建为 bool 查询, AND 组使用 must, OR 组使用 should(至少命中一个), 取反条件使用 must_not.
+// 精确匹配使用 term/terms, 文本字段需映射为 keyword 才能按值命中
+func (g *FilterGroup) BuildToElastic() elastic.Query {
+	if query := g.buildElasticQuery(); query != nil {
+		return query
+	}
+	return elastic.NewMatchAllQuery()
+}
+
+func (g *FilterGroup) buildElasticQuery() elastic.Query {
+	var queries []elastic.Query
+	for _, filter := range g.Filters {
+		queries = append(queries, filter.buildElasticQuery())
+	}
+	for _, subGroup := range g.Groups {
+		if subGroup == nil {
+			continue
+		}
+		if query := subGroup.buildElasticQuery(); query != nil {
+			queries = append(queries, query)
+		}
+	}
+
+	switch {
+	case len(queries) == 0:
+		return nil
+	case len(queries) == 1:
+		return queries[0]
+	case g.Logic == FilterLogic_OR:
+		return elastic.NewBoolQuery().Should(queries...).MinimumNumberShouldMatch(1)
+	default:
+		return elastic.NewBoolQuery().Must(queries...)
+	}
+}
+
+func (f FilterSpec) buildElasticQuery() elastic.Query {
+	switch f.FilterType {
+	case FilterType_EQ:
+		if f.Value == nil {
+			return elastic.NewBoolQuery().MustNot(elastic.NewExistsQuery(f.Column))
+		}
+		return elastic.NewTermQuery(f.Column, f.Value)
+	case FilterType_NE:
+		if f.Value == nil {
+			return elastic.NewExistsQuery(f.Column)
+		}
+		return elastic.NewBoolQuery().MustNot(elastic.NewTermQuery(f.Column, f.Value))
+	case FilterType_GT:
+		return elastic.NewRangeQuery(f.Column).Gt(f.Value)
+	case FilterType_GTE:
+		return elastic.NewRangeQuery(f.Column).Gte(f.Value)
+	case FilterType_LT:
+		return elastic.NewRangeQuery(f.Column).Lt(f.Value)
+	case FilterType_LTE:
+		return elastic.NewRangeQuery(f.Column).Lte(f.Value)
+	case FilterType_IN:
+		return elastic.NewTermsQuery(f.Column, toInterfaceSlice(f.Value)...)
+	case FilterType_NOT_IN:
+		return elastic.NewBoolQuery().MustNot(elastic.NewTermsQuery(f.Column, toInterfaceSlice(f.Value)...))
+	case FilterType_LIKE, FilterType_STARTS_WITH, FilterType_ENDS_WITH, FilterType_CONTAINS:
+		pattern, _ := f.LikePattern()
+		return elastic.NewWildcardQuery(f.Column, likeToWildcard(pattern))
+	case FilterType_NOT_LIKE:
+		pattern, _ := f.LikePattern()
+		return elastic.NewBoolQuery().Must(elastic.NewExistsQuery(f.Column)).MustNot(elastic.NewWildcardQuery(f.Column, likeToWildcard(pattern)))
+	case FilterType_REGEX:
+		pattern, _ := f.Value.(string)
+		return elastic.NewRegexpQuery(f.Column, pattern)
+	case FilterType_BETWEEN:
+		values := f.Values()
+		return elastic.NewRangeQuery(f.Column).Gte(values[0]).Lte(values[1])
+	case FilterType_ARRAY_CONTAINS:
+		var queries []elastic.Query
+		for _, value := range f.Values() {
+			queries = append(queries, elastic.NewTermQuery(f.Column, value))
+		}
+		return elastic.NewBoolQuery().Must(queries...)
+	case FilterType_ARRAY_CONTAINS_ANY:
+		return elastic.NewTermsQuery(f.Column, f.Values()...)
+	case FilterType_NEAR, FilterType_WITHIN_RADIUS:
+		radius, _ := f.Value.(GeoRadius)
+		if radius.Radius <= 0 {
+			return elastic.NewExistsQuery(f.Column)
+		}
+		return elastic.NewGeoDistanceQuery(f.Column).Point(radius.Center.Lat, radius.Center.Lon).Distance(fmt.Sprintf("%gm", radius.Radius))
+	case FilterType_WITHIN_BOX:
+		box, _ := f.Value.(GeoBox)
+		return elastic.NewGeoBoundingBoxQuery(f.Column).TopLeft(box.Max.Lat, box.Min.Lon).BottomRight(box.Min.Lat, box.Max.Lon)
+	case FilterType_WITHIN_POLYGON:
+		polygon, _ := f.Value.(GeoPolygon)
+		query := elastic.NewGeoPolygonQuery(f.Column)
+		for _, point := range polygon {
+			query.AddPoint(point.Lat, point.Lon)
+		}
+		return query
+	case FilterType_EXISTS:
+		if f.Exists() {
+			return elastic.NewExistsQuery(f.Column)
+		}
+		return elastic.NewBoolQuery().MustNot(elastic.NewExistsQuery(f.Column))
+	case FilterType_IS_NULL:
+		return elastic.NewBoolQuery().MustNot(elastic.NewExistsQuery(f.Column))
+	case FilterType_IS_NOT_NULL:
+		return elastic.NewExistsQuery(f.Column)
+	default:
+		panic("unsupported filter type")
+	}
+}
+
+// likeToWildcard 将 SQL LIKE 模式(% _ 及 \ 转义)转换为 wildcard 模式(* ?)
+func likeToWildcard(pattern string) string {
+	var builder strings.Builder
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			if r == '*' || r == '?' || r == '\\' {
+				builder.WriteRune('\\')
+			}
+			builder.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '%':
+			builder.WriteRune('*')
+		case r == '_':
+			builder.WriteRune('?')
+		case r == '*' || r == '?':
+			builder.WriteRune('\\')
+			builder.WriteRune(r)
+		default:
+			builder.WriteRune(r)
+		}
+	}
+	return builder.String()
+}
+
+// toInterfaceSlice 将任意切片展开为 []interface{}, 非切片值作为单个元素
+func toInterfaceSlice(value interface{}) []interface{} {
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return []interface{}{value}
+	}
+	values := make([]interface{}, v.Len())
+	for i := range values {
+		values[i] = v.Index(i).Interface()
+	}
+	return values
+}
+
+func (s *SortSpecs) BuildToElastic() []elastic.Sorter {
+	sorters := make([]elastic.Sorter, 0, len(*s))
+	for i := range *s {
+		if near := (*s)[i].Near; near != nil {
+			sorters = append(sorters, elastic.NewGeoDistanceSort((*s)[i].Property).Point(near.Lat, near.Lon).Order((*s)[i].Type != SortType_DESC))
+			continue
+		}
+		// 缺失字段视为最小值, 与其他实现一致
+		ascending := (*s)[i].Type != SortType_DESC
+		missing := "_last"
+		if ascending {
+			missing = "_first"
+		}
+		sorters = append(sorters, elastic.NewFieldSort((*s)[i].Property).Order(ascending).Missing(missing))
+	}
+	return sorters
+}
+
+// BuildToElastic 返回 from/size, size 为 0 表示未指定
+func (s *LimitSpec) BuildToElastic() (from int, size int) {
+	if s.UseCursor {
+		return 0, s.Size + 1
+	}
+	if s.Page > 1 {
+		from = (s.Page - 1) * s.Size
+	}
+	return from, s.Size
+}
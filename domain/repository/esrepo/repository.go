@@ -0,0 +1,497 @@
+package esrepo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+
+	"github.com/olivere/elastic"
+	"go.uber.org/zap"
+
+	"github.com/henrion-y/base.services/domain/repository"
+	"github.com/henrion-y/base.services/infra/zlog"
+)
+
+// 索引名取 Model.TableName(), 使用 es6 的单一类型 _doc
+const docType = "_doc"
+
+// defaultSize 未指定翻页时的最大返回条数, 与 index.max_result_window 默认值一致
+const defaultSize = 10000
+
+var (
+	ErrTransactionNotSupported = errors.New("esrepo: transaction is not supported")
+	ErrAggregateNotSupported   = errors.New("esrepo: aggregate is not supported")
+	ErrDocumentIDRequired      = errors.New("esrepo: upsert requires a model implementing Document with non-empty id")
+)
+
+// Document 模型实现该接口时使用其返回值作为文档 id, 否则由 es 自动生成
+type Document interface {
+	DocumentID() string
+}
+
+type esRepository struct {
+	Client *elastic.Client
+}
+
+func NewBaseRepository(client *elastic.Client) repository.BaseRepository {
+	return &esRepository{Client: client}
+}
+
+func (r *esRepository) Create(ctx context.Context, mod repository.Model) error {
+	repository.InitVersion(mod)
+	service := r.Client.Index().Index(mod.TableName()).Type(docType).BodyJson(mod)
+	if doc, ok := mod.(Document); ok && doc.DocumentID() != "" {
+		service = service.Id(doc.DocumentID())
+	}
+
+	_, err := service.Do(ctx)
+	if err != nil {
+		zlog.Error("esRepo.Create", zap.Any("mod", mod), zap.Error(err))
+	}
+	return err
+}
+
+// CreateBatch 每批执行一次 Bulk 写入, 返回每批成功的条数, 某批有失败项时停止并返回错误
+func (r *esRepository) CreateBatch(ctx context.Context, models interface{}, batchSize int) ([]int64, error) {
+	batches, err := repository.SplitBatches(models, batchSize)
+	if err != nil || len(batches) == 0 {
+		return nil, err
+	}
+
+	counts := make([]int64, 0, len(batches))
+	for _, batch := range batches {
+		service := r.Client.Bulk()
+		for _, item := range batch.Items {
+			repository.InitVersion(item)
+			request := elastic.NewBulkIndexRequest().Index(item.TableName()).Type(docType).Doc(item)
+			if doc, ok := item.(Document); ok && doc.DocumentID() != "" {
+				request = request.Id(doc.DocumentID())
+			}
+			service = service.Add(request)
+		}
+
+		resp, err := service.Do(ctx)
+		if err == nil && resp.Errors {
+			counts = append(counts, int64(len(resp.Succeeded())))
+			failed := resp.Failed()
+			reason := ""
+			if failed[0].Error != nil {
+				reason = failed[0].Error.Reason
+			}
+			err = fmt.Errorf("esrepo: bulk index %d failed, first error: %s", len(failed), reason)
+		}
+		if err != nil {
+			zlog.Error("esRepo.CreateBatch", zap.Int("batchSize", batchSize), zap.Int("batch", len(counts)), zap.Error(err))
+			return counts, err
+		}
+		counts = append(counts, int64(len(resp.Succeeded())))
+	}
+	return counts, nil
+}
+
+// Upsert 以文档 id 作为唯一键, mod 必须实现 Document, conflictColumns 被忽略
+func (r *esRepository) Upsert(ctx context.Context, mod repository.Model, conflictColumns []string, updateColumns []string) (int64, error) {
+	doc, ok := mod.(Document)
+	if !ok || doc.DocumentID() == "" {
+		return 0, ErrDocumentIDRequired
+	}
+
+	if err := modelColumns(mod).Check(updateColumns...); err != nil {
+		zlog.Error("esRepo.Upsert", zap.Any("mod", mod), zap.Error(err))
+		return 0, err
+	}
+
+	service := r.Client.Update().Index(mod.TableName()).Type(docType).Id(doc.DocumentID())
+	if len(updateColumns) == 0 {
+		service = service.Doc(mod).DocAsUpsert(true)
+	} else {
+		partial, err := partialDoc(mod, updateColumns)
+		if err != nil {
+			zlog.Error("esRepo.Upsert.partialDoc", zap.Any("mod", mod), zap.Error(err))
+			return 0, err
+		}
+		service = service.Doc(partial).Upsert(mod)
+	}
+
+	resp, err := service.Do(ctx)
+	if err != nil {
+		zlog.Error("esRepo.Upsert", zap.Any("mod", mod), zap.Strings("updateColumns", updateColumns), zap.Error(err))
+		return 0, err
+	}
+	if resp.Result == "noop" {
+		return 0, nil
+	}
+	return 1, nil
+}
+
+func (r *esRepository) Update(ctx context.Context, mod repository.Model, data map[string]interface{}, filterGroup *repository.FilterGroup) (int64, error) {
+	filterGroup = repository.ExcludeDeleted(mod, filterGroup)
+	column, ok := repository.VersionColumn(mod)
+	if !ok {
+		return r.update(ctx, mod, data, filterGroup, "")
+	}
+
+	// 乐观锁: 以当前版本为条件, 版本在脚本中加 1
+	filterGroup, version := repository.VersionFilter(mod, filterGroup)
+	updated, err := r.update(ctx, mod, data, filterGroup, column)
+	if err != nil {
+		return 0, err
+	}
+	if err = repository.CheckVersion(mod, version, updated); err != nil {
+		zlog.Error("esRepo.Update", zap.Any("mod", mod), zap.Any("data", data), zap.Error(err))
+		return 0, err
+	}
+	return updated, nil
+}
+
+// update versionColumn 不为空时在脚本中将该列加 1
+func (r *esRepository) update(ctx context.Context, mod repository.Model, data map[string]interface{}, filterGroup *repository.FilterGroup, versionColumn string) (int64, error) {
+	columns := modelColumns(mod)
+	err := columns.CheckData(data)
+	if err == nil {
+		err = columns.CheckFilter(filterGroup)
+	}
+	if err != nil {
+		zlog.Error("esRepo.Update", zap.Any("mod", mod), zap.Any("data", data), zap.Error(err))
+		return 0, err
+	}
+
+	if versionColumn != "" {
+		data = repository.WithUpdateOperator(data, repository.UpdateOperator_INC, versionColumn, 1)
+	}
+	ops, err := repository.BuildUpdateToElastic(data)
+	if err != nil {
+		zlog.Error("esRepo.Update", zap.Any("mod", mod), zap.Any("data", data), zap.Error(err))
+		return 0, err
+	}
+	script := elastic.NewScript(repository.ElasticUpdateScript).
+		Lang("painless").
+		Params(map[string]interface{}{"ops": ops})
+
+	resp, err := r.Client.UpdateByQuery(mod.TableName()).
+		Type(docType).
+		Query(buildQuery(filterGroup)).
+		Script(script).
+		ProceedOnVersionConflict().
+		Do(ctx)
+	if err != nil {
+		zlog.Error("esRepo.Update", zap.Any("mod", mod), zap.Any("data", data), zap.Any("filterGroup", filterGroup), zap.Error(err))
+		return 0, err
+	}
+	return resp.Updated, nil
+}
+
+func (r *esRepository) Delete(ctx context.Context, mod repository.Model, filterGroup *repository.FilterGroup) error {
+	if column, ok := repository.SoftDeleteColumn(mod); ok {
+		_, err := r.Update(ctx, mod, map[string]interface{}{column: time.Now()}, filterGroup)
+		return err
+	}
+
+	err := modelColumns(mod).CheckFilter(filterGroup)
+	if err != nil {
+		zlog.Error("esRepo.Delete", zap.Any("mod", mod), zap.Error(err))
+		return err
+	}
+
+	_, err = r.Client.DeleteByQuery(mod.TableName()).
+		Type(docType).
+		Query(buildQuery(filterGroup)).
+		ProceedOnVersionConflict().
+		Do(ctx)
+	if err != nil {
+		zlog.Error("esRepo.Delete", zap.Any("mod", mod), zap.Any("filterGroup", filterGroup), zap.Error(err))
+	}
+	return err
+}
+
+func (r *esRepository) Restore(ctx context.Context, mod repository.Model, filterGroup *repository.FilterGroup) (int64, error) {
+	filterGroup, err := repository.OnlyDeleted(mod, filterGroup)
+	if err != nil {
+		zlog.Error("esRepo.Restore", zap.Any("mod", mod), zap.Error(err))
+		return 0, err
+	}
+	column, _ := repository.SoftDeleteColumn(mod)
+	return r.update(ctx, mod, map[string]interface{}{column: nil}, filterGroup, "")
+}
+
+func (r *esRepository) Find(ctx context.Context, mod repository.Model, result interface{}, fields []string, filterGroup *repository.FilterGroup, sortSpecs *repository.SortSpecs, limitSpec *repository.LimitSpec) error {
+	return r.find(ctx, mod, result, fields, repository.ExcludeDeleted(mod, filterGroup), sortSpecs, limitSpec)
+}
+
+func (r *esRepository) FindWithDeleted(ctx context.Context, mod repository.Model, result interface{}, fields []string, filterGroup *repository.FilterGroup, sortSpecs *repository.SortSpecs, limitSpec *repository.LimitSpec) error {
+	return r.find(ctx, mod, result, fields, filterGroup, sortSpecs, limitSpec)
+}
+
+func (r *esRepository) find(ctx context.Context, mod repository.Model, result interface{}, fields []string, filterGroup *repository.FilterGroup, sortSpecs *repository.SortSpecs, limitSpec *repository.LimitSpec) error {
+	if err := modelColumns(mod).CheckQuery(fields, filterGroup, sortSpecs); err != nil {
+		zlog.Error("esRepo.Find", zap.Any("mod", mod), zap.Error(err))
+		return err
+	}
+
+	if limitSpec != nil {
+		// 游标翻页时追加主键作为次级排序
+		fields, sortSpecs = limitSpec.CursorSpecs(mod, fields, sortSpecs)
+	}
+
+	if limitSpec != nil {
+		// 游标翻页时追加 keyset 条件
+		var err error
+		filterGroup, err = limitSpec.BuildCursorFilter(filterGroup, sortSpecs)
+		if err != nil {
+			zlog.Error("esRepo.Find.BuildCursorFilter", zap.Any("mod", mod),
+				zap.Any("sortSpecs", sortSpecs),
+				zap.Any("limitSpec", limitSpec),
+				zap.Error(err))
+			return err
+		}
+	}
+
+	hits, err := r.search(ctx, mod, fields, filterGroup, sortSpecs, limitSpec)
+	if err != nil {
+		zlog.Error("esRepo.Find", zap.Any("mod", mod),
+			zap.Any("filterGroup", filterGroup),
+			zap.Any("sortSpecs", sortSpecs),
+			zap.Any("limitSpec", limitSpec),
+			zap.Any("fields", fields),
+			zap.Error(err))
+		return err
+	}
+
+	if err = decodeHits(hits, result); err != nil {
+		zlog.Error("esRepo.Find.decodeHits", zap.Any("mod", mod), zap.Error(err))
+		return err
+	}
+
+	if limitSpec != nil {
+		err = limitSpec.FillNextCursor(result, sortSpecs)
+		if err != nil {
+			zlog.Error("esRepo.Find.FillNextCursor", zap.Any("mod", mod),
+				zap.Any("sortSpecs", sortSpecs),
+				zap.Any("limitSpec", limitSpec),
+				zap.Error(err))
+			return err
+		}
+	}
+	return nil
+}
+
+// FindEach 使用 scroll 逐批读取, 结束后清除 scroll 上下文
+func (r *esRepository) FindEach(ctx context.Context, mod repository.Model, result interface{}, fields []string, filterGroup *repository.FilterGroup, sortSpecs *repository.SortSpecs, batchSize int, fn func() error) error {
+	filterGroup = repository.ExcludeDeleted(mod, filterGroup)
+	if err := modelColumns(mod).CheckQuery(fields, filterGroup, sortSpecs); err != nil {
+		zlog.Error("esRepo.FindEach", zap.Any("mod", mod), zap.Error(err))
+		return err
+	}
+	batch, err := repository.NewEachBatch(ctx, result, batchSize, fn)
+	if err != nil {
+		return err
+	}
+
+	scroll := r.Client.Scroll(mod.TableName()).Type(docType).Query(buildQuery(filterGroup)).Size(batch.BatchSize())
+	if len(fields) > 0 {
+		scroll = scroll.FetchSourceContext(elastic.NewFetchSourceContext(true).Include(fields...))
+	}
+	if sortSpecs != nil && len(*sortSpecs) > 0 {
+		scroll = scroll.SortBy(sortSpecs.BuildToElastic()...)
+	}
+	defer scroll.Clear(context.Background())
+
+	for err == nil {
+		var searchResult *elastic.SearchResult
+		searchResult, err = scroll.Do(ctx)
+		if err != nil || searchResult.Hits == nil {
+			break
+		}
+		for _, hit := range searchResult.Hits.Hits {
+			if hit.Source == nil {
+				continue
+			}
+			err = batch.Add(func(dest interface{}) error {
+				return json.Unmarshal(*hit.Source, dest)
+			})
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err == nil || err == io.EOF {
+		err = batch.Flush()
+	}
+	if err = repository.EachResult(err); err != nil {
+		zlog.Error("esRepo.FindEach", zap.Any("mod", mod),
+			zap.Any("filterGroup", filterGroup),
+			zap.Any("sortSpecs", sortSpecs),
+			zap.Int("batchSize", batch.BatchSize()),
+			zap.Error(err))
+	}
+	return err
+}
+
+func (r *esRepository) FindOne(ctx context.Context, mod repository.Model, fields []string, filterGroup *repository.FilterGroup, sortSpecs *repository.SortSpecs) error {
+	filterGroup = repository.ExcludeDeleted(mod, filterGroup)
+	if err := modelColumns(mod).CheckQuery(fields, filterGroup, sortSpecs); err != nil {
+		zlog.Error("esRepo.FindOne", zap.Any("mod", mod), zap.Error(err))
+		return err
+	}
+
+	hits, err := r.search(ctx, mod, fields, filterGroup, sortSpecs, repository.NewLimitSpec(0, 1))
+	if err != nil {
+		zlog.Error("esRepo.FindOne", zap.Any("mod", mod),
+			zap.Any("filterGroup", filterGroup),
+			zap.Any("sortSpecs", sortSpecs),
+			zap.Any("fields", fields),
+			zap.Error(err))
+		return err
+	}
+	// 与其他实现一致, 记录不存在时不返回错误
+	if len(hits) == 0 || hits[0].Source == nil {
+		return nil
+	}
+
+	err = json.Unmarshal(*hits[0].Source, mod)
+	if err != nil {
+		zlog.Error("esRepo.FindOne.Unmarshal", zap.Any("mod", mod), zap.Error(err))
+	}
+	return err
+}
+
+func (r *esRepository) Count(ctx context.Context, mod repository.Model, filterGroup *repository.FilterGroup) (int64, error) {
+	filterGroup = repository.ExcludeDeleted(mod, filterGroup)
+	if err := modelColumns(mod).CheckFilter(filterGroup); err != nil {
+		zlog.Error("esRepo.Count", zap.Any("mod", mod), zap.Error(err))
+		return 0, err
+	}
+
+	count, err := r.Client.Count(mod.TableName()).Type(docType).Query(buildQuery(filterGroup)).Do(ctx)
+	if err != nil {
+		zlog.Error("esRepo.Count", zap.Any("mod", mod), zap.Any("filterGroup", filterGroup), zap.Error(err))
+	}
+	return count, err
+}
+
+func (r *esRepository) FindPage(ctx context.Context, mod repository.Model, result interface{}, fields []string, filterGroup *repository.FilterGroup, sortSpecs *repository.SortSpecs, limitSpec *repository.LimitSpec) (*repository.Page, error) {
+	return repository.LoadPage(ctx, r, mod, result, fields, filterGroup, sortSpecs, limitSpec)
+}
+
+func (r *esRepository) FindByIDs(ctx context.Context, mod repository.Model, result interface{}, ids interface{}) error {
+	return r.Find(ctx, mod, result, nil, repository.IDsFilter(mod, ids), nil, nil)
+}
+
+// Exists 找到一条匹配的文档后即停止计数
+func (r *esRepository) Exists(ctx context.Context, mod repository.Model, filterGroup *repository.FilterGroup) (bool, error) {
+	filterGroup = repository.ExcludeDeleted(mod, filterGroup)
+	if err := modelColumns(mod).CheckFilter(filterGroup); err != nil {
+		zlog.Error("esRepo.Exists", zap.Any("mod", mod), zap.Error(err))
+		return false, err
+	}
+
+	count, err := r.Client.Count(mod.TableName()).Type(docType).Query(buildQuery(filterGroup)).TerminateAfter(1).Do(ctx)
+	if err != nil {
+		zlog.Error("esRepo.Exists", zap.Any("mod", mod), zap.Any("filterGroup", filterGroup), zap.Error(err))
+	}
+	return count > 0, err
+}
+
+// Distinct 暂不支持, 直接返回 ErrAggregateNotSupported
+func (r *esRepository) Distinct(ctx context.Context, mod repository.Model, column string, result interface{}, filterGroup *repository.FilterGroup) error {
+	return ErrAggregateNotSupported
+}
+
+// Aggregate 暂不支持, 直接返回 ErrAggregateNotSupported
+func (r *esRepository) Aggregate(ctx context.Context, mod repository.Model, result interface{}, filterGroup *repository.FilterGroup, aggregateSpec *repository.AggregateSpec, sortSpecs *repository.SortSpecs, limitSpec *repository.LimitSpec) error {
+	return ErrAggregateNotSupported
+}
+
+// WithTransaction es 不支持事务, 直接返回 ErrTransactionNotSupported
+func (r *esRepository) WithTransaction(ctx context.Context, fn func(txRepo repository.BaseRepository) error) error {
+	return ErrTransactionNotSupported
+}
+
+func (r *esRepository) search(ctx context.Context, mod repository.Model, fields []string, filterGroup *repository.FilterGroup, sortSpecs *repository.SortSpecs, limitSpec *repository.LimitSpec) ([]*elastic.SearchHit, error) {
+	service := r.Client.Search(mod.TableName()).Type(docType).Query(buildQuery(filterGroup))
+
+	if len(fields) > 0 {
+		service = service.FetchSourceContext(elastic.NewFetchSourceContext(true).Include(fields...))
+	}
+	if sortSpecs != nil && len(*sortSpecs) > 0 {
+		service = service.SortBy(sortSpecs.BuildToElastic()...)
+	}
+
+	from, size := 0, defaultSize
+	if limitSpec != nil {
+		from, size = limitSpec.BuildToElastic()
+		if size <= 0 {
+			size = defaultSize
+		}
+	}
+	service = service.From(from).Size(size)
+
+	searchResult, err := service.Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if searchResult.Hits == nil {
+		return nil, nil
+	}
+	return searchResult.Hits.Hits, nil
+}
+
+// modelColumns 模型允许使用的列, 另外允许按文档 _id 查询
+func modelColumns(mod repository.Model) *repository.ColumnSet {
+	return repository.ModelColumns(mod).With("_id")
+}
+
+func buildQuery(filterGroup *repository.FilterGroup) elastic.Query {
+	if filterGroup == nil {
+		return elastic.NewMatchAllQuery()
+	}
+	return filterGroup.BuildToElastic()
+}
+
+// decodeHits 将命中文档的 _source 解码到切片指针 result 中
+func decodeHits(hits []*elastic.SearchHit, result interface{}) error {
+	resultValue := reflect.ValueOf(result)
+	if resultValue.Kind() != reflect.Ptr || resultValue.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("esrepo: result must be a pointer to slice, got %T", result)
+	}
+
+	list := reflect.MakeSlice(resultValue.Elem().Type(), 0, len(hits))
+	for _, hit := range hits {
+		if hit.Source == nil {
+			continue
+		}
+		item := reflect.New(list.Type().Elem())
+		if err := json.Unmarshal(*hit.Source, item.Interface()); err != nil {
+			return err
+		}
+		list = reflect.Append(list, item.Elem())
+	}
+	resultValue.Elem().Set(list)
+	return nil
+}
+
+// partialDoc 取出 mod 中 columns 对应的 json 字段, 作为局部更新的文档
+func partialDoc(mod repository.Model, columns []string) (map[string]interface{}, error) {
+	raw, err := json.Marshal(mod)
+	if err != nil {
+		return nil, err
+	}
+	var source map[string]interface{}
+	if err = json.Unmarshal(raw, &source); err != nil {
+		return nil, err
+	}
+
+	partial := make(map[string]interface{}, len(columns))
+	for _, column := range columns {
+		value, ok := source[column]
+		if !ok {
+			return nil, fmt.Errorf("esrepo: unknown column %s", column)
+		}
+		partial[column] = value
+	}
+	return partial, nil
+}
@@ -0,0 +1,107 @@
+package esrepo
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	_elastic "github.com/olivere/elastic"
+	"github.com/spf13/viper"
+
+	"github.com/henrion-y/base.services/database/elastic"
+	"github.com/henrion-y/base.services/domain/repository"
+)
+
+type User struct {
+	ID    int       `json:"id"`
+	Name  string    `json:"name"`
+	Age   int       `json:"age"`
+	Ctime time.Time `json:"ctime"`
+}
+
+func (t *User) TableName() string {
+	return "t_user_repository"
+}
+
+func getClient() *_elastic.Client {
+	v := viper.New()
+	v.Set("elastic.Host", "http://127.0.0.1:9200")
+	v.Set("elastic.SetSniff", false)
+	client, err := elastic.NewElasticProvider(v)
+	if err != nil {
+		panic(err)
+	}
+	return client
+}
+
+func TestBuildToElastic(t *testing.T) {
+	filterGroup := repository.NewFilterGroup().Equals("name", "张飞").NotIn("age", []int{1, 2}).Or(
+		repository.NewFilterGroup().GreaterThanOrEqual("age", 18).Like("name", "张%"),
+		repository.NewFilterGroup().IsNull("dtime"),
+	)
+	source, err := filterGroup.BuildToElastic().Source()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(source)
+
+	want := `{"bool":{"must":[{"term":{"name":"张飞"}},{"bool":{"must_not":{"terms":{"age":[1,2]}}}},` +
+		`{"bool":{"minimum_should_match":"1","should":[{"bool":{"must":[{"range":{"age":{"from":18,"include_lower":true,"include_upper":true,"to":null}}},{"wildcard":{"name":{"wildcard":"张*"}}}]}},` +
+		`{"bool":{"must_not":{"exists":{"field":"dtime"}}}}]}}]}}`
+	if string(data) != want {
+		t.Fatalf("got %s", data)
+	}
+}
+
+func TestBaseRepository_Create(t *testing.T) {
+	repo := NewBaseRepository(getClient())
+
+	err := repo.Create(context.Background(), &User{ID: 1, Name: "张飞", Age: 28, Ctime: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBaseRepository_Find(t *testing.T) {
+	repo := NewBaseRepository(getClient())
+
+	var list []User
+	err := repo.Find(context.Background(), &User{}, &list, []string{"name", "age"},
+		repository.NewFilterGroup().GreaterThan("age", 10),
+		repository.NewSortSpecs("age", repository.SortType_DESC), repository.NewLimitSpec(0, 20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(list)
+}
+
+func TestBaseRepository_Count(t *testing.T) {
+	repo := NewBaseRepository(getClient())
+
+	count, err := repo.Count(context.Background(), &User{}, repository.NewFilterGroup().Equals("name", "张飞"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(count)
+}
+
+func TestBaseRepository_Update(t *testing.T) {
+	repo := NewBaseRepository(getClient())
+
+	rowCount, err := repo.Update(context.Background(), &User{}, map[string]interface{}{"age": 19},
+		repository.NewFilterGroup().Equals("name", "张飞"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(rowCount)
+}
+
+func TestBaseRepository_Delete(t *testing.T) {
+	repo := NewBaseRepository(getClient())
+
+	err := repo.Delete(context.Background(), &User{}, repository.NewFilterGroup().Equals("id", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
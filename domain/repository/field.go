@@ -0,0 +1,146 @@
+package repository
+
+import (
+	"reflect"
+	"strings"
+
+	"gorm.io/gorm/schema"
+)
+
+var namingStrategy = schema.NamingStrategy{}
+
+// ColumnValue 按列名从结构体或 map 中取值, 支持 a.b 形式的嵌套路径.
+// 结构体字段按 gorm column 标签、bson 标签、json 标签、蛇形字段名、小写字段名依次匹配
+func ColumnValue(obj interface{}, column string) (interface{}, bool) {
+	v, ok := columnField(reflect.ValueOf(obj), column)
+	if !ok {
+		return nil, false
+	}
+	return v.Interface(), true
+}
+
+// FieldByColumn 按列名查找结构体字段或 map 值, 匹配规则同 ColumnValue. v 可寻址时返回的结构体字段可直接赋值
+func FieldByColumn(v reflect.Value, column string) (reflect.Value, bool) {
+	return columnField(v, column)
+}
+
+// StructColumns 返回结构体各字段对应的列名, 每个字段取 gorm column 标签、bson 标签、json 标签、蛇形字段名中第一个可用的
+func StructColumns(t reflect.Type) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var columns []string
+	for i := 0; i < t.NumField(); i++ {
+		fieldType := t.Field(i)
+		if fieldType.Anonymous || strings.Contains(fieldType.Tag.Get("bson"), "inline") {
+			if embedded := indirectType(fieldType.Type); embedded.Kind() == reflect.Struct {
+				columns = append(columns, StructColumns(embedded)...)
+				continue
+			}
+		}
+		if fieldType.PkgPath != "" {
+			continue
+		}
+		columns = append(columns, fieldColumnNames(fieldType)[0])
+	}
+	return columns
+}
+
+// StructFieldColumnNames 返回结构体字段可能对应的所有列名
+func StructFieldColumnNames(field reflect.StructField) []string {
+	return fieldColumnNames(field)
+}
+
+func columnField(v reflect.Value, column string) (reflect.Value, bool) {
+	v = indirectValue(v)
+	switch v.Kind() {
+	case reflect.Struct:
+		if field, ok := structField(v, column); ok {
+			return field, true
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() == reflect.String {
+			value := v.MapIndex(reflect.ValueOf(column).Convert(v.Type().Key()))
+			if value.IsValid() {
+				return value, true
+			}
+		}
+	default:
+		return reflect.Value{}, false
+	}
+
+	// 嵌套路径
+	if idx := strings.Index(column, "."); idx > 0 {
+		if parent, ok := columnField(v, column[:idx]); ok {
+			return columnField(parent, column[idx+1:])
+		}
+	}
+	return reflect.Value{}, false
+}
+
+func structField(v reflect.Value, column string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		fieldType := t.Field(i)
+		if fieldType.PkgPath != "" && !fieldType.Anonymous {
+			continue
+		}
+		field := v.Field(i)
+
+		// 匿名嵌入及 bson inline 的结构体展开匹配
+		if fieldType.Anonymous || strings.Contains(fieldType.Tag.Get("bson"), "inline") {
+			if embedded := indirectValue(field); embedded.Kind() == reflect.Struct {
+				if value, ok := structField(embedded, column); ok {
+					return value, true
+				}
+			}
+			if fieldType.Anonymous {
+				continue
+			}
+		}
+
+		for _, name := range fieldColumnNames(fieldType) {
+			if name == column {
+				return field, true
+			}
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// fieldColumnNames 字段可能对应的列名
+func fieldColumnNames(field reflect.StructField) []string {
+	var names []string
+	for _, setting := range strings.Split(field.Tag.Get("gorm"), ";") {
+		if kv := strings.SplitN(setting, ":", 2); len(kv) == 2 && strings.EqualFold(strings.TrimSpace(kv[0]), "column") {
+			names = append(names, strings.TrimSpace(kv[1]))
+		}
+	}
+	for _, key := range []string{"bson", "json"} {
+		if name := strings.Split(field.Tag.Get(key), ",")[0]; name != "" && name != "-" {
+			names = append(names, name)
+		}
+	}
+	return append(names, namingStrategy.ColumnName("", field.Name), strings.ToLower(field.Name))
+}
+
+func indirectType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+func indirectValue(v reflect.Value) reflect.Value {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	return v
+}
@@ -0,0 +1,247 @@
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gorm.io/gorm/clause"
+)
+
+/********* 过滤条件 ***********/
+
+/*
+各操作符在 MySQL、Mongo、Elasticsearch 与 memrepo 中的语义保持一致:
+1. LIKE 系列(LIKE、NOT_LIKE、STARTS_WITH、ENDS_WITH、CONTAINS)统一转换为 LIKE 模式, 不区分大小写;
+   Mongo 中按 LIKE 模式转换为锚定的正则, 不再把值直接当作正则. 这是不兼容的变更: 原来 Mongo 中 Like("name", "foo")
+   是不区分大小写的子串匹配, 现在与 SQL 一致为整值匹配; 子串、前缀、后缀匹配改用 Contains、StartsWith、EndsWith,
+   确需正则时改用 Regex
+2. NOT_LIKE 与 SQL 一致, 列值为 NULL 时不命中
+3. REGEX 直接交给数据库执行, 语法与大小写规则取决于数据库(MySQL REGEXP、PostgreSQL ~、Mongo $regex、ES regexp)
+4. ARRAY_CONTAINS 在 MySQL 中使用 JSON_CONTAINS, 列须为 JSON 数组, 其他 SQL 方言见 dialect.go; Mongo 使用 $all
+5. ARRAY_CONTAINS_ANY 在 SQL 中为多个 ARRAY_CONTAINS 的 OR; Mongo 使用 $elemMatch + $in
+6. EXISTS 表示字段存在且非空, SQL 中等价于 IS NOT NULL
+7. 地理位置条件见 geo.go
+*/
+
+var ErrInvalidFilterValue = errors.New("invalid filter value")
+
+// Validate 校验过滤值是否符合操作符的要求, 各仓储在执行前通过 ColumnSet.CheckFilter 调用
+func (f FilterSpec) Validate() error {
+	switch f.FilterType {
+	case FilterType_EQ, FilterType_NE, FilterType_GT, FilterType_GTE, FilterType_LT, FilterType_LTE,
+		FilterType_IN, FilterType_NOT_IN, FilterType_IS_NULL, FilterType_IS_NOT_NULL:
+		return nil
+	case FilterType_LIKE, FilterType_NOT_LIKE, FilterType_STARTS_WITH, FilterType_ENDS_WITH, FilterType_CONTAINS, FilterType_REGEX:
+		if _, ok := f.Value.(string); !ok {
+			return f.invalid("must be a string")
+		}
+	case FilterType_BETWEEN:
+		if len(f.Values()) != 2 {
+			return f.invalid("must be a slice of two elements")
+		}
+	case FilterType_ARRAY_CONTAINS, FilterType_ARRAY_CONTAINS_ANY:
+		if len(f.Values()) == 0 {
+			return f.invalid("must not be empty")
+		}
+	case FilterType_EXISTS:
+		if _, ok := f.Value.(bool); !ok && f.Value != nil {
+			return f.invalid("must be a bool")
+		}
+	case FilterType_NEAR, FilterType_WITHIN_RADIUS, FilterType_WITHIN_BOX, FilterType_WITHIN_POLYGON:
+		return f.validateGeo()
+	default:
+		return fmt.Errorf("%w: unsupported filter type %s", ErrInvalidFilterValue, f.FilterType)
+	}
+	return nil
+}
+
+func (f FilterSpec) invalid(reason string) error {
+	return fmt.Errorf("%w: %s value of column %s %s", ErrInvalidFilterValue, f.FilterType, f.Column, reason)
+}
+
+// Values 将 Value 展开为切片, 用于 IN、BETWEEN、ARRAY_CONTAINS 等多值操作符, 非切片值作为单个元素
+func (f FilterSpec) Values() []interface{} {
+	return toInterfaceSlice(f.Value)
+}
+
+// LikePattern 返回 LIKE 系列操作符对应的 LIKE 模式, STARTS_WITH 等操作符的值会先转义
+func (f FilterSpec) LikePattern() (string, bool) {
+	value, ok := f.Value.(string)
+	if !ok {
+		return "", false
+	}
+	switch f.FilterType {
+	case FilterType_LIKE, FilterType_NOT_LIKE:
+		return value, true
+	case FilterType_STARTS_WITH:
+		return EscapeLike(value) + "%", true
+	case FilterType_ENDS_WITH:
+		return "%" + EscapeLike(value), true
+	case FilterType_CONTAINS:
+		return "%" + EscapeLike(value) + "%", true
+	default:
+		return "", false
+	}
+}
+
+// Exists EXISTS 操作符要求的结果, Value 为 nil 时视为 true
+func (f FilterSpec) Exists() bool {
+	exists, ok := f.Value.(bool)
+	return !ok || exists
+}
+
+// EscapeLike 转义 LIKE 模式中的 \ % _, 使其按字面量匹配
+func EscapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// LikeToRegex 将 LIKE 模式(% _ 及 \ 转义)转换为锚定首尾的正则
+func LikeToRegex(pattern string) string {
+	var builder strings.Builder
+	builder.WriteString("^")
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			builder.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '%':
+			builder.WriteString(".*")
+		case r == '_':
+			builder.WriteString(".")
+		default:
+			builder.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	builder.WriteString("$")
+	return builder.String()
+}
+
+func (f FilterSpec) buildSQLExpression(dialect SQLDialect, columns map[string]clause.Column) (clause.Expression, error) {
+	column, ok := columns[f.Column]
+	if !ok {
+		column = clause.Column{Name: f.Column}
+	}
+	if isGeoFilter(f.FilterType) {
+		if radius, ok := f.Value.(GeoRadius); ok && radius.Radius <= 0 {
+			return clause.Expr{SQL: "? IS NOT NULL", Vars: []interface{}{column}}, nil
+		}
+		return dialect.Geo(column, f.Value)
+	}
+	switch f.FilterType {
+	case FilterType_IS_NULL:
+		return clause.Expr{SQL: "? IS NULL", Vars: []interface{}{column}}, nil
+	case FilterType_IS_NOT_NULL:
+		return clause.Expr{SQL: "? IS NOT NULL", Vars: []interface{}{column}}, nil
+	case FilterType_EXISTS:
+		if f.Exists() {
+			return clause.Expr{SQL: "? IS NOT NULL", Vars: []interface{}{column}}, nil
+		}
+		return clause.Expr{SQL: "? IS NULL", Vars: []interface{}{column}}, nil
+	case FilterType_BETWEEN:
+		values := f.Values()
+		return clause.Expr{SQL: "? BETWEEN ? AND ?", Vars: []interface{}{column, values[0], values[1]}}, nil
+	case FilterType_LIKE, FilterType_STARTS_WITH, FilterType_ENDS_WITH, FilterType_CONTAINS, FilterType_NOT_LIKE:
+		pattern, _ := f.LikePattern()
+		return dialect.Like(column, pattern, f.FilterType == FilterType_NOT_LIKE), nil
+	case FilterType_REGEX:
+		pattern, _ := f.Value.(string)
+		return dialect.Regex(column, pattern)
+	case FilterType_IN, FilterType_NOT_IN:
+		return dialect.In(column, f.Values(), f.FilterType == FilterType_NOT_IN), nil
+	case FilterType_ARRAY_CONTAINS:
+		return dialect.ArrayContains(column, f.Values()), nil
+	case FilterType_ARRAY_CONTAINS_ANY:
+		var expressions []clause.Expression
+		for _, value := range f.Values() {
+			expressions = append(expressions, dialect.ArrayContains(column, value))
+		}
+		if len(expressions) == 1 {
+			return expressions[0], nil
+		}
+		return clause.Or(expressions...), nil
+	default:
+		return clause.Expr{
+			SQL:  fmt.Sprintf("? %s ?", toSQLComparator(f.FilterType)),
+			Vars: []interface{}{column, f.Value},
+		}, nil
+	}
+}
+
+func toSQLComparator(filterType FilterType) string {
+	switch filterType {
+	case FilterType_EQ:
+		return "="
+	case FilterType_NE:
+		return "<>"
+	case FilterType_GT:
+		return ">"
+	case FilterType_GTE:
+		return ">="
+	case FilterType_LT:
+		return "<"
+	case FilterType_LTE:
+		return "<="
+	default:
+		panic("unsupported filter type")
+	}
+}
+
+// jsonString 转换为 JSON 文本, 用于 JSON 列的比较与审计记录
+func jsonString(value interface{}) string {
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// buildMongoCondition 返回单个过滤条件中列名对应的条件文档
+func (f FilterSpec) buildMongoCondition() bson.D {
+	if isGeoFilter(f.FilterType) {
+		return f.buildGeoMongoCondition()
+	}
+	switch f.FilterType {
+	case FilterType_NE, FilterType_IS_NOT_NULL:
+		return bson.D{{Key: "$ne", Value: f.Value}}
+	case FilterType_GT:
+		return bson.D{{Key: "$gt", Value: f.Value}}
+	case FilterType_GTE:
+		return bson.D{{Key: "$gte", Value: f.Value}}
+	case FilterType_LT:
+		return bson.D{{Key: "$lt", Value: f.Value}}
+	case FilterType_LTE:
+		return bson.D{{Key: "$lte", Value: f.Value}}
+	case FilterType_IN:
+		return bson.D{{Key: "$in", Value: f.Value}}
+	case FilterType_NOT_IN:
+		return bson.D{{Key: "$nin", Value: f.Value}}
+	case FilterType_BETWEEN:
+		values := f.Values()
+		return bson.D{{Key: "$gte", Value: values[0]}, {Key: "$lte", Value: values[1]}}
+	case FilterType_LIKE, FilterType_STARTS_WITH, FilterType_ENDS_WITH, FilterType_CONTAINS:
+		// MongoDB使用正则表达式来实现LIKE功能
+		pattern, _ := f.LikePattern()
+		return bson.D{{Key: "$regex", Value: primitive.Regex{Pattern: LikeToRegex(pattern), Options: "is"}}}
+	case FilterType_NOT_LIKE:
+		pattern, _ := f.LikePattern()
+		return bson.D{{Key: "$ne", Value: nil}, {Key: "$not", Value: primitive.Regex{Pattern: LikeToRegex(pattern), Options: "is"}}}
+	case FilterType_REGEX:
+		return bson.D{{Key: "$regex", Value: primitive.Regex{Pattern: f.Value.(string)}}}
+	case FilterType_ARRAY_CONTAINS:
+		return bson.D{{Key: "$all", Value: f.Values()}}
+	case FilterType_ARRAY_CONTAINS_ANY:
+		return bson.D{{Key: "$elemMatch", Value: bson.D{{Key: "$in", Value: f.Values()}}}}
+	case FilterType_EXISTS:
+		if f.Exists() {
+			return bson.D{{Key: "$exists", Value: true}, {Key: "$ne", Value: nil}}
+		}
+		return bson.D{{Key: "$eq", Value: nil}}
+	default:
+		return bson.D{{Key: "$eq", Value: f.Value}}
+	}
+}
@@ -0,0 +1,66 @@
+package repository_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/henrion-y/base.services/domain/repository"
+	"github.com/henrion-y/base.services/domain/repository/memrepo"
+)
+
+// 装饰器与公共函数的测试以 memrepo 作为被装饰的仓储
+
+type User struct {
+	ID    int        `json:"id" gorm:"primary_key"`
+	Name  string     `json:"name" gorm:"name"`
+	Age   int        `json:"age" gorm:"age"`
+	Ctime time.Time  `json:"ctime" gorm:"update_time_stamp"`
+	Dtime *time.Time `json:"dtime" gorm:"dtime"`
+}
+
+func (t *User) TableName() string {
+	return "t_user_repository"
+}
+
+func newRepo(t *testing.T) repository.BaseRepository {
+	repo := memrepo.NewBaseRepository()
+	now := time.Now()
+	users := []*User{
+		{Name: "张飞", Age: 28, Ctime: now},
+		{Name: "关羽", Age: 21, Ctime: now.Add(time.Second)},
+		{Name: "刘备", Age: 30, Ctime: now.Add(2 * time.Second), Dtime: &now},
+		{Name: "赵云", Age: 21, Ctime: now.Add(3 * time.Second)},
+	}
+	for _, user := range users {
+		if err := repo.Create(context.Background(), user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return repo
+}
+
+func findNames(t *testing.T, repo repository.BaseRepository, filterGroup *repository.FilterGroup, sortSpecs *repository.SortSpecs, limitSpec *repository.LimitSpec) []string {
+	var list []User
+	err := repo.Find(context.Background(), &User{}, &list, nil, filterGroup, sortSpecs, limitSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, user := range list {
+		names = append(names, user.Name)
+	}
+	return names
+}
+
+func assertNames(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package repository
+
+import (
+	"context"
+	"reflect"
+)
+
+// Repository 基于 BaseRepository 的泛型仓储, 省去调用方传 Model 与 interface{} 结果再做类型转换.
+// T 为模型类型, 一般使用指针类型, 如 Repository[*User]
+type Repository[T Model] struct {
+	base BaseRepository
+}
+
+// NewRepository 使用任意 BaseRepository 实现(gormrepo、mongorepo 等)创建泛型仓储
+func NewRepository[T Model](base BaseRepository) *Repository[T] {
+	return &Repository[T]{base: base}
+}
+
+// Base 返回底层的 BaseRepository
+func (r *Repository[T]) Base() BaseRepository {
+	return r.base
+}
+
+func (r *Repository[T]) Create(ctx context.Context, mod T) error {
+	return r.base.Create(ctx, mod)
+}
+
+// CreateBatch 批量插入, 返回每批插入的行数
+func (r *Repository[T]) CreateBatch(ctx context.Context, models []T, batchSize int) ([]int64, error) {
+	return r.base.CreateBatch(ctx, models, batchSize)
+}
+
+// Upsert 按 conflictColumns 插入或更新, 见 BaseRepository.Upsert
+func (r *Repository[T]) Upsert(ctx context.Context, mod T, conflictColumns []string, updateColumns []string) (int64, error) {
+	return r.base.Upsert(ctx, mod, conflictColumns, updateColumns)
+}
+
+func (r *Repository[T]) Update(ctx context.Context, data map[string]interface{}, filterGroup *FilterGroup) (int64, error) {
+	return r.base.Update(ctx, newModel[T](), data, filterGroup)
+}
+
+// UpdateWithVersion 以 mod 当前的版本作为乐观锁条件更新, 成功后 mod 的版本加 1, 见 VersionModel
+func (r *Repository[T]) UpdateWithVersion(ctx context.Context, mod T, data map[string]interface{}, filterGroup *FilterGroup) (int64, error) {
+	return r.base.Update(ctx, mod, data, filterGroup)
+}
+
+func (r *Repository[T]) Delete(ctx context.Context, filterGroup *FilterGroup) error {
+	return r.base.Delete(ctx, newModel[T](), filterGroup)
+}
+
+// Restore 恢复软删除的记录, 见 BaseRepository.Restore
+func (r *Repository[T]) Restore(ctx context.Context, filterGroup *FilterGroup) (int64, error) {
+	return r.base.Restore(ctx, newModel[T](), filterGroup)
+}
+
+func (r *Repository[T]) Count(ctx context.Context, filterGroup *FilterGroup) (int64, error) {
+	return r.base.Count(ctx, newModel[T](), filterGroup)
+}
+
+func (r *Repository[T]) Exists(ctx context.Context, filterGroup *FilterGroup) (bool, error) {
+	return r.base.Exists(ctx, newModel[T](), filterGroup)
+}
+
+// Distinct 查询 column 的不重复值, result 为切片指针, 如 *[]string
+func (r *Repository[T]) Distinct(ctx context.Context, column string, result interface{}, filterGroup *FilterGroup) error {
+	return r.base.Distinct(ctx, newModel[T](), column, result, filterGroup)
+}
+
+// FindByIDs 按主键批量查询, ids 为切片, 见 BaseRepository.FindByIDs
+func (r *Repository[T]) FindByIDs(ctx context.Context, ids interface{}) ([]T, error) {
+	var list []T
+	if err := r.base.FindByIDs(ctx, newModel[T](), &list, ids); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Find 按条件查询列表, 游标翻页时 limitSpec.NextCursor 会被回填
+func (r *Repository[T]) Find(ctx context.Context, fields []string, filterGroup *FilterGroup, sortSpecs *SortSpecs, limitSpec *LimitSpec) ([]T, error) {
+	var list []T
+	err := r.base.Find(ctx, newModel[T](), &list, fields, filterGroup, sortSpecs, limitSpec)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// FindWithDeleted 与 Find 相同, 但结果包含软删除的记录
+func (r *Repository[T]) FindWithDeleted(ctx context.Context, fields []string, filterGroup *FilterGroup, sortSpecs *SortSpecs, limitSpec *LimitSpec) ([]T, error) {
+	var list []T
+	err := r.base.FindWithDeleted(ctx, newModel[T](), &list, fields, filterGroup, sortSpecs, limitSpec)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// FindAll 按条件查询全部记录
+func (r *Repository[T]) FindAll(ctx context.Context, filterGroup *FilterGroup, sortSpecs *SortSpecs) ([]T, error) {
+	return r.Find(ctx, nil, filterGroup, sortSpecs, nil)
+}
+
+// FindEach 分批遍历查询结果, fn 返回 ErrStopIteration 时提前结束, 见 BaseRepository.FindEach
+func (r *Repository[T]) FindEach(ctx context.Context, fields []string, filterGroup *FilterGroup, sortSpecs *SortSpecs, batchSize int, fn func(batch []T) error) error {
+	var batch []T
+	return r.base.FindEach(ctx, newModel[T](), &batch, fields, filterGroup, sortSpecs, batchSize, func() error {
+		return fn(batch)
+	})
+}
+
+// Get 查询一条记录, 第二个返回值表示是否找到
+func (r *Repository[T]) Get(ctx context.Context, filterGroup *FilterGroup) (T, bool, error) {
+	return r.GetSorted(ctx, nil, filterGroup, nil)
+}
+
+// GetSorted 按排序查询第一条记录, 第二个返回值表示是否找到
+func (r *Repository[T]) GetSorted(ctx context.Context, fields []string, filterGroup *FilterGroup, sortSpecs *SortSpecs) (T, bool, error) {
+	var zero T
+	// FindOne 在记录不存在时不返回错误, 这里用 Find 取一条来区分是否找到
+	list, err := r.Find(ctx, fields, filterGroup, sortSpecs, NewLimitSpec(0, 1))
+	if err != nil || len(list) == 0 {
+		return zero, false, err
+	}
+	return list[0], true, nil
+}
+
+// FindPage 分页查询, 同时返回列表与翻页信息, Page.Items 指向返回的列表, 见 BaseRepository.FindPage
+func (r *Repository[T]) FindPage(ctx context.Context, fields []string, filterGroup *FilterGroup, sortSpecs *SortSpecs, limitSpec *LimitSpec) ([]T, *Page, error) {
+	var list []T
+	page, err := r.base.FindPage(ctx, newModel[T](), &list, fields, filterGroup, sortSpecs, limitSpec)
+	if err != nil {
+		return nil, nil, err
+	}
+	return list, page, nil
+}
+
+// Aggregate 分组聚合查询, 聚合结果与模型结构不同, result 仍由调用方传入切片指针
+func (r *Repository[T]) Aggregate(ctx context.Context, result interface{}, filterGroup *FilterGroup, aggregateSpec *AggregateSpec, sortSpecs *SortSpecs, limitSpec *LimitSpec) error {
+	return r.base.Aggregate(ctx, newModel[T](), result, filterGroup, aggregateSpec, sortSpecs, limitSpec)
+}
+
+// WithTransaction 在事务中执行 fn, 见 BaseRepository.WithTransaction
+func (r *Repository[T]) WithTransaction(ctx context.Context, fn func(txRepo *Repository[T]) error) error {
+	return r.base.WithTransaction(ctx, func(txRepo BaseRepository) error {
+		return fn(NewRepository[T](txRepo))
+	})
+}
+
+// newModel 构造用于获取表名等信息的模型实例, 指针类型会分配一个零值对象
+func newModel[T Model]() T {
+	var mod T
+	if typ := reflect.TypeOf(mod); typ != nil && typ.Kind() == reflect.Ptr {
+		mod = reflect.New(typ.Elem()).Interface().(T)
+	}
+	return mod
+}
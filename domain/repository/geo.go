@@ -0,0 +1,311 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/henrion-y/base.services/infra/geo"
+)
+
+/********* 地理位置 ***********/
+
+/*
+地理位置过滤与距离排序, 坐标使用 geo.Coordinate, 距离单位为米. 各实现对位置列的要求:
+1. MySQL: 列为 POINT 类型, 按 POINT(经度, 纬度) 存储, SRID 为 0. 半径使用 ST_Distance_Sphere, 矩形使用 MBRContains, 多边形使用 ST_Contains;
+   PostgreSQL 依赖 PostGIS, 列为 geometry(Point, 4326), 使用 ST_DistanceSphere 与 ST_Contains; SQLite 不支持, 见 dialect.go
+2. Mongo: 列为 GeoJSON Point(见 GeoPoint). 半径使用 $geoWithin + $centerSphere, 矩形与多边形使用 $geoWithin + $geometry, NEAR 使用 $nearSphere(需要 2dsphere 索引)
+3. Elasticsearch: 列为 geo_point
+4. memrepo: 列为 geo.Coordinate、GeoPoint 或 [经度, 纬度] 切片
+
+NEAR 与 WITHIN_RADIUS 都按球面距离过滤, NEAR 的半径为 0 时不限距离. Mongo 的 $nearSphere 会按距离由近到远返回,
+但不能用于 Count、聚合与更新, mongorepo 在这些场景下会把 NEAR 换成 WITHIN_RADIUS(见 ReplaceNear); 需要按距离排序时使用 SortSpecs.AddDistance
+*/
+
+const (
+	FilterType_NEAR           FilterType = "NEAR"           // 距离 center 不超过 Radius, Value 为 GeoRadius
+	FilterType_WITHIN_RADIUS  FilterType = "WITHIN_RADIUS"  // 在圆形范围内, Value 为 GeoRadius
+	FilterType_WITHIN_BOX     FilterType = "WITHIN_BOX"     // 在矩形范围内, Value 为 GeoBox
+	FilterType_WITHIN_POLYGON FilterType = "WITHIN_POLYGON" // 在多边形范围内, Value 为 GeoPolygon
+)
+
+var ErrDistanceSortNotSupported = errors.New("distance sort must be the first ascending sort in mongo")
+
+// GeoRadius 圆形范围, Radius 单位为米
+type GeoRadius struct {
+	Center geo.Coordinate
+	Radius float64
+}
+
+// GeoBox 矩形范围, Min 为西南角, Max 为东北角
+type GeoBox struct {
+	Min geo.Coordinate
+	Max geo.Coordinate
+}
+
+// GeoPolygon 多边形的顶点, 首尾不需要重复
+type GeoPolygon []geo.Coordinate
+
+// GeoPoint GeoJSON Point, mongo 中的位置列使用该结构存储
+type GeoPoint struct {
+	Type        string    `json:"type" bson:"type"`
+	Coordinates []float64 `json:"coordinates" bson:"coordinates"` // [经度, 纬度]
+}
+
+func NewGeoPoint(coordinate geo.Coordinate) GeoPoint {
+	return GeoPoint{Type: "Point", Coordinates: []float64{coordinate.Lon, coordinate.Lat}}
+}
+
+// Near 添加一个距离 center 不超过 maxDistance 米的过滤条件, maxDistance 为 0 时不限距离
+func (g *FilterGroup) Near(column string, center geo.Coordinate, maxDistance float64) *FilterGroup {
+	return g.AddFilter(column, FilterType_NEAR, GeoRadius{Center: center, Radius: maxDistance})
+}
+
+// WithinRadius 添加一个在圆形范围内的过滤条件, radius 单位为米
+func (g *FilterGroup) WithinRadius(column string, center geo.Coordinate, radius float64) *FilterGroup {
+	return g.AddFilter(column, FilterType_WITHIN_RADIUS, GeoRadius{Center: center, Radius: radius})
+}
+
+// WithinBox 添加一个在矩形范围内的过滤条件, min 为西南角, max 为东北角
+func (g *FilterGroup) WithinBox(column string, min geo.Coordinate, max geo.Coordinate) *FilterGroup {
+	return g.AddFilter(column, FilterType_WITHIN_BOX, GeoBox{Min: min, Max: max})
+}
+
+// WithinPolygon 添加一个在多边形范围内的过滤条件
+func (g *FilterGroup) WithinPolygon(column string, points ...geo.Coordinate) *FilterGroup {
+	return g.AddFilter(column, FilterType_WITHIN_POLYGON, GeoPolygon(points))
+}
+
+// AddDistance 按 property 列到 center 的距离排序
+func (s *SortSpecs) AddDistance(property string, center geo.Coordinate, sortType SortType) *SortSpecs {
+	*s = append(*s, SortSpec{Property: property, Type: sortType, Near: &center})
+	return s
+}
+
+// HasDistance 是否包含距离排序
+func (s *SortSpecs) HasDistance() bool {
+	if s == nil {
+		return false
+	}
+	for _, spec := range *s {
+		if spec.Near != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Contains 判断坐标是否在圆形范围内, Radius 为 0 时不限距离
+func (r GeoRadius) Contains(coordinate geo.Coordinate) bool {
+	return r.Radius <= 0 || r.Center.DistanceTo(coordinate) <= r.Radius
+}
+
+// Contains 判断坐标是否在矩形范围内, 含边界
+func (b GeoBox) Contains(coordinate geo.Coordinate) bool {
+	return coordinate.Lon >= b.Min.Lon && coordinate.Lon <= b.Max.Lon &&
+		coordinate.Lat >= b.Min.Lat && coordinate.Lat <= b.Max.Lat
+}
+
+// Contains 判断坐标是否在多边形内(射线法, 按平面坐标计算)
+func (p GeoPolygon) Contains(coordinate geo.Coordinate) bool {
+	inside := false
+	for i, j := 0, len(p)-1; i < len(p); j, i = i, i+1 {
+		a, b := p[i], p[j]
+		if (a.Lat > coordinate.Lat) != (b.Lat > coordinate.Lat) &&
+			coordinate.Lon < (b.Lon-a.Lon)*(coordinate.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lon {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// ToCoordinate 将位置列的值转换为坐标, 支持 geo.Coordinate、GeoPoint 与 [经度, 纬度] 切片
+func ToCoordinate(value interface{}) (geo.Coordinate, bool) {
+	switch v := value.(type) {
+	case geo.Coordinate:
+		return v, true
+	case *geo.Coordinate:
+		if v != nil {
+			return *v, true
+		}
+	case GeoPoint:
+		return lonLat(v.Coordinates)
+	case *GeoPoint:
+		if v != nil {
+			return lonLat(v.Coordinates)
+		}
+	default:
+		rv := reflect.ValueOf(value)
+		if (rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array) && rv.Len() == 2 &&
+			rv.Index(0).Kind() == reflect.Float64 {
+			return geo.Coordinate{Lon: rv.Index(0).Float(), Lat: rv.Index(1).Float()}, true
+		}
+	}
+	return geo.Coordinate{}, false
+}
+
+func lonLat(coordinates []float64) (geo.Coordinate, bool) {
+	if len(coordinates) != 2 {
+		return geo.Coordinate{}, false
+	}
+	return geo.Coordinate{Lon: coordinates[0], Lat: coordinates[1]}, true
+}
+
+// ReplaceNear 返回把 NEAR 换成 WITHIN_RADIUS(不限距离时换成 EXISTS)的副本, 用于不支持 $nearSphere 的场景, 没有 NEAR 时原样返回
+func ReplaceNear(filterGroup *FilterGroup) *FilterGroup {
+	if filterGroup == nil || !hasNear(filterGroup) {
+		return filterGroup
+	}
+	group := &FilterGroup{Logic: filterGroup.Logic}
+	for _, filter := range filterGroup.Filters {
+		if filter.FilterType == FilterType_NEAR {
+			filter = nearToWithin(filter)
+		}
+		group.Filters = append(group.Filters, filter)
+	}
+	for _, subGroup := range filterGroup.Groups {
+		group.Groups = append(group.Groups, ReplaceNear(subGroup))
+	}
+	return group
+}
+
+func nearToWithin(filter FilterSpec) FilterSpec {
+	if radius, _ := filter.Value.(GeoRadius); radius.Radius <= 0 {
+		return FilterSpec{Column: filter.Column, FilterType: FilterType_EXISTS, Value: true}
+	}
+	filter.FilterType = FilterType_WITHIN_RADIUS
+	return filter
+}
+
+func hasNear(filterGroup *FilterGroup) bool {
+	for _, filter := range filterGroup.Filters {
+		if filter.FilterType == FilterType_NEAR {
+			return true
+		}
+	}
+	for _, subGroup := range filterGroup.Groups {
+		if subGroup != nil && hasNear(subGroup) {
+			return true
+		}
+	}
+	return false
+}
+
+// BuildMongoDistanceSort mongo 的 sort 不支持按距离排序, 改为追加不限距离的 NEAR 条件由 $nearSphere 排序.
+// 距离排序必须是第一个且为升序, 之后的排序字段会覆盖 $nearSphere 的顺序, 因此被忽略; 过滤组顶层已有同列同中心的 NEAR 时不再追加
+func BuildMongoDistanceSort(filterGroup *FilterGroup, sortSpecs *SortSpecs) (*FilterGroup, *SortSpecs, error) {
+	if !sortSpecs.HasDistance() {
+		return filterGroup, sortSpecs, nil
+	}
+	first := (*sortSpecs)[0]
+	if first.Near == nil || first.Type == SortType_DESC {
+		return nil, nil, ErrDistanceSortNotSupported
+	}
+	if filterGroup != nil {
+		for i, filter := range filterGroup.Filters {
+			radius, _ := filter.Value.(GeoRadius)
+			if filter.FilterType == FilterType_NEAR && filter.Column == first.Property && radius.Center == *first.Near {
+				return replaceNearExcept(filterGroup, i), nil, nil
+			}
+		}
+	}
+	// 其余 NEAR 换成 WITHIN_RADIUS, 一个查询只能有一个 $nearSphere
+	return withFilter(NewFilterGroup().Near(first.Property, *first.Near, 0), ReplaceNear(filterGroup)), nil, nil
+}
+
+// replaceNearExcept 与 ReplaceNear 相同, 但保留顶层第 keep 个过滤条件
+func replaceNearExcept(filterGroup *FilterGroup, keep int) *FilterGroup {
+	group := ReplaceNear(filterGroup)
+	group.Filters[keep] = filterGroup.Filters[keep]
+	return group
+}
+
+func (f FilterSpec) validateGeo() error {
+	switch f.FilterType {
+	case FilterType_NEAR, FilterType_WITHIN_RADIUS:
+		radius, ok := f.Value.(GeoRadius)
+		if !ok {
+			return f.invalid("must be a GeoRadius")
+		}
+		if radius.Radius < 0 || radius.Radius == 0 && f.FilterType == FilterType_WITHIN_RADIUS {
+			return f.invalid("requires a positive radius")
+		}
+	case FilterType_WITHIN_BOX:
+		box, ok := f.Value.(GeoBox)
+		if !ok {
+			return f.invalid("must be a GeoBox")
+		}
+		if box.Min.Lat > box.Max.Lat || box.Min.Lon > box.Max.Lon {
+			return f.invalid("requires min to be the south-west corner")
+		}
+	case FilterType_WITHIN_POLYGON:
+		polygon, ok := f.Value.(GeoPolygon)
+		if !ok {
+			return f.invalid("must be a GeoPolygon")
+		}
+		if len(polygon) < 3 {
+			return f.invalid("requires at least three points")
+		}
+	}
+	return nil
+}
+
+func isGeoFilter(filterType FilterType) bool {
+	switch filterType {
+	case FilterType_NEAR, FilterType_WITHIN_RADIUS, FilterType_WITHIN_BOX, FilterType_WITHIN_POLYGON:
+		return true
+	}
+	return false
+}
+
+func (f FilterSpec) buildGeoMongoCondition() bson.D {
+	switch value := f.Value.(type) {
+	case GeoRadius:
+		if f.FilterType == FilterType_NEAR {
+			near := bson.D{{Key: "$geometry", Value: NewGeoPoint(value.Center)}}
+			if value.Radius > 0 {
+				near = append(near, bson.E{Key: "$maxDistance", Value: value.Radius})
+			}
+			return bson.D{{Key: "$nearSphere", Value: near}}
+		}
+		// $centerSphere 的半径单位为弧度
+		center := bson.A{bson.A{value.Center.Lon, value.Center.Lat}, value.Radius / geo.EarthRadius}
+		return bson.D{{Key: "$geoWithin", Value: bson.D{{Key: "$centerSphere", Value: center}}}}
+	case GeoBox:
+		polygon := GeoPolygon{value.Min, {Lat: value.Min.Lat, Lon: value.Max.Lon}, value.Max, {Lat: value.Max.Lat, Lon: value.Min.Lon}}
+		return polygon.mongoWithin()
+	case GeoPolygon:
+		return value.mongoWithin()
+	default:
+		panic("unsupported geo filter value")
+	}
+}
+
+func (p GeoPolygon) mongoWithin() bson.D {
+	ring := make(bson.A, 0, len(p)+1)
+	for _, point := range p.closed() {
+		ring = append(ring, bson.A{point.Lon, point.Lat})
+	}
+	geometry := bson.D{{Key: "type", Value: "Polygon"}, {Key: "coordinates", Value: bson.A{ring}}}
+	return bson.D{{Key: "$geoWithin", Value: bson.D{{Key: "$geometry", Value: geometry}}}}
+}
+
+// closed 返回首尾相同的闭合顶点
+func (p GeoPolygon) closed() GeoPolygon {
+	if len(p) > 0 && p[0] != p[len(p)-1] {
+		return append(p[:len(p):len(p)], p[0])
+	}
+	return p
+}
+
+// wkt 返回 POLYGON((经度 纬度, ...)) 形式的 WKT
+func (p GeoPolygon) wkt() string {
+	points := make([]string, 0, len(p)+1)
+	for _, point := range p.closed() {
+		points = append(points, fmt.Sprintf("%g %g", point.Lon, point.Lat))
+	}
+	return "POLYGON((" + strings.Join(points, ", ") + "))"
+}
@@ -0,0 +1,38 @@
+package gormrepo
+
+import (
+	"strings"
+	"testing"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+
+	"github.com/henrion-y/base.services/domain/repository"
+)
+
+// newPostgresDryRun 返回只生成 SQL 不连接数据库的 PostgreSQL 会话
+func newPostgresDryRun(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=127.0.0.1 user=test dbname=test"}),
+		&gorm.Config{DryRun: true, DisableAutomaticPing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestPostgres_AggregateHaving(t *testing.T) {
+	db := newPostgresDryRun(t)
+	aggregateSpec := repository.NewAggregateSpec("user_id").Sum("amount", "total").Count("cnt").
+		SetHaving(repository.NewFilterGroup().GreaterThan("total", 100).GreaterThan("cnt", 1).Equals("user_id", 1))
+
+	var result []map[string]interface{}
+	stmt := aggregateSpec.BuildToSQL(db.Table("t_order")).Find(&result).Statement
+	if stmt.Error != nil {
+		t.Fatal(stmt.Error)
+	}
+	// HAVING 中的别名替换为聚合表达式, 分组列不变
+	want := `HAVING SUM("amount") > $1 AND COUNT(*) > $2 AND "user_id" = $3`
+	if sql := stmt.SQL.String(); !strings.Contains(sql, want) {
+		t.Fatalf("expect %s, got %s", want, sql)
+	}
+}
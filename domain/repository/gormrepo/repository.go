@@ -2,38 +2,220 @@ package gormrepo
 
 import (
 	"context"
+	"strings"
+	"time"
+
 	"go.uber.org/zap"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"github.com/henrion-y/base.services/domain/repository"
 	"github.com/henrion-y/base.services/infra/zlog"
 )
 
+// SessionResolver 返回绑定 ctx 的会话, 可按 ctx 选择主库或从库, 如 database/gorm.Resolver
+type SessionResolver interface {
+	Session(ctx context.Context, db *gorm.DB) *gorm.DB
+}
+
+// contextResolver 默认的 SessionResolver, 只绑定 ctx
+type contextResolver struct{}
+
+func (contextResolver) Session(ctx context.Context, db *gorm.DB) *gorm.DB {
+	return db.WithContext(ctx)
+}
+
 type gormRepository struct {
-	Db *gorm.DB
+	Db       *gorm.DB
+	resolver SessionResolver
+	inTx     bool // 是否为事务内的仓储
 }
 
 func NewBaseRepository(db *gorm.DB) repository.BaseRepository {
-	return &gormRepository{Db: db}
+	return NewBaseRepositoryWithResolver(db, nil)
+}
+
+// NewBaseRepositoryWithResolver 读写均通过 resolver 获取会话, 配置了从库时传入 database/gorm.Resolver 使 WithPrimary 生效;
+// resolver 为 nil 时只绑定 ctx
+func NewBaseRepositoryWithResolver(db *gorm.DB, resolver SessionResolver) repository.BaseRepository {
+	if resolver == nil {
+		resolver = contextResolver{}
+	}
+	return &gormRepository{Db: db, resolver: resolver}
+}
+
+// session 返回绑定 ctx 的会话, 事务内的仓储使用事务的连接
+func (r *gormRepository) session(ctx context.Context) *gorm.DB {
+	return r.resolver.Session(ctx, r.Db)
 }
 
 func (r *gormRepository) Create(ctx context.Context, mod repository.Model) error {
-	err := r.Db.Create(mod).Error
+	repository.InitVersion(mod)
+	// 显式指定表名, 使按实例返回表名的模型(如 AuditLog、OutboxEvent)写入配置的表
+	err := r.session(ctx).Table(mod.TableName()).Create(mod).Error
 	if err != nil {
 		zlog.Error("gormRepo.Create", zap.Any("mod", mod), zap.Error(err))
 	}
 	return err
 }
 
+// CreateBatch 与 gorm CreateInBatches 一样在事务中逐批插入, 任一批失败时整体回滚.
+// 这里自行分批是为了拿到每批的 RowsAffected
+func (r *gormRepository) CreateBatch(ctx context.Context, models interface{}, batchSize int) ([]int64, error) {
+	batches, err := repository.SplitBatches(models, batchSize)
+	if err != nil || len(batches) == 0 {
+		return nil, err
+	}
+
+	var counts []int64
+	createBatches := func(tx *gorm.DB) error {
+		counts = make([]int64, 0, len(batches))
+		for _, batch := range batches {
+			for _, item := range batch.Items {
+				repository.InitVersion(item)
+			}
+			result := tx.Table(batch.Items[0].TableName()).Create(batch.Models)
+			if result.Error != nil {
+				return result.Error
+			}
+			counts = append(counts, result.RowsAffected)
+		}
+		return nil
+	}
+
+	if r.inTx {
+		err = createBatches(r.session(ctx))
+	} else {
+		err = r.session(ctx).Transaction(createBatches)
+	}
+	if err != nil {
+		zlog.Error("gormRepo.CreateBatch", zap.Int("batchSize", batchSize), zap.Int("batches", len(batches)), zap.Error(err))
+		// 事务已回滚, 没有成功写入的批次
+		return nil, err
+	}
+	return counts, nil
+}
+
+func (r *gormRepository) Upsert(ctx context.Context, mod repository.Model, conflictColumns []string, updateColumns []string) (int64, error) {
+	columns := repository.ModelColumns(mod)
+	err := columns.Check(conflictColumns...)
+	if err == nil {
+		err = columns.Check(updateColumns...)
+	}
+	if err != nil {
+		zlog.Error("gormRepo.Upsert", zap.Any("mod", mod), zap.Error(err))
+		return 0, err
+	}
+
+	session := r.session(ctx)
+	onConflict := clause.OnConflict{}
+	for _, column := range conflictColumns {
+		onConflict.Columns = append(onConflict.Columns, clause.Column{Name: column})
+	}
+	if versionColumn, ok := repository.VersionColumn(mod); ok {
+		// 乐观锁: 插入时版本为 1, 冲突时版本在原值上加 1, 不使用模型中的版本
+		repository.InitVersion(mod)
+		onConflict.DoUpdates, err = versionedUpdates(session, mod, conflictColumns, updateColumns, versionColumn)
+		if err != nil {
+			zlog.Error("gormRepo.Upsert", zap.Any("mod", mod), zap.Error(err))
+			return 0, err
+		}
+	} else if len(updateColumns) > 0 {
+		onConflict.DoUpdates = clause.AssignmentColumns(updateColumns)
+	} else {
+		onConflict.UpdateAll = true
+	}
+
+	tx := session.Table(mod.TableName()).Clauses(onConflict).Create(mod)
+	err = tx.Error
+	if err != nil {
+		zlog.Error("gormRepo.Upsert", zap.Any("mod", mod),
+			zap.Strings("conflictColumns", conflictColumns),
+			zap.Strings("updateColumns", updateColumns),
+			zap.Error(err))
+	}
+	return tx.RowsAffected, err
+}
+
+// versionedUpdates 返回开启乐观锁的模型冲突时的更新内容: 版本列为 版本 + 1, 其余列取插入的值;
+// updateColumns 为空时与 gorm 的 UpdateAll 一样更新除主键、冲突列、创建时间及数据库默认值列以外的全部列
+func versionedUpdates(db *gorm.DB, mod repository.Model, conflictColumns []string, updateColumns []string, versionColumn string) (clause.Set, error) {
+	if len(updateColumns) == 0 {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(mod); err != nil {
+			return nil, err
+		}
+		conflict := make(map[string]bool, len(conflictColumns))
+		for _, column := range conflictColumns {
+			conflict[column] = true
+		}
+		for _, field := range stmt.Schema.Fields {
+			if field.DBName == "" || field.PrimaryKey || conflict[field.DBName] || field.AutoCreateTime > 0 ||
+				field.HasDefaultValue && field.DefaultValueInterface == nil && !strings.EqualFold(field.DefaultValue, "NULL") {
+				continue
+			}
+			updateColumns = append(updateColumns, field.DBName)
+		}
+	}
+
+	var columns []string
+	for _, column := range updateColumns {
+		if column != versionColumn {
+			columns = append(columns, column)
+		}
+	}
+	version := clause.Column{Table: mod.TableName(), Name: versionColumn}
+	return append(clause.AssignmentColumns(columns),
+		clause.Assignment{Column: clause.Column{Name: versionColumn}, Value: gorm.Expr("? + 1", version)}), nil
+}
+
 func (r *gormRepository) Update(ctx context.Context, mod repository.Model, data map[string]interface{}, filterGroup *repository.FilterGroup) (int64, error) {
-	mysqlConn := r.Db.Table(mod.TableName())
+	filterGroup = repository.ExcludeDeleted(mod, filterGroup)
+	column, ok := repository.VersionColumn(mod)
+	if !ok {
+		return r.update(ctx, mod, data, filterGroup)
+	}
+
+	// 乐观锁: 以当前版本为条件, 版本在同一条语句中加 1
+	filterGroup, version := repository.VersionFilter(mod, filterGroup)
+	versionData := repository.WithUpdateOperator(data, repository.UpdateOperator_INC, column, 1)
+
+	rowsAffected, err := r.update(ctx, mod, versionData, filterGroup)
+	if err != nil {
+		return 0, err
+	}
+	if err = repository.CheckVersion(mod, version, rowsAffected); err != nil {
+		zlog.Error("gormRepo.Update", zap.Any("mod", mod), zap.Any("data", data), zap.Error(err))
+		return 0, err
+	}
+	return rowsAffected, nil
+}
+
+func (r *gormRepository) update(ctx context.Context, mod repository.Model, data map[string]interface{}, filterGroup *repository.FilterGroup) (int64, error) {
+	columns := repository.ModelColumns(mod)
+	err := columns.CheckData(data)
+	if err == nil {
+		err = columns.CheckFilter(filterGroup)
+	}
+	if err != nil {
+		zlog.Error("gormRepo.Update", zap.Any("mod", mod), zap.Any("data", data), zap.Error(err))
+		return 0, err
+	}
+
+	values, err := repository.BuildUpdateToSQL(repository.DialectOf(r.Db), data)
+	if err != nil {
+		zlog.Error("gormRepo.Update", zap.Any("mod", mod), zap.Any("data", data), zap.Error(err))
+		return 0, err
+	}
+
+	mysqlConn := r.session(ctx).Table(mod.TableName())
 
 	if filterGroup != nil {
-		mysqlConn = filterGroup.BuildToMysql(mysqlConn)
+		mysqlConn = filterGroup.BuildToSQL(mysqlConn)
 	}
 
-	tx := mysqlConn.Updates(data)
-	err := tx.Error
+	tx := mysqlConn.Updates(values)
+	err = tx.Error
 	if err != nil {
 		zlog.Error("gormRepo.Update", zap.Any("mod", mod), zap.Any("data", data), zap.Any("filterGroup", filterGroup), zap.Error(err))
 	}
@@ -42,34 +224,85 @@ func (r *gormRepository) Update(ctx context.Context, mod repository.Model, data
 }
 
 func (r *gormRepository) Delete(ctx context.Context, mod repository.Model, filterGroup *repository.FilterGroup) error {
-	mysqlConn := r.Db.Table(mod.TableName())
+	if column, ok := repository.SoftDeleteColumn(mod); ok {
+		_, err := r.Update(ctx, mod, map[string]interface{}{column: time.Now()}, filterGroup)
+		return err
+	}
+
+	err := repository.ModelColumns(mod).CheckFilter(filterGroup)
+	if err != nil {
+		zlog.Error("gormRepo.Delete", zap.Any("mod", mod), zap.Error(err))
+		return err
+	}
+
+	mysqlConn := r.session(ctx).Table(mod.TableName())
 
 	if filterGroup != nil {
-		mysqlConn = filterGroup.BuildToMysql(mysqlConn)
+		mysqlConn = filterGroup.BuildToSQL(mysqlConn)
 	}
 
-	err := mysqlConn.Delete(mod).Error
+	err = mysqlConn.Delete(mod).Error
 	if err != nil {
 		zlog.Error("gormRepo.Delete", zap.Any("mod", mod), zap.Any("filterGroup", filterGroup), zap.Error(err))
 	}
 	return err
 }
 
+func (r *gormRepository) Restore(ctx context.Context, mod repository.Model, filterGroup *repository.FilterGroup) (int64, error) {
+	filterGroup, err := repository.OnlyDeleted(mod, filterGroup)
+	if err != nil {
+		zlog.Error("gormRepo.Restore", zap.Any("mod", mod), zap.Error(err))
+		return 0, err
+	}
+	column, _ := repository.SoftDeleteColumn(mod)
+	return r.update(ctx, mod, map[string]interface{}{column: nil}, filterGroup)
+}
+
 func (r *gormRepository) Find(ctx context.Context, mod repository.Model, result interface{}, fields []string, filterGroup *repository.FilterGroup, sortSpecs *repository.SortSpecs, limitSpec *repository.LimitSpec) error {
-	mysqlConn := r.Db.Table(mod.TableName())
+	return r.find(ctx, mod, result, fields, repository.ExcludeDeleted(mod, filterGroup), sortSpecs, limitSpec)
+}
+
+func (r *gormRepository) FindWithDeleted(ctx context.Context, mod repository.Model, result interface{}, fields []string, filterGroup *repository.FilterGroup, sortSpecs *repository.SortSpecs, limitSpec *repository.LimitSpec) error {
+	return r.find(ctx, mod, result, fields, filterGroup, sortSpecs, limitSpec)
+}
+
+func (r *gormRepository) find(ctx context.Context, mod repository.Model, result interface{}, fields []string, filterGroup *repository.FilterGroup, sortSpecs *repository.SortSpecs, limitSpec *repository.LimitSpec) error {
+	if err := repository.ModelColumns(mod).CheckQuery(fields, filterGroup, sortSpecs); err != nil {
+		zlog.Error("gormRepo.Find", zap.Any("mod", mod), zap.Error(err))
+		return err
+	}
+
+	if limitSpec != nil {
+		// 游标翻页时追加主键作为次级排序
+		fields, sortSpecs = limitSpec.CursorSpecs(mod, fields, sortSpecs)
+	}
+
+	mysqlConn := r.session(ctx).Table(mod.TableName())
 
 	if len(fields) > 0 {
 		mysqlConn = mysqlConn.Select(fields)
 	}
 
+	if limitSpec != nil {
+		// 游标翻页时追加 keyset 条件
+		var err error
+		filterGroup, err = limitSpec.BuildCursorFilter(filterGroup, sortSpecs)
+		if err != nil {
+			zlog.Error("gormRepo.Find.BuildCursorFilter", zap.Any("mod", mod),
+				zap.Any("sortSpecs", sortSpecs),
+				zap.Any("limitSpec", limitSpec),
+				zap.Error(err))
+			return err
+		}
+	}
 	if filterGroup != nil {
-		mysqlConn = filterGroup.BuildToMysql(mysqlConn)
+		mysqlConn = filterGroup.BuildToSQL(mysqlConn)
 	}
 	if sortSpecs != nil {
-		sortSpecs.BuildToMysql(mysqlConn)
+		sortSpecs.BuildToSQL(mysqlConn)
 	}
 	if limitSpec != nil {
-		limitSpec.BuildToMysql(mysqlConn)
+		limitSpec.BuildToSQL(mysqlConn)
 	}
 
 	err := mysqlConn.Scan(result).Error
@@ -81,25 +314,98 @@ func (r *gormRepository) Find(ctx context.Context, mod repository.Model, result
 			zap.Error(err))
 		return err
 	}
+
+	if limitSpec != nil {
+		err = limitSpec.FillNextCursor(result, sortSpecs)
+		if err != nil {
+			zlog.Error("gormRepo.Find.FillNextCursor", zap.Any("mod", mod),
+				zap.Any("sortSpecs", sortSpecs),
+				zap.Any("limitSpec", limitSpec),
+				zap.Error(err))
+			return err
+		}
+	}
 	return nil
 }
 
+// FindEach 使用 Rows 逐行读取, 每 batchSize 条调用一次 fn
+func (r *gormRepository) FindEach(ctx context.Context, mod repository.Model, result interface{}, fields []string, filterGroup *repository.FilterGroup, sortSpecs *repository.SortSpecs, batchSize int, fn func() error) error {
+	filterGroup = repository.ExcludeDeleted(mod, filterGroup)
+	if err := repository.ModelColumns(mod).CheckQuery(fields, filterGroup, sortSpecs); err != nil {
+		zlog.Error("gormRepo.FindEach", zap.Any("mod", mod), zap.Error(err))
+		return err
+	}
+	batch, err := repository.NewEachBatch(ctx, result, batchSize, fn)
+	if err != nil {
+		return err
+	}
+
+	mysqlConn := r.session(ctx).Table(mod.TableName())
+	if len(fields) > 0 {
+		mysqlConn = mysqlConn.Select(fields)
+	}
+	if filterGroup != nil {
+		mysqlConn = filterGroup.BuildToSQL(mysqlConn)
+	}
+	if sortSpecs != nil {
+		sortSpecs.BuildToSQL(mysqlConn)
+	}
+
+	rows, err := mysqlConn.Rows()
+	if err != nil {
+		zlog.Error("gormRepo.FindEach.Rows", zap.Any("mod", mod),
+			zap.Any("filterGroup", filterGroup),
+			zap.Any("sortSpecs", sortSpecs),
+			zap.Error(err))
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		err = batch.Add(func(dest interface{}) error {
+			return mysqlConn.ScanRows(rows, dest)
+		})
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	if err == nil {
+		err = batch.Flush()
+	}
+	if err = repository.EachResult(err); err != nil {
+		zlog.Error("gormRepo.FindEach", zap.Any("mod", mod),
+			zap.Any("filterGroup", filterGroup),
+			zap.Any("sortSpecs", sortSpecs),
+			zap.Int("batchSize", batch.BatchSize()),
+			zap.Error(err))
+	}
+	return err
+}
+
 func (r *gormRepository) FindOne(ctx context.Context, mod repository.Model, fields []string, filterGroup *repository.FilterGroup, sortSpecs *repository.SortSpecs) error {
-	mysqlConn := r.Db.Table(mod.TableName())
+	filterGroup = repository.ExcludeDeleted(mod, filterGroup)
+	if err := repository.ModelColumns(mod).CheckQuery(fields, filterGroup, sortSpecs); err != nil {
+		zlog.Error("gormRepo.FindOne", zap.Any("mod", mod), zap.Error(err))
+		return err
+	}
+
+	mysqlConn := r.session(ctx).Table(mod.TableName())
 
 	if len(fields) > 0 {
 		mysqlConn = mysqlConn.Select(fields)
 	}
 
-	mysqlConn = filterGroup.BuildToMysql(mysqlConn)
 	if filterGroup != nil {
-		mysqlConn = filterGroup.BuildToMysql(mysqlConn)
+		mysqlConn = filterGroup.BuildToSQL(mysqlConn)
 	}
 	if sortSpecs != nil {
-		sortSpecs.BuildToMysql(mysqlConn)
+		sortSpecs.BuildToSQL(mysqlConn)
 	}
 	limitSpec := repository.NewLimitSpec(0, 1)
-	limitSpec.BuildToMysql(mysqlConn)
+	limitSpec.BuildToSQL(mysqlConn)
 
 	err := mysqlConn.Scan(mod).Error
 	if err != nil && err != gorm.ErrRecordNotFound {
@@ -114,11 +420,17 @@ func (r *gormRepository) FindOne(ctx context.Context, mod repository.Model, fiel
 }
 
 func (r *gormRepository) Count(ctx context.Context, mod repository.Model, filterGroup *repository.FilterGroup) (int64, error) {
-	mysqlConn := r.Db.Table(mod.TableName())
+	filterGroup = repository.ExcludeDeleted(mod, filterGroup)
+	if err := repository.ModelColumns(mod).CheckFilter(filterGroup); err != nil {
+		zlog.Error("gormRepo.Count", zap.Any("mod", mod), zap.Error(err))
+		return 0, err
+	}
+
+	mysqlConn := r.session(ctx).Table(mod.TableName())
 
 	var count int64
 	if filterGroup != nil {
-		mysqlConn = filterGroup.BuildToMysql(mysqlConn)
+		mysqlConn = filterGroup.BuildToSQL(mysqlConn)
 	}
 
 	err := mysqlConn.Count(&count).Error
@@ -130,3 +442,120 @@ func (r *gormRepository) Count(ctx context.Context, mod repository.Model, filter
 	}
 	return count, nil
 }
+
+func (r *gormRepository) FindByIDs(ctx context.Context, mod repository.Model, result interface{}, ids interface{}) error {
+	return r.Find(ctx, mod, result, nil, repository.IDsFilter(mod, ids), nil, nil)
+}
+
+// Exists 执行 SELECT 1 ... LIMIT 1
+func (r *gormRepository) Exists(ctx context.Context, mod repository.Model, filterGroup *repository.FilterGroup) (bool, error) {
+	filterGroup = repository.ExcludeDeleted(mod, filterGroup)
+	if err := repository.ModelColumns(mod).CheckFilter(filterGroup); err != nil {
+		zlog.Error("gormRepo.Exists", zap.Any("mod", mod), zap.Error(err))
+		return false, err
+	}
+
+	mysqlConn := r.session(ctx).Table(mod.TableName()).Select("1")
+	if filterGroup != nil {
+		mysqlConn = filterGroup.BuildToSQL(mysqlConn)
+	}
+
+	var rows []int
+	err := mysqlConn.Limit(1).Scan(&rows).Error
+	if err != nil {
+		zlog.Error("gormRepo.Exists", zap.Any("mod", mod),
+			zap.Any("filterGroup", filterGroup),
+			zap.Error(err))
+		return false, err
+	}
+	return len(rows) > 0, nil
+}
+
+func (r *gormRepository) Distinct(ctx context.Context, mod repository.Model, column string, result interface{}, filterGroup *repository.FilterGroup) error {
+	filterGroup = repository.ExcludeDeleted(mod, filterGroup)
+	columns := repository.ModelColumns(mod)
+	err := columns.Check(column)
+	if err == nil {
+		err = columns.CheckFilter(filterGroup)
+	}
+	if err != nil {
+		zlog.Error("gormRepo.Distinct", zap.Any("mod", mod), zap.Error(err))
+		return err
+	}
+
+	// 通过 clause 构建 SELECT DISTINCT, 使列名按方言加引号
+	mysqlConn := r.session(ctx).Table(mod.TableName()).
+		Clauses(clause.Select{Distinct: true, Columns: []clause.Column{{Name: column}}})
+	if filterGroup != nil {
+		mysqlConn = filterGroup.BuildToSQL(mysqlConn)
+	}
+
+	err = mysqlConn.Pluck(column, result).Error
+	if err != nil {
+		zlog.Error("gormRepo.Distinct", zap.Any("mod", mod),
+			zap.String("column", column),
+			zap.Any("filterGroup", filterGroup),
+			zap.Error(err))
+	}
+	return err
+}
+
+// FindPage 依次执行 Find 与 Count, 能由本页结果推算总数时不执行 Count
+func (r *gormRepository) FindPage(ctx context.Context, mod repository.Model, result interface{}, fields []string, filterGroup *repository.FilterGroup, sortSpecs *repository.SortSpecs, limitSpec *repository.LimitSpec) (*repository.Page, error) {
+	return repository.LoadPage(ctx, r, mod, result, fields, filterGroup, sortSpecs, limitSpec)
+}
+
+func (r *gormRepository) Aggregate(ctx context.Context, mod repository.Model, result interface{}, filterGroup *repository.FilterGroup, aggregateSpec *repository.AggregateSpec, sortSpecs *repository.SortSpecs, limitSpec *repository.LimitSpec) error {
+	filterGroup = repository.ExcludeDeleted(mod, filterGroup)
+	err := aggregateSpec.Validate()
+	if err == nil && limitSpec != nil && limitSpec.UseCursor {
+		err = repository.ErrAggregateCursorNotAllow
+	}
+	if err == nil {
+		err = repository.ModelColumns(mod).CheckAggregate(filterGroup, aggregateSpec, sortSpecs)
+	}
+	if err != nil {
+		zlog.Error("gormRepo.Aggregate", zap.Any("mod", mod), zap.Any("aggregateSpec", aggregateSpec), zap.Error(err))
+		return err
+	}
+
+	mysqlConn := r.session(ctx).Table(mod.TableName())
+	if filterGroup != nil {
+		mysqlConn = filterGroup.BuildToSQL(mysqlConn)
+	}
+	mysqlConn = aggregateSpec.BuildToSQL(mysqlConn)
+	if sortSpecs != nil {
+		sortSpecs.BuildToSQL(mysqlConn)
+	}
+	if limitSpec != nil {
+		limitSpec.BuildToSQL(mysqlConn)
+	}
+
+	err = mysqlConn.Scan(result).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		zlog.Error("gormRepo.Aggregate", zap.Any("mod", mod),
+			zap.Any("filterGroup", filterGroup),
+			zap.Any("aggregateSpec", aggregateSpec),
+			zap.Any("sortSpecs", sortSpecs),
+			zap.Any("limitSpec", limitSpec),
+			zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+func (r *gormRepository) WithTransaction(ctx context.Context, fn func(txRepo repository.BaseRepository) error) error {
+	// 已处于事务中时复用当前事务, 避免产生嵌套事务; panic 交给外层事务的 CallTxFunc 处理
+	if r.inTx {
+		return fn(r)
+	}
+
+	err := r.session(ctx).Transaction(func(tx *gorm.DB) error {
+		return repository.CallTxFunc(&gormRepository{Db: tx, resolver: r.resolver, inTx: true}, fn)
+	})
+	if err != nil {
+		zlog.Error("gormRepo.WithTransaction", zap.Error(err))
+	}
+	repository.RethrowTxPanic(err)
+	return err
+}
@@ -2,6 +2,7 @@ package gormrepo
 
 import (
 	"context"
+	"errors"
 	"github.com/henrion-y/base.services/database/gorm"
 	"github.com/spf13/viper"
 	"testing"
@@ -182,3 +183,216 @@ func TestBaseRepository_Delete(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestBaseRepository_WithTransaction(t *testing.T) {
+	db := getDB()
+	repo := NewBaseRepository(db)
+
+	mod := User{}
+	err := repo.WithTransaction(context.Background(), func(txRepo repository.BaseRepository) error {
+		_, err := txRepo.Update(context.Background(), &mod, map[string]interface{}{"age": 30},
+			repository.NewFilterGroup().Equals("name", "张飞"))
+		if err != nil {
+			return err
+		}
+		// 嵌套调用复用当前事务
+		return txRepo.WithTransaction(context.Background(), func(txRepo repository.BaseRepository) error {
+			return txRepo.Create(context.Background(), &User{Name: "刘备", Age: 30, Ctime: time.Now(), Mtime: time.Now()})
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 回调 panic 时回滚后重新 panic
+	defer func() {
+		if r := recover(); r != "rollback" {
+			t.Fatalf("expect panic rethrown after rollback, got %v", r)
+		}
+	}()
+	_ = repo.WithTransaction(context.Background(), func(txRepo repository.BaseRepository) error {
+		_, err := txRepo.Update(context.Background(), &mod, map[string]interface{}{"age": 99},
+			repository.NewFilterGroup().Equals("name", "张飞"))
+		if err != nil {
+			return err
+		}
+		panic("rollback")
+	})
+}
+
+// 游标翻页
+func TestBaseRepository_FindByCursor(t *testing.T) {
+	db := getDB()
+	repo := NewBaseRepository(db)
+
+	mod := User{}
+	sortSpecs := repository.NewSortSpecs("age", repository.SortType_DESC).AddAsc("id")
+	limitSpec := repository.NewCursorLimitSpec("", 1)
+	for {
+		var list []User
+		err := repo.Find(context.Background(), &mod, &list, nil, repository.NewFilterGroup().GreaterThan("age", 0), sortSpecs, limitSpec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Log(list)
+		if limitSpec.NextCursor == "" {
+			break
+		}
+		limitSpec = repository.NewCursorLimitSpec(limitSpec.NextCursor, 1)
+	}
+}
+
+func TestRepository_Generic(t *testing.T) {
+	repo := repository.NewRepository[*User](NewBaseRepository(getDB()))
+
+	user, found, err := repo.Get(context.Background(), repository.NewFilterGroup().Equals("name", "张飞"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(user, found)
+
+	list, page, err := repo.FindPage(context.Background(), nil, repository.NewFilterGroup().GreaterThan("age", 0),
+		repository.NewSortSpecs("id", repository.SortType_ASC), repository.NewLimitSpec(1, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(list, page.Total)
+}
+
+func TestBaseRepository_Aggregate(t *testing.T) {
+	db := getDB()
+	repo := NewBaseRepository(db)
+
+	var list []struct {
+		Age int
+		Cnt int64
+	}
+	aggregateSpec := repository.NewAggregateSpec("age").Count("cnt").SetHaving(repository.NewFilterGroup().GreaterThan("cnt", 0))
+	err := repo.Aggregate(context.Background(), &User{}, &list, repository.NewFilterGroup().GreaterThan("age", 10),
+		aggregateSpec, repository.NewSortSpecs("cnt", repository.SortType_DESC), repository.NewLimitSpec(0, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(list)
+}
+
+func TestBaseRepository_CreateBatch(t *testing.T) {
+	repo := NewBaseRepository(getDB())
+
+	newTime := time.Now()
+	users := []*User{
+		{Name: "马超", Age: 25, Ctime: newTime, Mtime: newTime},
+		{Name: "黄忠", Age: 60, Ctime: newTime, Mtime: newTime},
+		{Name: "魏延", Age: 35, Ctime: newTime, Mtime: newTime},
+	}
+	counts, err := repo.CreateBatch(context.Background(), users, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(counts)
+}
+
+func TestBaseRepository_Upsert(t *testing.T) {
+	repo := NewBaseRepository(getDB())
+
+	newTime := time.Now()
+	rowCount, err := repo.Upsert(context.Background(), &User{ID: 1, Name: "张飞", Age: 40, Ctime: newTime, Mtime: newTime},
+		[]string{"id"}, []string{"age", "mtime"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(rowCount)
+}
+
+type Article struct {
+	ID        int        `json:"id" gorm:"primary_key"`
+	Title     string     `json:"title"`
+	DeletedAt *time.Time `json:"deleted_at"`
+}
+
+func (a *Article) TableName() string {
+	return "t_article_repository"
+}
+
+func (a *Article) SoftDeleteColumn() string {
+	return "deleted_at"
+}
+
+func TestBaseRepository_SoftDelete(t *testing.T) {
+	db := getDB()
+	if err := db.AutoMigrate(&Article{}); err != nil {
+		t.Fatal(err)
+	}
+	repo := NewBaseRepository(db)
+
+	err := repo.Create(context.Background(), &Article{Title: "soft delete"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	filterGroup := repository.NewFilterGroup().Equals("title", "soft delete")
+	if err = repo.Delete(context.Background(), &Article{}, filterGroup); err != nil {
+		t.Fatal(err)
+	}
+
+	var list []Article
+	if err = repo.FindWithDeleted(context.Background(), &Article{}, &list, nil, filterGroup, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Log(list)
+
+	rowCount, err := repo.Restore(context.Background(), &Article{}, filterGroup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(rowCount)
+}
+
+type Account struct {
+	ID      int `json:"id" gorm:"primary_key"`
+	Balance int `json:"balance"`
+	Version int `json:"version"`
+}
+
+func (a *Account) TableName() string {
+	return "t_account_repository"
+}
+
+func (a *Account) VersionColumn() string {
+	return "version"
+}
+
+func TestBaseRepository_OptimisticLock(t *testing.T) {
+	db := getDB()
+	if err := db.AutoMigrate(&Account{}); err != nil {
+		t.Fatal(err)
+	}
+	repo := NewBaseRepository(db)
+
+	account := &Account{Balance: 100}
+	if err := repo.Create(context.Background(), account); err != nil {
+		t.Fatal(err)
+	}
+	stale := *account
+	filterGroup := repository.NewFilterGroup().Equals("id", account.ID)
+	if _, err := repo.Update(context.Background(), account, map[string]interface{}{"balance": 80}, filterGroup); err != nil {
+		t.Fatal(err)
+	}
+	_, err := repo.Update(context.Background(), &stale, map[string]interface{}{"balance": 50}, filterGroup)
+	if !errors.Is(err, repository.ErrVersionConflict) {
+		t.Fatalf("expect ErrVersionConflict, got %v", err)
+	}
+}
+
+func TestBaseRepository_FindEach(t *testing.T) {
+	repo := NewBaseRepository(getDB())
+
+	var list []User
+	err := repo.FindEach(context.Background(), &User{}, &list, nil, repository.NewFilterGroup().GreaterThan("age", 0),
+		repository.NewSortSpecs("id", repository.SortType_ASC), 2, func() error {
+			t.Log(list)
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,316 @@
+package gormrepo
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/henrion-y/base.services/database/gorm"
+	"github.com/henrion-y/base.services/domain/repository"
+)
+
+// Tags 以 JSON 数组文本存储
+type Tags []string
+
+func (t Tags) Value() (driver.Value, error) {
+	if t == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(t)
+	return string(data), err
+}
+
+func (t *Tags) Scan(value interface{}) error {
+	switch value := value.(type) {
+	case nil:
+		*t = nil
+		return nil
+	case string:
+		return json.Unmarshal([]byte(value), t)
+	case []byte:
+		return json.Unmarshal(value, t)
+	}
+	return fmt.Errorf("cannot scan %T into Tags", value)
+}
+
+type Product struct {
+	ID        int        `json:"id" gorm:"primary_key"`
+	Name      string     `json:"name" gorm:"column:name"`
+	Stock     int        `json:"stock" gorm:"column:stock"`
+	Tags      Tags       `json:"tags" gorm:"column:tags;type:text"`
+	CheckedAt *time.Time `json:"checked_at" gorm:"column:checked_at"`
+}
+
+func (p *Product) TableName() string {
+	return "t_product_repository"
+}
+
+func newSqliteRepo(t *testing.T) repository.BaseRepository {
+	v := viper.New()
+	v.Set("database.Driver", "sqlite")
+	v.Set("database.Db", filepath.Join(t.TempDir(), "repository.db"))
+	db, err := gorm.NewDbProvider(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.AutoMigrate(&Product{}); err != nil {
+		t.Fatal(err)
+	}
+	return NewBaseRepository(db)
+}
+
+func TestSqlite_Filter(t *testing.T) {
+	ctx := context.Background()
+	repo := newSqliteRepo(t)
+	products := []*Product{
+		{Name: "Apple", Stock: 10, Tags: Tags{"fruit", "red"}},
+		{Name: "banana", Stock: 0, Tags: Tags{"fruit"}},
+		{Name: "100% Juice", Stock: 5, Tags: Tags{"drink"}},
+	}
+	if _, err := repo.CreateBatch(ctx, products, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	byID := repository.NewSortSpecs("id", repository.SortType_ASC)
+	cases := []struct {
+		name   string
+		filter *repository.FilterGroup
+		want   []string
+	}{
+		{"like ignores case", repository.NewFilterGroup().Like("name", "a%"), []string{"Apple"}},
+		{"starts with escapes %", repository.NewFilterGroup().StartsWith("name", "100%"), []string{"100% Juice"}},
+		{"in", repository.NewFilterGroup().In("stock", []int{0, 5}), []string{"banana", "100% Juice"}},
+		{"not in", repository.NewFilterGroup().NotIn("stock", []int{0, 5}), []string{"Apple"}},
+		{"array contains", repository.NewFilterGroup().ArrayContains("tags", []string{"fruit", "red"}), []string{"Apple"}},
+		{"array contains any", repository.NewFilterGroup().ArrayContainsAny("tags", []string{"red", "drink"}), []string{"Apple", "100% Juice"}},
+	}
+	for _, c := range cases {
+		var list []Product
+		if err := repo.Find(ctx, &Product{}, &list, nil, c.filter, byID, nil); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		var names []string
+		for _, item := range list {
+			names = append(names, item.Name)
+		}
+		if fmt.Sprint(names) != fmt.Sprint(c.want) {
+			t.Fatalf("%s: expect %v, got %v", c.name, c.want, names)
+		}
+	}
+
+	var list []Product
+	err := repo.Find(ctx, &Product{}, &list, nil, repository.NewFilterGroup().Regex("name", "^A"), nil, nil)
+	if !errors.Is(err, repository.ErrDialectUnsupported) {
+		t.Fatalf("expect ErrDialectUnsupported, got %v", err)
+	}
+}
+
+func TestSqlite_UpdateSpec(t *testing.T) {
+	ctx := context.Background()
+	repo := newSqliteRepo(t)
+	product := &Product{Name: "Apple", Stock: 10, Tags: Tags{"fruit", "red", "fruit"}}
+	if err := repo.Create(ctx, product); err != nil {
+		t.Fatal(err)
+	}
+	byID := repository.NewFilterGroup().Equals("id", product.ID)
+
+	updates := []repository.UpdateSpec{
+		repository.NewUpdateSpec().Inc("stock", -3).Pull("tags", "fruit").CurrentDate("checked_at"),
+		repository.NewUpdateSpec().Min("stock", 5).AddToSet("tags", "red"),
+		repository.NewUpdateSpec().Push("tags", "sweet"),
+	}
+	for _, spec := range updates {
+		if _, err := repo.Update(ctx, &Product{}, spec, byID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := &Product{}
+	if err := repo.FindOne(ctx, got, nil, byID, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got.Stock != 5 || fmt.Sprint(got.Tags) != "[red sweet]" || got.CheckedAt == nil {
+		t.Fatalf("unexpected product after update: %+v", got)
+	}
+
+	if _, err := repo.Update(ctx, &Product{}, repository.NewUpdateSpec().Unset("tags"), byID); err != nil {
+		t.Fatal(err)
+	}
+	got = &Product{}
+	if err := repo.FindOne(ctx, got, nil, byID, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got.Tags != nil {
+		t.Fatalf("expect tags unset, got %v", got.Tags)
+	}
+}
+
+func TestSqlite_Lookup(t *testing.T) {
+	ctx := context.Background()
+	repo := newSqliteRepo(t)
+	products := []*Product{{Name: "Apple", Stock: 10}, {Name: "banana", Stock: 0}, {Name: "Cherry", Stock: 10}}
+	if _, err := repo.CreateBatch(ctx, products, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if exists, err := repo.Exists(ctx, &Product{}, repository.NewFilterGroup().Equals("stock", 0)); err != nil || !exists {
+		t.Fatalf("expect exists, got %v %v", exists, err)
+	}
+	if exists, err := repo.Exists(ctx, &Product{}, repository.NewFilterGroup().GreaterThan("stock", 10)); err != nil || exists {
+		t.Fatalf("expect not exists, got %v %v", exists, err)
+	}
+
+	var stocks []int
+	if err := repo.Distinct(ctx, &Product{}, "stock", &stocks, repository.NewFilterGroup().IsNotNull("name")); err != nil || len(stocks) != 2 {
+		t.Fatalf("unexpected distinct stocks %v %v", stocks, err)
+	}
+
+	var list []Product
+	if err := repo.FindByIDs(ctx, &Product{}, &list, []int{products[0].ID, products[2].ID}); err != nil || len(list) != 2 {
+		t.Fatalf("unexpected products %v %v", list, err)
+	}
+}
+
+func TestSqlite_Cursor(t *testing.T) {
+	ctx := context.Background()
+	repo := newSqliteRepo(t)
+	now := time.Now()
+	products := []*Product{
+		{Name: "Apple", Stock: 10, CheckedAt: &now},
+		{Name: "banana", Stock: 0},
+		{Name: "Cherry", Stock: 10},
+		{Name: "Durian", Stock: 0, CheckedAt: &now},
+	}
+	if _, err := repo.CreateBatch(ctx, products, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// 排序值相同及为 NULL 的记录逐页取出, 不会被跳过; NULL 视为最小值
+	cases := []struct {
+		sortSpecs *repository.SortSpecs
+		want      []string
+	}{
+		{repository.NewSortSpecs("stock", repository.SortType_DESC), []string{"Apple", "Cherry", "banana", "Durian"}},
+		{repository.NewSortSpecs("checked_at", repository.SortType_ASC), []string{"banana", "Cherry", "Apple", "Durian"}},
+		{repository.NewSortSpecs("checked_at", repository.SortType_DESC), []string{"Apple", "Durian", "banana", "Cherry"}},
+	}
+	for _, c := range cases {
+		var names []string
+		limitSpec := repository.NewCursorLimitSpec("", 1)
+		for i := 0; i < len(products)+1; i++ {
+			var list []Product
+			if err := repo.Find(ctx, &Product{}, &list, []string{"name"}, nil, c.sortSpecs, limitSpec); err != nil {
+				t.Fatal(err)
+			}
+			for _, item := range list {
+				names = append(names, item.Name)
+			}
+			if limitSpec.NextCursor == "" {
+				break
+			}
+			limitSpec = repository.NewCursorLimitSpec(limitSpec.NextCursor, 1)
+		}
+		if fmt.Sprint(names) != fmt.Sprint(c.want) {
+			t.Fatalf("%s: expect %v, got %v", c.sortSpecs, c.want, names)
+		}
+	}
+}
+
+func TestSqlite_Context(t *testing.T) {
+	v := viper.New()
+	v.Set("database.Driver", "sqlite")
+	v.Set("database.Db", filepath.Join(t.TempDir(), "repository.db"))
+	db, err := gorm.NewDbProvider(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.AutoMigrate(&Product{}); err != nil {
+		t.Fatal(err)
+	}
+	repo := NewBaseRepositoryWithResolver(db, gorm.Resolver{})
+
+	// 写入同样绑定 ctx, ctx 取消后不再执行
+	ctx, cancel := context.WithCancel(gorm.WithPrimary(context.Background()))
+	cancel()
+	byName := repository.NewFilterGroup().Equals("name", "Apple")
+	if err = repo.Create(ctx, &Product{Name: "Apple"}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("create: expect context.Canceled, got %v", err)
+	}
+	if _, err = repo.Upsert(ctx, &Product{Name: "Apple"}, []string{"id"}, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("upsert: expect context.Canceled, got %v", err)
+	}
+	if _, err = repo.Update(ctx, &Product{}, map[string]interface{}{"stock": 1}, byName); !errors.Is(err, context.Canceled) {
+		t.Fatalf("update: expect context.Canceled, got %v", err)
+	}
+	if err = repo.Delete(ctx, &Product{}, byName); !errors.Is(err, context.Canceled) {
+		t.Fatalf("delete: expect context.Canceled, got %v", err)
+	}
+
+	ctx = gorm.WithPrimary(context.Background())
+	if err = repo.Create(ctx, &Product{Name: "Apple"}); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := repo.Exists(ctx, &Product{}, byName); err != nil || !exists {
+		t.Fatalf("expect exists, got %v %v", exists, err)
+	}
+}
+
+func TestSqlite_UpsertVersion(t *testing.T) {
+	ctx := context.Background()
+	repo := newSqliteRepo(t)
+	db := repo.(*gormRepository).Db
+	if err := db.AutoMigrate(&Account{}); err != nil {
+		t.Fatal(err)
+	}
+
+	account := &Account{Balance: 100}
+	if _, err := repo.Upsert(ctx, account, []string{"id"}, nil); err != nil || account.Version != 1 {
+		t.Fatalf("expect version 1 after insert, got %d %v", account.Version, err)
+	}
+	stale := *account
+	// 冲突时版本在原值上加 1, 模型中的版本被忽略
+	for _, updateColumns := range [][]string{nil, {"balance"}} {
+		if _, err := repo.Upsert(ctx, &Account{ID: account.ID, Balance: 50}, []string{"id"}, updateColumns); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := &Account{}
+	if err := repo.FindOne(ctx, got, nil, repository.NewFilterGroup().Equals("id", account.ID), nil); err != nil {
+		t.Fatal(err)
+	}
+	if got.Balance != 50 || got.Version != 3 {
+		t.Fatalf("expect balance 50 version 3, got %+v", got)
+	}
+	_, err := repo.Update(ctx, &stale, map[string]interface{}{"balance": 0}, repository.NewFilterGroup().Equals("id", account.ID))
+	if !errors.Is(err, repository.ErrVersionConflict) {
+		t.Fatalf("expect ErrVersionConflict, got %v", err)
+	}
+}
+
+func TestSqlite_AggregateHaving(t *testing.T) {
+	ctx := context.Background()
+	repo := newSqliteRepo(t)
+	products := []*Product{{Name: "Apple", Stock: 10}, {Name: "banana", Stock: 0}, {Name: "Cherry", Stock: 10}}
+	if _, err := repo.CreateBatch(ctx, products, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var list []struct {
+		Stock int
+		Cnt   int
+	}
+	aggregateSpec := repository.NewAggregateSpec("stock").Count("cnt").SetHaving(repository.NewFilterGroup().GreaterThan("cnt", 1))
+	if err := repo.Aggregate(ctx, &Product{}, &list, nil, aggregateSpec, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Stock != 10 || list[0].Cnt != 2 {
+		t.Fatalf("unexpected aggregate result %+v", list)
+	}
+}
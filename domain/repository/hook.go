@@ -0,0 +1,310 @@
+package repository
+
+import (
+	"context"
+	"time"
+)
+
+/********* 钩子 ***********/
+
+/*
+NewHookRepository 以装饰器的方式为任意 BaseRepository 实现(gormrepo、mongorepo 等)增加钩子链:
+1. 每次调用前按注册顺序执行各钩子的 Before, Before 可修改 HookCall 中的入参(如 Data、FilterGroup), 返回 error 时中止调用
+2. 调用完成后按相反顺序执行 After, call.Err 为调用结果; 调用成功而 After 返回 error 时, 该 error 作为调用结果返回
+3. 某个钩子的 Before 中止调用时, 只执行已通过 Before 的钩子的 After
+4. WithTransaction 中的 txRepo 同样带有钩子, HookCall.Repo 为事务内的仓储, 钩子通过它读写即处于同一事务
+*/
+
+type Operation string
+
+const (
+	Operation_CREATE            Operation = "CREATE"
+	Operation_CREATE_BATCH      Operation = "CREATE_BATCH"
+	Operation_UPSERT            Operation = "UPSERT"
+	Operation_UPDATE            Operation = "UPDATE"
+	Operation_DELETE            Operation = "DELETE"
+	Operation_RESTORE           Operation = "RESTORE"
+	Operation_FIND              Operation = "FIND"
+	Operation_FIND_WITH_DELETED Operation = "FIND_WITH_DELETED"
+	Operation_FIND_ONE          Operation = "FIND_ONE"
+	Operation_FIND_EACH         Operation = "FIND_EACH"
+	Operation_FIND_BY_IDS       Operation = "FIND_BY_IDS"
+	Operation_COUNT             Operation = "COUNT"
+	Operation_EXISTS            Operation = "EXISTS"
+	Operation_DISTINCT          Operation = "DISTINCT"
+	Operation_FIND_PAGE         Operation = "FIND_PAGE"
+	Operation_AGGREGATE         Operation = "AGGREGATE"
+)
+
+// IsWrite 是否为写操作
+func (o Operation) IsWrite() bool {
+	switch o {
+	case Operation_CREATE, Operation_CREATE_BATCH, Operation_UPSERT, Operation_UPDATE, Operation_DELETE, Operation_RESTORE:
+		return true
+	default:
+		return false
+	}
+}
+
+// HookCall 一次仓储调用, 各字段按操作填充, 未用到的为零值
+type HookCall struct {
+	Operation Operation
+	Repo      BaseRepository // 被装饰的仓储, 事务中为 txRepo
+	Model     Model
+	Models    interface{} // CreateBatch 的模型切片
+
+	Data            map[string]interface{} // Update 的更新内容
+	ConflictColumns []string               // Upsert 的冲突列
+	UpdateColumns   []string               // Upsert 的更新列
+
+	Fields        []string
+	Column        string // Distinct 的列
+	FilterGroup   *FilterGroup
+	SortSpecs     *SortSpecs
+	LimitSpec     *LimitSpec
+	AggregateSpec *AggregateSpec
+	BatchSize     int         // FindEach 的批大小
+	Result        interface{} // Find、FindPage、Aggregate 的结果指针
+	Page          *Page       // FindPage 的结果, 仅 After 中有效
+
+	RowsAffected     int64         // Update、Upsert、Restore 的受影响行数, Count 的总数, Exists 存在时为 1
+	CallbackDuration time.Duration // FindEach 中调用方回调的累计耗时, 仅 After 中有效
+	Err              error         // 调用结果, 仅 After 中有效
+
+	values map[string]interface{}
+}
+
+// Set 保存钩子自身的数据, 用于在同一次调用的 Before 与 After 之间传递
+func (c *HookCall) Set(key string, value interface{}) {
+	if c.values == nil {
+		c.values = make(map[string]interface{})
+	}
+	c.values[key] = value
+}
+
+// Get 读取 Set 保存的数据
+func (c *HookCall) Get(key string) (interface{}, bool) {
+	value, ok := c.values[key]
+	return value, ok
+}
+
+type Hook interface {
+	Before(ctx context.Context, call *HookCall) error
+	After(ctx context.Context, call *HookCall) error
+}
+
+// HookFuncs 用函数实现 Hook, 未设置的函数视为直接通过
+type HookFuncs struct {
+	BeforeFunc func(ctx context.Context, call *HookCall) error
+	AfterFunc  func(ctx context.Context, call *HookCall) error
+}
+
+func (h HookFuncs) Before(ctx context.Context, call *HookCall) error {
+	if h.BeforeFunc == nil {
+		return nil
+	}
+	return h.BeforeFunc(ctx, call)
+}
+
+func (h HookFuncs) After(ctx context.Context, call *HookCall) error {
+	if h.AfterFunc == nil {
+		return nil
+	}
+	return h.AfterFunc(ctx, call)
+}
+
+type hookRepository struct {
+	base  BaseRepository
+	hooks []Hook
+}
+
+// NewHookRepository 为 base 增加钩子链, hooks 按顺序执行 Before、逆序执行 After
+func NewHookRepository(base BaseRepository, hooks ...Hook) BaseRepository {
+	return &hookRepository{base: base, hooks: hooks}
+}
+
+func (r *hookRepository) invoke(ctx context.Context, call *HookCall, fn func(call *HookCall) error) error {
+	call.Repo = r.base
+	passed := 0
+	for _, hook := range r.hooks {
+		if call.Err = hook.Before(ctx, call); call.Err != nil {
+			break
+		}
+		passed++
+	}
+	if call.Err == nil {
+		call.Err = fn(call)
+	}
+	for i := passed - 1; i >= 0; i-- {
+		if err := r.hooks[i].After(ctx, call); err != nil && call.Err == nil {
+			call.Err = err
+		}
+	}
+	return call.Err
+}
+
+func (r *hookRepository) Create(ctx context.Context, mod Model) error {
+	call := &HookCall{Operation: Operation_CREATE, Model: mod}
+	return r.invoke(ctx, call, func(call *HookCall) error {
+		return r.base.Create(ctx, call.Model)
+	})
+}
+
+func (r *hookRepository) CreateBatch(ctx context.Context, models interface{}, batchSize int) ([]int64, error) {
+	var counts []int64
+	call := &HookCall{Operation: Operation_CREATE_BATCH, Models: models}
+	err := r.invoke(ctx, call, func(call *HookCall) (err error) {
+		counts, err = r.base.CreateBatch(ctx, call.Models, batchSize)
+		for _, count := range counts {
+			call.RowsAffected += count
+		}
+		return err
+	})
+	return counts, err
+}
+
+func (r *hookRepository) Upsert(ctx context.Context, mod Model, conflictColumns []string, updateColumns []string) (int64, error) {
+	call := &HookCall{Operation: Operation_UPSERT, Model: mod, ConflictColumns: conflictColumns, UpdateColumns: updateColumns}
+	err := r.invoke(ctx, call, func(call *HookCall) (err error) {
+		call.RowsAffected, err = r.base.Upsert(ctx, call.Model, call.ConflictColumns, call.UpdateColumns)
+		return err
+	})
+	return call.RowsAffected, err
+}
+
+func (r *hookRepository) Update(ctx context.Context, mod Model, data map[string]interface{}, filterGroup *FilterGroup) (int64, error) {
+	call := &HookCall{Operation: Operation_UPDATE, Model: mod, Data: data, FilterGroup: filterGroup}
+	err := r.invoke(ctx, call, func(call *HookCall) (err error) {
+		call.RowsAffected, err = r.base.Update(ctx, call.Model, call.Data, call.FilterGroup)
+		return err
+	})
+	return call.RowsAffected, err
+}
+
+func (r *hookRepository) Delete(ctx context.Context, mod Model, filterGroup *FilterGroup) error {
+	call := &HookCall{Operation: Operation_DELETE, Model: mod, FilterGroup: filterGroup}
+	return r.invoke(ctx, call, func(call *HookCall) error {
+		return r.base.Delete(ctx, call.Model, call.FilterGroup)
+	})
+}
+
+func (r *hookRepository) Restore(ctx context.Context, mod Model, filterGroup *FilterGroup) (int64, error) {
+	call := &HookCall{Operation: Operation_RESTORE, Model: mod, FilterGroup: filterGroup}
+	err := r.invoke(ctx, call, func(call *HookCall) (err error) {
+		call.RowsAffected, err = r.base.Restore(ctx, call.Model, call.FilterGroup)
+		return err
+	})
+	return call.RowsAffected, err
+}
+
+func (r *hookRepository) Find(ctx context.Context, mod Model, result interface{}, fields []string, filterGroup *FilterGroup, sortSpecs *SortSpecs, limitSpec *LimitSpec) error {
+	call := &HookCall{Operation: Operation_FIND, Model: mod, Result: result, Fields: fields,
+		FilterGroup: filterGroup, SortSpecs: sortSpecs, LimitSpec: limitSpec}
+	return r.invoke(ctx, call, func(call *HookCall) error {
+		return r.base.Find(ctx, call.Model, call.Result, call.Fields, call.FilterGroup, call.SortSpecs, call.LimitSpec)
+	})
+}
+
+func (r *hookRepository) FindWithDeleted(ctx context.Context, mod Model, result interface{}, fields []string, filterGroup *FilterGroup, sortSpecs *SortSpecs, limitSpec *LimitSpec) error {
+	call := &HookCall{Operation: Operation_FIND_WITH_DELETED, Model: mod, Result: result, Fields: fields,
+		FilterGroup: filterGroup, SortSpecs: sortSpecs, LimitSpec: limitSpec}
+	return r.invoke(ctx, call, func(call *HookCall) error {
+		return r.base.FindWithDeleted(ctx, call.Model, call.Result, call.Fields, call.FilterGroup, call.SortSpecs, call.LimitSpec)
+	})
+}
+
+func (r *hookRepository) FindOne(ctx context.Context, mod Model, fields []string, filterGroup *FilterGroup, sortSpecs *SortSpecs) error {
+	call := &HookCall{Operation: Operation_FIND_ONE, Model: mod, Result: mod, Fields: fields,
+		FilterGroup: filterGroup, SortSpecs: sortSpecs}
+	return r.invoke(ctx, call, func(call *HookCall) error {
+		return r.base.FindOne(ctx, call.Model, call.Fields, call.FilterGroup, call.SortSpecs)
+	})
+}
+
+// FindEach 的 After 在全部批次处理完后执行
+func (r *hookRepository) FindEach(ctx context.Context, mod Model, result interface{}, fields []string, filterGroup *FilterGroup, sortSpecs *SortSpecs, batchSize int, fn func() error) error {
+	call := &HookCall{Operation: Operation_FIND_EACH, Model: mod, Result: result, Fields: fields,
+		FilterGroup: filterGroup, SortSpecs: sortSpecs, BatchSize: batchSize}
+	return r.invoke(ctx, call, func(call *HookCall) error {
+		return r.base.FindEach(ctx, call.Model, call.Result, call.Fields, call.FilterGroup, call.SortSpecs, call.BatchSize, func() error {
+			start := time.Now()
+			defer func() { call.CallbackDuration += time.Since(start) }()
+			return fn()
+		})
+	})
+}
+
+// FindByIDs 转换为 主键 IN ids 的 Find, 钩子可像 Find 一样修改 FilterGroup
+func (r *hookRepository) FindByIDs(ctx context.Context, mod Model, result interface{}, ids interface{}) error {
+	call := &HookCall{Operation: Operation_FIND_BY_IDS, Model: mod, Result: result, FilterGroup: IDsFilter(mod, ids)}
+	return r.invoke(ctx, call, func(call *HookCall) error {
+		return r.base.Find(ctx, call.Model, call.Result, nil, call.FilterGroup, nil, nil)
+	})
+}
+
+func (r *hookRepository) Count(ctx context.Context, mod Model, filterGroup *FilterGroup) (int64, error) {
+	call := &HookCall{Operation: Operation_COUNT, Model: mod, FilterGroup: filterGroup}
+	err := r.invoke(ctx, call, func(call *HookCall) (err error) {
+		call.RowsAffected, err = r.base.Count(ctx, call.Model, call.FilterGroup)
+		return err
+	})
+	return call.RowsAffected, err
+}
+
+func (r *hookRepository) Exists(ctx context.Context, mod Model, filterGroup *FilterGroup) (bool, error) {
+	call := &HookCall{Operation: Operation_EXISTS, Model: mod, FilterGroup: filterGroup}
+	err := r.invoke(ctx, call, func(call *HookCall) error {
+		exists, err := r.base.Exists(ctx, call.Model, call.FilterGroup)
+		if exists {
+			call.RowsAffected = 1
+		}
+		return err
+	})
+	return call.RowsAffected > 0, err
+}
+
+func (r *hookRepository) Distinct(ctx context.Context, mod Model, column string, result interface{}, filterGroup *FilterGroup) error {
+	call := &HookCall{Operation: Operation_DISTINCT, Model: mod, Column: column, Result: result, FilterGroup: filterGroup}
+	return r.invoke(ctx, call, func(call *HookCall) error {
+		return r.base.Distinct(ctx, call.Model, call.Column, call.Result, call.FilterGroup)
+	})
+}
+
+func (r *hookRepository) FindPage(ctx context.Context, mod Model, result interface{}, fields []string, filterGroup *FilterGroup, sortSpecs *SortSpecs, limitSpec *LimitSpec) (*Page, error) {
+	call := &HookCall{Operation: Operation_FIND_PAGE, Model: mod, Result: result, Fields: fields,
+		FilterGroup: filterGroup, SortSpecs: sortSpecs, LimitSpec: limitSpec}
+	err := r.invoke(ctx, call, func(call *HookCall) (err error) {
+		call.Page, err = r.base.FindPage(ctx, call.Model, call.Result, call.Fields, call.FilterGroup, call.SortSpecs, call.LimitSpec)
+		return err
+	})
+	return call.Page, err
+}
+
+func (r *hookRepository) Aggregate(ctx context.Context, mod Model, result interface{}, filterGroup *FilterGroup, aggregateSpec *AggregateSpec, sortSpecs *SortSpecs, limitSpec *LimitSpec) error {
+	call := &HookCall{Operation: Operation_AGGREGATE, Model: mod, Result: result, FilterGroup: filterGroup,
+		AggregateSpec: aggregateSpec, SortSpecs: sortSpecs, LimitSpec: limitSpec}
+	return r.invoke(ctx, call, func(call *HookCall) error {
+		return r.base.Aggregate(ctx, call.Model, call.Result, call.FilterGroup, call.AggregateSpec, call.SortSpecs, call.LimitSpec)
+	})
+}
+
+func (r *hookRepository) WithTransaction(ctx context.Context, fn func(txRepo BaseRepository) error) error {
+	return r.base.WithTransaction(ctx, func(txRepo BaseRepository) error {
+		return fn(&hookRepository{base: txRepo, hooks: r.hooks})
+	})
+}
+
+/********* 操作人 ***********/
+
+type operatorKey struct{}
+
+// WithOperator 在 ctx 中记录当前操作人, 供 StampHook、AuditHook 使用
+func WithOperator(ctx context.Context, operator string) context.Context {
+	return context.WithValue(ctx, operatorKey{}, operator)
+}
+
+// OperatorFromContext 返回 WithOperator 记录的操作人, 未记录时返回空字符串
+func OperatorFromContext(ctx context.Context) string {
+	operator, _ := ctx.Value(operatorKey{}).(string)
+	return operator
+}
@@ -0,0 +1,94 @@
+package repository_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/henrion-y/base.services/domain/repository"
+	"github.com/henrion-y/base.services/domain/repository/memrepo"
+)
+
+type Order struct {
+	ID        int    `json:"id" gorm:"primary_key"`
+	Amount    int    `json:"amount" gorm:"amount"`
+	CreatedBy string `json:"created_by" gorm:"created_by"`
+	UpdatedBy string `json:"updated_by" gorm:"updated_by"`
+}
+
+func (o *Order) TableName() string {
+	return "t_order_repository"
+}
+
+func TestHookRepository_Audit(t *testing.T) {
+	base := memrepo.NewBaseRepository()
+	var operations []repository.Operation
+	recorder := repository.HookFuncs{
+		AfterFunc: func(ctx context.Context, call *repository.HookCall) error {
+			operations = append(operations, call.Operation)
+			return nil
+		},
+	}
+	repo := repository.NewHookRepository(base, recorder, repository.NewStampHook("created_by", "updated_by"),
+		repository.NewAuditHook("", nil))
+
+	ctx := repository.WithOperator(context.Background(), "admin")
+	order := &Order{Amount: 100}
+	if err := repo.Create(ctx, order); err != nil {
+		t.Fatal(err)
+	}
+	if order.CreatedBy != "admin" || order.UpdatedBy != "admin" {
+		t.Fatalf("expect stamped by admin, got %+v", order)
+	}
+
+	byID := repository.NewFilterGroup().Equals("id", order.ID)
+	ctx = repository.WithOperator(context.Background(), "auditor")
+	data := map[string]interface{}{"amount": 80}
+	if _, err := repo.Update(ctx, &Order{}, data, byID); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := data["updated_by"]; ok {
+		t.Fatal("stamp hook must not modify the caller's data")
+	}
+	if err := repo.Delete(ctx, &Order{}, byID); err != nil {
+		t.Fatal(err)
+	}
+
+	var logs []repository.AuditLog
+	if err := base.Find(ctx, &repository.AuditLog{}, &logs, nil, nil, repository.NewSortSpecs("id", repository.SortType_ASC), nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 3 || logs[0].Operator != "admin" || logs[1].Operator != "auditor" {
+		t.Fatalf("expect 3 audit logs, got %+v", logs)
+	}
+	update := logs[1]
+	want := `[{"id":1,"changes":{"amount":{"old":100,"new":80},"updated_by":{"old":"admin","new":"auditor"}}}]`
+	if update.Operation != string(repository.Operation_UPDATE) || update.TargetTable != "t_order_repository" ||
+		update.RowsAffected != 1 || update.Changes != want {
+		t.Fatalf("unexpected update audit log %+v", update)
+	}
+	if logs[2].Operation != string(repository.Operation_DELETE) || logs[2].RowsAffected != 1 {
+		t.Fatalf("unexpected delete audit log %+v", logs[2])
+	}
+	if len(operations) != 3 {
+		t.Fatalf("expect 3 hooked operations, got %v", operations)
+	}
+
+	// Before 返回 error 时中止调用
+	denied := errors.New("denied")
+	repo = repository.NewHookRepository(base, repository.HookFuncs{
+		BeforeFunc: func(ctx context.Context, call *repository.HookCall) error {
+			if call.Operation.IsWrite() {
+				return denied
+			}
+			return nil
+		},
+	})
+	if err := repo.Create(ctx, &Order{Amount: 1}); !errors.Is(err, denied) {
+		t.Fatalf("expect denied, got %v", err)
+	}
+	count, err := repo.Count(ctx, &Order{}, nil)
+	if err != nil || count != 0 {
+		t.Fatalf("expect no orders, got %d %v", count, err)
+	}
+}
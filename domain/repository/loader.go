@@ -0,0 +1,186 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+/********* 按主键批量查询 ***********/
+
+/*
+FindByIDs 按主键批量查询, 主键列见 PrimaryKeyColumn. Loader 在一次请求内合并并发的 FindByIDs:
+1. 同一模型(表名与结果类型相同)在 wait 时间内的调用合并为一次 IN 查询, 各调用只取回自己请求的 id
+2. 合并后的查询使用第一个调用的 ctx 执行, 该 ctx 取消时同一批的调用都会失败; 其余调用的 ctx 取消时只是不再等待
+3. Loader 不缓存结果, 须按请求创建(如在中间件中 WithLoader), 不要在事务内使用事务外的 Loader
+*/
+
+const DefaultLoaderWait = time.Millisecond
+
+// PrimaryKeyModel 模型实现该接口时使用返回的列作为主键, 否则按 PrimaryKeyColumn 的规则推断
+type PrimaryKeyModel interface {
+	Model
+	PrimaryKeyColumn() string
+}
+
+// PrimaryKeyColumn 返回模型的主键列: 带 gorm primaryKey 标签或 bson _id 标签的字段, 其次为 ID 字段, 都没有时为 id
+func PrimaryKeyColumn(mod Model) string {
+	if primaryKeyModel, ok := mod.(PrimaryKeyModel); ok && primaryKeyModel.PrimaryKeyColumn() != "" {
+		return primaryKeyModel.PrimaryKeyColumn()
+	}
+	if t := indirectType(reflect.TypeOf(mod)); t.Kind() == reflect.Struct {
+		if field, ok := primaryKeyStructField(t); ok {
+			if strings.Split(field.Tag.Get("bson"), ",")[0] == "_id" {
+				return "_id"
+			}
+			return fieldColumnNames(field)[0]
+		}
+		if field, ok := t.FieldByName("ID"); ok {
+			return fieldColumnNames(field)[0]
+		}
+	}
+	return "id"
+}
+
+func primaryKeyStructField(t reflect.Type) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous {
+			if embedded := indirectType(field.Type); embedded.Kind() == reflect.Struct {
+				if primaryKey, ok := primaryKeyStructField(embedded); ok {
+					return primaryKey, true
+				}
+			}
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		gormTag := strings.ToLower(strings.ReplaceAll(field.Tag.Get("gorm"), "_", ""))
+		if strings.Contains(gormTag, "primarykey") || strings.Split(field.Tag.Get("bson"), ",")[0] == "_id" {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// IDsFilter 返回 主键 IN ids 的过滤条件, 供各仓储实现 FindByIDs
+func IDsFilter(mod Model, ids interface{}) *FilterGroup {
+	return NewFilterGroup().In(PrimaryKeyColumn(mod), ids)
+}
+
+// Loader 合并并发的 FindByIDs, 见 NewLoader
+type Loader struct {
+	repo    BaseRepository
+	wait    time.Duration
+	mu      sync.Mutex
+	pending map[loaderKey]*loaderBatch
+}
+
+type loaderKey struct {
+	table      string
+	resultType reflect.Type // 结果切片类型
+}
+
+type loaderBatch struct {
+	mod   Model
+	ids   []interface{}
+	done  chan struct{}
+	items reflect.Value // 合并查询的结果切片
+	err   error
+}
+
+// NewLoader 创建请求内使用的 Loader, wait <= 0 时使用 DefaultLoaderWait
+func NewLoader(repo BaseRepository, wait time.Duration) *Loader {
+	if wait <= 0 {
+		wait = DefaultLoaderWait
+	}
+	return &Loader{repo: repo, wait: wait, pending: make(map[loaderKey]*loaderBatch)}
+}
+
+type loaderContextKey struct{}
+
+// WithLoader 在 ctx 中记录当前请求的 Loader
+func WithLoader(ctx context.Context, loader *Loader) context.Context {
+	return context.WithValue(ctx, loaderContextKey{}, loader)
+}
+
+// LoaderFromContext 返回 WithLoader 记录的 Loader
+func LoaderFromContext(ctx context.Context) (*Loader, bool) {
+	loader, ok := ctx.Value(loaderContextKey{}).(*Loader)
+	return loader, ok
+}
+
+// FindByIDs 与 BaseRepository.FindByIDs 相同, 同一模型的并发调用合并为一次查询
+func (l *Loader) FindByIDs(ctx context.Context, mod Model, result interface{}, ids interface{}) error {
+	resultValue := reflect.ValueOf(result)
+	if resultValue.Kind() != reflect.Ptr || resultValue.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("loader: result must be a pointer to slice, got %T", result)
+	}
+	idList := toInterfaceSlice(ids)
+	if len(idList) == 0 {
+		resultValue.Elem().Set(reflect.MakeSlice(resultValue.Elem().Type(), 0, 0))
+		return nil
+	}
+
+	key := loaderKey{table: mod.TableName(), resultType: resultValue.Elem().Type()}
+	l.mu.Lock()
+	batch, ok := l.pending[key]
+	if !ok {
+		batch = &loaderBatch{mod: mod, done: make(chan struct{})}
+		l.pending[key] = batch
+		time.AfterFunc(l.wait, func() {
+			l.dispatch(ctx, key, batch)
+		})
+	}
+	batch.ids = append(batch.ids, idList...)
+	l.mu.Unlock()
+
+	select {
+	case <-batch.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if batch.err != nil {
+		return batch.err
+	}
+
+	// 只取回本次请求的 id, 按 JSON 比较以忽略 int 与 int64 等类型差异
+	wanted := make(map[string]bool, len(idList))
+	for _, id := range idList {
+		wanted[jsonString(id)] = true
+	}
+	column := PrimaryKeyColumn(mod)
+	list := reflect.MakeSlice(key.resultType, 0, len(idList))
+	for i := 0; i < batch.items.Len(); i++ {
+		item := batch.items.Index(i)
+		if id, ok := ColumnValue(item.Interface(), column); ok && wanted[jsonString(id)] {
+			list = reflect.Append(list, item)
+		}
+	}
+	resultValue.Elem().Set(list)
+	return nil
+}
+
+// dispatch 执行合并后的查询, 之后到达的调用进入新的一批
+func (l *Loader) dispatch(ctx context.Context, key loaderKey, batch *loaderBatch) {
+	l.mu.Lock()
+	delete(l.pending, key)
+	seen := make(map[string]bool, len(batch.ids))
+	ids := make([]interface{}, 0, len(batch.ids))
+	for _, id := range batch.ids {
+		if idKey := jsonString(id); !seen[idKey] {
+			seen[idKey] = true
+			ids = append(ids, id)
+		}
+	}
+	l.mu.Unlock()
+
+	items := reflect.New(key.resultType)
+	batch.err = l.repo.FindByIDs(ctx, batch.mod, items.Interface(), ids)
+	batch.items = items.Elem()
+	close(batch.done)
+}
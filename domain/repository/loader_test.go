@@ -0,0 +1,55 @@
+package repository_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/henrion-y/base.services/domain/repository"
+)
+
+// lookupRepository 记录 FindByIDs 的调用
+type lookupRepository struct {
+	repository.BaseRepository
+	mu    sync.Mutex
+	calls [][]interface{}
+}
+
+func (r *lookupRepository) FindByIDs(ctx context.Context, mod repository.Model, result interface{}, ids interface{}) error {
+	r.mu.Lock()
+	r.calls = append(r.calls, ids.([]interface{}))
+	r.mu.Unlock()
+	return r.BaseRepository.FindByIDs(ctx, mod, result, ids)
+}
+
+func TestLoader(t *testing.T) {
+	ctx := context.Background()
+	repo := &lookupRepository{BaseRepository: newRepo(t)}
+	loader := repository.NewLoader(repo, 10*time.Millisecond)
+
+	requests := [][]int{{1, 2}, {2, 4}, {5}}
+	results := make([][]User, len(requests))
+	var wg sync.WaitGroup
+	for i, ids := range requests {
+		wg.Add(1)
+		go func(i int, ids []int) {
+			defer wg.Done()
+			if err := loader.FindByIDs(ctx, &User{}, &results[i], ids); err != nil {
+				t.Error(err)
+			}
+		}(i, ids)
+	}
+	wg.Wait()
+
+	if len(repo.calls) != 1 || len(repo.calls[0]) != 4 {
+		t.Fatalf("expect one merged query of 4 ids, got %v", repo.calls)
+	}
+	for i, want := range [][]string{{"张飞", "关羽"}, {"关羽", "赵云"}, nil} {
+		var names []string
+		for _, user := range results[i] {
+			names = append(names, user.Name)
+		}
+		assertNames(t, names, want...)
+	}
+}
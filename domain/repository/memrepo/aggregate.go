@@ -0,0 +1,222 @@
+package memrepo
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/henrion-y/base.services/domain/repository"
+)
+
+/*
+聚合语义与 SQL 一致: SUM/AVG/MIN/MAX 忽略 NULL, 没有非空值时结果为 NULL;
+不分组时即使没有匹配记录也返回一行
+*/
+
+func (r *memRepository) Aggregate(ctx context.Context, mod repository.Model, result interface{}, filterGroup *repository.FilterGroup, aggregateSpec *repository.AggregateSpec, sortSpecs *repository.SortSpecs, limitSpec *repository.LimitSpec) error {
+	filterGroup = repository.ExcludeDeleted(mod, filterGroup)
+	if err := aggregateSpec.Validate(); err != nil {
+		return err
+	}
+	if err := repository.ModelColumns(mod).CheckAggregate(filterGroup, aggregateSpec, sortSpecs); err != nil {
+		return err
+	}
+	if limitSpec != nil && limitSpec.UseCursor {
+		return repository.ErrAggregateCursorNotAllow
+	}
+	resultValue := reflect.ValueOf(result)
+	if resultValue.Kind() != reflect.Ptr || resultValue.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("memrepo: result must be a pointer to slice, got %T", result)
+	}
+
+	records, err := r.query(mod, filterGroup, nil)
+	if err != nil {
+		return err
+	}
+	rows, err := aggregateRecords(records, aggregateSpec)
+	if err != nil {
+		return err
+	}
+
+	var matched []reflect.Value
+	for _, row := range rows {
+		ok, err := matchGroup(row, aggregateSpec.Having)
+		if err != nil {
+			return err
+		}
+		if ok {
+			matched = append(matched, row)
+		}
+	}
+	if err = sortRecords(matched, sortSpecs); err != nil {
+		return err
+	}
+	matched = limitRecords(matched, limitSpec)
+
+	list := reflect.MakeSlice(resultValue.Elem().Type(), 0, len(matched))
+	for _, row := range matched {
+		item := reflect.New(list.Type().Elem()).Elem()
+		if err = assignRow(item, row.Interface().(map[string]interface{})); err != nil {
+			return err
+		}
+		list = reflect.Append(list, item)
+	}
+	resultValue.Elem().Set(list)
+	return nil
+}
+
+// aggregateRecords 按分组列聚合, 每组生成一行 map, 保持分组首次出现的顺序
+func aggregateRecords(records []reflect.Value, aggregateSpec *repository.AggregateSpec) ([]reflect.Value, error) {
+	var keys []string
+	groups := make(map[string][]reflect.Value)
+	for _, record := range records {
+		var builder strings.Builder
+		for _, column := range aggregateSpec.GroupBy {
+			field, ok := repository.FieldByColumn(record, column)
+			if !ok {
+				return nil, fmt.Errorf("memrepo: unknown column %s", column)
+			}
+			value := indirect(field)
+			fmt.Fprintf(&builder, "%T:%v|", value, value)
+		}
+		key := builder.String()
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], record)
+	}
+	if len(aggregateSpec.GroupBy) == 0 && len(keys) == 0 {
+		keys = append(keys, "")
+	}
+
+	rows := make([]reflect.Value, 0, len(keys))
+	for _, key := range keys {
+		group := groups[key]
+		row := make(map[string]interface{}, len(aggregateSpec.GroupBy)+len(aggregateSpec.Aggregations))
+		if len(group) > 0 {
+			for _, column := range aggregateSpec.GroupBy {
+				field, _ := repository.FieldByColumn(group[0], column)
+				row[column] = indirect(field)
+			}
+		}
+		for _, aggregation := range aggregateSpec.Aggregations {
+			value, err := aggregate(group, aggregation)
+			if err != nil {
+				return nil, err
+			}
+			row[aggregation.Alias] = value
+		}
+		rows = append(rows, reflect.ValueOf(row))
+	}
+	return rows, nil
+}
+
+func aggregate(records []reflect.Value, aggregation repository.Aggregation) (interface{}, error) {
+	if aggregation.Func == repository.AggregateFunc_COUNT && aggregation.Column == "" {
+		return int64(len(records)), nil
+	}
+
+	var values []interface{}
+	for _, record := range records {
+		field, ok := repository.FieldByColumn(record, aggregation.Column)
+		if !ok {
+			return nil, fmt.Errorf("memrepo: unknown column %s", aggregation.Column)
+		}
+		if value := indirect(field); value != nil {
+			values = append(values, value)
+		}
+	}
+
+	switch aggregation.Func {
+	case repository.AggregateFunc_COUNT:
+		return int64(len(values)), nil
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	switch aggregation.Func {
+	case repository.AggregateFunc_SUM, repository.AggregateFunc_AVG:
+		var intSum int64
+		var floatSum float64
+		allInt := true
+		for _, value := range values {
+			v := reflect.ValueOf(value)
+			if !isNumber(v) {
+				return nil, fmt.Errorf("memrepo: cannot %s non-numeric column %s", aggregation.Func, aggregation.Column)
+			}
+			if isInt(v) {
+				intSum += v.Int()
+			} else {
+				allInt = false
+			}
+			floatSum += toFloat(v)
+		}
+		if aggregation.Func == repository.AggregateFunc_AVG {
+			return floatSum / float64(len(values)), nil
+		}
+		if allInt {
+			return intSum, nil
+		}
+		return floatSum, nil
+	default:
+		best := values[0]
+		for _, value := range values[1:] {
+			result, ok := compareValues(value, best)
+			if !ok {
+				return nil, fmt.Errorf("memrepo: cannot compare values of column %s", aggregation.Column)
+			}
+			if (aggregation.Func == repository.AggregateFunc_MIN && result < 0) ||
+				(aggregation.Func == repository.AggregateFunc_MAX && result > 0) {
+				best = value
+			}
+		}
+		return best, nil
+	}
+}
+
+// assignRow 将聚合结果行写入结构体(按列名匹配字段)或 map
+func assignRow(dst reflect.Value, row map[string]interface{}) error {
+	switch dst.Kind() {
+	case reflect.Ptr:
+		ptr := reflect.New(dst.Type().Elem())
+		if err := assignRow(ptr.Elem(), row); err != nil {
+			return err
+		}
+		dst.Set(ptr)
+		return nil
+	case reflect.Map:
+		if dst.Type().Key().Kind() != reflect.String {
+			break
+		}
+		dst.Set(reflect.MakeMapWithSize(dst.Type(), len(row)))
+		for column, value := range row {
+			item := reflect.New(dst.Type().Elem()).Elem()
+			if err := setValue(item, value); err != nil {
+				return fmt.Errorf("memrepo: column %s: %w", column, err)
+			}
+			dst.SetMapIndex(reflect.ValueOf(column).Convert(dst.Type().Key()), item)
+		}
+		return nil
+	case reflect.Struct:
+		for i := 0; i < dst.NumField(); i++ {
+			fieldType := dst.Type().Field(i)
+			if fieldType.PkgPath != "" {
+				continue
+			}
+			for _, name := range repository.StructFieldColumnNames(fieldType) {
+				value, ok := row[name]
+				if !ok {
+					continue
+				}
+				if err := setValue(dst.Field(i), value); err != nil {
+					return fmt.Errorf("memrepo: column %s: %w", name, err)
+				}
+				break
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("memrepo: cannot scan aggregate row into %s", dst.Type())
+}
@@ -0,0 +1,256 @@
+package memrepo
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/henrion-y/base.services/domain/repository"
+)
+
+// copyRecord 复制结构体, 返回指向副本的指针
+func copyRecord(record reflect.Value) reflect.Value {
+	ptr := reflect.New(record.Type())
+	ptr.Elem().Set(record)
+	return ptr
+}
+
+// assignRecord 将记录写入 dst, dst 可以是同类型结构体(指针)、其他结构体(按列名匹配字段)或 map[string]interface{}.
+// fields 不为空时只写入指定列, 与数据库的 select 行为一致
+func assignRecord(dst reflect.Value, record reflect.Value, fields []string) error {
+	switch dst.Kind() {
+	case reflect.Ptr:
+		ptr := reflect.New(dst.Type().Elem())
+		if err := assignRecord(ptr.Elem(), record, fields); err != nil {
+			return err
+		}
+		dst.Set(ptr)
+		return nil
+	case reflect.Interface:
+		if dst.NumMethod() == 0 {
+			dst.Set(copyRecord(record.Elem()))
+			return nil
+		}
+		if record.Type().Implements(dst.Type()) {
+			dst.Set(copyRecord(record.Elem()))
+			return nil
+		}
+	case reflect.Struct:
+		if dst.Type() == record.Elem().Type() && len(fields) == 0 {
+			dst.Set(record.Elem())
+			return nil
+		}
+		return assignStruct(dst, record, fields)
+	case reflect.Map:
+		if dst.Type().Key().Kind() != reflect.String {
+			break
+		}
+		if dst.IsNil() {
+			dst.Set(reflect.MakeMap(dst.Type()))
+		}
+		for _, column := range repository.StructColumns(record.Type()) {
+			if len(fields) > 0 && !containsAny(fields, column) {
+				continue
+			}
+			value, _ := repository.FieldByColumn(record, column)
+			item := reflect.New(dst.Type().Elem()).Elem()
+			if err := setValue(item, value.Interface()); err != nil {
+				return fmt.Errorf("memrepo: column %s: %w", column, err)
+			}
+			dst.SetMapIndex(reflect.ValueOf(column).Convert(dst.Type().Key()), item)
+		}
+		return nil
+	}
+	return fmt.Errorf("memrepo: cannot scan %s into %s", record.Elem().Type(), dst.Type())
+}
+
+func assignStruct(dst reflect.Value, record reflect.Value, fields []string) error {
+	typ := dst.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		fieldType := typ.Field(i)
+		if fieldType.Anonymous && indirectType(fieldType.Type).Kind() == reflect.Struct {
+			if err := assignRecordField(dst.Field(i), record, fields); err != nil {
+				return err
+			}
+			continue
+		}
+		if fieldType.PkgPath != "" {
+			continue
+		}
+
+		names := repository.StructFieldColumnNames(fieldType)
+		if len(fields) > 0 && !containsAny(fields, names...) {
+			continue
+		}
+		for _, name := range names {
+			value, ok := repository.FieldByColumn(record, name)
+			if !ok {
+				continue
+			}
+			if err := setValue(dst.Field(i), value.Interface()); err != nil {
+				return fmt.Errorf("memrepo: column %s: %w", name, err)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// assignRecordField 写入匿名嵌入的结构体字段
+func assignRecordField(field reflect.Value, record reflect.Value, fields []string) error {
+	if !field.CanSet() {
+		return nil
+	}
+	if field.Kind() == reflect.Ptr {
+		ptr := reflect.New(field.Type().Elem())
+		if err := assignStruct(ptr.Elem(), record, fields); err != nil {
+			return err
+		}
+		field.Set(ptr)
+		return nil
+	}
+	return assignStruct(field, record, fields)
+}
+
+// setValue 赋值, 支持指针与非指针之间、可转换类型之间的赋值
+func setValue(field reflect.Value, value interface{}) error {
+	if value == nil {
+		field.Set(reflect.Zero(field.Type()))
+		return nil
+	}
+
+	v := reflect.ValueOf(value)
+	if v.Kind() == reflect.Ptr && !v.Type().AssignableTo(field.Type()) {
+		if v.IsNil() {
+			field.Set(reflect.Zero(field.Type()))
+			return nil
+		}
+		v = v.Elem()
+	}
+
+	switch {
+	case v.Type().AssignableTo(field.Type()):
+		field.Set(v)
+	case field.Kind() == reflect.Ptr:
+		ptr := reflect.New(field.Type().Elem())
+		if err := setValue(ptr.Elem(), v.Interface()); err != nil {
+			return err
+		}
+		field.Set(ptr)
+	case v.Type().ConvertibleTo(field.Type()) && !(isNumber(v) && field.Kind() == reflect.String):
+		// 数值转字符串会被当作 rune 处理, 不允许
+		field.Set(v.Convert(field.Type()))
+	default:
+		return fmt.Errorf("cannot assign %s to %s", v.Type(), field.Type())
+	}
+	return nil
+}
+
+func containsAny(list []string, values ...string) bool {
+	for _, item := range list {
+		for _, value := range values {
+			if item == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applyUpdate 在记录上执行一个单列更新, 语义见 repository.UpdateSpec
+func applyUpdate(record reflect.Value, assignment repository.UpdateAssignment) error {
+	field, ok := repository.FieldByColumn(record, assignment.Column)
+	if !ok || !field.CanSet() {
+		return fmt.Errorf("memrepo: unknown column %s", assignment.Column)
+	}
+
+	var err error
+	switch assignment.Operator {
+	case repository.UpdateOperator_INC:
+		err = incrementValue(field, assignment.Value)
+	case repository.UpdateOperator_UNSET:
+		field.Set(reflect.Zero(field.Type()))
+	case repository.UpdateOperator_MIN, repository.UpdateOperator_MAX:
+		if isNil(field.Interface()) {
+			err = setValue(field, assignment.Value)
+			break
+		}
+		result, ok := compareValues(assignment.Value, field.Interface())
+		if !ok {
+			err = fmt.Errorf("cannot compare %T with %s", assignment.Value, field.Type())
+			break
+		}
+		if (assignment.Operator == repository.UpdateOperator_MIN && result < 0) ||
+			(assignment.Operator == repository.UpdateOperator_MAX && result > 0) {
+			err = setValue(field, assignment.Value)
+		}
+	case repository.UpdateOperator_CURRENT_DATE:
+		err = setValue(field, time.Now())
+	case repository.UpdateOperator_PUSH, repository.UpdateOperator_ADD_TO_SET, repository.UpdateOperator_PULL:
+		err = updateSlice(field, assignment)
+	default:
+		err = setValue(field, assignment.Value)
+	}
+	if err != nil {
+		return fmt.Errorf("memrepo: column %s: %w", assignment.Column, err)
+	}
+	return nil
+}
+
+// incrementValue 数值字段加上 value, 指针字段为 nil 时视为 0.
+// 记录是浅拷贝, 指针字段须重新分配, 避免修改原记录
+func incrementValue(field reflect.Value, value interface{}) error {
+	target := field
+	if field.Kind() == reflect.Ptr {
+		ptr := reflect.New(field.Type().Elem())
+		if !field.IsNil() {
+			ptr.Elem().Set(field.Elem())
+		}
+		field.Set(ptr)
+		target = ptr.Elem()
+	}
+
+	v := reflect.ValueOf(indirect(reflect.ValueOf(value)))
+	if !v.IsValid() || !isNumber(v) || !isNumber(target) {
+		return fmt.Errorf("cannot increment %s by %T", field.Type(), value)
+	}
+	delta := v.Convert(target.Type())
+	switch {
+	case isInt(target):
+		target.SetInt(target.Int() + delta.Int())
+	case isUint(target):
+		target.SetUint(target.Uint() + delta.Uint())
+	default:
+		target.SetFloat(target.Float() + delta.Float())
+	}
+	return nil
+}
+
+// updateSlice 执行 $push、$addToSet、$pull, 总是生成新的切片, 避免修改原记录
+func updateSlice(field reflect.Value, assignment repository.UpdateAssignment) error {
+	if field.Kind() != reflect.Slice {
+		return fmt.Errorf("%s requires a slice, got %s", assignment.Operator, field.Type())
+	}
+	item := reflect.New(field.Type().Elem()).Elem()
+	if err := setValue(item, assignment.Value); err != nil {
+		return err
+	}
+
+	exists := false
+	result := reflect.MakeSlice(field.Type(), 0, field.Len()+1)
+	for i := 0; i < field.Len(); i++ {
+		if equalValues(field.Index(i).Interface(), item.Interface()) {
+			exists = true
+			if assignment.Operator == repository.UpdateOperator_PULL {
+				continue
+			}
+		}
+		result = reflect.Append(result, field.Index(i))
+	}
+	if assignment.Operator == repository.UpdateOperator_PUSH ||
+		(assignment.Operator == repository.UpdateOperator_ADD_TO_SET && !exists) {
+		result = reflect.Append(result, item)
+	}
+	field.Set(result)
+	return nil
+}
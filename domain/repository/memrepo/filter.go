@@ -0,0 +1,393 @@
+package memrepo
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/henrion-y/base.services/domain/repository"
+)
+
+/*
+过滤、排序语义与 SQL 构建器保持一致:
+1. 组内 Filters 与 Groups 按组的 Logic 连接, 默认 AND
+2. 列值为 NULL 时除 IS_NULL 外的比较均不成立; EQ/NE 的比较值为 nil 时等价于 IS_NULL/IS_NOT_NULL
+3. LIKE 系列按 SQL 通配符 % _ 匹配, 不区分大小写; REGEX 按 Go 正则匹配
+4. ARRAY_CONTAINS/ARRAY_CONTAINS_ANY 要求列为切片或数组, 地理位置条件要求列为 geo.Coordinate、GeoPoint 或 [经度, 纬度]
+5. 排序时 NULL 视为最小值
+*/
+
+// matchGroup 判断记录是否满足过滤组
+func matchGroup(record reflect.Value, g *repository.FilterGroup) (bool, error) {
+	if g == nil {
+		return true, nil
+	}
+
+	or := g.Logic == repository.FilterLogic_OR
+	conditions := 0
+	for _, filter := range g.Filters {
+		matched, err := matchFilter(record, filter)
+		if err != nil {
+			return false, err
+		}
+		conditions++
+		if or && matched {
+			return true, nil
+		}
+		if !or && !matched {
+			return false, nil
+		}
+	}
+	for _, subGroup := range g.Groups {
+		if isEmptyGroup(subGroup) {
+			continue
+		}
+		matched, err := matchGroup(record, subGroup)
+		if err != nil {
+			return false, err
+		}
+		conditions++
+		if or && matched {
+			return true, nil
+		}
+		if !or && !matched {
+			return false, nil
+		}
+	}
+
+	// 没有任何条件时视为匹配; OR 组有条件但都未命中时不匹配
+	return !or || conditions == 0, nil
+}
+
+func isEmptyGroup(g *repository.FilterGroup) bool {
+	if g == nil {
+		return true
+	}
+	if len(g.Filters) > 0 {
+		return false
+	}
+	for _, subGroup := range g.Groups {
+		if !isEmptyGroup(subGroup) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchFilter(record reflect.Value, filter repository.FilterSpec) (bool, error) {
+	field, ok := repository.FieldByColumn(record, filter.Column)
+	if !ok {
+		return false, fmt.Errorf("memrepo: unknown column %s", filter.Column)
+	}
+	value := indirect(field)
+
+	switch filter.FilterType {
+	case repository.FilterType_IS_NULL:
+		return value == nil, nil
+	case repository.FilterType_IS_NOT_NULL:
+		return value != nil, nil
+	case repository.FilterType_EXISTS:
+		return (value != nil) == filter.Exists(), nil
+	case repository.FilterType_EQ:
+		if isNil(filter.Value) {
+			return value == nil, nil
+		}
+	case repository.FilterType_NE:
+		if isNil(filter.Value) {
+			return value != nil, nil
+		}
+	}
+
+	if value == nil {
+		return false, nil
+	}
+
+	switch filter.FilterType {
+	case repository.FilterType_EQ:
+		return equalValues(value, filter.Value), nil
+	case repository.FilterType_NE:
+		return !equalValues(value, filter.Value), nil
+	case repository.FilterType_GT, repository.FilterType_GTE, repository.FilterType_LT, repository.FilterType_LTE:
+		result, ok := compareValues(value, filter.Value)
+		if !ok {
+			return false, fmt.Errorf("memrepo: cannot compare column %s with %T", filter.Column, filter.Value)
+		}
+		switch filter.FilterType {
+		case repository.FilterType_GT:
+			return result > 0, nil
+		case repository.FilterType_GTE:
+			return result >= 0, nil
+		case repository.FilterType_LT:
+			return result < 0, nil
+		default:
+			return result <= 0, nil
+		}
+	case repository.FilterType_IN, repository.FilterType_NOT_IN:
+		values := reflect.ValueOf(filter.Value)
+		if values.Kind() != reflect.Slice && values.Kind() != reflect.Array {
+			return false, fmt.Errorf("memrepo: %s value of column %s must be a slice", filter.FilterType, filter.Column)
+		}
+		in := false
+		for i := 0; i < values.Len(); i++ {
+			if equalValues(value, values.Index(i).Interface()) {
+				in = true
+				break
+			}
+		}
+		return in == (filter.FilterType == repository.FilterType_IN), nil
+	case repository.FilterType_BETWEEN:
+		values := filter.Values()
+		if len(values) != 2 {
+			return false, fmt.Errorf("memrepo: BETWEEN value of column %s must be a slice of two elements", filter.Column)
+		}
+		lower, ok1 := compareValues(value, values[0])
+		upper, ok2 := compareValues(value, values[1])
+		if !ok1 || !ok2 {
+			return false, fmt.Errorf("memrepo: cannot compare column %s with %T", filter.Column, values[0])
+		}
+		return lower >= 0 && upper <= 0, nil
+	case repository.FilterType_LIKE, repository.FilterType_NOT_LIKE, repository.FilterType_STARTS_WITH,
+		repository.FilterType_ENDS_WITH, repository.FilterType_CONTAINS:
+		pattern, ok := filter.LikePattern()
+		if !ok {
+			return false, fmt.Errorf("memrepo: %s value of column %s must be a string", filter.FilterType, filter.Column)
+		}
+		matched := likeRegexp(pattern).MatchString(fmt.Sprint(value))
+		return matched == (filter.FilterType != repository.FilterType_NOT_LIKE), nil
+	case repository.FilterType_REGEX:
+		pattern, ok := filter.Value.(string)
+		if !ok {
+			return false, fmt.Errorf("memrepo: REGEX value of column %s must be a string", filter.Column)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return false, fmt.Errorf("memrepo: invalid REGEX value of column %s: %w", filter.Column, err)
+		}
+		return re.MatchString(fmt.Sprint(value)), nil
+	case repository.FilterType_NEAR, repository.FilterType_WITHIN_RADIUS, repository.FilterType_WITHIN_BOX, repository.FilterType_WITHIN_POLYGON:
+		coordinate, ok := repository.ToCoordinate(value)
+		if !ok {
+			return false, fmt.Errorf("memrepo: column %s is not a location", filter.Column)
+		}
+		switch area := filter.Value.(type) {
+		case repository.GeoRadius:
+			return area.Contains(coordinate), nil
+		case repository.GeoBox:
+			return area.Contains(coordinate), nil
+		case repository.GeoPolygon:
+			return area.Contains(coordinate), nil
+		default:
+			return false, fmt.Errorf("memrepo: invalid %s value of column %s", filter.FilterType, filter.Column)
+		}
+	case repository.FilterType_ARRAY_CONTAINS, repository.FilterType_ARRAY_CONTAINS_ANY:
+		array := reflect.ValueOf(value)
+		if array.Kind() != reflect.Slice && array.Kind() != reflect.Array {
+			return false, fmt.Errorf("memrepo: column %s is not an array", filter.Column)
+		}
+		matchAny := filter.FilterType == repository.FilterType_ARRAY_CONTAINS_ANY
+		for _, expected := range filter.Values() {
+			found := false
+			for i := 0; i < array.Len(); i++ {
+				if equalValues(array.Index(i).Interface(), expected) {
+					found = true
+					break
+				}
+			}
+			if found == matchAny {
+				return matchAny, nil
+			}
+		}
+		return !matchAny, nil
+	default:
+		return false, fmt.Errorf("memrepo: unsupported filter type %s", filter.FilterType)
+	}
+}
+
+// likeRegexp 将 SQL LIKE 模式转换为正则, 支持 \ 转义
+func likeRegexp(pattern string) *regexp.Regexp {
+	return regexp.MustCompile("(?is)" + repository.LikeToRegex(pattern))
+}
+
+// sortRecords 按排序规则稳定排序
+func sortRecords(records []reflect.Value, sortSpecs *repository.SortSpecs) error {
+	if sortSpecs == nil || len(*sortSpecs) == 0 {
+		return nil
+	}
+	for _, spec := range *sortSpecs {
+		for _, record := range records {
+			if _, ok := repository.FieldByColumn(record, spec.Property); !ok {
+				return fmt.Errorf("memrepo: unknown sort property %s", spec.Property)
+			}
+		}
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		for _, spec := range *sortSpecs {
+			a, _ := repository.FieldByColumn(records[i], spec.Property)
+			b, _ := repository.FieldByColumn(records[j], spec.Property)
+			result := compareForSort(sortValue(a, spec), sortValue(b, spec))
+			if result == 0 {
+				continue
+			}
+			if spec.Type == repository.SortType_DESC {
+				return result > 0
+			}
+			return result < 0
+		}
+		return false
+	})
+	return nil
+}
+
+// sortValue 距离排序时返回到中心点的距离, 不是位置的值视为 NULL
+func sortValue(field reflect.Value, spec repository.SortSpec) interface{} {
+	value := indirect(field)
+	if spec.Near == nil || value == nil {
+		return value
+	}
+	coordinate, ok := repository.ToCoordinate(value)
+	if !ok {
+		return nil
+	}
+	return spec.Near.DistanceTo(coordinate)
+}
+
+func compareForSort(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	result, _ := compareValues(a, b)
+	return result
+}
+
+func equalValues(a, b interface{}) bool {
+	if result, ok := compareValues(a, b); ok {
+		return result == 0
+	}
+	return reflect.DeepEqual(indirect(reflect.ValueOf(a)), indirect(reflect.ValueOf(b)))
+}
+
+// compareValues 比较两个值, 数值类型之间、字符串、时间、布尔可比较
+func compareValues(a, b interface{}) (int, bool) {
+	a, b = indirect(reflect.ValueOf(a)), indirect(reflect.ValueOf(b))
+	if a == nil || b == nil {
+		return 0, false
+	}
+
+	if at, ok := a.(time.Time); ok {
+		bt, ok := b.(time.Time)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case at.Before(bt):
+			return -1, true
+		case at.After(bt):
+			return 1, true
+		default:
+			return 0, true
+		}
+	}
+
+	// 与 mongo 一致, ObjectID 按字节比较, 即按生成时间排序
+	if aid, ok := a.(primitive.ObjectID); ok {
+		bid, ok := b.(primitive.ObjectID)
+		if !ok {
+			return 0, false
+		}
+		return bytes.Compare(aid[:], bid[:]), true
+	}
+
+	av, bv := reflect.ValueOf(a), reflect.ValueOf(b)
+	switch {
+	case isInt(av) && isInt(bv):
+		return compareOrdered(av.Int(), bv.Int()), true
+	case isUint(av) && isUint(bv):
+		return compareOrdered(av.Uint(), bv.Uint()), true
+	case isNumber(av) && isNumber(bv):
+		return compareOrdered(toFloat(av), toFloat(bv)), true
+	case av.Kind() == reflect.String && bv.Kind() == reflect.String:
+		return strings.Compare(av.String(), bv.String()), true
+	case av.Kind() == reflect.Bool && bv.Kind() == reflect.Bool:
+		return compareOrdered(boolToInt(av.Bool()), boolToInt(bv.Bool())), true
+	}
+	return 0, false
+}
+
+func compareOrdered[T int64 | uint64 | float64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func isInt(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return false
+}
+
+func isUint(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	}
+	return false
+}
+
+func isNumber(v reflect.Value) bool {
+	return isInt(v) || isUint(v) || v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64
+}
+
+func toFloat(v reflect.Value) float64 {
+	switch {
+	case isInt(v):
+		return float64(v.Int())
+	case isUint(v):
+		return float64(v.Uint())
+	default:
+		return v.Float()
+	}
+}
+
+func boolToInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func isNil(value interface{}) bool {
+	return indirect(reflect.ValueOf(value)) == nil
+}
+
+// indirect 解引用指针与接口, nil 返回 nil
+func indirect(v reflect.Value) interface{} {
+	for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if !v.IsValid() || !v.CanInterface() {
+		return nil
+	}
+	return v.Interface()
+}
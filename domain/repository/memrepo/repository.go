@@ -0,0 +1,635 @@
+package memrepo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/henrion-y/base.services/domain/repository"
+)
+
+/*
+内存版 BaseRepository, 用于业务代码的单元测试, 过滤、排序、翻页语义与 gormrepo/mongorepo 保持一致.
+每张表只存放同一种模型结构体, 记录在写入与读出时都会复制, 调用方修改返回值不会影响存储
+*/
+
+type memRepository struct {
+	store *store
+	inTx  bool // 是否为事务内的仓储
+}
+
+type store struct {
+	mu     sync.RWMutex
+	tables map[string]*table
+	txMu   sync.Mutex // 事务串行执行
+}
+
+type table struct {
+	typ     reflect.Type    // 模型结构体类型
+	records []reflect.Value // 指向结构体副本的指针
+	autoID  int64
+}
+
+func NewBaseRepository() repository.BaseRepository {
+	return &memRepository{store: &store{tables: make(map[string]*table)}}
+}
+
+func (r *memRepository) Create(ctx context.Context, mod repository.Model) error {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	return r.store.insert(mod)
+}
+
+// CreateBatch 逐条写入, 某条失败时已写入的记录保留, 与 mongorepo 的有序批量写入一致
+func (r *memRepository) CreateBatch(ctx context.Context, models interface{}, batchSize int) ([]int64, error) {
+	batches, err := repository.SplitBatches(models, batchSize)
+	if err != nil || len(batches) == 0 {
+		return nil, err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	counts := make([]int64, 0, len(batches))
+	for _, batch := range batches {
+		var count int64
+		for _, item := range batch.Items {
+			if err = r.store.insert(item); err != nil {
+				if count > 0 {
+					counts = append(counts, count)
+				}
+				return counts, err
+			}
+			count++
+		}
+		counts = append(counts, count)
+	}
+	return counts, nil
+}
+
+// Upsert conflictColumns 为空时按主键匹配, 插入或更新都返回 1, 更新时保留原记录的主键
+func (r *memRepository) Upsert(ctx context.Context, mod repository.Model, conflictColumns []string, updateColumns []string) (int64, error) {
+	columns := repository.ModelColumns(mod)
+	if err := columns.Check(conflictColumns...); err != nil {
+		return 0, err
+	}
+	if err := columns.Check(updateColumns...); err != nil {
+		return 0, err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	modValue := reflect.Indirect(reflect.ValueOf(mod))
+	if modValue.Kind() != reflect.Struct {
+		return 0, fmt.Errorf("memrepo: model must be a struct, got %T", mod)
+	}
+	t, err := r.store.table(mod.TableName(), modValue.Type())
+	if err != nil {
+		return 0, err
+	}
+
+	idx, err := t.findConflict(modValue, conflictColumns)
+	if err != nil {
+		return 0, err
+	}
+	if idx < 0 {
+		return 1, r.store.insert(mod)
+	}
+
+	record := copyRecord(t.records[idx].Elem())
+	if len(updateColumns) == 0 {
+		// 更新全部列, 主键保持不变
+		record = copyRecord(modValue)
+		if primaryKey, ok := primaryKeyField(record.Elem()); ok {
+			existing, _ := primaryKeyField(t.records[idx].Elem())
+			primaryKey.Set(existing)
+		}
+	} else {
+		for _, column := range updateColumns {
+			src, ok := repository.FieldByColumn(modValue, column)
+			dst, dstOk := repository.FieldByColumn(record, column)
+			if !ok || !dstOk || !dst.CanSet() {
+				return 0, fmt.Errorf("memrepo: unknown column %s", column)
+			}
+			if err = setValue(dst, src.Interface()); err != nil {
+				return 0, fmt.Errorf("memrepo: column %s: %w", column, err)
+			}
+		}
+	}
+	// 乐观锁: 冲突时版本在原值上加 1, 不使用模型中的版本
+	if _, ok := repository.VersionColumn(mod); ok {
+		version := repository.ModelVersion(t.records[idx].Interface().(repository.Model))
+		repository.SetModelVersion(record.Interface().(repository.Model), version+1)
+	}
+	t.records[idx] = record
+	return 1, nil
+}
+
+// insert 写入一条记录, 调用方需持有写锁
+func (s *store) insert(mod repository.Model) error {
+	repository.InitVersion(mod)
+	modValue := reflect.ValueOf(mod)
+	structType := reflect.Indirect(modValue).Type()
+	if structType.Kind() != reflect.Struct {
+		return fmt.Errorf("memrepo: model must be a struct, got %T", mod)
+	}
+	t, err := s.table(mod.TableName(), structType)
+	if err != nil {
+		return err
+	}
+
+	// 与数据库自增主键一致, 主键为零值时自动分配并回写到 mod
+	if modValue.Kind() == reflect.Ptr {
+		t.fillPrimaryKey(modValue.Elem())
+	}
+	t.records = append(t.records, copyRecord(reflect.Indirect(modValue)))
+	return nil
+}
+
+func (r *memRepository) Update(ctx context.Context, mod repository.Model, data map[string]interface{}, filterGroup *repository.FilterGroup) (int64, error) {
+	filterGroup = repository.ExcludeDeleted(mod, filterGroup)
+	column, ok := repository.VersionColumn(mod)
+	if !ok {
+		return r.update(mod, data, filterGroup, "")
+	}
+
+	filterGroup, version := repository.VersionFilter(mod, filterGroup)
+	rowsAffected, err := r.update(mod, data, filterGroup, column)
+	if err != nil {
+		return 0, err
+	}
+	if err = repository.CheckVersion(mod, version, rowsAffected); err != nil {
+		return 0, err
+	}
+	return rowsAffected, nil
+}
+
+// update versionColumn 不为空时将该列加 1
+func (r *memRepository) update(mod repository.Model, data map[string]interface{}, filterGroup *repository.FilterGroup, versionColumn string) (int64, error) {
+	if versionColumn != "" {
+		data = repository.WithUpdateOperator(data, repository.UpdateOperator_INC, versionColumn, 1)
+	}
+	columns := repository.ModelColumns(mod)
+	if err := columns.CheckData(data); err != nil {
+		return 0, err
+	}
+	assignments, err := repository.ParseUpdateData(data)
+	if err != nil {
+		return 0, err
+	}
+	if err := columns.CheckFilter(filterGroup); err != nil {
+		return 0, err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	t := r.store.tables[mod.TableName()]
+	if t == nil {
+		return 0, nil
+	}
+	matched, err := t.filter(filterGroup)
+	if err != nil {
+		return 0, err
+	}
+
+	// 先在副本上赋值, 全部成功后再替换, 避免部分更新
+	updated := make([]reflect.Value, len(matched))
+	for i, idx := range matched {
+		record := copyRecord(t.records[idx].Elem())
+		for _, assignment := range assignments {
+			if err = applyUpdate(record, assignment); err != nil {
+				return 0, err
+			}
+		}
+		updated[i] = record
+	}
+	for i, idx := range matched {
+		t.records[idx] = updated[i]
+	}
+	return int64(len(matched)), nil
+}
+
+func (r *memRepository) Delete(ctx context.Context, mod repository.Model, filterGroup *repository.FilterGroup) error {
+	if column, ok := repository.SoftDeleteColumn(mod); ok {
+		_, err := r.Update(ctx, mod, map[string]interface{}{column: time.Now()}, filterGroup)
+		return err
+	}
+
+	if err := repository.ModelColumns(mod).CheckFilter(filterGroup); err != nil {
+		return err
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	t := r.store.tables[mod.TableName()]
+	if t == nil {
+		return nil
+	}
+	matched, err := t.filter(filterGroup)
+	if err != nil {
+		return err
+	}
+
+	deleted := make(map[int]bool, len(matched))
+	for _, idx := range matched {
+		deleted[idx] = true
+	}
+	records := t.records[:0:0]
+	for idx, record := range t.records {
+		if !deleted[idx] {
+			records = append(records, record)
+		}
+	}
+	t.records = records
+	return nil
+}
+
+func (r *memRepository) Restore(ctx context.Context, mod repository.Model, filterGroup *repository.FilterGroup) (int64, error) {
+	filterGroup, err := repository.OnlyDeleted(mod, filterGroup)
+	if err != nil {
+		return 0, err
+	}
+	column, _ := repository.SoftDeleteColumn(mod)
+	return r.update(mod, map[string]interface{}{column: nil}, filterGroup, "")
+}
+
+func (r *memRepository) Find(ctx context.Context, mod repository.Model, result interface{}, fields []string, filterGroup *repository.FilterGroup, sortSpecs *repository.SortSpecs, limitSpec *repository.LimitSpec) error {
+	return r.find(mod, result, fields, repository.ExcludeDeleted(mod, filterGroup), sortSpecs, limitSpec)
+}
+
+func (r *memRepository) FindWithDeleted(ctx context.Context, mod repository.Model, result interface{}, fields []string, filterGroup *repository.FilterGroup, sortSpecs *repository.SortSpecs, limitSpec *repository.LimitSpec) error {
+	return r.find(mod, result, fields, filterGroup, sortSpecs, limitSpec)
+}
+
+func (r *memRepository) find(mod repository.Model, result interface{}, fields []string, filterGroup *repository.FilterGroup, sortSpecs *repository.SortSpecs, limitSpec *repository.LimitSpec) error {
+	resultValue := reflect.ValueOf(result)
+	if resultValue.Kind() != reflect.Ptr || resultValue.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("memrepo: result must be a pointer to slice, got %T", result)
+	}
+	if err := repository.ModelColumns(mod).CheckQuery(fields, filterGroup, sortSpecs); err != nil {
+		return err
+	}
+
+	if limitSpec != nil {
+		fields, sortSpecs = limitSpec.CursorSpecs(mod, fields, sortSpecs)
+		var err error
+		filterGroup, err = limitSpec.BuildCursorFilter(filterGroup, sortSpecs)
+		if err != nil {
+			return err
+		}
+	}
+
+	records, err := r.query(mod, filterGroup, sortSpecs)
+	if err != nil {
+		return err
+	}
+	records = limitRecords(records, limitSpec)
+
+	list := reflect.MakeSlice(resultValue.Elem().Type(), 0, len(records))
+	for _, record := range records {
+		item := reflect.New(list.Type().Elem()).Elem()
+		if err = assignRecord(item, record, fields); err != nil {
+			return err
+		}
+		list = reflect.Append(list, item)
+	}
+	resultValue.Elem().Set(list)
+
+	if limitSpec != nil {
+		return limitSpec.FillNextCursor(result, sortSpecs)
+	}
+	return nil
+}
+
+// FindEach 先按条件取出记录副本, 再分批赋值给 result
+func (r *memRepository) FindEach(ctx context.Context, mod repository.Model, result interface{}, fields []string, filterGroup *repository.FilterGroup, sortSpecs *repository.SortSpecs, batchSize int, fn func() error) error {
+	filterGroup = repository.ExcludeDeleted(mod, filterGroup)
+	if err := repository.ModelColumns(mod).CheckQuery(fields, filterGroup, sortSpecs); err != nil {
+		return err
+	}
+	batch, err := repository.NewEachBatch(ctx, result, batchSize, fn)
+	if err != nil {
+		return err
+	}
+
+	records, err := r.query(mod, filterGroup, sortSpecs)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		err = batch.Add(func(dest interface{}) error {
+			return assignRecord(reflect.ValueOf(dest).Elem(), record, fields)
+		})
+		if err != nil {
+			return repository.EachResult(err)
+		}
+	}
+	return repository.EachResult(batch.Flush())
+}
+
+func (r *memRepository) FindOne(ctx context.Context, mod repository.Model, fields []string, filterGroup *repository.FilterGroup, sortSpecs *repository.SortSpecs) error {
+	modValue := reflect.ValueOf(mod)
+	if modValue.Kind() != reflect.Ptr {
+		return fmt.Errorf("memrepo: FindOne model must be a pointer, got %T", mod)
+	}
+	filterGroup = repository.ExcludeDeleted(mod, filterGroup)
+	if err := repository.ModelColumns(mod).CheckQuery(fields, filterGroup, sortSpecs); err != nil {
+		return err
+	}
+
+	records, err := r.query(mod, filterGroup, sortSpecs)
+	if err != nil || len(records) == 0 {
+		// 与 gormrepo/mongorepo 一致, 记录不存在时不返回错误
+		return err
+	}
+	return assignRecord(modValue.Elem(), records[0], fields)
+}
+
+func (r *memRepository) Count(ctx context.Context, mod repository.Model, filterGroup *repository.FilterGroup) (int64, error) {
+	filterGroup = repository.ExcludeDeleted(mod, filterGroup)
+	if err := repository.ModelColumns(mod).CheckFilter(filterGroup); err != nil {
+		return 0, err
+	}
+
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	t := r.store.tables[mod.TableName()]
+	if t == nil {
+		return 0, nil
+	}
+	matched, err := t.filter(filterGroup)
+	return int64(len(matched)), err
+}
+
+func (r *memRepository) FindByIDs(ctx context.Context, mod repository.Model, result interface{}, ids interface{}) error {
+	return r.Find(ctx, mod, result, nil, repository.IDsFilter(mod, ids), nil, nil)
+}
+
+func (r *memRepository) Exists(ctx context.Context, mod repository.Model, filterGroup *repository.FilterGroup) (bool, error) {
+	count, err := r.Count(ctx, mod, filterGroup)
+	return count > 0, err
+}
+
+// Distinct 按记录顺序返回第一次出现的值, 值按 JSON 比较
+func (r *memRepository) Distinct(ctx context.Context, mod repository.Model, column string, result interface{}, filterGroup *repository.FilterGroup) error {
+	resultValue := reflect.ValueOf(result)
+	if resultValue.Kind() != reflect.Ptr || resultValue.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("memrepo: result must be a pointer to slice, got %T", result)
+	}
+	filterGroup = repository.ExcludeDeleted(mod, filterGroup)
+	columns := repository.ModelColumns(mod)
+	if err := columns.Check(column); err != nil {
+		return err
+	}
+	if err := columns.CheckFilter(filterGroup); err != nil {
+		return err
+	}
+
+	records, err := r.query(mod, filterGroup, nil)
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	list := reflect.MakeSlice(resultValue.Elem().Type(), 0, len(records))
+	for _, record := range records {
+		value, _ := repository.ColumnValue(record.Interface(), column)
+		key, _ := json.Marshal(value)
+		if seen[string(key)] {
+			continue
+		}
+		seen[string(key)] = true
+		item := reflect.New(list.Type().Elem()).Elem()
+		if err = setValue(item, value); err != nil {
+			return err
+		}
+		list = reflect.Append(list, item)
+	}
+	resultValue.Elem().Set(list)
+	return nil
+}
+
+func (r *memRepository) FindPage(ctx context.Context, mod repository.Model, result interface{}, fields []string, filterGroup *repository.FilterGroup, sortSpecs *repository.SortSpecs, limitSpec *repository.LimitSpec) (*repository.Page, error) {
+	return repository.LoadPage(ctx, r, mod, result, fields, filterGroup, sortSpecs, limitSpec)
+}
+
+// WithTransaction 事务开始时对全部数据做快照, fn 返回 error 或 panic 时恢复快照.
+// 事务之间串行执行, 事务外的并发写入在回滚时会一并丢失, 仅适用于测试场景
+
+func (r *memRepository) WithTransaction(ctx context.Context, fn func(txRepo repository.BaseRepository) error) error {
+	// 已处于事务中时复用当前事务; panic 交给外层事务的 CallTxFunc 处理
+	if r.inTx {
+		return fn(r)
+	}
+
+	r.store.txMu.Lock()
+	defer r.store.txMu.Unlock()
+
+	snapshot := r.store.snapshot()
+	err := repository.CallTxFunc(&memRepository{store: r.store, inTx: true}, fn)
+	if err != nil {
+		r.store.restore(snapshot)
+	}
+	repository.RethrowTxPanic(err)
+	return err
+}
+
+// query 过滤并排序, 返回记录副本
+func (r *memRepository) query(mod repository.Model, filterGroup *repository.FilterGroup, sortSpecs *repository.SortSpecs) ([]reflect.Value, error) {
+	r.store.mu.RLock()
+	defer r.store.mu.RUnlock()
+
+	t := r.store.tables[mod.TableName()]
+	if t == nil {
+		return nil, nil
+	}
+	matched, err := t.filter(filterGroup)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]reflect.Value, len(matched))
+	for i, idx := range matched {
+		records[i] = copyRecord(t.records[idx].Elem())
+	}
+	if err = sortRecords(records, sortSpecs); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func limitRecords(records []reflect.Value, limitSpec *repository.LimitSpec) []reflect.Value {
+	if limitSpec == nil {
+		return records
+	}
+
+	size := limitSpec.Size
+	if limitSpec.UseCursor {
+		// 与数据库实现一致多取一条, 由 FillNextCursor 截断
+		size++
+	} else if limitSpec.Page > 1 {
+		offset := (limitSpec.Page - 1) * limitSpec.Size
+		if offset >= len(records) {
+			return nil
+		}
+		records = records[offset:]
+	}
+	if size > 0 && size < len(records) {
+		records = records[:size]
+	}
+	return records
+}
+
+func (s *store) table(name string, typ reflect.Type) (*table, error) {
+	t := s.tables[name]
+	if t == nil {
+		t = &table{typ: typ}
+		s.tables[name] = t
+	}
+	if t.typ != typ {
+		return nil, fmt.Errorf("memrepo: table %s stores %s, got %s", name, t.typ, typ)
+	}
+	return t, nil
+}
+
+func (s *store) snapshot() map[string]table {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snapshot := make(map[string]table, len(s.tables))
+	for name, t := range s.tables {
+		records := make([]reflect.Value, len(t.records))
+		for i, record := range t.records {
+			records[i] = copyRecord(record.Elem())
+		}
+		snapshot[name] = table{typ: t.typ, records: records, autoID: t.autoID}
+	}
+	return snapshot
+}
+
+func (s *store) restore(snapshot map[string]table) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tables = make(map[string]*table, len(snapshot))
+	for name := range snapshot {
+		t := snapshot[name]
+		s.tables[name] = &t
+	}
+}
+
+// findConflict 返回 conflictColumns 的值与 record 全部相等的记录下标, 不存在时返回 -1
+func (t *table) findConflict(record reflect.Value, conflictColumns []string) (int, error) {
+	var values []interface{}
+	if len(conflictColumns) == 0 {
+		primaryKey, ok := primaryKeyField(record)
+		if !ok {
+			return 0, fmt.Errorf("memrepo: %s has no primary key", record.Type())
+		}
+		values = append(values, primaryKey.Interface())
+	}
+	for _, column := range conflictColumns {
+		field, ok := repository.FieldByColumn(record, column)
+		if !ok {
+			return 0, fmt.Errorf("memrepo: unknown column %s", column)
+		}
+		values = append(values, indirect(field))
+	}
+
+	for idx, existing := range t.records {
+		matched := true
+		for i, value := range values {
+			var field reflect.Value
+			if len(conflictColumns) == 0 {
+				field, _ = primaryKeyField(existing.Elem())
+			} else {
+				field, _ = repository.FieldByColumn(existing, conflictColumns[i])
+			}
+			if !reflect.DeepEqual(indirect(field), value) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return idx, nil
+		}
+	}
+	return -1, nil
+}
+
+// filter 返回满足条件的记录下标
+func (t *table) filter(filterGroup *repository.FilterGroup) ([]int, error) {
+	var matched []int
+	for idx, record := range t.records {
+		ok, err := matchGroup(record, filterGroup)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matched = append(matched, idx)
+		}
+	}
+	return matched, nil
+}
+
+// fillPrimaryKey 为零值主键分配自增 id, bson _id 为 ObjectID 时生成新的 ObjectID
+func (t *table) fillPrimaryKey(record reflect.Value) {
+	field, ok := primaryKeyField(record)
+	if !ok || !field.CanSet() || !field.IsZero() {
+		return
+	}
+
+	switch {
+	case field.Type() == reflect.TypeOf(primitive.ObjectID{}):
+		field.Set(reflect.ValueOf(primitive.NewObjectID()))
+	case isInt(field):
+		t.autoID++
+		field.SetInt(t.autoID)
+	case isUint(field):
+		t.autoID++
+		field.SetUint(uint64(t.autoID))
+	}
+}
+
+func primaryKeyField(record reflect.Value) (reflect.Value, bool) {
+	typ := record.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		fieldType := typ.Field(i)
+		if fieldType.PkgPath != "" {
+			continue
+		}
+		if fieldType.Anonymous && indirectType(fieldType.Type).Kind() == reflect.Struct {
+			if embedded := reflect.Indirect(record.Field(i)); embedded.IsValid() && embedded.Kind() == reflect.Struct {
+				if field, ok := primaryKeyField(embedded); ok {
+					return field, true
+				}
+			}
+			continue
+		}
+		gormTag := strings.ToLower(strings.ReplaceAll(fieldType.Tag.Get("gorm"), "_", ""))
+		if strings.Contains(gormTag, "primarykey") || strings.Split(fieldType.Tag.Get("bson"), ",")[0] == "_id" {
+			return record.Field(i), true
+		}
+	}
+	if field := record.FieldByName("ID"); field.IsValid() {
+		return field, true
+	}
+	return reflect.Value{}, false
+}
+
+func indirectType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
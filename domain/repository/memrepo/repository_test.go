@@ -0,0 +1,875 @@
+package memrepo
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/henrion-y/base.services/domain/repository"
+	"github.com/henrion-y/base.services/infra/geo"
+)
+
+type User struct {
+	ID    int        `json:"id" gorm:"primary_key"`
+	Name  string     `json:"name" gorm:"name"`
+	Age   int        `json:"age" gorm:"age"`
+	Ctime time.Time  `json:"ctime" gorm:"update_time_stamp"`
+	Dtime *time.Time `json:"dtime" gorm:"dtime"`
+}
+
+func (t *User) TableName() string {
+	return "t_user_repository"
+}
+
+func newRepo(t *testing.T) repository.BaseRepository {
+	repo := NewBaseRepository()
+	now := time.Now()
+	users := []*User{
+		{Name: "张飞", Age: 28, Ctime: now},
+		{Name: "关羽", Age: 21, Ctime: now.Add(time.Second)},
+		{Name: "刘备", Age: 30, Ctime: now.Add(2 * time.Second), Dtime: &now},
+		{Name: "赵云", Age: 21, Ctime: now.Add(3 * time.Second)},
+	}
+	for _, user := range users {
+		if err := repo.Create(context.Background(), user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return repo
+}
+
+func findNames(t *testing.T, repo repository.BaseRepository, filterGroup *repository.FilterGroup, sortSpecs *repository.SortSpecs, limitSpec *repository.LimitSpec) []string {
+	var list []User
+	err := repo.Find(context.Background(), &User{}, &list, nil, filterGroup, sortSpecs, limitSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, user := range list {
+		names = append(names, user.Name)
+	}
+	return names
+}
+
+func assertNames(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestBaseRepository_Create(t *testing.T) {
+	repo := newRepo(t)
+
+	user := &User{Name: "马超", Age: 25}
+	if err := repo.Create(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != 5 {
+		t.Fatalf("expect auto increment id 5, got %d", user.ID)
+	}
+}
+
+func TestBaseRepository_Find(t *testing.T) {
+	repo := newRepo(t)
+	byID := repository.NewSortSpecs("id", repository.SortType_ASC)
+
+	cases := []struct {
+		filterGroup *repository.FilterGroup
+		want        []string
+	}{
+		{repository.NewFilterGroup().Equals("age", 21), []string{"关羽", "赵云"}},
+		{repository.NewFilterGroup().NotEquals("age", 21), []string{"张飞", "刘备"}},
+		{repository.NewFilterGroup().GreaterThan("age", 28), []string{"刘备"}},
+		{repository.NewFilterGroup().GreaterThanOrEqual("age", 28), []string{"张飞", "刘备"}},
+		{repository.NewFilterGroup().LessThan("age", 28), []string{"关羽", "赵云"}},
+		{repository.NewFilterGroup().LessThanOrEqual("age", 28.0), []string{"张飞", "关羽", "赵云"}},
+		{repository.NewFilterGroup().In("name", []string{"张飞", "赵云"}), []string{"张飞", "赵云"}},
+		{repository.NewFilterGroup().NotIn("id", []int64{1, 2}), []string{"刘备", "赵云"}},
+		{repository.NewFilterGroup().Like("name", "张%"), []string{"张飞"}},
+		{repository.NewFilterGroup().IsNull("dtime"), []string{"张飞", "关羽", "赵云"}},
+		{repository.NewFilterGroup().IsNotNull("dtime"), []string{"刘备"}},
+		{repository.NewFilterGroup().Equals("age", 21).Equals("name", "赵云"), []string{"赵云"}},
+		{
+			repository.NewFilterGroup().Equals("age", 21).Or(
+				repository.NewFilterGroup().Equals("name", "关羽"),
+				repository.NewFilterGroup().GreaterThan("id", 3),
+			),
+			[]string{"关羽", "赵云"},
+		},
+		{
+			repository.NewFilterGroup().SetLogic(repository.FilterLogic_OR).Equals("name", "张飞").And(
+				repository.NewFilterGroup().Equals("age", 21),
+				repository.NewFilterGroup().Like("name", "%云"),
+			),
+			[]string{"张飞", "赵云"},
+		},
+		{repository.NewFilterGroup().Or(), []string{"张飞", "关羽", "刘备", "赵云"}},
+	}
+	for _, c := range cases {
+		assertNames(t, findNames(t, repo, c.filterGroup, byID, nil), c.want...)
+	}
+
+	var list []User
+	err := repo.Find(context.Background(), &User{}, &list, nil, repository.NewFilterGroup().Equals("unknown", 1), nil, nil)
+	if err == nil {
+		t.Fatal("expect error for unknown column")
+	}
+}
+
+func TestBaseRepository_FindSortAndLimit(t *testing.T) {
+	repo := newRepo(t)
+
+	sortSpecs := repository.NewSortSpecs("age", repository.SortType_DESC).AddAsc("id")
+	assertNames(t, findNames(t, repo, nil, sortSpecs, nil), "刘备", "张飞", "关羽", "赵云")
+	assertNames(t, findNames(t, repo, nil, sortSpecs, repository.NewLimitSpec(2, 3)), "赵云")
+	assertNames(t, findNames(t, repo, nil, sortSpecs, repository.NewLimitSpec(0, 2)), "刘备", "张飞")
+
+	// NULL 排在最前
+	assertNames(t, findNames(t, repo, nil, repository.NewSortSpecs("dtime", repository.SortType_DESC), nil), "刘备", "张飞", "关羽", "赵云")
+}
+
+func TestBaseRepository_FindByCursor(t *testing.T) {
+	repo := newRepo(t)
+
+	sortSpecs := repository.NewSortSpecs("age", repository.SortType_DESC).AddAsc("id")
+	limitSpec := repository.NewCursorLimitSpec("", 3)
+	assertNames(t, findNames(t, repo, nil, sortSpecs, limitSpec), "刘备", "张飞", "关羽")
+	if limitSpec.NextCursor == "" {
+		t.Fatal("expect next cursor")
+	}
+
+	limitSpec = repository.NewCursorLimitSpec(limitSpec.NextCursor, 3)
+	assertNames(t, findNames(t, repo, nil, sortSpecs, limitSpec), "赵云")
+	if limitSpec.NextCursor != "" {
+		t.Fatal("expect no more pages")
+	}
+
+	// 未指定唯一排序时按主键区分排序值相同的记录, dtime 为 NULL 的记录视为最小值
+	for sortSpecs, want := range map[*repository.SortSpecs][]string{
+		repository.NewSortSpecs("age", repository.SortType_ASC):    {"关羽", "赵云", "张飞", "刘备"},
+		repository.NewSortSpecs("dtime", repository.SortType_DESC): {"刘备", "张飞", "关羽", "赵云"},
+	} {
+		var names []string
+		limitSpec = repository.NewCursorLimitSpec("", 1)
+		for i := 0; i < len(want)+1; i++ {
+			names = append(names, findNames(t, repo, nil, sortSpecs, limitSpec)...)
+			if limitSpec.NextCursor == "" {
+				break
+			}
+			limitSpec = repository.NewCursorLimitSpec(limitSpec.NextCursor, 1)
+		}
+		assertNames(t, names, want...)
+	}
+
+	var list []User
+	err := repo.Find(context.Background(), &User{}, &list, nil, nil, repository.NewSortSpecs("id", repository.SortType_ASC),
+		repository.NewCursorLimitSpec("bad", 3))
+	if !errors.Is(err, repository.ErrInvalidCursor) {
+		t.Fatalf("expect ErrInvalidCursor, got %v", err)
+	}
+}
+
+func TestBaseRepository_FindInto(t *testing.T) {
+	repo := newRepo(t)
+
+	// 部分字段
+	var users []*User
+	err := repo.Find(context.Background(), &User{}, &users, []string{"name"}, repository.NewFilterGroup().Equals("id", 1), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].Name != "张飞" || users[0].Age != 0 {
+		t.Fatalf("unexpected result %+v", users)
+	}
+
+	// 其他结构体
+	type brief struct {
+		Name string
+		Age  int64
+	}
+	var briefs []brief
+	err = repo.Find(context.Background(), &User{}, &briefs, nil, repository.NewFilterGroup().Equals("id", 1), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(briefs) != 1 || briefs[0].Name != "张飞" || briefs[0].Age != 28 {
+		t.Fatalf("unexpected result %+v", briefs)
+	}
+
+	// map
+	var rows []map[string]interface{}
+	err = repo.Find(context.Background(), &User{}, &rows, []string{"name", "age"}, repository.NewFilterGroup().Equals("id", 1), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0]["name"] != "张飞" || rows[0]["age"] != 28 || len(rows[0]) != 2 {
+		t.Fatalf("unexpected result %+v", rows)
+	}
+}
+
+func TestFindOne(t *testing.T) {
+	repo := newRepo(t)
+
+	mod := User{}
+	err := repo.FindOne(context.Background(), &mod, []string{"name", "age"}, repository.NewFilterGroup().Equals("age", 21),
+		repository.NewSortSpecs("id", repository.SortType_DESC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mod.Name != "赵云" || mod.ID != 0 {
+		t.Fatalf("unexpected result %+v", mod)
+	}
+}
+
+func TestBaseRepository_Count(t *testing.T) {
+	repo := newRepo(t)
+
+	count, err := repo.Count(context.Background(), &User{}, repository.NewFilterGroup().Equals("age", 21))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("expect 2, got %d", count)
+	}
+}
+
+func TestBaseRepository_Update(t *testing.T) {
+	repo := newRepo(t)
+
+	now := time.Now()
+	rowCount, err := repo.Update(context.Background(), &User{}, map[string]interface{}{"age": 19, "dtime": now},
+		repository.NewFilterGroup().Equals("age", 21))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rowCount != 2 {
+		t.Fatalf("expect 2, got %d", rowCount)
+	}
+	assertNames(t, findNames(t, repo, repository.NewFilterGroup().Equals("age", 19).IsNotNull("dtime"), nil, nil), "关羽", "赵云")
+
+	_, err = repo.Update(context.Background(), &User{}, map[string]interface{}{"age": "x"}, nil)
+	if err == nil {
+		t.Fatal("expect error for mismatched type")
+	}
+}
+
+func TestBaseRepository_Delete(t *testing.T) {
+	repo := newRepo(t)
+
+	err := repo.Delete(context.Background(), &User{}, repository.NewFilterGroup().In("id", []int{1, 3}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertNames(t, findNames(t, repo, nil, nil, nil), "关羽", "赵云")
+}
+
+func TestBaseRepository_WithTransaction(t *testing.T) {
+	repo := newRepo(t)
+
+	// 回调 panic 时回滚后重新 panic
+	func() {
+		defer func() {
+			if r := recover(); r != "rollback" {
+				t.Fatalf("expect panic rethrown after rollback, got %v", r)
+			}
+		}()
+		_ = repo.WithTransaction(context.Background(), func(txRepo repository.BaseRepository) error {
+			if err := txRepo.Delete(context.Background(), &User{}, nil); err != nil {
+				return err
+			}
+			return txRepo.WithTransaction(context.Background(), func(txRepo repository.BaseRepository) error {
+				panic("rollback")
+			})
+		})
+	}()
+	assertNames(t, findNames(t, repo, nil, nil, nil), "张飞", "关羽", "刘备", "赵云")
+
+	err := repo.WithTransaction(context.Background(), func(txRepo repository.BaseRepository) error {
+		return txRepo.Delete(context.Background(), &User{}, repository.NewFilterGroup().Equals("id", 1))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertNames(t, findNames(t, repo, nil, nil, nil), "关羽", "刘备", "赵云")
+}
+
+func TestRepository_Generic(t *testing.T) {
+	repo := repository.NewRepository[*User](newRepo(t))
+
+	user, found, err := repo.Get(context.Background(), repository.NewFilterGroup().Equals("name", "关羽"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || user.Age != 21 {
+		t.Fatalf("unexpected result %+v %v", user, found)
+	}
+
+	_, found, err = repo.Get(context.Background(), repository.NewFilterGroup().Equals("name", "曹操"))
+	if err != nil || found {
+		t.Fatalf("expect not found, got %v %v", found, err)
+	}
+
+	list, page, err := repo.FindPage(context.Background(), nil, nil, repository.NewSortSpecs("id", repository.SortType_ASC), repository.NewLimitSpec(2, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || page.Total != 4 || page.HasNext {
+		t.Fatalf("unexpected result %v %+v", list, page)
+	}
+}
+
+func TestBaseRepository_Aggregate(t *testing.T) {
+	repo := newRepo(t)
+
+	type ageStat struct {
+		Age    int
+		Cnt    int64
+		SumID  int64 `json:"sum_id"`
+		MaxAge int   `json:"max_age"`
+	}
+	var stats []ageStat
+	aggregateSpec := repository.NewAggregateSpec("age").Count("cnt").Sum("id", "").Max("age", "").
+		SetHaving(repository.NewFilterGroup().GreaterThanOrEqual("cnt", 1))
+	err := repo.Aggregate(context.Background(), &User{}, &stats, repository.NewFilterGroup().LessThan("age", 30),
+		aggregateSpec, repository.NewSortSpecs("cnt", repository.SortType_DESC), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 || stats[0] != (ageStat{21, 2, 6, 21}) || stats[1] != (ageStat{28, 1, 1, 28}) {
+		t.Fatalf("unexpected result %+v", stats)
+	}
+
+	// 不分组且无匹配记录时返回一行
+	var rows []map[string]interface{}
+	err = repo.Aggregate(context.Background(), &User{}, &rows, repository.NewFilterGroup().GreaterThan("age", 100),
+		repository.NewAggregateSpec().Count("cnt").Avg("age", "avg_age"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0]["cnt"] != int64(0) || rows[0]["avg_age"] != nil {
+		t.Fatalf("unexpected result %+v", rows)
+	}
+}
+
+func TestBaseRepository_CreateBatch(t *testing.T) {
+	repo := newRepo(t)
+
+	users := []*User{{Name: "马超", Age: 25}, {Name: "黄忠", Age: 60}, {Name: "魏延", Age: 35}}
+	counts, err := repo.CreateBatch(context.Background(), users, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 2 || counts[0] != 2 || counts[1] != 1 {
+		t.Fatalf("expect [2 1], got %v", counts)
+	}
+	if users[2].ID != 7 {
+		t.Fatalf("expect auto increment id 7, got %d", users[2].ID)
+	}
+
+	counts, err = repo.CreateBatch(context.Background(), []*User{}, 2)
+	if err != nil || counts != nil {
+		t.Fatalf("expect empty batch to be a no-op, got %v %v", counts, err)
+	}
+	if _, err = repo.CreateBatch(context.Background(), &User{}, 2); err == nil {
+		t.Fatal("expect error for non-slice models")
+	}
+}
+
+func TestBaseRepository_Upsert(t *testing.T) {
+	repo := newRepo(t)
+
+	rowCount, err := repo.Upsert(context.Background(), &User{Name: "张飞", Age: 40}, []string{"name"}, []string{"age"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rowCount != 1 {
+		t.Fatalf("expect 1, got %d", rowCount)
+	}
+	assertNames(t, findNames(t, repo, repository.NewFilterGroup().Equals("age", 40).Equals("id", 1), nil, nil), "张飞")
+
+	_, err = repo.Upsert(context.Background(), &User{Name: "马超", Age: 25}, []string{"name"}, []string{"age"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertNames(t, findNames(t, repo, repository.NewFilterGroup().Equals("id", 5), nil, nil), "马超")
+
+	// 不指定冲突列时按主键匹配, 更新全部列
+	_, err = repo.Upsert(context.Background(), &User{ID: 2, Name: "关云长", Age: 22}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertNames(t, findNames(t, repo, repository.NewFilterGroup().Equals("age", 22), nil, nil), "关云长")
+	count, _ := repo.Count(context.Background(), &User{}, nil)
+	if count != 5 {
+		t.Fatalf("expect 5, got %d", count)
+	}
+}
+
+type Article struct {
+	ID        int        `json:"id" gorm:"primary_key"`
+	Title     string     `json:"title"`
+	DeletedAt *time.Time `json:"deleted_at"`
+}
+
+func (a *Article) TableName() string {
+	return "t_article_repository"
+}
+
+func (a *Article) SoftDeleteColumn() string {
+	return "deleted_at"
+}
+
+func TestBaseRepository_SoftDelete(t *testing.T) {
+	ctx := context.Background()
+	repo := NewBaseRepository()
+	for _, title := range []string{"a", "b", "c"} {
+		if err := repo.Create(ctx, &Article{Title: title}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := repo.Delete(ctx, &Article{}, repository.NewFilterGroup().In("title", []string{"a", "b"})); err != nil {
+		t.Fatal(err)
+	}
+	var list []Article
+	if err := repo.Find(ctx, &Article{}, &list, nil, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Title != "c" {
+		t.Fatalf("expect only c, got %v", list)
+	}
+	if count, _ := repo.Count(ctx, &Article{}, nil); count != 1 {
+		t.Fatalf("expect 1, got %d", count)
+	}
+	rowCount, err := repo.Update(ctx, &Article{}, map[string]interface{}{"title": "x"}, repository.NewFilterGroup().Equals("title", "a"))
+	if err != nil || rowCount != 0 {
+		t.Fatalf("expect deleted rows not updated, got %d %v", rowCount, err)
+	}
+
+	if err = repo.FindWithDeleted(ctx, &Article{}, &list, nil, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 || list[0].DeletedAt == nil {
+		t.Fatalf("expect 3 with deleted, got %v", list)
+	}
+
+	rowCount, err = repo.Restore(ctx, &Article{}, repository.NewFilterGroup().Equals("title", "a"))
+	if err != nil || rowCount != 1 {
+		t.Fatalf("expect 1 restored, got %d %v", rowCount, err)
+	}
+	if count, _ := repo.Count(ctx, &Article{}, nil); count != 2 {
+		t.Fatalf("expect 2, got %d", count)
+	}
+
+	if _, err = repo.Restore(ctx, &User{}, nil); !errors.Is(err, repository.ErrSoftDeleteNotSupported) {
+		t.Fatalf("expect ErrSoftDeleteNotSupported, got %v", err)
+	}
+}
+
+func TestBaseRepository_UnknownColumn(t *testing.T) {
+	ctx := context.Background()
+	repo := newRepo(t)
+
+	var list []User
+	var columnErr *repository.ColumnError
+	cases := []error{
+		repo.Find(ctx, &User{}, &list, nil, nil, repository.NewSortSpecs("age; DROP TABLE t_user_repository", repository.SortType_ASC), nil),
+		repo.Find(ctx, &User{}, &list, []string{"name", "password"}, nil, nil, nil),
+		repo.Delete(ctx, &User{}, repository.NewFilterGroup().Or(repository.NewFilterGroup().Equals("1=1 OR id", 1))),
+	}
+	_, err := repo.Update(ctx, &User{}, map[string]interface{}{"role": "admin"}, nil)
+	cases = append(cases, err)
+	_, err = repo.Count(ctx, &User{}, repository.NewFilterGroup().Equals("$where", "1"))
+	cases = append(cases, err)
+	for i, err := range cases {
+		if !errors.Is(err, repository.ErrUnknownColumn) || !errors.As(err, &columnErr) {
+			t.Fatalf("case %d: expect ColumnError, got %v", i, err)
+		}
+	}
+	if count, _ := repo.Count(ctx, &User{}, nil); count != 4 {
+		t.Fatalf("expect nothing deleted, got %d", count)
+	}
+
+	var rows []map[string]interface{}
+	err = repo.Aggregate(ctx, &User{}, &rows, nil, repository.NewAggregateSpec("age").Count("cnt"),
+		repository.NewSortSpecs("cnt", repository.SortType_DESC), nil)
+	if err != nil {
+		t.Fatalf("expect aggregate alias allowed in sort, got %v", err)
+	}
+}
+
+type Post struct {
+	ID    int      `json:"id" gorm:"primary_key"`
+	Title string   `json:"title" gorm:"title"`
+	Tags  []string `json:"tags" gorm:"tags"`
+}
+
+func (p *Post) TableName() string {
+	return "t_post_repository"
+}
+
+func TestBaseRepository_FilterOperators(t *testing.T) {
+	repo := newRepo(t)
+	byID := repository.NewSortSpecs("id", repository.SortType_ASC)
+
+	cases := []struct {
+		filterGroup *repository.FilterGroup
+		want        []string
+	}{
+		{repository.NewFilterGroup().Between("age", 21, 28), []string{"张飞", "关羽", "赵云"}},
+		{repository.NewFilterGroup().NotLike("name", "张%"), []string{"关羽", "刘备", "赵云"}},
+		{repository.NewFilterGroup().StartsWith("name", "赵"), []string{"赵云"}},
+		{repository.NewFilterGroup().EndsWith("name", "羽"), []string{"关羽"}},
+		{repository.NewFilterGroup().Contains("name", "%"), nil},
+		{repository.NewFilterGroup().Regex("name", "^(张|刘)"), []string{"张飞", "刘备"}},
+		{repository.NewFilterGroup().Exists("dtime", true), []string{"刘备"}},
+		{repository.NewFilterGroup().Exists("dtime", false), []string{"张飞", "关羽", "赵云"}},
+	}
+	for _, c := range cases {
+		assertNames(t, findNames(t, repo, c.filterGroup, byID, nil), c.want...)
+	}
+
+	ctx := context.Background()
+	for _, post := range []*Post{
+		{Title: "a", Tags: []string{"go", "db"}},
+		{Title: "b", Tags: []string{"go"}},
+		{Title: "c", Tags: []string{"rust", "db"}},
+	} {
+		if err := repo.Create(ctx, post); err != nil {
+			t.Fatal(err)
+		}
+	}
+	findTitles := func(filterGroup *repository.FilterGroup) []string {
+		var list []Post
+		if err := repo.Find(ctx, &Post{}, &list, nil, filterGroup, byID, nil); err != nil {
+			t.Fatal(err)
+		}
+		var titles []string
+		for _, post := range list {
+			titles = append(titles, post.Title)
+		}
+		return titles
+	}
+	assertNames(t, findTitles(repository.NewFilterGroup().ArrayContains("tags", []string{"go", "db"})), "a")
+	assertNames(t, findTitles(repository.NewFilterGroup().ArrayContainsAny("tags", []string{"rust", "db"})), "a", "c")
+
+	var list []User
+	err := repo.Find(ctx, &User{}, &list, nil, repository.NewFilterGroup().AddFilter("age", repository.FilterType_BETWEEN, 21), nil, nil)
+	if !errors.Is(err, repository.ErrInvalidFilterValue) {
+		t.Fatalf("expect ErrInvalidFilterValue, got %v", err)
+	}
+}
+
+type Shop struct {
+	ID       int            `json:"id" gorm:"primary_key"`
+	Name     string         `json:"name" gorm:"name"`
+	Location geo.Coordinate `json:"location" gorm:"location"`
+}
+
+func (s *Shop) TableName() string {
+	return "t_shop_repository"
+}
+
+func TestBaseRepository_Geo(t *testing.T) {
+	ctx := context.Background()
+	repo := NewBaseRepository()
+	center := geo.Coordinate{Lat: 39.9042, Lon: 116.4074}
+	for _, shop := range []*Shop{
+		{Name: "c", Location: geo.Coordinate{Lat: 40.0000, Lon: 116.4074}}, // 约 10.7km
+		{Name: "a", Location: geo.Coordinate{Lat: 39.9100, Lon: 116.4100}}, // 约 0.7km
+		{Name: "b", Location: geo.Coordinate{Lat: 39.9300, Lon: 116.4074}}, // 约 2.9km
+	} {
+		if err := repo.Create(ctx, shop); err != nil {
+			t.Fatal(err)
+		}
+	}
+	findNames := func(filterGroup *repository.FilterGroup, sortSpecs *repository.SortSpecs) []string {
+		var list []Shop
+		if err := repo.Find(ctx, &Shop{}, &list, nil, filterGroup, sortSpecs, nil); err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, shop := range list {
+			names = append(names, shop.Name)
+		}
+		return names
+	}
+	byDistance := repository.NewDefaultSortSpecs().AddDistance("location", center, repository.SortType_ASC)
+
+	assertNames(t, findNames(repository.NewFilterGroup().Near("location", center, 3000), byDistance), "a", "b")
+	assertNames(t, findNames(repository.NewFilterGroup().WithinRadius("location", center, 1000), nil), "a")
+	assertNames(t, findNames(nil, byDistance), "a", "b", "c")
+	assertNames(t, findNames(nil, repository.NewDefaultSortSpecs().AddDistance("location", center, repository.SortType_DESC)), "c", "b", "a")
+	assertNames(t, findNames(repository.NewFilterGroup().WithinBox("location",
+		geo.Coordinate{Lat: 39.92, Lon: 116.40}, geo.Coordinate{Lat: 40.01, Lon: 116.41}), byDistance), "b", "c")
+	assertNames(t, findNames(repository.NewFilterGroup().WithinPolygon("location",
+		geo.Coordinate{Lat: 39.90, Lon: 116.40}, geo.Coordinate{Lat: 39.90, Lon: 116.42}, geo.Coordinate{Lat: 39.95, Lon: 116.40}), byDistance), "a", "b")
+
+	var list []Shop
+	err := repo.Find(ctx, &Shop{}, &list, nil, repository.NewFilterGroup().WithinPolygon("location", center), nil, nil)
+	if !errors.Is(err, repository.ErrInvalidFilterValue) {
+		t.Fatalf("expect ErrInvalidFilterValue, got %v", err)
+	}
+}
+
+type Account struct {
+	ID      int    `json:"id" gorm:"primary_key"`
+	Balance int    `json:"balance" gorm:"balance"`
+	Version uint32 `json:"version" gorm:"version"`
+}
+
+func (a *Account) TableName() string {
+	return "t_account_repository"
+}
+
+func (a *Account) VersionColumn() string {
+	return "version"
+}
+
+func TestBaseRepository_OptimisticLock(t *testing.T) {
+	ctx := context.Background()
+	repo := NewBaseRepository()
+	account := &Account{Balance: 100}
+	if err := repo.Create(ctx, account); err != nil {
+		t.Fatal(err)
+	}
+	if account.Version != 1 {
+		t.Fatalf("expect version 1 after create, got %d", account.Version)
+	}
+
+	byID := repository.NewFilterGroup().Equals("id", account.ID)
+	stale := *account
+	rowCount, err := repo.Update(ctx, account, map[string]interface{}{"balance": 80}, byID)
+	if err != nil || rowCount != 1 || account.Version != 2 {
+		t.Fatalf("expect updated to version 2, got %d %d %v", rowCount, account.Version, err)
+	}
+
+	_, err = repo.Update(ctx, &stale, map[string]interface{}{"balance": 50}, byID)
+	if !errors.Is(err, repository.ErrVersionConflict) {
+		t.Fatalf("expect ErrVersionConflict, got %v", err)
+	}
+
+	// 空模型不加版本条件, 只递增版本
+	if _, err = repo.Update(ctx, &Account{}, map[string]interface{}{"balance": 60}, byID); err != nil {
+		t.Fatal(err)
+	}
+	var list []Account
+	if err = repo.Find(ctx, &Account{}, &list, nil, byID, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Balance != 60 || list[0].Version != 3 {
+		t.Fatalf("expect balance 60 version 3, got %+v", list)
+	}
+
+	// Upsert 插入时版本为 1, 冲突时在原值上加 1
+	inserted := &Account{Balance: 10}
+	if _, err = repo.Upsert(ctx, inserted, []string{"id"}, nil); err != nil || inserted.Version != 1 {
+		t.Fatalf("expect version 1 after upsert insert, got %d %v", inserted.Version, err)
+	}
+	// 模型中的旧版本不会写回, 持有旧版本的更新仍然冲突
+	stale = Account{ID: account.ID, Balance: 70, Version: 1}
+	if _, err = repo.Upsert(ctx, &stale, []string{"id"}, []string{"balance", "version"}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = repo.Update(ctx, &stale, map[string]interface{}{"balance": 50}, byID)
+	if !errors.Is(err, repository.ErrVersionConflict) {
+		t.Fatalf("expect ErrVersionConflict after upsert, got %v", err)
+	}
+}
+
+func TestBaseRepository_FindEach(t *testing.T) {
+	repo := newRepo(t)
+	ctx := context.Background()
+
+	var list []*User
+	var batches [][]*User
+	err := repo.FindEach(ctx, &User{}, &list, nil, nil, repository.NewSortSpecs("id", repository.SortType_ASC), 2, func() error {
+		batches = append(batches, list)
+		return nil
+	})
+	if err != nil || len(batches) != 2 || len(batches[0]) != 2 || len(batches[1]) != 2 || batches[1][1].Name != "赵云" {
+		t.Fatalf("expect 2 batches of 2 users, got %v %v", batches, err)
+	}
+
+	// 提前结束
+	var names []string
+	err = repository.NewRepository[*User](repo).FindEach(ctx, nil, nil, repository.NewSortSpecs("id", repository.SortType_ASC), 1,
+		func(batch []*User) error {
+			names = append(names, batch[0].Name)
+			if len(names) == 2 {
+				return repository.ErrStopIteration
+			}
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertNames(t, names, "张飞", "关羽")
+
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	var users []User
+	err = repo.FindEach(cancelCtx, &User{}, &users, nil, nil, nil, 0, func() error { return nil })
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expect context canceled, got %v", err)
+	}
+}
+
+type Stat struct {
+	ID        int        `json:"id" gorm:"primary_key"`
+	Hits      int64      `json:"hits" gorm:"hits"`
+	Low       int        `json:"low" gorm:"low"`
+	High      int        `json:"high" gorm:"high"`
+	Tags      []string   `json:"tags" gorm:"tags"`
+	Note      string     `json:"note" gorm:"note"`
+	CheckedAt *time.Time `json:"checked_at" gorm:"checked_at"`
+}
+
+func (s *Stat) TableName() string {
+	return "t_stat_repository"
+}
+
+func TestBaseRepository_UpdateSpec(t *testing.T) {
+	ctx := context.Background()
+	repo := NewBaseRepository()
+	stat := &Stat{Hits: 1, Low: 5, High: 5, Tags: []string{"a", "b", "a"}, Note: "x"}
+	if err := repo.Create(ctx, stat); err != nil {
+		t.Fatal(err)
+	}
+	byID := repository.NewFilterGroup().Equals("id", stat.ID)
+
+	spec := repository.NewUpdateSpec().
+		Inc("hits", 2).
+		Min("low", 3).
+		Max("high", 3).
+		Pull("tags", "a").
+		Unset("note").
+		CurrentDate("checked_at")
+	if _, err := repo.Update(ctx, &Stat{}, spec, byID); err != nil {
+		t.Fatal(err)
+	}
+	// b 已存在, AddToSet 不重复追加
+	if _, err := repo.Update(ctx, &Stat{}, repository.NewUpdateSpec().AddToSet("tags", "b"), byID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Update(ctx, &Stat{}, repository.NewUpdateSpec().Push("tags", "c"), byID); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := []map[string]interface{}{
+		repository.NewUpdateSpec().Set("tags", nil).Push("tags", "c"),
+		{"$rename": map[string]interface{}{"note": "remark"}},
+		{"$inc": 1},
+	}
+	for _, data := range invalid {
+		if _, err := repo.Update(ctx, &Stat{}, data, byID); !errors.Is(err, repository.ErrInvalidUpdate) {
+			t.Fatalf("expect ErrInvalidUpdate for %v, got %v", data, err)
+		}
+	}
+	if _, err := repo.Update(ctx, &Stat{}, repository.NewUpdateSpec().Inc("missing", 1), byID); !errors.Is(err, repository.ErrUnknownColumn) {
+		t.Fatalf("expect ErrUnknownColumn, got %v", err)
+	}
+	if _, err := repo.Update(ctx, &Stat{}, repository.NewUpdateSpec().Push("note", "c"), byID); err == nil {
+		t.Fatal("expect error when pushing to a non slice column")
+	}
+
+	var list []Stat
+	if err := repo.Find(ctx, &Stat{}, &list, nil, byID, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	got := list[0]
+	if got.Hits != 3 || got.Low != 3 || got.High != 5 || got.Note != "" || got.CheckedAt == nil ||
+		len(got.Tags) != 2 || got.Tags[0] != "b" || got.Tags[1] != "c" {
+		t.Fatalf("unexpected record after update: %+v", got)
+	}
+	if len(stat.Tags) != 3 {
+		t.Fatalf("update must not modify the created model, got %v", stat.Tags)
+	}
+}
+
+func TestBaseRepository_Lookup(t *testing.T) {
+	ctx := context.Background()
+	repo := repository.NewRepository[*User](newRepo(t))
+
+	if exists, err := repo.Exists(ctx, repository.NewFilterGroup().Equals("name", "关羽")); err != nil || !exists {
+		t.Fatalf("expect exists, got %v %v", exists, err)
+	}
+	if exists, err := repo.Exists(ctx, repository.NewFilterGroup().Equals("name", "曹操")); err != nil || exists {
+		t.Fatalf("expect not exists, got %v %v", exists, err)
+	}
+
+	var ages []int64
+	if err := repo.Distinct(ctx, "age", &ages, nil); err != nil || len(ages) != 3 {
+		t.Fatalf("unexpected distinct ages %v %v", ages, err)
+	}
+
+	list, err := repo.FindByIDs(ctx, []int64{2, 4, 5})
+	if err != nil || len(list) != 2 {
+		t.Fatalf("unexpected users %v %v", list, err)
+	}
+	if column := repository.PrimaryKeyColumn(&User{}); column != "id" {
+		t.Fatalf("expect primary key id, got %s", column)
+	}
+}
+
+type Note struct {
+	ID    primitive.ObjectID `json:"_id" bson:"_id"`
+	Title string             `json:"title" bson:"title"`
+}
+
+func (n *Note) TableName() string {
+	return "t_note_repository"
+}
+
+// ObjectID 按字节比较, 与 mongo 一致
+func TestBaseRepository_ObjectID(t *testing.T) {
+	ctx := context.Background()
+	repo := NewBaseRepository()
+	var ids []primitive.ObjectID
+	for i, title := range []string{"a", "b", "c"} {
+		id := primitive.NewObjectIDFromTimestamp(time.Unix(int64(1700000000+i), 0))
+		ids = append(ids, id)
+		if err := repo.Create(ctx, &Note{ID: id, Title: title}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	titles := func(list []Note) []string {
+		var titles []string
+		for _, note := range list {
+			titles = append(titles, note.Title)
+		}
+		return titles
+	}
+
+	var list []Note
+	err := repo.Find(ctx, &Note{}, &list, nil, repository.NewFilterGroup().GreaterThan("_id", ids[0]),
+		repository.NewSortSpecs("_id", repository.SortType_DESC), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertNames(t, titles(list), "c", "b")
+
+	var got []string
+	limitSpec := repository.NewCursorLimitSpec("", 2)
+	for i := 0; i < len(ids); i++ {
+		list = nil
+		if err = repo.Find(ctx, &Note{}, &list, nil, nil, nil, limitSpec); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, titles(list)...)
+		if limitSpec.NextCursor == "" {
+			break
+		}
+		limitSpec = repository.NewCursorLimitSpec(limitSpec.NextCursor, 2)
+	}
+	assertNames(t, got, "a", "b", "c")
+}
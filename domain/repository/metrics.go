@@ -0,0 +1,197 @@
+package repository
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/henrion-y/base.services/infra/zlog"
+)
+
+/********* 慢查询与指标 ***********/
+
+/*
+NewMetricsRepository 记录每次调用的耗时, 一般用于 gormrepo、mongorepo:
+1. 每次调用按 表名、操作 上报 QueryMetrics.ObserveQuery, 接入 Prometheus 时由调用方实现 QueryMetrics, 见 QueryMetrics
+2. 耗时达到 slowThreshold 时通过 zlog.Warn 输出慢查询日志, 包含渲染后的 FilterGroup、SortSpecs、LimitSpec(见 FilterGroup.String)
+3. 与其他钩子一起使用时应放在最后一个, 耗时只包含数据库调用; 被其他钩子的 Before 中止的调用不计时
+   FindEach 的耗时为各批查询的总耗时, 不包含调用方回调的耗时(见 HookCall.CallbackDuration)
+4. WithTransaction 本身不计时, 事务内的调用各自计时
+*/
+
+const DefaultSlowThreshold = 200 * time.Millisecond
+
+// QueryMetrics 查询指标, 接入 Prometheus 时可按 table、operation、status 标签用 CounterVec 计数,
+// 按 table、operation 标签用 HistogramVec 记录 duration.Seconds()
+type QueryMetrics interface {
+	ObserveQuery(table string, operation Operation, duration time.Duration, err error)
+}
+
+// QueryMetricsFunc 用函数实现 QueryMetrics
+type QueryMetricsFunc func(table string, operation Operation, duration time.Duration, err error)
+
+func (f QueryMetricsFunc) ObserveQuery(table string, operation Operation, duration time.Duration, err error) {
+	f(table, operation, duration, err)
+}
+
+// NewMetricsRepository 为 base 增加耗时统计与慢查询日志, metrics 为 nil 时只输出慢查询日志.
+// slowThreshold 为 0 时使用 DefaultSlowThreshold, 小于 0 时不输出慢查询日志
+func NewMetricsRepository(base BaseRepository, metrics QueryMetrics, slowThreshold time.Duration) BaseRepository {
+	return NewHookRepository(base, NewMetricsHook(metrics, slowThreshold))
+}
+
+// MetricsHook 耗时统计钩子, 可与其他钩子一起用于 NewHookRepository, 一般放在最后一个
+type MetricsHook struct {
+	metrics       QueryMetrics
+	slowThreshold time.Duration
+}
+
+func NewMetricsHook(metrics QueryMetrics, slowThreshold time.Duration) *MetricsHook {
+	if slowThreshold == 0 {
+		slowThreshold = DefaultSlowThreshold
+	}
+	return &MetricsHook{metrics: metrics, slowThreshold: slowThreshold}
+}
+
+const metricsStartKey = "metrics.start"
+
+func (h *MetricsHook) Before(ctx context.Context, call *HookCall) error {
+	call.Set(metricsStartKey, time.Now())
+	return nil
+}
+
+func (h *MetricsHook) After(ctx context.Context, call *HookCall) error {
+	value, ok := call.Get(metricsStartKey)
+	if !ok {
+		return nil
+	}
+	duration := time.Since(value.(time.Time)) - call.CallbackDuration
+	table := callTable(call)
+	if h.metrics != nil {
+		h.metrics.ObserveQuery(table, call.Operation, duration, call.Err)
+	}
+	if h.slowThreshold > 0 && duration >= h.slowThreshold {
+		zlog.Warn("metricsHook.slowQuery",
+			zap.String("table", table),
+			zap.String("operation", string(call.Operation)),
+			zap.Duration("duration", duration),
+			zap.String("filter", call.FilterGroup.String()),
+			zap.String("sort", call.SortSpecs.String()),
+			zap.String("limit", call.LimitSpec.String()),
+			zap.Error(call.Err))
+	}
+	return nil
+}
+
+// callTable 返回调用的表名, CreateBatch 取第一个模型的表名
+func callTable(call *HookCall) string {
+	if call.Model != nil {
+		return call.Model.TableName()
+	}
+	value := indirectValue(reflect.ValueOf(call.Models))
+	if value.Kind() != reflect.Slice || value.Len() == 0 {
+		return ""
+	}
+	item := value.Index(0)
+	if item.Kind() != reflect.Ptr && item.Kind() != reflect.Interface && item.CanAddr() {
+		item = item.Addr()
+	}
+	if mod, ok := item.Interface().(Model); ok {
+		return mod.TableName()
+	}
+	return ""
+}
+
+// DefaultQueryBuckets QueryStats 的默认耗时分桶
+var DefaultQueryBuckets = []time.Duration{
+	5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond,
+	250 * time.Millisecond, 500 * time.Millisecond, time.Second, 2500 * time.Millisecond, 5 * time.Second,
+}
+
+// QueryStats 进程内的 QueryMetrics 实现, 按 表名、操作 统计调用次数、失败次数与耗时分布, 可用于没有接入 Prometheus 的服务或测试
+type QueryStats struct {
+	buckets []time.Duration
+	mu      sync.Mutex
+	stats   map[queryStatKey]*QueryStat
+}
+
+type queryStatKey struct {
+	table     string
+	operation Operation
+}
+
+// QueryStat 一个 表名、操作 的统计, Buckets[i] 为耗时不超过 Bounds[i] 的调用次数(累计值, 同 Prometheus 直方图)
+type QueryStat struct {
+	Table     string          `json:"table"`
+	Operation Operation       `json:"operation"`
+	Count     int64           `json:"count"`
+	Errors    int64           `json:"errors"`
+	Sum       time.Duration   `json:"sum"`
+	Max       time.Duration   `json:"max"`
+	Bounds    []time.Duration `json:"bounds"`
+	Buckets   []int64         `json:"buckets"`
+}
+
+// NewQueryStats 创建 QueryStats, buckets 为耗时分桶的上界, 为空时使用 DefaultQueryBuckets
+func NewQueryStats(buckets ...time.Duration) *QueryStats {
+	if len(buckets) == 0 {
+		buckets = DefaultQueryBuckets
+	}
+	buckets = append([]time.Duration(nil), buckets...)
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i] < buckets[j] })
+	return &QueryStats{buckets: buckets, stats: make(map[queryStatKey]*QueryStat)}
+}
+
+func (s *QueryStats) ObserveQuery(table string, operation Operation, duration time.Duration, err error) {
+	key := queryStatKey{table: table, operation: operation}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stat, ok := s.stats[key]
+	if !ok {
+		stat = &QueryStat{Table: table, Operation: operation, Bounds: s.buckets, Buckets: make([]int64, len(s.buckets))}
+		s.stats[key] = stat
+	}
+	stat.Count++
+	if err != nil {
+		stat.Errors++
+	}
+	stat.Sum += duration
+	if duration > stat.Max {
+		stat.Max = duration
+	}
+	for i, bound := range s.buckets {
+		if duration <= bound {
+			stat.Buckets[i]++
+		}
+	}
+}
+
+// Snapshot 返回当前的统计, 按表名、操作排序
+func (s *QueryStats) Snapshot() []QueryStat {
+	s.mu.Lock()
+	list := make([]QueryStat, 0, len(s.stats))
+	for _, stat := range s.stats {
+		item := *stat
+		item.Buckets = append([]int64(nil), stat.Buckets...)
+		list = append(list, item)
+	}
+	s.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Table != list[j].Table {
+			return list[i].Table < list[j].Table
+		}
+		return list[i].Operation < list[j].Operation
+	})
+	return list
+}
+
+// Reset 清空统计
+func (s *QueryStats) Reset() {
+	s.mu.Lock()
+	s.stats = make(map[queryStatKey]*QueryStat)
+	s.mu.Unlock()
+}
@@ -0,0 +1,71 @@
+package repository_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/henrion-y/base.services/domain/repository"
+)
+
+func TestMetricsRepository(t *testing.T) {
+	ctx := context.Background()
+	stats := repository.NewQueryStats(time.Hour)
+	// 阈值极小, 每次调用都输出慢查询日志
+	repo := repository.NewMetricsRepository(newRepo(t), stats, time.Nanosecond)
+
+	var list []User
+	filterGroup := repository.NewFilterGroup().Equals("age", 21)
+	if err := repo.Find(ctx, &User{}, &list, nil, filterGroup, repository.NewSortSpecs("id", repository.SortType_DESC), repository.NewLimitSpec(1, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Count(ctx, &User{}, filterGroup); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateBatch(ctx, []*User{{Name: "马超", Age: 26}}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Count(ctx, &User{}, repository.NewFilterGroup().Equals("unknown", 1)); err == nil {
+		t.Fatal("expect error for unknown column")
+	}
+	var user User
+	if err := repo.FindOne(ctx, &user, nil, repository.NewFilterGroup().Equals("name", "关羽"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := stats.Snapshot()
+	want := map[repository.Operation][2]int64{
+		repository.Operation_CREATE_BATCH: {1, 0},
+		repository.Operation_COUNT:        {2, 1},
+		repository.Operation_FIND:         {1, 0},
+		repository.Operation_FIND_ONE:     {1, 0},
+	}
+	if len(snapshot) != len(want) {
+		t.Fatalf("unexpected stats %+v", snapshot)
+	}
+	for _, stat := range snapshot {
+		if stat.Table != "t_user_repository" || [2]int64{stat.Count, stat.Errors} != want[stat.Operation] || stat.Buckets[0] != stat.Count {
+			t.Fatalf("unexpected stat %+v", stat)
+		}
+	}
+}
+
+func TestMetricsRepository_FindEach(t *testing.T) {
+	ctx := context.Background()
+	stats := repository.NewQueryStats(20 * time.Millisecond)
+	repo := repository.NewMetricsRepository(newRepo(t), stats, -1)
+
+	// 耗时不包含调用方回调的耗时
+	var list []User
+	err := repo.FindEach(ctx, &User{}, &list, nil, nil, repository.NewSortSpecs("id", repository.SortType_ASC), 2, func() error {
+		time.Sleep(30 * time.Millisecond)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := stats.Snapshot()
+	if len(snapshot) != 1 || snapshot[0].Operation != repository.Operation_FIND_EACH || snapshot[0].Buckets[0] != 1 {
+		t.Fatalf("expect FindEach within 20ms, got %+v", snapshot)
+	}
+}
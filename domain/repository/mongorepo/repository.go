@@ -2,8 +2,14 @@ package mongorepo
 
 import (
 	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.uber.org/zap"
@@ -13,7 +19,8 @@ import (
 )
 
 type mongoRepository struct {
-	Db *mongo.Database
+	Db      *mongo.Database
+	session mongo.Session // 事务会话, 非事务仓储为 nil
 }
 
 func NewBaseRepository(db *mongo.Database) repository.BaseRepository {
@@ -22,7 +29,9 @@ func NewBaseRepository(db *mongo.Database) repository.BaseRepository {
 
 func (r *mongoRepository) Create(ctx context.Context, mod repository.Model) error {
 	collection := r.Db.Collection(mod.TableName())
+	ctx = r.sessionContext(ctx)
 
+	repository.InitVersion(mod)
 	_, err := collection.InsertOne(ctx, mod)
 	if err != nil {
 		zlog.Error("mongoRepo.Create", zap.Any("mod", mod), zap.Error(err))
@@ -30,18 +39,121 @@ func (r *mongoRepository) Create(ctx context.Context, mod repository.Model) erro
 	return err
 }
 
+// CreateBatch 每批执行一次有序的 BulkWrite, 某批失败时停止并返回之前各批的插入数
+func (r *mongoRepository) CreateBatch(ctx context.Context, models interface{}, batchSize int) ([]int64, error) {
+	batches, err := repository.SplitBatches(models, batchSize)
+	if err != nil || len(batches) == 0 {
+		return nil, err
+	}
+
+	collection := r.Db.Collection(batches[0].Items[0].TableName())
+	ctx = r.sessionContext(ctx)
+
+	counts := make([]int64, 0, len(batches))
+	for _, batch := range batches {
+		writeModels := make([]mongo.WriteModel, len(batch.Items))
+		for i, item := range batch.Items {
+			repository.InitVersion(item)
+			writeModels[i] = mongo.NewInsertOneModel().SetDocument(item)
+		}
+
+		bulkResult, err := collection.BulkWrite(ctx, writeModels)
+		if err != nil {
+			zlog.Error("mongoRepo.CreateBatch", zap.Int("batchSize", batchSize),
+				zap.Int("batch", len(counts)),
+				zap.Error(err))
+			return counts, err
+		}
+		counts = append(counts, bulkResult.InsertedCount)
+	}
+	return counts, nil
+}
+
+// Upsert conflictColumns 为空时按 _id 匹配, _id 为空时生成新的 ObjectID 并回填到模型(见 fillObjectID), updateColumns 之外的字段只在插入时写入($setOnInsert);
+// 开启乐观锁时版本通过 $inc 加 1, 新文档为 1
+func (r *mongoRepository) Upsert(ctx context.Context, mod repository.Model, conflictColumns []string, updateColumns []string) (int64, error) {
+	columns := modelColumns(mod)
+	err := columns.Check(conflictColumns...)
+	if err == nil {
+		err = columns.Check(updateColumns...)
+	}
+	if err != nil {
+		zlog.Error("mongoRepo.Upsert", zap.Any("mod", mod), zap.Error(err))
+		return 0, err
+	}
+
+	collection := r.Db.Collection(mod.TableName())
+	ctx = r.sessionContext(ctx)
+
+	repository.InitVersion(mod)
+	filter, update, err := buildUpsert(mod, conflictColumns, updateColumns)
+	if err != nil {
+		zlog.Error("mongoRepo.Upsert.buildUpsert", zap.Any("mod", mod), zap.Error(err))
+		return 0, err
+	}
+
+	writeModel := mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update).SetUpsert(true)
+	bulkResult, err := collection.BulkWrite(ctx, []mongo.WriteModel{writeModel})
+	if err != nil {
+		zlog.Error("mongoRepo.Upsert", zap.Any("mod", mod),
+			zap.Strings("conflictColumns", conflictColumns),
+			zap.Strings("updateColumns", updateColumns),
+			zap.Error(err))
+		return 0, err
+	}
+	return bulkResult.UpsertedCount + bulkResult.ModifiedCount, nil
+}
+
 func (r *mongoRepository) Update(ctx context.Context, mod repository.Model, data map[string]interface{},
 	filterGroup *repository.FilterGroup) (int64, error) {
+	filterGroup = repository.ExcludeDeleted(mod, filterGroup)
+	column, ok := repository.VersionColumn(mod)
+	if !ok {
+		return r.update(ctx, mod, data, filterGroup, "")
+	}
+
+	// 乐观锁: 以当前版本为条件, 版本通过 $inc 加 1
+	filterGroup, version := repository.VersionFilter(mod, filterGroup)
+	modifiedCount, err := r.update(ctx, mod, data, filterGroup, column)
+	if err != nil {
+		return 0, err
+	}
+	if err = repository.CheckVersion(mod, version, modifiedCount); err != nil {
+		zlog.Error("mongoRepo.Update", zap.Any("mod", mod), zap.Any("data", data), zap.Error(err))
+		return 0, err
+	}
+	return modifiedCount, nil
+}
+
+// update versionColumn 不为空时通过 $inc 将该列加 1
+func (r *mongoRepository) update(ctx context.Context, mod repository.Model, data map[string]interface{},
+	filterGroup *repository.FilterGroup, versionColumn string) (int64, error) {
+	columns := modelColumns(mod)
+	err := columns.CheckData(data)
+	if err == nil {
+		err = columns.CheckFilter(filterGroup)
+	}
+	if err != nil {
+		zlog.Error("mongoRepo.Update", zap.Any("mod", mod), zap.Any("data", data), zap.Error(err))
+		return 0, err
+	}
+
 	collection := r.Db.Collection(mod.TableName())
+	ctx = r.sessionContext(ctx)
 
-	update := bson.D{}
-	for k, v := range data {
-		update = append(update, bson.E{Key: "$set", Value: bson.M{k: v}})
+	if versionColumn != "" {
+		data = repository.WithUpdateOperator(data, repository.UpdateOperator_INC, versionColumn, 1)
+	}
+	update, err := repository.BuildUpdateToMongo(data)
+	if err != nil {
+		zlog.Error("mongoRepo.Update", zap.Any("mod", mod), zap.Any("data", data), zap.Error(err))
+		return 0, err
 	}
 
 	filter := bson.D{}
 	if filterGroup != nil {
-		filter = filterGroup.BuildToMongo()
+		// $nearSphere 只能用于查询
+		filter = repository.ReplaceNear(filterGroup).BuildToMongo()
 	}
 
 	updateResult, err := collection.UpdateMany(ctx, filter, update)
@@ -50,16 +162,29 @@ func (r *mongoRepository) Update(ctx context.Context, mod repository.Model, data
 			zap.Any("data", data),
 			zap.Any("filterGroup", filterGroup),
 			zap.Error(err))
+		return 0, err
 	}
-	return updateResult.ModifiedCount, err
+	return updateResult.ModifiedCount, nil
 }
 
 func (r *mongoRepository) Delete(ctx context.Context, mod repository.Model, filterGroup *repository.FilterGroup) error {
+	if column, ok := repository.SoftDeleteColumn(mod); ok {
+		_, err := r.Update(ctx, mod, map[string]interface{}{column: time.Now()}, filterGroup)
+		return err
+	}
+
+	if err := modelColumns(mod).CheckFilter(filterGroup); err != nil {
+		zlog.Error("mongoRepo.Delete", zap.Any("mod", mod), zap.Error(err))
+		return err
+	}
+
 	collection := r.Db.Collection(mod.TableName())
+	ctx = r.sessionContext(ctx)
 
 	filter := bson.D{}
 	if filterGroup != nil {
-		filter = filterGroup.BuildToMongo()
+		// $nearSphere 只能用于查询
+		filter = repository.ReplaceNear(filterGroup).BuildToMongo()
 	}
 
 	_, err := collection.DeleteMany(ctx, filter)
@@ -71,8 +196,37 @@ func (r *mongoRepository) Delete(ctx context.Context, mod repository.Model, filt
 	return err
 }
 
+func (r *mongoRepository) Restore(ctx context.Context, mod repository.Model, filterGroup *repository.FilterGroup) (int64, error) {
+	filterGroup, err := repository.OnlyDeleted(mod, filterGroup)
+	if err != nil {
+		zlog.Error("mongoRepo.Restore", zap.Any("mod", mod), zap.Error(err))
+		return 0, err
+	}
+	column, _ := repository.SoftDeleteColumn(mod)
+	return r.update(ctx, mod, map[string]interface{}{column: nil}, filterGroup, "")
+}
+
 func (r *mongoRepository) Find(ctx context.Context, mod repository.Model, result interface{}, fields []string, filterGroup *repository.FilterGroup, sortSpecs *repository.SortSpecs, limitSpec *repository.LimitSpec) error {
+	return r.find(ctx, mod, result, fields, repository.ExcludeDeleted(mod, filterGroup), sortSpecs, limitSpec)
+}
+
+func (r *mongoRepository) FindWithDeleted(ctx context.Context, mod repository.Model, result interface{}, fields []string, filterGroup *repository.FilterGroup, sortSpecs *repository.SortSpecs, limitSpec *repository.LimitSpec) error {
+	return r.find(ctx, mod, result, fields, filterGroup, sortSpecs, limitSpec)
+}
+
+func (r *mongoRepository) find(ctx context.Context, mod repository.Model, result interface{}, fields []string, filterGroup *repository.FilterGroup, sortSpecs *repository.SortSpecs, limitSpec *repository.LimitSpec) error {
+	if err := modelColumns(mod).CheckQuery(fields, filterGroup, sortSpecs); err != nil {
+		zlog.Error("mongoRepo.Find", zap.Any("mod", mod), zap.Error(err))
+		return err
+	}
+
+	if limitSpec != nil {
+		// 游标翻页时追加主键作为次级排序
+		fields, sortSpecs = limitSpec.CursorSpecs(mod, fields, sortSpecs)
+	}
+
 	collection := r.Db.Collection(mod.TableName())
+	ctx = r.sessionContext(ctx)
 
 	filter := bson.D{}
 	var sort interface{}
@@ -88,11 +242,29 @@ func (r *mongoRepository) Find(ctx context.Context, mod repository.Model, result
 		formatProjection = nil
 	}
 
-	if filterGroup != nil {
-		filter = filterGroup.BuildToMongo()
+	if limitSpec != nil {
+		// 游标翻页时追加 keyset 条件
+		var err error
+		filterGroup, err = limitSpec.BuildCursorFilter(filterGroup, sortSpecs)
+		if err != nil {
+			zlog.Error("mongoRepo.Find.BuildCursorFilter", zap.Any("mod", mod),
+				zap.Any("sortSpecs", sortSpecs),
+				zap.Any("limitSpec", limitSpec),
+				zap.Error(err))
+			return err
+		}
+	}
+	// 距离排序转换为 $nearSphere 条件, 游标仍按原排序生成
+	queryGroup, querySorts, err := repository.BuildMongoDistanceSort(filterGroup, sortSpecs)
+	if err != nil {
+		zlog.Error("mongoRepo.Find.BuildMongoDistanceSort", zap.Any("mod", mod), zap.Any("sortSpecs", sortSpecs), zap.Error(err))
+		return err
+	}
+	if queryGroup != nil {
+		filter = queryGroup.BuildToMongo()
 	}
-	if sortSpecs != nil {
-		sort = sortSpecs.BuildToMongo()
+	if querySorts != nil {
+		sort = querySorts.BuildToMongo()
 	}
 	if limitSpec != nil {
 		limit, skip = limitSpec.BuildToMongo()
@@ -126,11 +298,95 @@ func (r *mongoRepository) Find(ctx context.Context, mod repository.Model, result
 		return err
 	}
 
+	if limitSpec != nil {
+		err = limitSpec.FillNextCursor(result, sortSpecs)
+		if err != nil {
+			zlog.Error("mongoRepo.Find.FillNextCursor", zap.Any("mod", mod),
+				zap.Any("sortSpecs", sortSpecs),
+				zap.Any("limitSpec", limitSpec),
+				zap.Error(err))
+			return err
+		}
+	}
 	return nil
 }
 
+// FindEach 使用游标逐条读取, 每 batchSize 条调用一次 fn
+func (r *mongoRepository) FindEach(ctx context.Context, mod repository.Model, result interface{}, fields []string, filterGroup *repository.FilterGroup, sortSpecs *repository.SortSpecs, batchSize int, fn func() error) error {
+	filterGroup = repository.ExcludeDeleted(mod, filterGroup)
+	if err := modelColumns(mod).CheckQuery(fields, filterGroup, sortSpecs); err != nil {
+		zlog.Error("mongoRepo.FindEach", zap.Any("mod", mod), zap.Error(err))
+		return err
+	}
+	batch, err := repository.NewEachBatch(ctx, result, batchSize, fn)
+	if err != nil {
+		return err
+	}
+
+	collection := r.Db.Collection(mod.TableName())
+	ctx = r.sessionContext(ctx)
+
+	queryGroup, querySorts, err := repository.BuildMongoDistanceSort(filterGroup, sortSpecs)
+	if err != nil {
+		zlog.Error("mongoRepo.FindEach.BuildMongoDistanceSort", zap.Any("mod", mod), zap.Any("sortSpecs", sortSpecs), zap.Error(err))
+		return err
+	}
+	filter := bson.D{}
+	if queryGroup != nil {
+		filter = queryGroup.BuildToMongo()
+	}
+	option := options.Find().SetBatchSize(int32(batch.BatchSize()))
+	if querySorts != nil {
+		option.SetSort(querySorts.BuildToMongo())
+	}
+	if len(fields) > 0 {
+		projection := make(bson.D, len(fields))
+		for index, field := range fields {
+			projection[index] = bson.E{Key: field, Value: 1}
+		}
+		option.SetProjection(projection)
+	}
+
+	cursor, err := collection.Find(ctx, filter, option)
+	if err != nil {
+		zlog.Error("mongoRepo.FindEach", zap.Any("mod", mod),
+			zap.Any("filterGroup", filterGroup),
+			zap.Any("sortSpecs", sortSpecs),
+			zap.Error(err))
+		return err
+	}
+	defer cursor.Close(context.Background())
+
+	for cursor.Next(ctx) {
+		if err = batch.Add(cursor.Decode); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = cursor.Err()
+	}
+	if err == nil {
+		err = batch.Flush()
+	}
+	if err = repository.EachResult(err); err != nil {
+		zlog.Error("mongoRepo.FindEach", zap.Any("mod", mod),
+			zap.Any("filterGroup", filterGroup),
+			zap.Any("sortSpecs", sortSpecs),
+			zap.Int("batchSize", batch.BatchSize()),
+			zap.Error(err))
+	}
+	return err
+}
+
 func (r *mongoRepository) FindOne(ctx context.Context, mod repository.Model, fields []string, filterGroup *repository.FilterGroup, sortSpecs *repository.SortSpecs) error {
+	filterGroup = repository.ExcludeDeleted(mod, filterGroup)
+	if err := modelColumns(mod).CheckQuery(fields, filterGroup, sortSpecs); err != nil {
+		zlog.Error("mongoRepo.FindOne", zap.Any("mod", mod), zap.Error(err))
+		return err
+	}
+
 	collection := r.Db.Collection(mod.TableName())
+	ctx = r.sessionContext(ctx)
 
 	filter := bson.D{}
 	var sort interface{}
@@ -144,18 +400,23 @@ func (r *mongoRepository) FindOne(ctx context.Context, mod repository.Model, fie
 	} else {
 		formatProjection = nil
 	}
-	if filterGroup != nil {
-		filter = filterGroup.BuildToMongo()
+	queryGroup, querySorts, err := repository.BuildMongoDistanceSort(filterGroup, sortSpecs)
+	if err != nil {
+		zlog.Error("mongoRepo.FindOne", zap.Any("mod", mod), zap.Any("sortSpecs", sortSpecs), zap.Error(err))
+		return err
+	}
+	if queryGroup != nil {
+		filter = queryGroup.BuildToMongo()
 	}
-	if sortSpecs != nil {
-		sort = sortSpecs.BuildToMongo()
+	if querySorts != nil {
+		sort = querySorts.BuildToMongo()
 	}
 
 	option := options.FindOneOptions{
 		Projection: formatProjection,
 		Sort:       sort,
 	}
-	err := collection.FindOne(ctx, filter, &option).Decode(mod)
+	err = collection.FindOne(ctx, filter, &option).Decode(mod)
 	if err != nil && err != mongo.ErrNoDocuments {
 		zlog.Error("mongoRepo.FindOne", zap.Any("mod", mod),
 			zap.Any("filterGroup", filterGroup),
@@ -169,11 +430,19 @@ func (r *mongoRepository) FindOne(ctx context.Context, mod repository.Model, fie
 }
 
 func (r *mongoRepository) Count(ctx context.Context, mod repository.Model, filterGroup *repository.FilterGroup) (int64, error) {
+	filterGroup = repository.ExcludeDeleted(mod, filterGroup)
+	if err := modelColumns(mod).CheckFilter(filterGroup); err != nil {
+		zlog.Error("mongoRepo.Count", zap.Any("mod", mod), zap.Error(err))
+		return 0, err
+	}
+
 	collection := r.Db.Collection(mod.TableName())
+	ctx = r.sessionContext(ctx)
 
 	filter := bson.D{}
 	if filterGroup != nil {
-		filter = filterGroup.BuildToMongo()
+		// $nearSphere 只能用于查询
+		filter = repository.ReplaceNear(filterGroup).BuildToMongo()
 	}
 
 	count, err := collection.CountDocuments(ctx, filter)
@@ -184,3 +453,276 @@ func (r *mongoRepository) Count(ctx context.Context, mod repository.Model, filte
 	}
 	return count, err
 }
+
+func (r *mongoRepository) FindByIDs(ctx context.Context, mod repository.Model, result interface{}, ids interface{}) error {
+	return r.Find(ctx, mod, result, nil, repository.IDsFilter(mod, ids), nil, nil)
+}
+
+// Exists 使用 limit 为 1 的 CountDocuments
+func (r *mongoRepository) Exists(ctx context.Context, mod repository.Model, filterGroup *repository.FilterGroup) (bool, error) {
+	filterGroup = repository.ExcludeDeleted(mod, filterGroup)
+	if err := modelColumns(mod).CheckFilter(filterGroup); err != nil {
+		zlog.Error("mongoRepo.Exists", zap.Any("mod", mod), zap.Error(err))
+		return false, err
+	}
+
+	collection := r.Db.Collection(mod.TableName())
+	ctx = r.sessionContext(ctx)
+
+	filter := bson.D{}
+	if filterGroup != nil {
+		filter = repository.ReplaceNear(filterGroup).BuildToMongo()
+	}
+
+	count, err := collection.CountDocuments(ctx, filter, options.Count().SetLimit(1))
+	if err != nil {
+		zlog.Error("mongoRepo.Exists", zap.Any("mod", mod),
+			zap.Any("filterGroup", filterGroup),
+			zap.Error(err))
+	}
+	return count > 0, err
+}
+
+// Distinct 取出的值按 bson 解码到 result
+func (r *mongoRepository) Distinct(ctx context.Context, mod repository.Model, column string, result interface{}, filterGroup *repository.FilterGroup) error {
+	filterGroup = repository.ExcludeDeleted(mod, filterGroup)
+	columns := modelColumns(mod)
+	err := columns.Check(column)
+	if err == nil {
+		err = columns.CheckFilter(filterGroup)
+	}
+	if err != nil {
+		zlog.Error("mongoRepo.Distinct", zap.Any("mod", mod), zap.Error(err))
+		return err
+	}
+
+	collection := r.Db.Collection(mod.TableName())
+	ctx = r.sessionContext(ctx)
+
+	filter := bson.D{}
+	if filterGroup != nil {
+		filter = repository.ReplaceNear(filterGroup).BuildToMongo()
+	}
+
+	values, err := collection.Distinct(ctx, column, filter)
+	if err == nil {
+		var valueType bsontype.Type
+		var data []byte
+		if valueType, data, err = bson.MarshalValue(values); err == nil {
+			err = bson.RawValue{Type: valueType, Value: data}.Unmarshal(result)
+		}
+	}
+	if err != nil {
+		zlog.Error("mongoRepo.Distinct", zap.Any("mod", mod),
+			zap.String("column", column),
+			zap.Any("filterGroup", filterGroup),
+			zap.Error(err))
+	}
+	return err
+}
+
+// FindPage 非事务中并发执行 Find 与 Count; 事务会话不能并发使用, 事务内依次执行
+func (r *mongoRepository) FindPage(ctx context.Context, mod repository.Model, result interface{}, fields []string, filterGroup *repository.FilterGroup, sortSpecs *repository.SortSpecs, limitSpec *repository.LimitSpec) (*repository.Page, error) {
+	if r.session != nil {
+		return repository.LoadPage(ctx, r, mod, result, fields, filterGroup, sortSpecs, limitSpec)
+	}
+
+	var total int64
+	var countErr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		total, countErr = r.Count(ctx, mod, filterGroup)
+	}()
+	err := r.Find(ctx, mod, result, fields, filterGroup, sortSpecs, limitSpec)
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	if countErr != nil {
+		return nil, countErr
+	}
+	return repository.NewPage(result, total, limitSpec), nil
+}
+
+func (r *mongoRepository) Aggregate(ctx context.Context, mod repository.Model, result interface{}, filterGroup *repository.FilterGroup, aggregateSpec *repository.AggregateSpec, sortSpecs *repository.SortSpecs, limitSpec *repository.LimitSpec) error {
+	filterGroup = repository.ExcludeDeleted(mod, filterGroup)
+	err := aggregateSpec.Validate()
+	if err == nil && limitSpec != nil && limitSpec.UseCursor {
+		err = repository.ErrAggregateCursorNotAllow
+	}
+	if err == nil {
+		err = modelColumns(mod).CheckAggregate(filterGroup, aggregateSpec, sortSpecs)
+	}
+	if err != nil {
+		zlog.Error("mongoRepo.Aggregate", zap.Any("mod", mod), zap.Any("aggregateSpec", aggregateSpec), zap.Error(err))
+		return err
+	}
+
+	collection := r.Db.Collection(mod.TableName())
+	ctx = r.sessionContext(ctx)
+
+	pipeline := aggregateSpec.BuildToMongo(repository.ReplaceNear(filterGroup), sortSpecs, limitSpec)
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err == nil {
+		err = cursor.All(ctx, result)
+	}
+	if err != nil {
+		zlog.Error("mongoRepo.Aggregate", zap.Any("mod", mod),
+			zap.Any("filterGroup", filterGroup),
+			zap.Any("aggregateSpec", aggregateSpec),
+			zap.Any("sortSpecs", sortSpecs),
+			zap.Any("limitSpec", limitSpec),
+			zap.Any("pipeline", pipeline),
+			zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+func (r *mongoRepository) WithTransaction(ctx context.Context, fn func(txRepo repository.BaseRepository) error) error {
+	// 已处于事务中时复用当前事务, mongo 不支持嵌套事务; panic 交给外层事务的 CallTxFunc 处理
+	if r.session != nil {
+		return fn(r)
+	}
+
+	session, err := r.Db.Client().StartSession()
+	if err != nil {
+		zlog.Error("mongoRepo.WithTransaction.StartSession", zap.Error(err))
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	// 注意: 遇到 TransientTransactionError 时驱动会重试整个回调, fn 需可重入
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		return nil, repository.CallTxFunc(&mongoRepository{Db: r.Db, session: session}, fn)
+	})
+	if err != nil {
+		zlog.Error("mongoRepo.WithTransaction", zap.Error(err))
+	}
+	repository.RethrowTxPanic(err)
+	return err
+}
+
+// sessionContext 事务仓储将会话绑定到 ctx 上, 使操作落在同一事务内
+func (r *mongoRepository) sessionContext(ctx context.Context) context.Context {
+	if r.session == nil {
+		return ctx
+	}
+	return mongo.NewSessionContext(ctx, r.session)
+}
+
+// modelColumns 模型允许使用的列, mongo 文档总是有 _id
+func modelColumns(mod repository.Model) *repository.ColumnSet {
+	return repository.ModelColumns(mod).With("_id")
+}
+
+// buildUpsert 将 mod 编码为文档后拆分为: conflictColumns 组成的 filter, updateColumns 组成的 $set, 其余字段组成的 $setOnInsert
+func buildUpsert(mod repository.Model, conflictColumns []string, updateColumns []string) (bson.D, bson.D, error) {
+	raw, err := bson.Marshal(mod)
+	if err != nil {
+		return nil, nil, err
+	}
+	var doc bson.D
+	if err = bson.Unmarshal(raw, &doc); err != nil {
+		return nil, nil, err
+	}
+	if len(conflictColumns) == 0 {
+		conflictColumns = []string{"_id"}
+	}
+	for _, column := range conflictColumns {
+		if column == "_id" {
+			if doc, err = fillObjectID(mod, doc); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	values := doc.Map()
+	filter := bson.D{}
+	conflict := make(map[string]bool, len(conflictColumns))
+	for _, column := range conflictColumns {
+		value, ok := values[column]
+		if !ok {
+			return nil, nil, fmt.Errorf("conflict column %s not found in %T", column, mod)
+		}
+		filter = append(filter, bson.E{Key: column, Value: value})
+		conflict[column] = true
+	}
+
+	updates := make(map[string]bool, len(updateColumns))
+	for _, column := range updateColumns {
+		updates[column] = true
+	}
+
+	versionColumn, versioned := repository.VersionColumn(mod)
+	set, setOnInsert := bson.D{}, bson.D{}
+	for _, e := range doc {
+		switch {
+		case conflict[e.Key]:
+			setOnInsert = append(setOnInsert, e)
+		case versioned && e.Key == versionColumn:
+			// 乐观锁: 版本通过 $inc 加 1, 新文档为 1, 不使用模型中的版本
+		case e.Key == "_id":
+			// _id 不可修改, 零值时交给数据库生成
+			if id, ok := e.Value.(primitive.ObjectID); !ok || !id.IsZero() {
+				setOnInsert = append(setOnInsert, e)
+			}
+		case len(updates) == 0 || updates[e.Key]:
+			set = append(set, e)
+		default:
+			setOnInsert = append(setOnInsert, e)
+		}
+	}
+
+	update := bson.D{}
+	if len(set) > 0 {
+		update = append(update, bson.E{Key: "$set", Value: set})
+	}
+	if len(setOnInsert) > 0 {
+		update = append(update, bson.E{Key: "$setOnInsert", Value: setOnInsert})
+	}
+	if versioned {
+		update = append(update, bson.E{Key: "$inc", Value: bson.D{{Key: versionColumn, Value: 1}}})
+	}
+	return filter, update, nil
+}
+
+// fillObjectID 按 _id 判断冲突而 _id 缺失或为零值时视为新文档, 生成 ObjectID 写入文档并回填到模型,
+// 避免所有新文档都匹配同一个零值 _id; _id 不是 ObjectID 类型时无法生成, 返回错误
+func fillObjectID(mod repository.Model, doc bson.D) (bson.D, error) {
+	index := -1
+	for i, e := range doc {
+		if e.Key == "_id" {
+			index = i
+			break
+		}
+	}
+	if index >= 0 && doc[index].Value != nil {
+		id, isObjectID := doc[index].Value.(primitive.ObjectID)
+		switch {
+		case isObjectID && !id.IsZero(), !isObjectID && !reflect.ValueOf(doc[index].Value).IsZero():
+			return doc, nil
+		case !isObjectID:
+			return nil, fmt.Errorf("upsert %T: _id is empty", mod)
+		}
+	}
+
+	id := primitive.NewObjectID()
+	if field, ok := repository.FieldByColumn(reflect.ValueOf(mod), "_id"); ok {
+		switch {
+		case field.Type() == reflect.TypeOf(id) && field.CanSet():
+			field.Set(reflect.ValueOf(id))
+		case field.Type() == reflect.TypeOf(&id) && field.CanSet():
+			field.Set(reflect.ValueOf(&id))
+		default:
+			return nil, fmt.Errorf("upsert %T: _id is empty and cannot be generated for %s", mod, field.Type())
+		}
+	}
+	if index >= 0 {
+		doc[index].Value = id
+	} else {
+		doc = append(bson.D{{Key: "_id", Value: id}}, doc...)
+	}
+	return doc, nil
+}
@@ -2,9 +2,13 @@ package mongorepo
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/henrion-y/base.services/database/mongo"
 	"github.com/henrion-y/base.services/domain/repository"
 	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	_mongo "go.mongodb.org/mongo-driver/mongo"
 	"testing"
 	"time"
@@ -161,3 +165,287 @@ func TestBaseRepository_Delete(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// mongo 事务需要副本集或分片集群环境
+func TestBaseRepository_WithTransaction(t *testing.T) {
+	repo := NewBaseRepository(getDb())
+
+	mod := User{}
+	err := repo.WithTransaction(context.Background(), func(txRepo repository.BaseRepository) error {
+		_, err := txRepo.Update(context.Background(), &mod, map[string]interface{}{"age": 30},
+			repository.NewFilterGroup().Equals("name", "张三"))
+		if err != nil {
+			return err
+		}
+		return txRepo.WithTransaction(context.Background(), func(txRepo repository.BaseRepository) error {
+			return txRepo.Create(context.Background(), &User{Name: "刘备", Age: 30, Ctime: time.Now(), Mtime: time.Now()})
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = repo.WithTransaction(context.Background(), func(txRepo repository.BaseRepository) error {
+		return errors.New("rollback")
+	})
+	if err == nil {
+		t.Fatal("expect error when transaction fails")
+	}
+	t.Log(err)
+}
+
+// 游标翻页
+func TestBaseRepository_FindByCursor(t *testing.T) {
+	repo := NewBaseRepository(getDb())
+
+	mod := User{}
+	sortSpecs := repository.NewSortSpecs("age", repository.SortType_DESC).AddAsc("name")
+	limitSpec := repository.NewCursorLimitSpec("", 1)
+	for {
+		var list []User
+		err := repo.Find(context.Background(), &mod, &list, nil, repository.NewFilterGroup().GreaterThan("age", 0), sortSpecs, limitSpec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Log(list)
+		if limitSpec.NextCursor == "" {
+			break
+		}
+		limitSpec = repository.NewCursorLimitSpec(limitSpec.NextCursor, 1)
+	}
+}
+
+func TestRepository_Generic(t *testing.T) {
+	repo := repository.NewRepository[User](NewBaseRepository(getDb()))
+
+	user, found, err := repo.Get(context.Background(), repository.NewFilterGroup().Equals("name", "张三"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(user, found)
+
+	list, page, err := repo.FindPage(context.Background(), nil, repository.NewFilterGroup().GreaterThan("age", 0),
+		repository.NewSortSpecs("age", repository.SortType_ASC), repository.NewLimitSpec(1, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(list, page.Total)
+}
+
+func TestBaseRepository_Aggregate(t *testing.T) {
+	repo := NewBaseRepository(getDb())
+
+	var list []struct {
+		Age int   `bson:"age"`
+		Cnt int64 `bson:"cnt"`
+	}
+	aggregateSpec := repository.NewAggregateSpec("age").Count("cnt").SetHaving(repository.NewFilterGroup().GreaterThan("cnt", 0))
+	err := repo.Aggregate(context.Background(), &User{}, &list, repository.NewFilterGroup().GreaterThan("age", 10),
+		aggregateSpec, repository.NewSortSpecs("cnt", repository.SortType_DESC), repository.NewLimitSpec(0, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(list)
+}
+
+func TestBaseRepository_CreateBatch(t *testing.T) {
+	repo := NewBaseRepository(getDb())
+
+	newTime := time.Now()
+	users := []User{
+		{ID: 11, Name: "马超", Age: 25, Ctime: newTime, Mtime: newTime},
+		{ID: 12, Name: "黄忠", Age: 60, Ctime: newTime, Mtime: newTime},
+		{ID: 13, Name: "魏延", Age: 35, Ctime: newTime, Mtime: newTime},
+	}
+	counts, err := repo.CreateBatch(context.Background(), users, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(counts)
+}
+
+func TestBaseRepository_Upsert(t *testing.T) {
+	repo := NewBaseRepository(getDb())
+
+	newTime := time.Now()
+	rowCount, err := repo.Upsert(context.Background(), &User{ID: 11, Name: "马超", Age: 26, Ctime: newTime, Mtime: newTime},
+		[]string{"id"}, []string{"age", "mtime"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(rowCount)
+}
+
+type Tag struct {
+	ID   primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Name string             `json:"name" bson:"name"`
+}
+
+func (t *Tag) TableName() string {
+	return "t_tag_repository"
+}
+
+type Code struct {
+	ID   string `json:"id" bson:"_id"`
+	Name string `json:"name" bson:"name"`
+}
+
+func (c *Code) TableName() string {
+	return "t_code_repository"
+}
+
+func TestBuildUpsert_ObjectID(t *testing.T) {
+	// 新文档各自生成 _id, 不会匹配同一个零值 _id
+	tags := []*Tag{{Name: "go"}, {Name: "mongo"}}
+	for _, tag := range tags {
+		filter, _, err := buildUpsert(tag, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tag.ID.IsZero() || len(filter) != 1 || filter[0].Key != "_id" || filter[0].Value != tag.ID {
+			t.Fatalf("expect filter by generated _id, got %v %+v", filter, tag)
+		}
+	}
+	if tags[0].ID == tags[1].ID {
+		t.Fatal("expect different _id for new documents")
+	}
+
+	// 已有 _id 时不重新生成
+	id := tags[0].ID
+	if _, _, err := buildUpsert(tags[0], nil, nil); err != nil || tags[0].ID != id {
+		t.Fatalf("expect _id unchanged, got %v %v", tags[0].ID, err)
+	}
+
+	if _, _, err := buildUpsert(&Code{Name: "a"}, nil, nil); err == nil {
+		t.Fatal("expect error for empty string _id")
+	}
+}
+
+func TestBaseRepository_UpsertNew(t *testing.T) {
+	ctx := context.Background()
+	repo := NewBaseRepository(getDb())
+	if err := repo.Delete(ctx, &Tag{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"go", "mongo"} {
+		if _, err := repo.Upsert(ctx, &Tag{Name: name}, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count, err := repo.Count(ctx, &Tag{}, nil)
+	if err != nil || count != 2 {
+		t.Fatalf("expect 2 tags, got %d %v", count, err)
+	}
+}
+
+type Article struct {
+	ID        int        `json:"id" bson:"id"`
+	Title     string     `json:"title" bson:"title"`
+	DeletedAt *time.Time `json:"deleted_at" bson:"deleted_at"`
+}
+
+func (a Article) TableName() string {
+	return "t_article_repository"
+}
+
+func (a Article) SoftDeleteColumn() string {
+	return "deleted_at"
+}
+
+func TestBaseRepository_SoftDelete(t *testing.T) {
+	repo := NewBaseRepository(getDb())
+
+	err := repo.Create(context.Background(), &Article{ID: 1, Title: "soft delete"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	filterGroup := repository.NewFilterGroup().Equals("title", "soft delete")
+	if err = repo.Delete(context.Background(), &Article{}, filterGroup); err != nil {
+		t.Fatal(err)
+	}
+
+	var list []Article
+	if err = repo.FindWithDeleted(context.Background(), &Article{}, &list, nil, filterGroup, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Log(list)
+
+	rowCount, err := repo.Restore(context.Background(), &Article{}, filterGroup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(rowCount)
+}
+
+type Account struct {
+	ID      int `json:"id" bson:"id"`
+	Balance int `json:"balance" bson:"balance"`
+	Version int `json:"version" bson:"version"`
+}
+
+func (a *Account) TableName() string {
+	return "t_account_repository"
+}
+
+func (a *Account) VersionColumn() string {
+	return "version"
+}
+
+func TestBaseRepository_OptimisticLock(t *testing.T) {
+	repo := NewBaseRepository(getDb())
+
+	account := &Account{ID: 1, Balance: 100}
+	if err := repo.Create(context.Background(), account); err != nil {
+		t.Fatal(err)
+	}
+	stale := *account
+	filterGroup := repository.NewFilterGroup().Equals("id", account.ID)
+	if _, err := repo.Update(context.Background(), account, map[string]interface{}{"balance": 80}, filterGroup); err != nil {
+		t.Fatal(err)
+	}
+	_, err := repo.Update(context.Background(), &stale, map[string]interface{}{"balance": 50}, filterGroup)
+	if !errors.Is(err, repository.ErrVersionConflict) {
+		t.Fatalf("expect ErrVersionConflict, got %v", err)
+	}
+
+	// Upsert 冲突时版本在原值上加 1, 模型中的旧版本不会写回, 持有旧版本的更新仍然冲突
+	stale = Account{ID: account.ID, Balance: 60, Version: 1}
+	if _, err = repo.Upsert(context.Background(), &stale, []string{"id"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	_, err = repo.Update(context.Background(), &stale, map[string]interface{}{"balance": 50}, filterGroup)
+	if !errors.Is(err, repository.ErrVersionConflict) {
+		t.Fatalf("expect ErrVersionConflict after upsert, got %v", err)
+	}
+}
+
+func TestBuildUpsert_Version(t *testing.T) {
+	account := &Account{ID: 1, Balance: 100}
+	_, update, err := buildUpsert(account, []string{"id"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 版本只出现在 $inc 中, 不被模型中的版本覆盖
+	want := bson.D{
+		{Key: "$set", Value: bson.D{{Key: "balance", Value: int64(100)}}},
+		{Key: "$setOnInsert", Value: bson.D{{Key: "id", Value: int64(1)}}},
+		{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}},
+	}
+	if fmt.Sprint(update) != fmt.Sprint(want) {
+		t.Fatalf("expect %v, got %v", want, update)
+	}
+}
+
+func TestBaseRepository_FindEach(t *testing.T) {
+	repo := NewBaseRepository(getDb())
+
+	var list []User
+	err := repo.FindEach(context.Background(), &User{}, &list, nil, nil,
+		repository.NewSortSpecs("age", repository.SortType_ASC), 2, func() error {
+			t.Log(list)
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
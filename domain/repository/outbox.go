@@ -0,0 +1,395 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+
+	"github.com/henrion-y/base.services/infra/zlog"
+)
+
+/********* 事务性发件箱 ***********/
+
+/*
+NewOutboxRepository 为写操作生成领域事件, 避免 写数据库 + 发消息 两次写入不一致:
+1. Create、CreateBatch、Upsert、Update、Delete、Restore 成功后, 在同一事务中向 outbox 表写入一条 OutboxEvent,
+   写操作与事件同时提交或回滚; 底层仓储须支持事务, 如 gormrepo(mongorepo 须部署为副本集).
+   事件 id 在写入前生成, 为 ObjectID 的十六进制文本(按秒递增, 同一进程内严格递增), 不依赖数据库自增, SQL 中 id 列须为 CHAR(24)
+2. Update、Delete、Restore 在执行前于同一事务中查询命中记录的主键, 写入 OutboxPayload.IDs, 因此每次多一次查询;
+   只命中一条记录时以其主键作为消息 key; 命中超过 OutboxMaxIDs 条时不写入主键, 以 IDsTruncated 标记, 消费方按 Filter 处理
+3. OutboxRelay 轮询待发送的事件, 通过 OutboxPublisher(如 kafka_client.Publisher)发布后标记为已发送;
+   发布失败按指数退避重试, 超过最大次数标记为失败
+4. 先发布后标记, 标记失败或多个 relay 同时运行时事件可能重复发布(至少一次), 消费方须按消息头中的 outbox_id 去重
+*/
+
+const (
+	DefaultOutboxTable = "t_outbox"
+	// OutboxMaxIDs 事件中最多记录的主键数, 避免批量修改产生过大的消息
+	OutboxMaxIDs = 1000
+)
+
+type OutboxStatus string
+
+const (
+	OutboxStatus_PENDING OutboxStatus = "PENDING" // 待发送
+	OutboxStatus_SENT    OutboxStatus = "SENT"    // 已发送
+	OutboxStatus_FAILED  OutboxStatus = "FAILED"  // 超过最大重试次数
+)
+
+// OutboxEvent outbox 表中的一条事件
+type OutboxEvent struct {
+	ID            string       `json:"id" gorm:"primaryKey;size:24" bson:"id,omitempty"`
+	Topic         string       `json:"topic" bson:"topic"`
+	Key           string       `json:"key" bson:"key"`         // 消息 key, 为单条记录的主键, 多条记录时为空
+	Payload       string       `json:"payload" bson:"payload"` // 消息内容, 为 OutboxPayload 的 JSON
+	Status        OutboxStatus `json:"status" bson:"status"`
+	Attempts      int          `json:"attempts" bson:"attempts"` // 已尝试发布的次数
+	LastError     string       `json:"last_error" bson:"last_error"`
+	NextAttemptAt time.Time    `json:"next_attempt_at" bson:"next_attempt_at"` // 下次可发布的时间
+	CreatedAt     time.Time    `json:"created_at" bson:"created_at"`
+	SentAt        *time.Time   `json:"sent_at" bson:"sent_at"`
+
+	table string
+}
+
+func (e *OutboxEvent) TableName() string {
+	if e.table == "" {
+		return DefaultOutboxTable
+	}
+	return e.table
+}
+
+// OutboxPayload 事件内容
+type OutboxPayload struct {
+	Table        string                 `json:"table"`
+	Operation    Operation              `json:"operation"`
+	Operator     string                 `json:"operator,omitempty"` // 见 WithOperator
+	Model        interface{}            `json:"model,omitempty"`    // Create、Upsert 的模型
+	Models       interface{}            `json:"models,omitempty"`   // CreateBatch 的模型切片
+	Data         map[string]interface{} `json:"data,omitempty"`     // Update 的更新内容
+	Filter       *FilterGroup           `json:"filter,omitempty"`
+	IDs          []interface{}          `json:"ids,omitempty"`           // Update、Delete、Restore 命中记录的主键
+	IDsTruncated bool                   `json:"ids_truncated,omitempty"` // 命中超过 OutboxMaxIDs 条, IDs 为空
+	OccurredAt   time.Time              `json:"occurred_at"`
+}
+
+type outboxRepository struct {
+	BaseRepository
+	table       string
+	topicPrefix string
+}
+
+// NewOutboxRepository 为 base 的写操作写入事件, table 为空时使用 DefaultOutboxTable;
+// 事件的 topic 为 topicPrefix + 被修改的表名, 如 topicPrefix 为 "events." 时 t_user 的事件写入 events.t_user
+func NewOutboxRepository(base BaseRepository, table string, topicPrefix string) BaseRepository {
+	if table == "" {
+		table = DefaultOutboxTable
+	}
+	return &outboxRepository{BaseRepository: base, table: table, topicPrefix: topicPrefix}
+}
+
+// write 在事务中执行写操作并写入事件, 对 outbox 表自身的写入不产生事件
+func (r *outboxRepository) write(ctx context.Context, payload *OutboxPayload, key func() string, fn func(txRepo BaseRepository) error) error {
+	if payload.Table == r.table {
+		return fn(r.BaseRepository)
+	}
+	return r.BaseRepository.WithTransaction(ctx, func(txRepo BaseRepository) error {
+		if err := fn(txRepo); err != nil {
+			return err
+		}
+		payload.Operator = OperatorFromContext(ctx)
+		payload.OccurredAt = time.Now()
+		data, err := json.Marshal(payload)
+		if err != nil {
+			zlog.Error("outboxRepository.write.Marshal", zap.String("table", payload.Table), zap.Error(err))
+			return err
+		}
+		event := &OutboxEvent{
+			ID:            primitive.NewObjectID().Hex(),
+			Topic:         r.topicPrefix + payload.Table,
+			Key:           key(),
+			Payload:       string(data),
+			Status:        OutboxStatus_PENDING,
+			NextAttemptAt: payload.OccurredAt,
+			CreatedAt:     payload.OccurredAt,
+			table:         r.table,
+		}
+		if err := txRepo.Create(ctx, event); err != nil {
+			zlog.Error("outboxRepository.write", zap.Any("event", event), zap.Error(err))
+			return err
+		}
+		return nil
+	})
+}
+
+func noKey() string {
+	return ""
+}
+
+// idsKey 只命中一条记录时以其主键作为消息 key
+func idsKey(payload *OutboxPayload) func() string {
+	return func() string {
+		if len(payload.IDs) != 1 {
+			return ""
+		}
+		return strings.Trim(jsonString(payload.IDs[0]), `"`)
+	}
+}
+
+// setAffectedIDs 查询 filterGroup 命中记录的主键写入 payload, 最多查询 OutboxMaxIDs + 1 条, 超过时只标记 IDsTruncated;
+// withDeleted 时查询已软删除的记录(Restore)
+func setAffectedIDs(ctx context.Context, txRepo BaseRepository, payload *OutboxPayload, mod Model, filterGroup *FilterGroup, withDeleted bool) error {
+	column := PrimaryKeyColumn(mod)
+	list := reflect.New(reflect.SliceOf(reflect.TypeOf(mod)))
+	limitSpec := NewLimitSpec(1, OutboxMaxIDs+1)
+	var err error
+	if withDeleted {
+		if filterGroup, err = OnlyDeleted(mod, filterGroup); err == nil {
+			err = txRepo.FindWithDeleted(ctx, mod, list.Interface(), []string{column}, filterGroup, nil, limitSpec)
+		}
+	} else {
+		err = txRepo.Find(ctx, mod, list.Interface(), []string{column}, filterGroup, nil, limitSpec)
+	}
+	if err != nil {
+		zlog.Error("outboxRepository.setAffectedIDs", zap.Any("mod", mod), zap.Any("filterGroup", filterGroup), zap.Error(err))
+		return err
+	}
+
+	if list.Elem().Len() > OutboxMaxIDs {
+		payload.IDs, payload.IDsTruncated = nil, true
+		return nil
+	}
+	ids := make([]interface{}, 0, list.Elem().Len())
+	for i := 0; i < list.Elem().Len(); i++ {
+		if id, ok := ColumnValue(list.Elem().Index(i).Interface(), column); ok {
+			ids = append(ids, id)
+		}
+	}
+	payload.IDs = ids
+	return nil
+}
+
+// modelKey 以记录 id 作为消息 key, 使同一记录的事件进入同一分区
+func modelKey(mod Model) func() string {
+	return func() string {
+		id := recordID(mod)
+		if id == nil || reflect.ValueOf(id).IsZero() {
+			return ""
+		}
+		return strings.Trim(jsonString(id), `"`)
+	}
+}
+
+func (r *outboxRepository) Create(ctx context.Context, mod Model) error {
+	payload := &OutboxPayload{Table: mod.TableName(), Operation: Operation_CREATE, Model: mod}
+	return r.write(ctx, payload, modelKey(mod), func(txRepo BaseRepository) error {
+		return txRepo.Create(ctx, mod)
+	})
+}
+
+func (r *outboxRepository) CreateBatch(ctx context.Context, models interface{}, batchSize int) ([]int64, error) {
+	batches, err := SplitBatches(models, 0)
+	if err != nil || len(batches) == 0 {
+		return r.BaseRepository.CreateBatch(ctx, models, batchSize)
+	}
+
+	var counts []int64
+	payload := &OutboxPayload{Table: batches[0].Items[0].TableName(), Operation: Operation_CREATE_BATCH, Models: models}
+	err = r.write(ctx, payload, noKey, func(txRepo BaseRepository) (err error) {
+		counts, err = txRepo.CreateBatch(ctx, models, batchSize)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+func (r *outboxRepository) Upsert(ctx context.Context, mod Model, conflictColumns []string, updateColumns []string) (int64, error) {
+	var rowsAffected int64
+	payload := &OutboxPayload{Table: mod.TableName(), Operation: Operation_UPSERT, Model: mod}
+	err := r.write(ctx, payload, modelKey(mod), func(txRepo BaseRepository) (err error) {
+		rowsAffected, err = txRepo.Upsert(ctx, mod, conflictColumns, updateColumns)
+		return err
+	})
+	return rowsAffected, err
+}
+
+func (r *outboxRepository) Update(ctx context.Context, mod Model, data map[string]interface{}, filterGroup *FilterGroup) (int64, error) {
+	var rowsAffected int64
+	payload := &OutboxPayload{Table: mod.TableName(), Operation: Operation_UPDATE, Data: data, Filter: filterGroup}
+	err := r.write(ctx, payload, idsKey(payload), func(txRepo BaseRepository) (err error) {
+		if err = setAffectedIDs(ctx, txRepo, payload, mod, filterGroup, false); err != nil {
+			return err
+		}
+		rowsAffected, err = txRepo.Update(ctx, mod, data, filterGroup)
+		return err
+	})
+	return rowsAffected, err
+}
+
+func (r *outboxRepository) Delete(ctx context.Context, mod Model, filterGroup *FilterGroup) error {
+	payload := &OutboxPayload{Table: mod.TableName(), Operation: Operation_DELETE, Filter: filterGroup}
+	return r.write(ctx, payload, idsKey(payload), func(txRepo BaseRepository) (err error) {
+		if err = setAffectedIDs(ctx, txRepo, payload, mod, filterGroup, false); err != nil {
+			return err
+		}
+		return txRepo.Delete(ctx, mod, filterGroup)
+	})
+}
+
+func (r *outboxRepository) Restore(ctx context.Context, mod Model, filterGroup *FilterGroup) (int64, error) {
+	var rowsAffected int64
+	payload := &OutboxPayload{Table: mod.TableName(), Operation: Operation_RESTORE, Filter: filterGroup}
+	err := r.write(ctx, payload, idsKey(payload), func(txRepo BaseRepository) (err error) {
+		if err = setAffectedIDs(ctx, txRepo, payload, mod, filterGroup, true); err != nil {
+			return err
+		}
+		rowsAffected, err = txRepo.Restore(ctx, mod, filterGroup)
+		return err
+	})
+	return rowsAffected, err
+}
+
+func (r *outboxRepository) WithTransaction(ctx context.Context, fn func(txRepo BaseRepository) error) error {
+	return r.BaseRepository.WithTransaction(ctx, func(txRepo BaseRepository) error {
+		return fn(&outboxRepository{BaseRepository: txRepo, table: r.table, topicPrefix: r.topicPrefix})
+	})
+}
+
+/********* 发件箱转发 ***********/
+
+// OutboxPublisher 发布事件的消息队列, headers 中带有 outbox_id 供消费方去重
+type OutboxPublisher interface {
+	Publish(ctx context.Context, topic string, key string, value []byte, headers map[string]string) error
+}
+
+// OutboxRelay 轮询 outbox 表并发布待发送的事件
+type OutboxRelay struct {
+	repo        BaseRepository
+	table       string
+	publisher   OutboxPublisher
+	batchSize   int
+	interval    time.Duration
+	maxAttempts int
+	maxBackoff  time.Duration
+}
+
+// NewOutboxRelay 创建转发器, repo 为 outbox 表所在的仓储, table 为空时使用 DefaultOutboxTable.
+// 默认每批 100 条, 空闲时每秒轮询一次, 最多尝试 10 次, 重试间隔从 1 秒起翻倍, 最长 10 分钟
+func NewOutboxRelay(repo BaseRepository, table string, publisher OutboxPublisher) *OutboxRelay {
+	if table == "" {
+		table = DefaultOutboxTable
+	}
+	return &OutboxRelay{
+		repo:        repo,
+		table:       table,
+		publisher:   publisher,
+		batchSize:   100,
+		interval:    time.Second,
+		maxAttempts: 10,
+		maxBackoff:  10 * time.Minute,
+	}
+}
+
+func (r *OutboxRelay) SetBatchSize(batchSize int) *OutboxRelay {
+	if batchSize > 0 {
+		r.batchSize = batchSize
+	}
+	return r
+}
+
+func (r *OutboxRelay) SetInterval(interval time.Duration) *OutboxRelay {
+	if interval > 0 {
+		r.interval = interval
+	}
+	return r
+}
+
+// SetMaxAttempts 设置最大尝试次数, <= 0 时不限次数
+func (r *OutboxRelay) SetMaxAttempts(maxAttempts int) *OutboxRelay {
+	r.maxAttempts = maxAttempts
+	return r
+}
+
+// Run 持续转发直到 ctx 结束, 一批事件全部处理完时立即处理下一批, 否则等待 interval
+func (r *OutboxRelay) Run(ctx context.Context) {
+	for {
+		sent, err := r.RelayOnce(ctx)
+		if err == nil && sent >= r.batchSize {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.interval):
+		}
+	}
+}
+
+// RelayOnce 发布一批到期的待发送事件, 返回本批处理的事件数
+func (r *OutboxRelay) RelayOnce(ctx context.Context) (int, error) {
+	var events []*OutboxEvent
+	now := time.Now()
+	filterGroup := NewFilterGroup().Equals("status", OutboxStatus_PENDING).LessThanOrEqual("next_attempt_at", now)
+	err := r.repo.Find(ctx, &OutboxEvent{table: r.table}, &events, nil, filterGroup,
+		NewSortSpecs("id", SortType_ASC), NewLimitSpec(1, r.batchSize))
+	if err != nil {
+		zlog.Error("OutboxRelay.RelayOnce", zap.String("table", r.table), zap.Error(err))
+		return 0, err
+	}
+
+	for _, event := range events {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		if err = r.relay(ctx, event); err != nil {
+			return 0, err
+		}
+	}
+	return len(events), nil
+}
+
+// relay 发布单个事件并更新状态, 只有更新状态失败时返回 error
+func (r *OutboxRelay) relay(ctx context.Context, event *OutboxEvent) error {
+	headers := map[string]string{"outbox_id": event.ID}
+	publishErr := r.publisher.Publish(ctx, event.Topic, event.Key, []byte(event.Payload), headers)
+
+	now := time.Now()
+	attempts := event.Attempts + 1
+	data := map[string]interface{}{"attempts": attempts}
+	if publishErr == nil {
+		data["status"] = OutboxStatus_SENT
+		data["sent_at"] = now
+	} else {
+		zlog.Error("OutboxRelay.relay.Publish", zap.String("id", event.ID), zap.String("topic", event.Topic), zap.Error(publishErr))
+		data["last_error"] = publishErr.Error()
+		data["next_attempt_at"] = now.Add(r.backoff(attempts))
+		if r.maxAttempts > 0 && attempts >= r.maxAttempts {
+			data["status"] = OutboxStatus_FAILED
+		}
+	}
+
+	_, err := r.repo.Update(ctx, &OutboxEvent{table: r.table}, data, NewFilterGroup().Equals("id", event.ID))
+	if err != nil {
+		zlog.Error("OutboxRelay.relay.Update", zap.String("id", event.ID), zap.Any("data", data), zap.Error(err))
+	}
+	return err
+}
+
+// backoff 第 n 次失败后的重试间隔: 1s、2s、4s... 最长 maxBackoff
+func (r *OutboxRelay) backoff(attempts int) time.Duration {
+	backoff := time.Second
+	for i := 1; i < attempts && backoff < r.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > r.maxBackoff {
+		backoff = r.maxBackoff
+	}
+	return backoff
+}
@@ -0,0 +1,141 @@
+package repository_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/henrion-y/base.services/domain/repository"
+	"github.com/henrion-y/base.services/domain/repository/memrepo"
+)
+
+type fakePublisher struct {
+	failures int
+	messages []string
+}
+
+func (p *fakePublisher) Publish(ctx context.Context, topic string, key string, value []byte, headers map[string]string) error {
+	if p.failures > 0 {
+		p.failures--
+		return errors.New("broker unavailable")
+	}
+	p.messages = append(p.messages, topic+"/"+key+"/"+headers["outbox_id"])
+	return nil
+}
+
+func TestOutboxRepository_Relay(t *testing.T) {
+	ctx := context.Background()
+	base := memrepo.NewBaseRepository()
+	repo := repository.NewOutboxRepository(base, "", "events.")
+
+	order := &Order{Amount: 100}
+	if err := repo.Create(ctx, order); err != nil {
+		t.Fatal(err)
+	}
+	// 写操作失败时事件随事务回滚
+	if _, err := repo.Update(ctx, &Order{}, map[string]interface{}{"unknown": 1}, nil); err == nil {
+		t.Fatal("expect unknown column error")
+	}
+	if _, err := repo.Update(ctx, &Order{}, map[string]interface{}{"amount": 80}, repository.NewFilterGroup().Equals("id", order.ID)); err != nil {
+		t.Fatal(err)
+	}
+
+	publisher := &fakePublisher{failures: 1}
+	relay := repository.NewOutboxRelay(base, "", publisher)
+	sent, err := relay.RelayOnce(ctx)
+	if err != nil || sent != 2 {
+		t.Fatalf("expect 2 events relayed, got %d %v", sent, err)
+	}
+	// 第一个事件发布失败, 退避期内不会再次发布
+	if sent, err = relay.RelayOnce(ctx); err != nil || sent != 0 {
+		t.Fatalf("expect no due events, got %d %v", sent, err)
+	}
+
+	var events []repository.OutboxEvent
+	if err = base.Find(ctx, &repository.OutboxEvent{}, &events, nil, nil, repository.NewSortSpecs("id", repository.SortType_ASC), nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Status != repository.OutboxStatus_PENDING || events[0].Attempts != 1 ||
+		events[0].LastError == "" || events[1].Status != repository.OutboxStatus_SENT || events[1].SentAt == nil {
+		t.Fatalf("unexpected events %+v", events)
+	}
+	if events[0].Key != "1" || events[0].ID == "" || events[1].ID <= events[0].ID {
+		t.Fatalf("expect create event keyed by id, got %+v", events[0])
+	}
+	// 只命中一条记录的更新以其主键作为 key, 事件中带有命中记录的主键
+	if want := "events.t_order_repository/1/" + events[1].ID; len(publisher.messages) != 1 || publisher.messages[0] != want {
+		t.Fatalf("expect message %s, got %v", want, publisher.messages)
+	}
+	var payload repository.OutboxPayload
+	if err = json.Unmarshal([]byte(events[1].Payload), &payload); err != nil || len(payload.IDs) != 1 || payload.IDs[0] != float64(1) {
+		t.Fatalf("unexpected update payload %s %v", events[1].Payload, err)
+	}
+}
+
+type Reading struct {
+	ID    int     `json:"id" gorm:"primary_key"`
+	Value float64 `json:"value" gorm:"value"`
+}
+
+func (r *Reading) TableName() string {
+	return "t_reading_repository"
+}
+
+func TestOutboxRepository_Payload(t *testing.T) {
+	ctx := context.Background()
+	base := memrepo.NewBaseRepository()
+	repo := repository.NewOutboxRepository(base, "", "")
+
+	// 事件内容无法编码时返回错误, 写操作随事务回滚
+	if err := repo.Create(ctx, &Reading{Value: math.NaN()}); err == nil {
+		t.Fatal("expect marshal error")
+	}
+	if count, err := base.Count(ctx, &Reading{}, nil); err != nil || count != 0 {
+		t.Fatalf("expect rolled back, got %d %v", count, err)
+	}
+
+	for _, value := range []float64{1, 2, 3} {
+		if err := base.Create(ctx, &Reading{Value: value}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := repo.Delete(ctx, &Reading{}, repository.NewFilterGroup().GreaterThan("value", 1)); err != nil {
+		t.Fatal(err)
+	}
+	var events []repository.OutboxEvent
+	if err := base.Find(ctx, &repository.OutboxEvent{}, &events, nil, nil, nil, nil); err != nil || len(events) != 1 {
+		t.Fatalf("expect 1 event, got %+v %v", events, err)
+	}
+	var payload repository.OutboxPayload
+	if err := json.Unmarshal([]byte(events[0].Payload), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if events[0].Key != "" || len(payload.IDs) != 2 || payload.IDs[0] != float64(2) || payload.IDs[1] != float64(3) {
+		t.Fatalf("expect deleted ids [2 3], got %q %v", events[0].Key, payload.IDs)
+	}
+
+	// 命中过多记录时只标记 IDsTruncated
+	readings := make([]*Reading, repository.OutboxMaxIDs+1)
+	for i := range readings {
+		readings[i] = &Reading{Value: 10}
+	}
+	if _, err := base.CreateBatch(ctx, readings, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Update(ctx, &Reading{}, map[string]interface{}{"value": 20}, repository.NewFilterGroup().Equals("value", 10)); err != nil {
+		t.Fatal(err)
+	}
+	events = nil
+	if err := base.Find(ctx, &repository.OutboxEvent{}, &events, nil, nil, repository.NewSortSpecs("id", repository.SortType_ASC), nil); err != nil || len(events) != 2 {
+		t.Fatalf("expect 2 events, got %v", err)
+	}
+	payload = repository.OutboxPayload{}
+	if err := json.Unmarshal([]byte(events[1].Payload), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if !payload.IDsTruncated || len(payload.IDs) != 0 || payload.Filter == nil {
+		t.Fatalf("expect truncated ids with filter, got %d %v", len(payload.IDs), payload.IDsTruncated)
+	}
+}
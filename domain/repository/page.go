@@ -0,0 +1,93 @@
+package repository
+
+import (
+	"context"
+	"reflect"
+)
+
+/********* 分页结果 ***********/
+
+/*
+FindPage 一次返回列表、满足条件的总数与翻页信息, 可直接作为 gin 接口的响应数据(见 controllers.ResponsePage):
+1. 总数按 filterGroup 统计, 不受翻页影响; 游标翻页时同样返回总数, Page 为 0
+2. 能由本页结果推算出总数时(不翻页、或本页不足 Size 条)不再执行 Count, 否则单独执行一次 Count.
+   SQL 中不使用已废弃的 SQL_CALC_FOUND_ROWS / FOUND_ROWS()
+3. mongorepo 在非事务中并发执行 Find 与 Count, 其他实现与事务内依次执行
+*/
+
+// Page FindPage 的结果, Items 为调用方传入的 result
+type Page struct {
+	Items      interface{} `json:"items"`
+	Total      int64       `json:"total"`
+	Page       int         `json:"page"`
+	Size       int         `json:"size"`
+	HasNext    bool        `json:"has_next"`
+	NextCursor string      `json:"next_cursor,omitempty"` // 游标翻页的下一页游标
+}
+
+// LoadPage 依次执行 Find 与 Count 构造 Page, 供各仓储实现 FindPage
+func LoadPage(ctx context.Context, repo BaseRepository, mod Model, result interface{}, fields []string, filterGroup *FilterGroup, sortSpecs *SortSpecs, limitSpec *LimitSpec) (*Page, error) {
+	if err := repo.Find(ctx, mod, result, fields, filterGroup, sortSpecs, limitSpec); err != nil {
+		return nil, err
+	}
+	total, ok := PageTotal(limitSpec, resultLen(result))
+	if !ok {
+		var err error
+		if total, err = repo.Count(ctx, mod, filterGroup); err != nil {
+			return nil, err
+		}
+	}
+	return NewPage(result, total, limitSpec), nil
+}
+
+// PageTotal 由本页条数推算总数, 无法推算时第二个返回值为 false, 需要执行 Count
+func PageTotal(limitSpec *LimitSpec, count int) (int64, bool) {
+	switch {
+	case limitSpec == nil || !limitSpec.UseCursor && limitSpec.Size <= 0:
+		return int64(count), true
+	case limitSpec.UseCursor:
+		return 0, false
+	}
+	offset := 0
+	if limitSpec.Page > 1 {
+		offset = (limitSpec.Page - 1) * limitSpec.Size
+	}
+	// 本页为空时可能是页码超出了范围, 只有首页才能确定总数为 0
+	if count > 0 && count < limitSpec.Size || count == 0 && offset == 0 {
+		return int64(offset + count), true
+	}
+	return 0, false
+}
+
+// NewPage 按 limitSpec 填充翻页信息, result 指向 nil 切片时置为空切片, 使 JSON 中 items 为 []
+func NewPage(result interface{}, total int64, limitSpec *LimitSpec) *Page {
+	if value := reflect.ValueOf(result); value.Kind() == reflect.Ptr && !value.IsNil() &&
+		value.Elem().Kind() == reflect.Slice && value.Elem().IsNil() {
+		value.Elem().Set(reflect.MakeSlice(value.Elem().Type(), 0, 0))
+	}
+
+	page := &Page{Items: result, Total: total, Page: 1}
+	switch {
+	case limitSpec == nil:
+	case limitSpec.UseCursor:
+		page.Page, page.Size = 0, limitSpec.Size
+		page.NextCursor = limitSpec.NextCursor
+		page.HasNext = limitSpec.NextCursor != ""
+	default:
+		if limitSpec.Page > 1 {
+			page.Page = limitSpec.Page
+		}
+		page.Size = limitSpec.Size
+		page.HasNext = page.Size > 0 && int64(page.Page*page.Size) < total
+	}
+	return page
+}
+
+// resultLen result 为切片指针时返回切片长度
+func resultLen(result interface{}) int {
+	value := indirectValue(reflect.ValueOf(result))
+	if value.Kind() != reflect.Slice {
+		return 0
+	}
+	return value.Len()
+}
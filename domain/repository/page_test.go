@@ -0,0 +1,62 @@
+package repository_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/henrion-y/base.services/domain/repository"
+)
+
+// countingRepository 记录 Count 的调用次数
+type countingRepository struct {
+	repository.BaseRepository
+	counts int
+}
+
+func (r *countingRepository) Count(ctx context.Context, mod repository.Model, filterGroup *repository.FilterGroup) (int64, error) {
+	r.counts++
+	return r.BaseRepository.Count(ctx, mod, filterGroup)
+}
+
+func TestLoadPage(t *testing.T) {
+	ctx := context.Background()
+	repo := &countingRepository{BaseRepository: newRepo(t)}
+	byID := repository.NewSortSpecs("id", repository.SortType_ASC)
+
+	cases := []struct {
+		limitSpec *repository.LimitSpec
+		want      repository.Page
+		counts    int
+	}{
+		{repository.NewLimitSpec(1, 3), repository.Page{Total: 4, Page: 1, Size: 3, HasNext: true}, 1},
+		{repository.NewLimitSpec(2, 3), repository.Page{Total: 4, Page: 2, Size: 3}, 0},
+		{repository.NewLimitSpec(3, 3), repository.Page{Total: 4, Page: 3, Size: 3}, 1},
+		{nil, repository.Page{Total: 4, Page: 1}, 0},
+		{repository.NewCursorLimitSpec("", 3), repository.Page{Total: 4, Size: 3, HasNext: true}, 1},
+	}
+	for i, c := range cases {
+		repo.counts = 0
+		var list []User
+		page, err := repository.LoadPage(ctx, repo, &User{}, &list, nil, nil, byID, c.limitSpec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.Total != c.want.Total || page.Page != c.want.Page || page.Size != c.want.Size || page.HasNext != c.want.HasNext || repo.counts != c.counts {
+			t.Fatalf("case %d: unexpected page %+v with %d counts", i, page, repo.counts)
+		}
+		if page.Items != &list || list == nil {
+			t.Fatalf("case %d: expect items to be the result", i)
+		}
+		if c.limitSpec != nil && c.limitSpec.UseCursor && page.NextCursor != c.limitSpec.NextCursor {
+			t.Fatalf("case %d: expect next cursor %q, got %q", i, c.limitSpec.NextCursor, page.NextCursor)
+		}
+	}
+
+	// 经钩子仓储调用
+	hookRepo := repository.NewHookRepository(repo.BaseRepository)
+	var list []User
+	page, err := hookRepo.FindPage(ctx, &User{}, &list, nil, repository.NewFilterGroup().Equals("age", 21), byID, repository.NewLimitSpec(1, 1))
+	if err != nil || page.Total != 2 || !page.HasNext || len(list) != 1 {
+		t.Fatalf("unexpected page %+v %v", page, err)
+	}
+}
@@ -0,0 +1,50 @@
+package repository
+
+import (
+	"errors"
+)
+
+/********* 软删除 ***********/
+
+var ErrSoftDeleteNotSupported = errors.New("model does not implement SoftDeleteModel")
+
+// SoftDeleteModel 模型实现该接口即开启软删除: Delete 只写入删除时间, Find、FindOne、Count、Update、Aggregate 自动排除已删除记录.
+// 删除标记列未删除时须为 NULL, 结构体字段一般使用 *time.Time
+type SoftDeleteModel interface {
+	Model
+	SoftDeleteColumn() string // 删除标记列, 如 deleted_at
+}
+
+// SoftDeleteColumn 返回模型的删除标记列, 未开启软删除时第二个返回值为 false
+func SoftDeleteColumn(mod Model) (string, bool) {
+	softDeleteModel, ok := mod.(SoftDeleteModel)
+	if !ok || softDeleteModel.SoftDeleteColumn() == "" {
+		return "", false
+	}
+	return softDeleteModel.SoftDeleteColumn(), true
+}
+
+// ExcludeDeleted 软删除模型在过滤条件上追加 未删除 的条件, 其他模型原样返回
+func ExcludeDeleted(mod Model, filterGroup *FilterGroup) *FilterGroup {
+	column, ok := SoftDeleteColumn(mod)
+	if !ok {
+		return filterGroup
+	}
+	return withFilter(NewFilterGroup().IsNull(column), filterGroup)
+}
+
+// OnlyDeleted 在过滤条件上追加 已删除 的条件, 模型未开启软删除时返回 ErrSoftDeleteNotSupported
+func OnlyDeleted(mod Model, filterGroup *FilterGroup) (*FilterGroup, error) {
+	column, ok := SoftDeleteColumn(mod)
+	if !ok {
+		return nil, ErrSoftDeleteNotSupported
+	}
+	return withFilter(NewFilterGroup().IsNotNull(column), filterGroup), nil
+}
+
+func withFilter(group *FilterGroup, filterGroup *FilterGroup) *FilterGroup {
+	if filterGroup == nil {
+		return group
+	}
+	return group.And(filterGroup)
+}
@@ -0,0 +1,272 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+/********* 多租户 ***********/
+
+/*
+NewTenantRepository 按 ctx 中的租户(见 WithTenant)自动隔离数据:
+1. Find、FindOne、FindByIDs、Count、Exists、Distinct、FindPage、Aggregate、Update、Delete、Restore 在过滤条件上追加 租户列 = 当前租户
+2. Create、CreateBatch、Upsert 将租户写入模型, 模型已有其他租户时返回 ErrTenantMismatch; Upsert 的冲突列会补上租户列
+3. MySQL 的 ON DUPLICATE KEY UPDATE 按任一唯一索引(包括不含租户列的主键)判断冲突, 补上的冲突列不起作用,
+   因此模型带有主键时 Upsert 先在事务中检查该主键的记录(包括已软删除的), 属于其他租户时返回 ErrTenantMismatch;
+   只用 NewTenantHook 组合钩子时检查不在事务中, 须由调用方开启事务. 其他唯一索引须包含租户列
+4. Update 不允许修改租户列
+5. ctx 中没有租户时返回 ErrTenantRequired, 需要跨租户操作时(如后台任务)须显式调用 WithoutTenant
+6. 模型没有租户列时不做处理
+7. 租户按租户列的类型转换(指针列按其元素类型): 数值之间按值转换, 整数用于字符串列时转为十进制文本, 如 uint64(5) 转为 "5";
+   其他类型不一致或转换会丢失精度时返回 ErrTenantMismatch
+*/
+
+const DefaultTenantColumn = "tenant_id"
+
+var (
+	ErrTenantRequired = errors.New("tenant required")
+	ErrTenantMismatch = errors.New("tenant mismatch")
+)
+
+type tenantKey struct{}
+
+type tenantBypassKey struct{}
+
+// WithTenant 在 ctx 中记录当前租户, 如由 JWT 中间件按 Claims 设置
+func WithTenant(ctx context.Context, tenant interface{}) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext 返回 WithTenant 记录的租户
+func TenantFromContext(ctx context.Context) (interface{}, bool) {
+	tenant := ctx.Value(tenantKey{})
+	return tenant, tenant != nil
+}
+
+// WithoutTenant 显式跳过租户隔离
+func WithoutTenant(ctx context.Context) context.Context {
+	return context.WithValue(ctx, tenantBypassKey{}, true)
+}
+
+// tenantBypassed ctx 是否经 WithoutTenant 标记
+func tenantBypassed(ctx context.Context) bool {
+	bypass, _ := ctx.Value(tenantBypassKey{}).(bool)
+	return bypass
+}
+
+// tenantScope 返回 ctx 的租户范围, 跳过隔离时为 "*", 没有租户时为空字符串; 用于区分不同租户的缓存
+func tenantScope(ctx context.Context) string {
+	if tenantBypassed(ctx) {
+		return "*"
+	}
+	tenant, ok := TenantFromContext(ctx)
+	if !ok {
+		return ""
+	}
+	value := indirectValue(reflect.ValueOf(tenant))
+	if !value.IsValid() {
+		return ""
+	}
+	return "=" + fmt.Sprint(value.Interface())
+}
+
+// NewTenantRepository 为 base 增加租户隔离, column 为空时使用 DefaultTenantColumn
+func NewTenantRepository(base BaseRepository, column string) BaseRepository {
+	return &tenantRepository{BaseRepository: NewHookRepository(base, NewTenantHook(column))}
+}
+
+// tenantRepository 在事务中执行带主键的 Upsert, 使租户钩子的检查与写入处于同一事务
+type tenantRepository struct {
+	BaseRepository
+}
+
+func (r *tenantRepository) Upsert(ctx context.Context, mod Model, conflictColumns []string, updateColumns []string) (int64, error) {
+	if tenantBypassed(ctx) || !hasPrimaryKey(mod) {
+		return r.BaseRepository.Upsert(ctx, mod, conflictColumns, updateColumns)
+	}
+	var rowsAffected int64
+	err := r.BaseRepository.WithTransaction(ctx, func(txRepo BaseRepository) (err error) {
+		rowsAffected, err = txRepo.Upsert(ctx, mod, conflictColumns, updateColumns)
+		return err
+	})
+	return rowsAffected, err
+}
+
+// hasPrimaryKey 模型的主键是否已赋值
+func hasPrimaryKey(mod Model) bool {
+	id, ok := ColumnValue(mod, PrimaryKeyColumn(mod))
+	if !ok {
+		return false
+	}
+	value := indirectValue(reflect.ValueOf(id))
+	return value.IsValid() && !value.IsZero()
+}
+
+// TenantHook 租户隔离钩子, 可与其他钩子一起用于 NewHookRepository, 一般放在第一个
+type TenantHook struct {
+	column string
+}
+
+func NewTenantHook(column string) *TenantHook {
+	if column == "" {
+		column = DefaultTenantColumn
+	}
+	return &TenantHook{column: column}
+}
+
+func (h *TenantHook) Before(ctx context.Context, call *HookCall) error {
+	if tenantBypassed(ctx) {
+		return nil
+	}
+	mod := call.Model
+	if call.Operation == Operation_CREATE_BATCH {
+		batches, err := SplitBatches(call.Models, 0)
+		if err != nil || len(batches) == 0 {
+			return err
+		}
+		mod = batches[0].Items[0]
+	}
+	columnType, ok := ModelColumns(mod).Type(h.column)
+	if !ok {
+		return nil
+	}
+
+	tenant, ok := TenantFromContext(ctx)
+	if !ok {
+		return fmt.Errorf("%w: %s %s", ErrTenantRequired, call.Operation, mod.TableName())
+	}
+	tenant, err := convertTenant(tenant, columnType)
+	if err != nil {
+		return err
+	}
+
+	switch call.Operation {
+	case Operation_CREATE:
+		return h.setTenant(call.Model, tenant)
+	case Operation_CREATE_BATCH:
+		batches, _ := SplitBatches(call.Models, 0)
+		for _, batch := range batches {
+			for _, item := range batch.Items {
+				if err := h.setTenant(item, tenant); err != nil {
+					return err
+				}
+			}
+		}
+	case Operation_UPSERT:
+		if err := h.setTenant(call.Model, tenant); err != nil {
+			return err
+		}
+		if err := h.checkUpsert(ctx, call, tenant); err != nil {
+			return err
+		}
+		if !containsString(call.ConflictColumns, h.column) {
+			call.ConflictColumns = append([]string{h.column}, call.ConflictColumns...)
+		}
+	case Operation_UPDATE:
+		assignments, err := ParseUpdateData(call.Data)
+		if err != nil {
+			return err
+		}
+		for _, assignment := range assignments {
+			if assignment.Column != h.column {
+				continue
+			}
+			value, err := convertTenant(assignment.Value, columnType)
+			if assignment.Operator != UpdateOperator_SET || err != nil || jsonString(value) != jsonString(tenant) {
+				return fmt.Errorf("%w: can not change %s by %s", ErrTenantMismatch, h.column, assignment.Operator)
+			}
+		}
+		call.FilterGroup = withFilter(NewFilterGroup().Equals(h.column, tenant), call.FilterGroup)
+	default:
+		call.FilterGroup = withFilter(NewFilterGroup().Equals(h.column, tenant), call.FilterGroup)
+	}
+	return nil
+}
+
+func (h *TenantHook) After(ctx context.Context, call *HookCall) error {
+	return nil
+}
+
+// checkUpsert 模型带有主键时检查该主键的记录是否属于其他租户, 避免 MySQL 按主键冲突覆盖其他租户的记录
+func (h *TenantHook) checkUpsert(ctx context.Context, call *HookCall, tenant interface{}) error {
+	if !hasPrimaryKey(call.Model) {
+		return nil
+	}
+	column := PrimaryKeyColumn(call.Model)
+	id, _ := ColumnValue(call.Model, column)
+	list := reflect.New(reflect.SliceOf(reflect.TypeOf(call.Model)))
+	err := call.Repo.FindWithDeleted(ctx, call.Model, list.Interface(), []string{column, h.column},
+		NewFilterGroup().Equals(column, id), nil, NewLimitSpec(0, 1))
+	if err != nil {
+		return err
+	}
+	if list.Elem().Len() == 0 {
+		return nil
+	}
+	existing, _ := ColumnValue(list.Elem().Index(0).Interface(), h.column)
+	if jsonString(existing) != jsonString(tenant) {
+		return fmt.Errorf("%w: %s %v of %s belongs to another tenant", ErrTenantMismatch, column, id, call.Model.TableName())
+	}
+	return nil
+}
+
+// setTenant 将租户写入模型的租户字段, 字段为 nil 指针时指向新的租户值, 字段已有其他租户时返回 ErrTenantMismatch
+func (h *TenantHook) setTenant(mod Model, tenant interface{}) error {
+	field, ok := FieldByColumn(reflect.ValueOf(mod), h.column)
+	if !ok || !field.CanSet() {
+		return fmt.Errorf("%w: can not set %s of %T", ErrTenantMismatch, h.column, mod)
+	}
+	value := reflect.ValueOf(tenant)
+	if field.Kind() == reflect.Ptr {
+		if field.IsNil() && value.Type().AssignableTo(field.Type().Elem()) {
+			ptr := reflect.New(field.Type().Elem())
+			ptr.Elem().Set(value)
+			field.Set(ptr)
+			return nil
+		}
+		field = field.Elem()
+	}
+	if !field.IsValid() || !value.Type().AssignableTo(field.Type()) {
+		return fmt.Errorf("%w: tenant %T is not assignable to %s", ErrTenantMismatch, tenant, h.column)
+	}
+	if !field.IsZero() && !reflect.DeepEqual(field.Interface(), tenant) {
+		return fmt.Errorf("%w: %s is %v, want %v", ErrTenantMismatch, h.column, field.Interface(), tenant)
+	}
+	field.Set(value)
+	return nil
+}
+
+// convertTenant 将租户转换为租户列的类型, 规则见 NewTenantRepository, 不做 reflect.Value.Convert 的整数转字符(rune)等隐式转换
+func convertTenant(tenant interface{}, columnType reflect.Type) (interface{}, error) {
+	columnType = indirectType(columnType)
+	value := indirectValue(reflect.ValueOf(tenant))
+	if !value.IsValid() {
+		return nil, fmt.Errorf("%w: tenant is nil", ErrTenantMismatch)
+	}
+
+	switch kind := value.Kind(); {
+	case value.Type() == columnType:
+		return value.Interface(), nil
+	case isIntegerKind(kind) && columnType.Kind() == reflect.String:
+		return reflect.ValueOf(fmt.Sprint(value.Interface())).Convert(columnType).Interface(), nil
+	case kind == reflect.String && columnType.Kind() == reflect.String:
+		return value.Convert(columnType).Interface(), nil
+	case isNumberKind(kind) && isNumberKind(columnType.Kind()):
+		// 转换前后的文本不同说明溢出、截断或丢失精度
+		converted := value.Convert(columnType)
+		if fmt.Sprint(converted.Interface()) == fmt.Sprint(value.Interface()) {
+			return converted.Interface(), nil
+		}
+	}
+	return nil, fmt.Errorf("%w: tenant %v (%T) can not be used as %s", ErrTenantMismatch, tenant, tenant, columnType)
+}
+
+func isIntegerKind(kind reflect.Kind) bool {
+	return kind >= reflect.Int && kind <= reflect.Uintptr
+}
+
+func isNumberKind(kind reflect.Kind) bool {
+	return isIntegerKind(kind) || kind == reflect.Float32 || kind == reflect.Float64
+}
@@ -0,0 +1,170 @@
+package repository_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/henrion-y/base.services/domain/repository"
+	"github.com/henrion-y/base.services/domain/repository/memrepo"
+)
+
+type Invoice struct {
+	ID       int    `json:"id" gorm:"primary_key"`
+	TenantID int64  `json:"tenant_id" gorm:"tenant_id"`
+	Title    string `json:"title" gorm:"title"`
+}
+
+func (i *Invoice) TableName() string {
+	return "t_invoice_repository"
+}
+
+func TestTenantRepository(t *testing.T) {
+	base := memrepo.NewBaseRepository()
+	repo := repository.NewTenantRepository(base, "")
+	tenantA := repository.WithTenant(context.Background(), uint64(1))
+	tenantB := repository.WithTenant(context.Background(), uint64(2))
+
+	for _, ctx := range []context.Context{tenantA, tenantA, tenantB} {
+		if err := repo.Create(ctx, &Invoice{Title: "invoice"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := repo.Create(tenantA, &Invoice{TenantID: 2}); !errors.Is(err, repository.ErrTenantMismatch) {
+		t.Fatalf("expect ErrTenantMismatch, got %v", err)
+	}
+	if err := repo.Create(context.Background(), &Invoice{}); !errors.Is(err, repository.ErrTenantRequired) {
+		t.Fatalf("expect ErrTenantRequired, got %v", err)
+	}
+
+	count, err := repo.Count(tenantA, &Invoice{}, nil)
+	if err != nil || count != 2 {
+		t.Fatalf("expect 2 invoices of tenant 1, got %d %v", count, err)
+	}
+	// 其他租户的记录不会被更新
+	rowCount, err := repo.Update(tenantB, &Invoice{}, map[string]interface{}{"title": "changed"}, repository.NewFilterGroup().Equals("id", 1))
+	if err != nil || rowCount != 0 {
+		t.Fatalf("expect no rows updated across tenants, got %d %v", rowCount, err)
+	}
+	if _, err = repo.Update(tenantA, &Invoice{}, map[string]interface{}{"tenant_id": 2}, nil); !errors.Is(err, repository.ErrTenantMismatch) {
+		t.Fatalf("expect ErrTenantMismatch, got %v", err)
+	}
+
+	var list []Invoice
+	if err = repo.Find(tenantB, &Invoice{}, &list, nil, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].TenantID != 2 {
+		t.Fatalf("expect 1 invoice of tenant 2, got %+v", list)
+	}
+
+	count, err = repo.Count(repository.WithoutTenant(context.Background()), &Invoice{}, nil)
+	if err != nil || count != 3 {
+		t.Fatalf("expect 3 invoices when bypassed, got %d %v", count, err)
+	}
+}
+
+func TestTenantRepository_Upsert(t *testing.T) {
+	repo := repository.NewTenantRepository(memrepo.NewBaseRepository(), "")
+	tenantA := repository.WithTenant(context.Background(), uint64(1))
+	tenantB := repository.WithTenant(context.Background(), uint64(2))
+	invoice := &Invoice{Title: "a"}
+	if err := repo.Create(tenantA, invoice); err != nil {
+		t.Fatal(err)
+	}
+
+	// 主键冲突时不能覆盖其他租户的记录
+	_, err := repo.Upsert(tenantB, &Invoice{ID: invoice.ID, Title: "b"}, []string{"id"}, nil)
+	if !errors.Is(err, repository.ErrTenantMismatch) {
+		t.Fatalf("expect ErrTenantMismatch, got %v", err)
+	}
+	if _, err = repo.Upsert(tenantA, &Invoice{ID: invoice.ID, Title: "c"}, []string{"id"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = repo.Upsert(tenantB, &Invoice{Title: "b"}, []string{"id"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var list []Invoice
+	err = repo.Find(repository.WithoutTenant(context.Background()), &Invoice{}, &list, nil, nil, repository.NewSortSpecs("id", repository.SortType_ASC), nil)
+	if err != nil || len(list) != 2 || list[0].Title != "c" || list[0].TenantID != 1 || list[1].TenantID != 2 {
+		t.Fatalf("unexpected invoices %+v %v", list, err)
+	}
+}
+
+type Ticket struct {
+	ID       int    `json:"id" gorm:"primary_key"`
+	TenantID string `json:"tenant_id" gorm:"tenant_id"`
+}
+
+func (t *Ticket) TableName() string {
+	return "t_ticket_repository"
+}
+
+func TestTenantRepository_StringColumn(t *testing.T) {
+	repo := repository.NewTenantRepository(memrepo.NewBaseRepository(), "")
+	tenant := repository.WithTenant(context.Background(), uint64(5))
+
+	// 整数租户转为十进制文本, 而不是 rune
+	ticket := &Ticket{}
+	if err := repo.Create(tenant, ticket); err != nil || ticket.TenantID != "5" {
+		t.Fatalf("expect tenant \"5\", got %q %v", ticket.TenantID, err)
+	}
+	if count, err := repo.Count(tenant, &Ticket{}, nil); err != nil || count != 1 {
+		t.Fatalf("expect 1 ticket, got %d %v", count, err)
+	}
+	if count, err := repo.Count(repository.WithTenant(context.Background(), "5"), &Ticket{}, nil); err != nil || count != 1 {
+		t.Fatalf("expect 1 ticket of tenant \"5\", got %d %v", count, err)
+	}
+	if _, err := repo.Update(tenant, &Ticket{}, map[string]interface{}{"tenant_id": "5"}, nil); err != nil {
+		t.Fatalf("expect setting the same tenant to be allowed, got %v", err)
+	}
+
+	for _, invalid := range []interface{}{1.5, true, []byte("5")} {
+		ctx := repository.WithTenant(context.Background(), invalid)
+		if err := repo.Create(ctx, &Ticket{}); !errors.Is(err, repository.ErrTenantMismatch) {
+			t.Fatalf("expect ErrTenantMismatch for %T, got %v", invalid, err)
+		}
+	}
+	if err := repo.Create(repository.WithTenant(context.Background(), int64(-1)), &Invoice{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Count(repository.WithTenant(context.Background(), 1.5), &Invoice{}, nil); !errors.Is(err, repository.ErrTenantMismatch) {
+		t.Fatalf("expect ErrTenantMismatch for a fractional tenant, got %v", err)
+	}
+}
+
+type Memo struct {
+	ID       int     `json:"id" gorm:"primary_key"`
+	TenantID *uint64 `json:"tenant_id" gorm:"tenant_id"`
+}
+
+func (m *Memo) TableName() string {
+	return "t_memo_repository"
+}
+
+func TestTenantRepository_PointerColumn(t *testing.T) {
+	repo := repository.NewTenantRepository(memrepo.NewBaseRepository(), "")
+	tenant := repository.WithTenant(context.Background(), 5)
+
+	memo := &Memo{}
+	if err := repo.Create(tenant, memo); err != nil || memo.TenantID == nil || *memo.TenantID != 5 {
+		t.Fatalf("expect tenant 5, got %v %v", memo.TenantID, err)
+	}
+	same, other := uint64(5), uint64(6)
+	if err := repo.Create(tenant, &Memo{TenantID: &same}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Create(tenant, &Memo{TenantID: &other}); !errors.Is(err, repository.ErrTenantMismatch) {
+		t.Fatalf("expect ErrTenantMismatch, got %v", err)
+	}
+	if _, err := repo.CreateBatch(tenant, []*Memo{{}, {}}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := repo.Count(tenant, &Memo{}, nil); err != nil || count != 4 {
+		t.Fatalf("expect 4 memos, got %d %v", count, err)
+	}
+	if count, err := repo.Count(repository.WithTenant(context.Background(), 6), &Memo{}, nil); err != nil || count != 0 {
+		t.Fatalf("expect no memos of tenant 6, got %d %v", count, err)
+	}
+}
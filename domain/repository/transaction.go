@@ -0,0 +1,43 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+
+	"go.uber.org/zap"
+
+	"github.com/henrion-y/base.services/infra/zlog"
+)
+
+// TxPanicError 事务回调中的 panic, 由 CallTxFunc 转换为 error 使事务回滚, 回滚后由 RethrowTxPanic 重新抛出
+type TxPanicError struct {
+	Value interface{} // recover 得到的值
+	Stack []byte
+}
+
+func (e *TxPanicError) Error() string {
+	return fmt.Sprintf("transaction panic: %v", e.Value)
+}
+
+// CallTxFunc 执行事务回调, 将回调中的 panic 转换为 *TxPanicError 返回, 以便事务走正常的回滚流程;
+// 调用方在事务结束后须调用 RethrowTxPanic, 与 gorm 的 Transaction 一样回滚后重新 panic
+func CallTxFunc(txRepo BaseRepository, fn func(txRepo BaseRepository) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			stack := debug.Stack()
+			zlog.Error("repository.CallTxFunc.panic", zap.Any("recover", r), zap.ByteString("stack", stack))
+			err = &TxPanicError{Value: r, Stack: stack}
+		}
+	}()
+
+	return fn(txRepo)
+}
+
+// RethrowTxPanic err 为 CallTxFunc 转换的 panic 时重新抛出原来的值, 在事务回滚后调用
+func RethrowTxPanic(err error) {
+	var txPanic *TxPanicError
+	if errors.As(err, &txPanic) {
+		panic(txPanic.Value)
+	}
+}
@@ -0,0 +1,274 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"gorm.io/gorm/clause"
+)
+
+/********* 更新操作符 ***********/
+
+/*
+BaseRepository.Update 的 data 中, 普通的 列名: 值 表示赋值($set), 以 $ 开头的键为操作符, 值为 列名: 操作数 的 map,
+一般通过 UpdateSpec 构造, 如 NewUpdateSpec().Set("name", "a").Inc("count", 1).Push("tags", "x").
+各操作符在 SQL、Mongo、Elasticsearch 与 memrepo 中的语义保持一致:
+1. $inc 列为 NULL 时视为 0
+2. $unset 在 SQL 中置为 NULL, Mongo、ES 中删除字段
+3. $min、$max 列为 NULL 时直接写入操作数
+4. $currentDate 写入当前时间, 操作数无意义; SQL 中使用数据库的当前时间
+5. $push、$addToSet、$pull 的列须为数组, SQL 中为 JSON 数组(见 dialect.go), 元素按 JSON 比较; $pull 在 MySQL 中依赖 JSON_TABLE(MySQL 8)
+6. 同一列只能出现一次, 否则返回 ErrInvalidUpdate
+*/
+
+var ErrInvalidUpdate = errors.New("invalid update")
+
+type UpdateOperator string
+
+const (
+	UpdateOperator_SET          UpdateOperator = "$set"
+	UpdateOperator_INC          UpdateOperator = "$inc"
+	UpdateOperator_UNSET        UpdateOperator = "$unset"
+	UpdateOperator_PUSH         UpdateOperator = "$push"
+	UpdateOperator_PULL         UpdateOperator = "$pull"
+	UpdateOperator_ADD_TO_SET   UpdateOperator = "$addToSet"
+	UpdateOperator_MIN          UpdateOperator = "$min"
+	UpdateOperator_MAX          UpdateOperator = "$max"
+	UpdateOperator_CURRENT_DATE UpdateOperator = "$currentDate"
+)
+
+func (o UpdateOperator) valid() bool {
+	switch o {
+	case UpdateOperator_SET, UpdateOperator_INC, UpdateOperator_UNSET, UpdateOperator_PUSH, UpdateOperator_PULL,
+		UpdateOperator_ADD_TO_SET, UpdateOperator_MIN, UpdateOperator_MAX, UpdateOperator_CURRENT_DATE:
+		return true
+	}
+	return false
+}
+
+// UpdateSpec 更新数据构造器, 可直接作为 BaseRepository.Update 的 data 传入
+type UpdateSpec map[string]interface{}
+
+func NewUpdateSpec() UpdateSpec {
+	return UpdateSpec{}
+}
+
+func (s UpdateSpec) Set(column string, value interface{}) UpdateSpec {
+	s[column] = value
+	return s
+}
+
+// Inc 列加上 value, value 为负数时为减
+func (s UpdateSpec) Inc(column string, value interface{}) UpdateSpec {
+	return s.operator(UpdateOperator_INC, column, value)
+}
+
+func (s UpdateSpec) Unset(column string) UpdateSpec {
+	return s.operator(UpdateOperator_UNSET, column, "")
+}
+
+// Push 向数组列追加一个元素
+func (s UpdateSpec) Push(column string, value interface{}) UpdateSpec {
+	return s.operator(UpdateOperator_PUSH, column, value)
+}
+
+// Pull 从数组列中删除所有等于 value 的元素
+func (s UpdateSpec) Pull(column string, value interface{}) UpdateSpec {
+	return s.operator(UpdateOperator_PULL, column, value)
+}
+
+// AddToSet 数组列中不存在 value 时追加
+func (s UpdateSpec) AddToSet(column string, value interface{}) UpdateSpec {
+	return s.operator(UpdateOperator_ADD_TO_SET, column, value)
+}
+
+// Min value 小于列的值时更新
+func (s UpdateSpec) Min(column string, value interface{}) UpdateSpec {
+	return s.operator(UpdateOperator_MIN, column, value)
+}
+
+// Max value 大于列的值时更新
+func (s UpdateSpec) Max(column string, value interface{}) UpdateSpec {
+	return s.operator(UpdateOperator_MAX, column, value)
+}
+
+// CurrentDate 将列置为当前时间
+func (s UpdateSpec) CurrentDate(column string) UpdateSpec {
+	return s.operator(UpdateOperator_CURRENT_DATE, column, true)
+}
+
+func (s UpdateSpec) operator(op UpdateOperator, column string, value interface{}) UpdateSpec {
+	operand, ok := s[string(op)].(map[string]interface{})
+	if !ok {
+		operand = make(map[string]interface{})
+		s[string(op)] = operand
+	}
+	operand[column] = value
+	return s
+}
+
+// UpdateAssignment 解析后的单列更新
+type UpdateAssignment struct {
+	Operator UpdateOperator
+	Column   string
+	Value    interface{}
+}
+
+// ParseUpdateData 将 Update 的 data 解析为单列更新, 按操作符、列名排序, 结果稳定
+func ParseUpdateData(data map[string]interface{}) ([]UpdateAssignment, error) {
+	var assignments []UpdateAssignment
+	columns := make(map[string]bool, len(data))
+	add := func(op UpdateOperator, column string, value interface{}) error {
+		if columns[column] {
+			return fmt.Errorf("%w: column %s is updated more than once", ErrInvalidUpdate, column)
+		}
+		columns[column] = true
+		assignments = append(assignments, UpdateAssignment{Operator: op, Column: column, Value: value})
+		return nil
+	}
+
+	for key, value := range data {
+		if !strings.HasPrefix(key, "$") {
+			if err := add(UpdateOperator_SET, key, value); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		op := UpdateOperator(key)
+		if !op.valid() {
+			return nil, fmt.Errorf("%w: unsupported operator %s", ErrInvalidUpdate, key)
+		}
+		operand := reflect.ValueOf(value)
+		if operand.Kind() != reflect.Map || operand.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("%w: operand of %s must be a map of column to value, got %T", ErrInvalidUpdate, key, value)
+		}
+		iter := operand.MapRange()
+		for iter.Next() {
+			if err := add(op, iter.Key().String(), iter.Value().Interface()); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	sort.Slice(assignments, func(i, j int) bool {
+		if assignments[i].Operator != assignments[j].Operator {
+			return assignments[i].Operator < assignments[j].Operator
+		}
+		return assignments[i].Column < assignments[j].Column
+	})
+	return assignments, nil
+}
+
+// WithUpdateOperator 返回追加了 op 的 data 副本, 不修改原 data, 用于各仓储追加版本递增等内部更新
+func WithUpdateOperator(data map[string]interface{}, op UpdateOperator, column string, value interface{}) map[string]interface{} {
+	spec := make(UpdateSpec, len(data)+1)
+	for key, v := range data {
+		if operand, ok := v.(map[string]interface{}); ok && strings.HasPrefix(key, "$") {
+			copied := make(map[string]interface{}, len(operand)+1)
+			for c, item := range operand {
+				copied[c] = item
+			}
+			v = copied
+		}
+		spec[key] = v
+	}
+	if op == UpdateOperator_SET {
+		return spec.Set(column, value)
+	}
+	return spec.operator(op, column, value)
+}
+
+// BuildUpdateToSQL 转换为 gorm Updates 使用的 列名: 值, 操作符按方言转换为表达式
+func BuildUpdateToSQL(dialect SQLDialect, data map[string]interface{}) (map[string]interface{}, error) {
+	assignments, err := ParseUpdateData(data)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]interface{}, len(assignments))
+	for _, assignment := range assignments {
+		column := clause.Column{Name: assignment.Column}
+		switch assignment.Operator {
+		case UpdateOperator_SET:
+			values[assignment.Column] = assignment.Value
+		case UpdateOperator_INC:
+			values[assignment.Column] = clause.Expr{SQL: "COALESCE(?, 0) + ?", Vars: []interface{}{column, assignment.Value}}
+		case UpdateOperator_UNSET:
+			values[assignment.Column] = nil
+		default:
+			if values[assignment.Column], err = dialect.UpdateValue(assignment); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return values, nil
+}
+
+// BuildUpdateToMongo 转换为 Mongo 的更新文档, 每个操作符只出现一次
+func BuildUpdateToMongo(data map[string]interface{}) (bson.D, error) {
+	assignments, err := ParseUpdateData(data)
+	if err != nil {
+		return nil, err
+	}
+	update := bson.D{}
+	for _, assignment := range assignments {
+		// assignments 已按操作符排序, 相同操作符连续出现
+		if len(update) == 0 || update[len(update)-1].Key != string(assignment.Operator) {
+			update = append(update, bson.E{Key: string(assignment.Operator), Value: bson.D{}})
+		}
+		last := &update[len(update)-1]
+		last.Value = append(last.Value.(bson.D), bson.E{Key: assignment.Column, Value: assignment.buildMongoValue()})
+	}
+	return update, nil
+}
+
+func (a UpdateAssignment) buildMongoValue() interface{} {
+	switch a.Operator {
+	case UpdateOperator_UNSET:
+		return ""
+	case UpdateOperator_CURRENT_DATE:
+		return true
+	}
+	return a.Value
+}
+
+// BuildUpdateToElastic 转换为 painless 脚本的 params.ops, 与 ElasticUpdateScript 配合使用
+func BuildUpdateToElastic(data map[string]interface{}) ([]map[string]interface{}, error) {
+	assignments, err := ParseUpdateData(data)
+	if err != nil {
+		return nil, err
+	}
+	ops := make([]map[string]interface{}, 0, len(assignments))
+	for _, assignment := range assignments {
+		value := assignment.Value
+		if assignment.Operator == UpdateOperator_CURRENT_DATE {
+			value = time.Now()
+		}
+		ops = append(ops, map[string]interface{}{
+			"op":     string(assignment.Operator),
+			"column": assignment.Column,
+			"value":  value,
+		})
+	}
+	return ops, nil
+}
+
+// ElasticUpdateScript 按 params.ops 执行更新的 painless 脚本, 字段名与值都通过 params 传入, 避免拼接脚本
+const ElasticUpdateScript = `for (op in params.ops) {
+  String c = op.column; def v = op.value; def cur = ctx._source[c];
+  if (op.op == '$set' || op.op == '$currentDate') { ctx._source[c] = v; }
+  else if (op.op == '$inc') { ctx._source[c] = (cur == null ? 0 : cur) + v; }
+  else if (op.op == '$unset') { ctx._source.remove(c); }
+  else if (op.op == '$min') { if (cur == null || v < cur) { ctx._source[c] = v; } }
+  else if (op.op == '$max') { if (cur == null || v > cur) { ctx._source[c] = v; } }
+  else if (op.op == '$push' || op.op == '$addToSet') {
+    if (cur == null) { cur = new ArrayList(); ctx._source[c] = cur; }
+    if (op.op == '$push' || !cur.contains(v)) { cur.add(v); }
+  }
+  else if (op.op == '$pull') { if (cur != null) { cur.removeIf(x -> x == v); } }
+}`
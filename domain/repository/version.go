@@ -0,0 +1,100 @@
+package repository
+
+import (
+	"errors"
+	"reflect"
+)
+
+/********* 乐观锁 ***********/
+
+var ErrVersionConflict = errors.New("version conflict")
+
+// VersionModel 模型实现该接口即开启乐观锁: Create 时版本为 0 会置为 1, Update 以模型当前的版本作为条件并原子地加 1,
+// 没有记录被更新时返回 ErrVersionConflict, 成功后模型的版本字段同步加 1.
+// 模型版本为 0 时(如泛型仓储传入的空模型)不加版本条件, 只递增版本. 版本字段须为整数类型
+type VersionModel interface {
+	Model
+	VersionColumn() string // 版本列, 如 version
+}
+
+// VersionColumn 返回模型的版本列, 未开启乐观锁时第二个返回值为 false
+func VersionColumn(mod Model) (string, bool) {
+	versionModel, ok := mod.(VersionModel)
+	if !ok || versionModel.VersionColumn() == "" {
+		return "", false
+	}
+	return versionModel.VersionColumn(), true
+}
+
+// ModelVersion 返回模型当前的版本, 未开启乐观锁或版本字段不是整数时返回 0
+func ModelVersion(mod Model) int64 {
+	field, ok := versionField(mod)
+	if !ok {
+		return 0
+	}
+	if field.CanInt() {
+		return field.Int()
+	}
+	return int64(field.Uint())
+}
+
+// SetModelVersion 设置模型的版本字段, 模型须为指针
+func SetModelVersion(mod Model, version int64) {
+	field, ok := versionField(mod)
+	if !ok || !field.CanSet() {
+		return
+	}
+	if field.CanInt() {
+		field.SetInt(version)
+	} else {
+		field.SetUint(uint64(version))
+	}
+}
+
+// InitVersion Create 前调用, 版本为 0 时置为 1
+func InitVersion(mod Model) {
+	if _, ok := VersionColumn(mod); ok && ModelVersion(mod) == 0 {
+		SetModelVersion(mod, 1)
+	}
+}
+
+// VersionFilter 在过滤条件上追加 版本 = 模型当前版本 的条件, 返回当前版本; 模型未开启乐观锁或版本为 0 时原样返回, 版本为 0
+func VersionFilter(mod Model, filterGroup *FilterGroup) (*FilterGroup, int64) {
+	column, ok := VersionColumn(mod)
+	if !ok {
+		return filterGroup, 0
+	}
+	version := ModelVersion(mod)
+	if version == 0 {
+		return filterGroup, 0
+	}
+	return withFilter(NewFilterGroup().Equals(column, version), filterGroup), version
+}
+
+// CheckVersion Update 完成后调用, 带版本条件却没有更新任何记录时返回 ErrVersionConflict, 否则同步模型的版本
+func CheckVersion(mod Model, version int64, rowsAffected int64) error {
+	if version == 0 {
+		return nil
+	}
+	if rowsAffected == 0 {
+		return ErrVersionConflict
+	}
+	SetModelVersion(mod, version+1)
+	return nil
+}
+
+func versionField(mod Model) (reflect.Value, bool) {
+	column, ok := VersionColumn(mod)
+	if !ok {
+		return reflect.Value{}, false
+	}
+	field, ok := FieldByColumn(reflect.ValueOf(mod), column)
+	if !ok {
+		return reflect.Value{}, false
+	}
+	field = indirectValue(field)
+	if !field.CanInt() && !field.CanUint() {
+		return reflect.Value{}, false
+	}
+	return field, true
+}
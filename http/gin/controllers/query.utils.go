@@ -0,0 +1,533 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/henrion-y/base.services/domain/repository"
+	"github.com/henrion-y/base.services/infra/xerror"
+)
+
+/*
+列表接口的查询参数解析, 支持两种形式:
+
+query string:
+	?status=1&filter[age][gte]=18&filter[id][in]=1,2&sort=-created_at,name&page=2&size=20
+	?cursor=xxx&size=20  携带 cursor 参数(首页为空)时使用游标翻页
+
+JSON body:
+	{"filter": {"logic": "OR", "filters": [{"column": "age", "op": "gte", "value": 18}], "groups": [...]},
+	 "sort": "-created_at,name", "page": 2, "size": 20, "cursor": "xxx"}
+
+只有 QueryRule 中声明的列与操作符才允许使用
+*/
+
+const (
+	defaultPageSize = 20
+	defaultMaxSize  = 100
+)
+
+// QueryRule 列表接口的查询规则
+type QueryRule struct {
+	Filters     map[string][]repository.FilterType // 允许过滤的列及其操作符, 操作符为空时只允许相等; REGEX 等开销大的操作符须显式列出
+	SortColumns []string                           // 允许排序的列
+	DefaultSort string                             // 未指定排序时使用, 格式同 sort 参数, 如 -created_at
+	DefaultSize int                                // 未指定 size 时的每页条数, 默认 20
+	MaxSize     int                                // 每页最大条数, 默认 100, 超出时按最大值截断
+	Model       repository.Model                   // 可选, 设置后按模型字段类型转换过滤值, 如 "18" 转为 int
+}
+
+// ListQuery 解析得到的查询条件, 可直接传给 BaseRepository.Find
+type ListQuery struct {
+	FilterGroup *repository.FilterGroup
+	SortSpecs   *repository.SortSpecs
+	LimitSpec   *repository.LimitSpec
+}
+
+// FindPage 按查询条件分页查询, 结果可直接用于 ResponsePage
+func (q *ListQuery) FindPage(ctx context.Context, repo repository.BaseRepository, mod repository.Model, result interface{}, fields []string) (*repository.Page, error) {
+	return repo.FindPage(ctx, mod, result, fields, q.FilterGroup, q.SortSpecs, q.LimitSpec)
+}
+
+// QueryBody JSON 形式的查询参数
+type QueryBody struct {
+	Filter *QueryFilterGroup `json:"filter"`
+	Sort   string            `json:"sort"`
+	Page   int               `json:"page"`
+	Size   int               `json:"size"`
+	Cursor *string           `json:"cursor"` // 不为 nil 时使用游标翻页
+}
+
+type QueryFilterGroup struct {
+	Logic   string             `json:"logic"` // AND(默认) 或 OR
+	Filters []QueryFilter      `json:"filters"`
+	Groups  []QueryFilterGroup `json:"groups"`
+}
+
+type QueryFilter struct {
+	Column string      `json:"column"`
+	Op     string      `json:"op"` // 操作符, 如 eq、gte、in、between、starts_with、exists, 大小写不敏感, 默认 eq
+	Value  interface{} `json:"value"`
+}
+
+// ParseListQuery 从 query string 解析列表查询条件, 参数错误时返回 *xerror.XError
+func ParseListQuery(c *gin.Context, rule *QueryRule) (*ListQuery, error) {
+	query, err := rule.ParseValues(c.Request.URL.Query())
+	if err != nil {
+		return nil, xerror.NewXError(xerror.ErrParamInvalid, err.Error()).WithRawError(err)
+	}
+	return query, nil
+}
+
+// ParseListQueryJSON 从 JSON body 解析列表查询条件, 参数错误时返回 *xerror.XError
+func ParseListQueryJSON(c *gin.Context, rule *QueryRule) (*ListQuery, error) {
+	body := QueryBody{}
+	decoder := json.NewDecoder(c.Request.Body)
+	// 数字保留原文, 再按字段类型转换, 避免大整数丢失精度
+	decoder.UseNumber()
+	if err := decoder.Decode(&body); err != nil {
+		return nil, xerror.NewXErrorByCode(xerror.ErrParamInvalid).WithRawError(err)
+	}
+
+	query, err := rule.ParseBody(&body)
+	if err != nil {
+		return nil, xerror.NewXError(xerror.ErrParamInvalid, err.Error()).WithRawError(err)
+	}
+	return query, nil
+}
+
+// ParseValues 解析 query string. 未加 filter 前缀的参数按相等条件处理, 不在 Filters 中的参数会被忽略
+func (r *QueryRule) ParseValues(values url.Values) (*ListQuery, error) {
+	// 按参数名排序, 保证生成的条件顺序稳定
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	filterGroup := repository.NewFilterGroup()
+	for _, key := range keys {
+		list := values[key]
+		switch key {
+		case "sort", "page", "size", "cursor":
+			continue
+		}
+
+		column, op, isFilter, err := parseFilterKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if !isFilter {
+			if _, ok := r.Filters[key]; !ok {
+				continue
+			}
+		}
+
+		var value interface{} = list[0]
+		if isListFilter(op) {
+			value = splitValues(list)
+		}
+		if err = r.addFilter(filterGroup, column, op, value); err != nil {
+			return nil, err
+		}
+	}
+
+	limitSpec, err := r.limitSpec(values.Get("page"), values.Get("size"), values.Has("cursor"), values.Get("cursor"))
+	if err != nil {
+		return nil, err
+	}
+	sortSpecs, err := r.sortSpecs(values.Get("sort"))
+	if err != nil {
+		return nil, err
+	}
+	return &ListQuery{FilterGroup: filterGroup, SortSpecs: sortSpecs, LimitSpec: limitSpec}, nil
+}
+
+// ParseBody 解析 JSON 形式的查询参数
+func (r *QueryRule) ParseBody(body *QueryBody) (*ListQuery, error) {
+	filterGroup := repository.NewFilterGroup()
+	if body.Filter != nil {
+		var err error
+		if filterGroup, err = r.filterGroup(body.Filter); err != nil {
+			return nil, err
+		}
+	}
+
+	cursor := ""
+	if body.Cursor != nil {
+		cursor = *body.Cursor
+	}
+	limitSpec, err := r.limitSpec(strconv.Itoa(body.Page), strconv.Itoa(body.Size), body.Cursor != nil, cursor)
+	if err != nil {
+		return nil, err
+	}
+	sortSpecs, err := r.sortSpecs(body.Sort)
+	if err != nil {
+		return nil, err
+	}
+	return &ListQuery{FilterGroup: filterGroup, SortSpecs: sortSpecs, LimitSpec: limitSpec}, nil
+}
+
+func (r *QueryRule) filterGroup(group *QueryFilterGroup) (*repository.FilterGroup, error) {
+	filterGroup := repository.NewFilterGroup()
+	switch strings.ToUpper(group.Logic) {
+	case "", string(repository.FilterLogic_AND):
+		filterGroup.SetLogic(repository.FilterLogic_AND)
+	case string(repository.FilterLogic_OR):
+		filterGroup.SetLogic(repository.FilterLogic_OR)
+	default:
+		return nil, fmt.Errorf("unsupported filter logic %s", group.Logic)
+	}
+
+	for _, filter := range group.Filters {
+		op, err := parseFilterType(filter.Op)
+		if err != nil {
+			return nil, err
+		}
+		if err = r.addFilter(filterGroup, filter.Column, op, filter.Value); err != nil {
+			return nil, err
+		}
+	}
+	for i := range group.Groups {
+		subGroup, err := r.filterGroup(&group.Groups[i])
+		if err != nil {
+			return nil, err
+		}
+		filterGroup.AddGroup(subGroup)
+	}
+	return filterGroup, nil
+}
+
+func (r *QueryRule) addFilter(filterGroup *repository.FilterGroup, column string, op repository.FilterType, value interface{}) error {
+	ops, ok := r.Filters[column]
+	if !ok {
+		return fmt.Errorf("filter on column %s is not allowed", column)
+	}
+	if len(ops) == 0 {
+		ops = []repository.FilterType{repository.FilterType_EQ}
+	}
+	if !containsFilterType(ops, op) {
+		return fmt.Errorf("filter %s on column %s is not allowed", strings.ToLower(string(op)), column)
+	}
+
+	switch op {
+	case repository.FilterType_IS_NULL, repository.FilterType_IS_NOT_NULL:
+		filterGroup.AddFilter(column, op, nil)
+		return nil
+	case repository.FilterType_EXISTS:
+		exists := true
+		switch v := value.(type) {
+		case bool:
+			exists = v
+		case string:
+			if v != "" {
+				b, err := strconv.ParseBool(v)
+				if err != nil {
+					return fmt.Errorf("invalid value %s for column %s", v, column)
+				}
+				exists = b
+			}
+		}
+		filterGroup.AddFilter(column, op, exists)
+		return nil
+	case repository.FilterType_LIKE, repository.FilterType_NOT_LIKE, repository.FilterType_STARTS_WITH,
+		repository.FilterType_ENDS_WITH, repository.FilterType_CONTAINS, repository.FilterType_REGEX:
+		// 模式匹配的值始终为字符串, 不按字段类型转换
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("filter %s on column %s requires a string", strings.ToLower(string(op)), column)
+		}
+		filterGroup.AddFilter(column, op, s)
+		return nil
+	}
+
+	if isListFilter(op) {
+		if _, ok := value.([]interface{}); !ok {
+			if s, ok := value.(string); ok {
+				value = splitValues([]string{s})
+			} else {
+				return fmt.Errorf("filter %s on column %s requires a list", strings.ToLower(string(op)), column)
+			}
+		}
+		if op == repository.FilterType_BETWEEN && len(value.([]interface{})) != 2 {
+			return fmt.Errorf("filter between on column %s requires two values", column)
+		}
+	}
+
+	isArray := op == repository.FilterType_ARRAY_CONTAINS || op == repository.FilterType_ARRAY_CONTAINS_ANY
+	value, err := r.convertValue(column, value, isArray)
+	if err != nil {
+		return err
+	}
+	filterGroup.AddFilter(column, op, value)
+	return nil
+}
+
+// isListFilter 值为列表的操作符
+func isListFilter(op repository.FilterType) bool {
+	switch op {
+	case repository.FilterType_IN, repository.FilterType_NOT_IN, repository.FilterType_BETWEEN,
+		repository.FilterType_ARRAY_CONTAINS, repository.FilterType_ARRAY_CONTAINS_ANY:
+		return true
+	}
+	return false
+}
+
+// sortSpecs 解析 -created_at,name 形式的排序参数, - 前缀表示降序
+func (r *QueryRule) sortSpecs(sortParam string) (*repository.SortSpecs, error) {
+	if sortParam == "" {
+		sortParam = r.DefaultSort
+	}
+	sortSpecs := repository.NewDefaultSortSpecs()
+	for _, item := range strings.Split(sortParam, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		sortType := repository.SortType_ASC
+		if strings.HasPrefix(item, "-") {
+			sortType = repository.SortType_DESC
+		}
+		property := strings.TrimLeft(item, "+-")
+		if !containsString(r.SortColumns, property) && !r.isDefaultSort(property) {
+			return nil, fmt.Errorf("sort on column %s is not allowed", property)
+		}
+		sortSpecs.Add(property, sortType)
+	}
+	return sortSpecs, nil
+}
+
+// isDefaultSort 默认排序的列总是允许
+func (r *QueryRule) isDefaultSort(property string) bool {
+	for _, item := range strings.Split(r.DefaultSort, ",") {
+		if strings.TrimLeft(strings.TrimSpace(item), "+-") == property {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *QueryRule) limitSpec(page string, size string, useCursor bool, cursor string) (*repository.LimitSpec, error) {
+	pageSize := r.DefaultSize
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	if size != "" && size != "0" {
+		n, err := strconv.Atoi(size)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid size %s", size)
+		}
+		pageSize = n
+	}
+	maxSize := r.MaxSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxSize
+	}
+	if pageSize > maxSize {
+		pageSize = maxSize
+	}
+
+	if useCursor {
+		return repository.NewCursorLimitSpec(cursor, pageSize), nil
+	}
+
+	pageNum := 1
+	if page != "" && page != "0" {
+		n, err := strconv.Atoi(page)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid page %s", page)
+		}
+		pageNum = n
+	}
+	return repository.NewLimitSpec(pageNum, pageSize), nil
+}
+
+// convertValue 设置了 Model 时按字段类型转换过滤值, 切片逐个转换; isArray 表示列本身为数组, 按元素类型转换
+func (r *QueryRule) convertValue(column string, value interface{}, isArray bool) (interface{}, error) {
+	if r.Model == nil {
+		if number, ok := value.(json.Number); ok {
+			return number.String(), nil
+		}
+		return value, nil
+	}
+	typ, ok := repository.ModelColumns(r.Model).Type(column)
+	if !ok {
+		return value, nil
+	}
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if isArray && (typ.Kind() == reflect.Slice || typ.Kind() == reflect.Array) {
+		typ = typ.Elem()
+	}
+
+	if list, ok := value.([]interface{}); ok {
+		converted := make([]interface{}, len(list))
+		for i, item := range list {
+			v, err := convertScalar(column, item, typ)
+			if err != nil {
+				return nil, err
+			}
+			converted[i] = v
+		}
+		return converted, nil
+	}
+	return convertScalar(column, value, typ)
+}
+
+func convertScalar(column string, value interface{}, typ reflect.Type) (interface{}, error) {
+	var s string
+	switch v := value.(type) {
+	case string:
+		s = v
+	case json.Number:
+		s = v.String()
+	case float64:
+		// 未开启 UseNumber 时 JSON 数字解析为 float64
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	case nil:
+		return nil, nil
+	default:
+		// bool 等 JSON 已解析好的值直接使用
+		return value, nil
+	}
+
+	var result interface{}
+	var err error
+	switch {
+	case typ == reflect.TypeOf(time.Time{}):
+		result, err = parseTime(s)
+	case typ == reflect.TypeOf(primitive.ObjectID{}):
+		result, err = primitive.ObjectIDFromHex(s)
+	default:
+		switch typ.Kind() {
+		case reflect.String:
+			result = s
+		case reflect.Bool:
+			result, err = strconv.ParseBool(s)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			result, err = strconv.ParseInt(s, 10, 64)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			result, err = strconv.ParseUint(s, 10, 64)
+		case reflect.Float32, reflect.Float64:
+			result, err = strconv.ParseFloat(s, 64)
+		default:
+			result = s
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %s for column %s", s, column)
+	}
+	return result, nil
+}
+
+func parseTime(s string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	// 秒级时间戳
+	seconds, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(seconds, 0), nil
+}
+
+// parseFilterKey 解析 filter[age][gte] 或 filter[age] 形式的参数名, 其他参数名按列名处理, 操作符为 EQ
+func parseFilterKey(key string) (string, repository.FilterType, bool, error) {
+	if !strings.HasPrefix(key, "filter[") {
+		return key, repository.FilterType_EQ, false, nil
+	}
+
+	rest := strings.TrimPrefix(key, "filter[")
+	end := strings.Index(rest, "]")
+	if end <= 0 {
+		return "", "", false, fmt.Errorf("invalid filter parameter %s", key)
+	}
+	column, rest := rest[:end], rest[end+1:]
+	if rest == "" {
+		return column, repository.FilterType_EQ, true, nil
+	}
+	if !strings.HasPrefix(rest, "[") || !strings.HasSuffix(rest, "]") {
+		return "", "", false, fmt.Errorf("invalid filter parameter %s", key)
+	}
+	op, err := parseFilterType(rest[1 : len(rest)-1])
+	return column, op, true, err
+}
+
+var filterTypes = map[string]repository.FilterType{
+	"EQ":          repository.FilterType_EQ,
+	"NE":          repository.FilterType_NE,
+	"GT":          repository.FilterType_GT,
+	"GTE":         repository.FilterType_GTE,
+	"LT":          repository.FilterType_LT,
+	"LTE":         repository.FilterType_LTE,
+	"IN":          repository.FilterType_IN,
+	"NOT_IN":      repository.FilterType_NOT_IN,
+	"NIN":         repository.FilterType_NOT_IN,
+	"LIKE":        repository.FilterType_LIKE,
+	"IS_NULL":     repository.FilterType_IS_NULL,
+	"IS_NOT_NULL": repository.FilterType_IS_NOT_NULL,
+
+	"BETWEEN":            repository.FilterType_BETWEEN,
+	"NOT_LIKE":           repository.FilterType_NOT_LIKE,
+	"STARTS_WITH":        repository.FilterType_STARTS_WITH,
+	"ENDS_WITH":          repository.FilterType_ENDS_WITH,
+	"CONTAINS":           repository.FilterType_CONTAINS,
+	"REGEX":              repository.FilterType_REGEX,
+	"ARRAY_CONTAINS":     repository.FilterType_ARRAY_CONTAINS,
+	"ARRAY_CONTAINS_ANY": repository.FilterType_ARRAY_CONTAINS_ANY,
+	"EXISTS":             repository.FilterType_EXISTS,
+}
+
+func parseFilterType(op string) (repository.FilterType, error) {
+	if op == "" {
+		return repository.FilterType_EQ, nil
+	}
+	filterType, ok := filterTypes[strings.ToUpper(op)]
+	if !ok {
+		return "", fmt.Errorf("unsupported filter operator %s", op)
+	}
+	return filterType, nil
+}
+
+// splitValues 支持 in=1,2 与重复参数 in=1&in=2 两种写法
+func splitValues(list []string) []interface{} {
+	var values []interface{}
+	for _, item := range list {
+		for _, value := range strings.Split(item, ",") {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func containsFilterType(list []repository.FilterType, filterType repository.FilterType) bool {
+	for _, item := range list {
+		if item == filterType {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,268 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/henrion-y/base.services/domain/repository"
+	"github.com/henrion-y/base.services/domain/repository/memrepo"
+	"github.com/henrion-y/base.services/infra/xerror"
+)
+
+type User struct {
+	ID    int64     `json:"id" gorm:"primary_key"`
+	Name  string    `json:"name" gorm:"name"`
+	Age   int       `json:"age" gorm:"age"`
+	Ctime time.Time `json:"ctime" gorm:"ctime"`
+}
+
+func (t *User) TableName() string {
+	return "t_user"
+}
+
+func newRule() *QueryRule {
+	return &QueryRule{
+		Filters: map[string][]repository.FilterType{
+			"name":  {repository.FilterType_EQ, repository.FilterType_LIKE},
+			"age":   {repository.FilterType_EQ, repository.FilterType_GTE},
+			"id":    {repository.FilterType_IN},
+			"ctime": {repository.FilterType_GTE, repository.FilterType_LT},
+		},
+		SortColumns: []string{"age", "name"},
+		DefaultSort: "-ctime",
+		MaxSize:     50,
+		Model:       &User{},
+	}
+}
+
+func TestQueryRule_ParseValues(t *testing.T) {
+	values, _ := url.ParseQuery("name=张飞&other=1&filter[age][gte]=18&filter[id][in]=1,2&filter[id][in]=3" +
+		"&filter[ctime][lt]=2024-01-02&sort=-age,name&page=2&size=100")
+	query, err := newRule().ParseValues(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filters := query.FilterGroup.Filters
+	if len(filters) != 4 {
+		t.Fatalf("filters = %+v", filters)
+	}
+	want := []struct {
+		column string
+		op     repository.FilterType
+	}{
+		{"age", repository.FilterType_GTE},
+		{"ctime", repository.FilterType_LT},
+		{"id", repository.FilterType_IN},
+		{"name", repository.FilterType_EQ},
+	}
+	for i, w := range want {
+		if filters[i].Column != w.column || filters[i].FilterType != w.op {
+			t.Fatalf("filters[%d] = %+v, want %s %s", i, filters[i], w.column, w.op)
+		}
+	}
+	if filters[0].Value != int64(18) {
+		t.Fatalf("age value = %#v", filters[0].Value)
+	}
+	if _, ok := filters[1].Value.(time.Time); !ok {
+		t.Fatalf("ctime value = %#v", filters[1].Value)
+	}
+	if ids := filters[2].Value.([]interface{}); len(ids) != 3 || ids[2] != int64(3) {
+		t.Fatalf("id value = %#v", filters[2].Value)
+	}
+
+	sorts := *query.SortSpecs
+	if len(sorts) != 2 || sorts[0].Property != "age" || sorts[0].Type != repository.SortType_DESC || sorts[1].Type != repository.SortType_ASC {
+		t.Fatalf("sorts = %+v", sorts)
+	}
+	if query.LimitSpec.Page != 2 || query.LimitSpec.Size != 50 {
+		t.Fatalf("limit = %+v", query.LimitSpec)
+	}
+}
+
+func TestQueryRule_ParseValuesDefault(t *testing.T) {
+	values, _ := url.ParseQuery("cursor=")
+	query, err := newRule().ParseValues(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sorts := *query.SortSpecs
+	if len(sorts) != 1 || sorts[0].Property != "ctime" || sorts[0].Type != repository.SortType_DESC {
+		t.Fatalf("sorts = %+v", sorts)
+	}
+	if !query.LimitSpec.UseCursor || query.LimitSpec.Size != 20 {
+		t.Fatalf("limit = %+v", query.LimitSpec)
+	}
+}
+
+func TestQueryRule_ParseValuesNotAllowed(t *testing.T) {
+	for _, raw := range []string{
+		"filter[password]=1",
+		"filter[name][gt]=a",
+		"filter[age][glob]=1",
+		"filter[age]]=1",
+		"filter[age][gte]=abc",
+		"sort=password",
+		"page=a",
+	} {
+		values, _ := url.ParseQuery(raw)
+		if _, err := newRule().ParseValues(values); err == nil {
+			t.Fatalf("%s: expected error", raw)
+		}
+	}
+}
+
+func TestQueryRule_ParseBody(t *testing.T) {
+	raw := `{"filter": {"logic": "or", "filters": [{"column": "age", "op": "gte", "value": 18}],
+		"groups": [{"filters": [{"column": "name", "op": "like", "value": "张%"}, {"column": "id", "op": "in", "value": [1, 2]}]}]},
+		"sort": "name", "size": 10}`
+	body := QueryBody{}
+	if err := json.Unmarshal([]byte(raw), &body); err != nil {
+		t.Fatal(err)
+	}
+	query, err := newRule().ParseBody(&body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	group := query.FilterGroup
+	if group.Logic != repository.FilterLogic_OR || len(group.Filters) != 1 || len(group.Groups) != 1 {
+		t.Fatalf("group = %+v", group)
+	}
+	if group.Filters[0].Value != int64(18) {
+		t.Fatalf("age value = %#v", group.Filters[0].Value)
+	}
+	subGroup := group.Groups[0]
+	if subGroup.Logic != repository.FilterLogic_AND || len(subGroup.Filters) != 2 {
+		t.Fatalf("subGroup = %+v", subGroup)
+	}
+	if query.LimitSpec.Page != 1 || query.LimitSpec.Size != 10 || query.LimitSpec.UseCursor {
+		t.Fatalf("limit = %+v", query.LimitSpec)
+	}
+
+	body.Filter.Filters[0].Column = "password"
+	if _, err = newRule().ParseBody(&body); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestQueryRule_ParseValuesOperators(t *testing.T) {
+	rule := &QueryRule{
+		Filters: map[string][]repository.FilterType{
+			"age":  {repository.FilterType_BETWEEN},
+			"name": {repository.FilterType_STARTS_WITH, repository.FilterType_EXISTS},
+		},
+		Model: &User{},
+	}
+	values, _ := url.ParseQuery("filter[age][between]=18,30&filter[name][starts_with]=12&filter[name][exists]=false")
+	query, err := rule.ParseValues(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filters := query.FilterGroup.Filters
+	if len(filters) != 3 {
+		t.Fatalf("filters = %+v", filters)
+	}
+	if between := filters[0].Value.([]interface{}); filters[0].FilterType != repository.FilterType_BETWEEN || between[1] != int64(30) {
+		t.Fatalf("between = %+v", filters[0])
+	}
+	if filters[1].FilterType != repository.FilterType_EXISTS || filters[1].Value != false {
+		t.Fatalf("exists = %+v", filters[1])
+	}
+	if filters[2].FilterType != repository.FilterType_STARTS_WITH || filters[2].Value != "12" {
+		t.Fatalf("starts_with = %+v", filters[2])
+	}
+
+	values, _ = url.ParseQuery("filter[age][between]=18")
+	if _, err = rule.ParseValues(values); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestQueryRule_DefaultOperators(t *testing.T) {
+	// 未列出操作符时只允许相等, REGEX 须显式列出
+	rule := &QueryRule{Filters: map[string][]repository.FilterType{"name": nil}}
+	values, _ := url.ParseQuery("filter[name][eq]=张飞")
+	if query, err := rule.ParseValues(values); err != nil || query.FilterGroup.Filters[0].FilterType != repository.FilterType_EQ {
+		t.Fatalf("expect eq filter, got %v", err)
+	}
+	for _, op := range []string{"regex", "like", "gte"} {
+		values, _ = url.ParseQuery("filter[name][" + op + "]=a")
+		if _, err := rule.ParseValues(values); err == nil {
+			t.Fatalf("expect %s to be rejected", op)
+		}
+	}
+
+	rule.Filters["name"] = []repository.FilterType{repository.FilterType_REGEX}
+	values, _ = url.ParseQuery("filter[name][regex]=^张")
+	if query, err := rule.ParseValues(values); err != nil || query.FilterGroup.Filters[0].FilterType != repository.FilterType_REGEX {
+		t.Fatalf("expect regex filter, got %v", err)
+	}
+}
+
+func TestListQuery_FindPage(t *testing.T) {
+	ctx := context.Background()
+	repo := memrepo.NewBaseRepository()
+	for _, name := range []string{"张飞", "关羽", "刘备"} {
+		if err := repo.Create(ctx, &User{Name: name, Age: 20, Ctime: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	values, _ := url.ParseQuery("filter[age][gte]=18&sort=name&page=1&size=2")
+	query, err := newRule().ParseValues(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list []User
+	page, err := query.FindPage(ctx, repo, &User{}, &list, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest("GET", "/users", nil)
+	ResponsePage(c, page)
+
+	resp := struct {
+		Code int32 `json:"code"`
+		Data struct {
+			Items   []User `json:"items"`
+			Total   int64  `json:"total"`
+			Page    int    `json:"page"`
+			Size    int    `json:"size"`
+			HasNext bool   `json:"has_next"`
+		} `json:"data"`
+	}{}
+	if err = json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Data.Items) != 2 || resp.Data.Total != 3 || resp.Data.Page != 1 || resp.Data.Size != 2 || !resp.Data.HasNext {
+		t.Fatalf("unexpected response %s", recorder.Body.String())
+	}
+}
+
+func TestResponsePage_Nil(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest("GET", "/users", nil)
+	ResponsePage(c, nil)
+
+	resp := struct {
+		Code int `json:"code"`
+	}{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Code != xerror.ErrRuntime {
+		t.Fatalf("expect runtime error, got %s", recorder.Body.String())
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"strings"
 
 	"github.com/gin-gonic/gin"
+
+	"github.com/henrion-y/base.services/domain/repository"
 	"github.com/henrion-y/base.services/infra/xerror"
 )
 
@@ -30,6 +32,16 @@ func ResponseData(c *gin.Context, data interface{}) {
 	c.JSON(http.StatusOK, RespData{Code: 0, Data: data})
 }
 
+// ResponsePage 返回分页结果, data 为 {"items": [...], "total": 100, "page": 1, "size": 20, "has_next": true};
+// page 为 nil 时视为调用方错误, 返回运行错误
+func ResponsePage(c *gin.Context, page *repository.Page) {
+	if page == nil {
+		ResponseError(c, xerror.NewXErrorByCode(xerror.ErrRuntime))
+		return
+	}
+	ResponseData(c, page)
+}
+
 func ResponseSuccess(c *gin.Context) {
 	fmt.Printf("%s %s response success", strings.ToUpper(c.Request.Method), c.Request.URL.Path)
 	c.JSON(http.StatusOK, RespData{Code: 0})
@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/henrion-y/base.services/domain/repository"
 	"github.com/henrion-y/base.services/infra/jwt"
 
 	"github.com/gin-gonic/gin"
@@ -44,6 +45,7 @@ func (m *JWTAuthMiddleware) SetClaims() gin.HandlerFunc {
 		}
 		// 将当前请求的claims信息保存到请求的上下文c上
 		ctx.Set("claims", claims)
+		setTenant(ctx, claims)
 		ctx.Next() // 后续的处理函数可以用过ctx.Get("claims")来获取当前请求的用户信息
 	}
 }
@@ -87,6 +89,15 @@ func (m *JWTAuthMiddleware) SetClaimsAbortTourist() gin.HandlerFunc {
 		}
 		// 将当前请求的claims信息保存到请求的上下文c上
 		ctx.Set("claims", claims)
+		setTenant(ctx, claims)
 		ctx.Next() // 后续的处理函数可以用过ctx.Get("claims")来获取当前请求的用户信息
 	}
 }
+
+// setTenant 将 claims 中的租户写入 Request 的 context, 供 repository.NewTenantRepository 使用
+func setTenant(ctx *gin.Context, claims *jwt.Claims) {
+	if claims.TenantId == 0 {
+		return
+	}
+	ctx.Request = ctx.Request.WithContext(repository.WithTenant(ctx.Request.Context(), claims.TenantId))
+}
@@ -1,7 +1,21 @@
 package geo
 
+import "math"
+
+// EarthRadius is the mean earth radius in meters
+const EarthRadius = 6371008.8
+
 // Coordinate present geo location
 type Coordinate struct {
 	Lat float64
 	Lon float64
 }
+
+// DistanceTo returns the great-circle distance to other in meters (haversine)
+func (c Coordinate) DistanceTo(other Coordinate) float64 {
+	lat1, lat2 := c.Lat*math.Pi/180, other.Lat*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (other.Lon - c.Lon) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * EarthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
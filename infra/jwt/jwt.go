@@ -17,7 +17,8 @@ type AuthService interface {
 }
 
 type JwtUserInfo struct {
-	UserId uint64 `json:"user_id"` // 用户id
+	UserId   uint64 `json:"user_id"`             // 用户id
+	TenantId uint64 `json:"tenant_id,omitempty"` // 租户id, 为 0 时不属于任何租户
 }
 
 // Claims custom token
@@ -0,0 +1,55 @@
+package kafka_client
+
+import (
+	"context"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+
+	"github.com/henrion-y/base.services/infra/zlog"
+)
+
+// NewPublisher 创建同步发布者, 等待全部副本确认, 发送失败由 sarama 重试 retryMax 次
+func NewPublisher(addrStr string, retryMax int) (*Publisher, error) {
+	saramaConfig := sarama.NewConfig()
+	saramaConfig.Producer.RequiredAcks = sarama.WaitForAll
+	saramaConfig.Producer.Retry.Max = retryMax
+	saramaConfig.Producer.Return.Successes = true
+	producer, err := sarama.NewSyncProducer(strings.Split(addrStr, ","), saramaConfig)
+	if err != nil {
+		zlog.Error("NewPublisher.NewSyncProducer", zap.Error(err))
+		return nil, err
+	}
+
+	return &Publisher{producer: producer}, nil
+}
+
+// Publisher 同步发送消息, 可作为 repository.OutboxRelay 的 OutboxPublisher
+type Publisher struct {
+	producer sarama.SyncProducer
+}
+
+// Publish 发送一条消息, key 为空时由 sarama 随机选择分区
+func (p *Publisher) Publish(ctx context.Context, topic string, key string, value []byte, headers map[string]string) error {
+	msg := &sarama.ProducerMessage{
+		Topic: topic,
+		Value: sarama.ByteEncoder(value),
+	}
+	if key != "" {
+		msg.Key = sarama.StringEncoder(key)
+	}
+	for k, v := range headers {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{Key: []byte(k), Value: []byte(v)})
+	}
+
+	_, _, err := p.producer.SendMessage(msg)
+	if err != nil {
+		zlog.Error("Publisher.Publish", zap.String("topic", topic), zap.String("key", key), zap.Error(err))
+	}
+	return err
+}
+
+func (p *Publisher) Close() error {
+	return p.producer.Close()
+}
@@ -0,0 +1,39 @@
+package redisapi
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RepositoryCache 基于 RedisApi 的 repository.Cache 实现, 用于 repository.NewCacheRepository
+type RepositoryCache struct {
+	redisApi *RedisApi
+	timeout  time.Duration
+}
+
+// NewRepositoryCache timeout 为单次读写的超时, 为 0 时使用默认的 2 秒
+func NewRepositoryCache(redisApi *RedisApi, timeout time.Duration) *RepositoryCache {
+	return &RepositoryCache{redisApi: redisApi, timeout: timeout}
+}
+
+func (c *RepositoryCache) Get(ctx context.Context, key string) (string, bool, error) {
+	val, err := c.redisApi.Get(ctx, key, c.timeout)
+	if err == redis.Nil {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return val, true, nil
+}
+
+func (c *RepositoryCache) Set(ctx context.Context, key string, value string, expiration time.Duration) error {
+	_, err := c.redisApi.Set(ctx, key, value, expiration, c.timeout)
+	return err
+}
+
+func (c *RepositoryCache) Incr(ctx context.Context, key string) (int64, error) {
+	return c.redisApi.IncrBy(ctx, c.timeout, key, 1)
+}